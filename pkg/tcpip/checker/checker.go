@@ -190,6 +190,20 @@ func ReceiveTOS(want uint8) ControlMessagesChecker {
 	}
 }
 
+// ReceiveTimestamp creates a checker that checks the Timestamp field in
+// ControlMessages.
+func ReceiveTimestamp(want int64) ControlMessagesChecker {
+	return func(t *testing.T, cm tcpip.ControlMessages) {
+		t.Helper()
+		if !cm.HasTimestamp {
+			t.Fatalf("got cm.HasTimestamp = %t, want cm.Timestamp = %d", cm.HasTimestamp, want)
+		}
+		if got := cm.Timestamp; got != want {
+			t.Fatalf("got cm.Timestamp = %d, want %d", got, want)
+		}
+	}
+}
+
 // TOS creates a checker that checks the TOS field.
 func TOS(tos uint8, label uint32) NetworkChecker {
 	return func(t *testing.T, h []header.Network) {
@@ -38,6 +38,10 @@ const (
 	// in an ICMPv4 message.
 	icmpv4ChecksumOffset = 2
 
+	// icmpv4GatewayOffset is the offset of the gateway address field
+	// in a ICMPv4Redirect message.
+	icmpv4GatewayOffset = 4
+
 	// icmpv4MTUOffset is the offset of the MTU field
 	// in a ICMPv4FragmentationNeeded message.
 	icmpv4MTUOffset = 6
@@ -130,6 +134,17 @@ func (b ICMPv4) SetMTU(mtu uint16) {
 	binary.BigEndian.PutUint16(b[icmpv4MTUOffset:], mtu)
 }
 
+// Gateway retrieves the gateway address field from an ICMPv4 redirect
+// message.
+func (b ICMPv4) Gateway() tcpip.Address {
+	return tcpip.Address(b[icmpv4GatewayOffset:][:IPv4AddressSize])
+}
+
+// SetGateway sets the gateway address field of an ICMPv4 redirect message.
+func (b ICMPv4) SetGateway(gateway tcpip.Address) {
+	copy(b[icmpv4GatewayOffset:][:IPv4AddressSize], gateway)
+}
+
 // Ident retrieves the Ident field from an ICMPv4 message.
 func (b ICMPv4) Ident() uint16 {
 	return binary.BigEndian.Uint16(b[icmpv4IdentOffset:])
@@ -65,6 +65,9 @@ const (
 	// packet-too-big packet.
 	ICMPv6PacketTooBigMinimumSize = ICMPv6MinimumSize
 
+	// ICMPv6MLDMinimumSize is the minimum size of a valid MLD packet.
+	ICMPv6MLDMinimumSize = ICMPv6HeaderSize + MLDMinimumSize
+
 	// icmpv6ChecksumOffset is the offset of the checksum field
 	// in an ICMPv6 message.
 	icmpv6ChecksumOffset = 2
@@ -101,6 +104,12 @@ const (
 	ICMPv6EchoRequest    ICMPv6Type = 128
 	ICMPv6EchoReply      ICMPv6Type = 129
 
+	// Multicast Listener Discovery (MLD) messages, see RFC 2710.
+
+	ICMPv6MulticastListenerQuery  ICMPv6Type = 130
+	ICMPv6MulticastListenerReport ICMPv6Type = 131
+	ICMPv6MulticastListenerDone   ICMPv6Type = 132
+
 	// Neighbor Discovery Protocol (NDP) messages, see RFC 4861.
 
 	ICMPv6RouterSolicit   ICMPv6Type = 133
@@ -0,0 +1,93 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header
+
+import (
+	"encoding/binary"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// IGMP represents an IGMPv2 message stored in a byte array.
+//
+// See RFC 2236 section 2 for more details.
+type IGMP []byte
+
+const (
+	// IGMPMinimumSize is the size of a valid IGMPv2 message.
+	IGMPMinimumSize = 8
+
+	// IGMPProtocolNumber is the IGMP transport protocol number.
+	IGMPProtocolNumber tcpip.TransportProtocolNumber = 2
+
+	// IGMPTTL is the TTL of the IP packets holding IGMP messages, as per RFC
+	// 2236 section 2.
+	IGMPTTL = 1
+
+	// igmpMaxRespTimeOffset is the offset of the maximum response time field
+	// in an IGMP message.
+	igmpMaxRespTimeOffset = 1
+
+	// igmpChecksumOffset is the offset of the checksum field in an IGMP
+	// message.
+	igmpChecksumOffset = 2
+
+	// igmpGroupAddressOffset is the offset of the group address field in an
+	// IGMP message.
+	igmpGroupAddressOffset = 4
+)
+
+// IGMPType is the IGMP type field described in RFC 2236 section 2.1.
+type IGMPType byte
+
+// Values of IGMPType defined in RFC 2236 section 2.1.
+const (
+	IGMPMembershipQuery    IGMPType = 0x11
+	IGMPv1MembershipReport IGMPType = 0x12
+	IGMPv2MembershipReport IGMPType = 0x16
+	IGMPLeaveGroup         IGMPType = 0x17
+)
+
+// Type is the IGMP type field.
+func (b IGMP) Type() IGMPType { return IGMPType(b[0]) }
+
+// SetType sets the IGMP type field.
+func (b IGMP) SetType(t IGMPType) { b[0] = byte(t) }
+
+// MaxRespTime is the maximum response time field, in tenths of a second.
+func (b IGMP) MaxRespTime() byte { return b[igmpMaxRespTimeOffset] }
+
+// SetMaxRespTime sets the maximum response time field.
+func (b IGMP) SetMaxRespTime(t byte) { b[igmpMaxRespTimeOffset] = t }
+
+// Checksum is the IGMP checksum field.
+func (b IGMP) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[igmpChecksumOffset:])
+}
+
+// SetChecksum sets the IGMP checksum field.
+func (b IGMP) SetChecksum(checksum uint16) {
+	binary.BigEndian.PutUint16(b[igmpChecksumOffset:], checksum)
+}
+
+// GroupAddress is the group address field.
+func (b IGMP) GroupAddress() tcpip.Address {
+	return tcpip.Address(b[igmpGroupAddressOffset:][:IPv4AddressSize])
+}
+
+// SetGroupAddress sets the group address field.
+func (b IGMP) SetGroupAddress(addr tcpip.Address) {
+	copy(b[igmpGroupAddressOffset:][:IPv4AddressSize], addr)
+}
@@ -26,6 +26,22 @@ const (
 	// m is the minimum IPv6 header size; we leave room for some potential
 	// IP options.
 	MaxIPPacketSize = 0xffff + 2*IPv6MinimumSize
+
+	// ECNMask is the mask for the ECN field held in the low two bits of the
+	// IPv4 TOS and IPv6 Traffic Class octets, as per RFC 3168 section 5.
+	ECNMask = 0x3
+
+	// ECNNotECT is the Not ECN-Capable Transport (Not-ECT) ECN codepoint.
+	ECNNotECT = 0x0
+
+	// ECNECT1 is the ECN-Capable Transport (ECT(1)) ECN codepoint.
+	ECNECT1 = 0x1
+
+	// ECNECT0 is the ECN-Capable Transport (ECT(0)) ECN codepoint.
+	ECNECT0 = 0x2
+
+	// ECNCE is the Congestion Experienced (CE) ECN codepoint.
+	ECNCE = 0x3
 )
 
 // Transport offers generic methods to query and/or update the fields of the
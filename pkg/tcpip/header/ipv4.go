@@ -83,6 +83,10 @@ const (
 	// IPv4MinimumSize is the minimum size of a valid IPv4 packet.
 	IPv4MinimumSize = 20
 
+	// IPv4MinimumMTU is the minimum MTU required by IPv4, per RFC 791,
+	// section 3.2.
+	IPv4MinimumMTU = 68
+
 	// IPv4MaximumHeaderSize is the maximum size of an IPv4 header. Given
 	// that there are only 4 bits to represents the header length in 32-bit
 	// units, the header cannot exceed 15*4 = 60 bytes.
@@ -107,6 +111,18 @@ const (
 	// IPv4Any is the non-routable IPv4 "any" meta address.
 	IPv4Any tcpip.Address = "\x00\x00\x00\x00"
 
+	// IPv4AllSystems is the all systems multicast group, joined by all the
+	// IPv4 hosts of a link, as per RFC 1112 section 4.
+	//
+	// The address is 224.0.0.1.
+	IPv4AllSystems tcpip.Address = "\xe0\x00\x00\x01"
+
+	// IPv4AllRoutersGroup is the all routers multicast group, joined by all
+	// the multicast routers of a link, as per RFC 2236 section 9.
+	//
+	// The address is 224.0.0.2.
+	IPv4AllRoutersGroup tcpip.Address = "\xe0\x00\x00\x02"
+
 	// IPv4MinimumProcessableDatagramSize is the minimum size of an IP
 	// packet that every IPv4 capable host must be able to
 	// process/reassemble.
@@ -117,6 +133,10 @@ const (
 const (
 	IPv4FlagMoreFragments = 1 << iota
 	IPv4FlagDontFragment
+
+	// IPv4FlagReserved is the reserved flag, which must be zero (RFC 791). It
+	// is also known as the "evil bit" (RFC 3514).
+	IPv4FlagReserved
 )
 
 // IPv4EmptySubnet is the empty IPv4 subnet.
@@ -220,6 +240,11 @@ func (b IPv4) SetTotalLength(totalLength uint16) {
 	binary.BigEndian.PutUint16(b[IPv4TotalLenOffset:], totalLength)
 }
 
+// SetTTL sets the "TTL" field of the ipv4 header.
+func (b IPv4) SetTTL(v uint8) {
+	b[ttl] = v
+}
+
 // SetChecksum sets the checksum field of the ipv4 header.
 func (b IPv4) SetChecksum(v uint16) {
 	binary.BigEndian.PutUint16(b[checksum:], v)
@@ -296,6 +321,15 @@ func (b IPv4) IsValid(pktSize int) bool {
 	return true
 }
 
+// IsV4LoopbackAddress determines if the provided address is an IPv4 loopback
+// address (range 127.0.0.0 to 127.255.255.255).
+func IsV4LoopbackAddress(addr tcpip.Address) bool {
+	if len(addr) != IPv4AddressSize {
+		return false
+	}
+	return addr[0] == 0x7f
+}
+
 // IsV4MulticastAddress determines if the provided address is an IPv4 multicast
 // address (range 224.0.0.0 to 239.255.255.255). The four most significant bits
 // will be 1110 = 0xe0.
@@ -0,0 +1,49 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package header
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// MLD is a Multicast Listener Discovery message. It will only contain the body
+// of an ICMPv6 packet.
+//
+// See RFC 2710 section 3 for more details.
+type MLD []byte
+
+const (
+	// MLDMinimumSize is the minimum size of a valid MLD message (body of an
+	// ICMPv6 packet).
+	MLDMinimumSize = 20
+
+	// MLDHopLimit is the IP hop limit of the packets holding MLD messages, as
+	// per RFC 2710 section 3.
+	MLDHopLimit = 1
+
+	// mldMulticastAddressOffset is the offset of the multicast address field
+	// in an MLD message.
+	mldMulticastAddressOffset = 4
+)
+
+// MulticastAddress is the multicast address field.
+func (b MLD) MulticastAddress() tcpip.Address {
+	return tcpip.Address(b[mldMulticastAddressOffset:][:IPv6AddressSize])
+}
+
+// SetMulticastAddress sets the multicast address field.
+func (b MLD) SetMulticastAddress(addr tcpip.Address) {
+	copy(b[mldMulticastAddressOffset:][:IPv6AddressSize], addr)
+}
@@ -129,6 +129,10 @@ type endpoint struct {
 	// disabled.
 	gsoMaxSize uint32
 
+	// gro is true if consecutive TCP segments read in a batch are coalesced
+	// before being dispatched.
+	gro bool
+
 	// wg keeps track of running goroutines.
 	wg sync.WaitGroup
 }
@@ -179,6 +183,12 @@ type Options struct {
 	// RXChecksumOffload if true, indicates that this endpoints capability
 	// set should include CapabilityRXChecksumOffload.
 	RXChecksumOffload bool
+
+	// GRO if true, indicates that consecutive TCP segments of the same flow
+	// read in a batch are coalesced before being dispatched, so that the
+	// stack processes fewer, larger segments. See package gro. It only
+	// applies to the RecvMMsg dispatch mode.
+	GRO bool
 }
 
 // fanoutID is used for AF_PACKET based endpoints to enable PACKET_FANOUT
@@ -230,6 +240,7 @@ func New(opts *Options) (stack.LinkEndpoint, error) {
 		addr:               opts.Address,
 		hdrSize:            hdrSize,
 		packetDispatchMode: opts.PacketDispatchMode,
+		gro:                opts.GRO,
 	}
 
 	// Create per channel dispatchers.
@@ -30,7 +30,10 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
 )
 
 const (
@@ -500,3 +503,131 @@ func TestRecvMMsgDispatcherCapLength(t *testing.T) {
 
 	}
 }
+
+// delayedAttachEndpoint is a LinkEndpoint which only attaches the endpoint it
+// wraps to its dispatcher when attach is called.
+type delayedAttachEndpoint struct {
+	stack.LinkEndpoint
+	dispatcher stack.NetworkDispatcher
+}
+
+// Attach implements stack.LinkEndpoint.Attach.
+func (e *delayedAttachEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+}
+
+func (e *delayedAttachEndpoint) attach() {
+	e.LinkEndpoint.Attach(e.dispatcher)
+}
+
+// TestGRO tests that consecutive TCP segments read in a batch are delivered to
+// the transport layer as a single segment.
+func TestGRO(t *testing.T) {
+	const (
+		nicID   = 1
+		srcAddr = tcpip.Address("\x0a\x00\x00\x01")
+		dstAddr = tcpip.Address("\x0a\x00\x00\x02")
+		srcPort = 1234
+		dstPort = 80
+	)
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+	defer syscall.Close(fds[1])
+
+	done := make(chan struct{})
+	ep, err := New(&Options{
+		FDs:                []int{fds[1]},
+		MTU:                mtu,
+		PacketDispatchMode: RecvMMsg,
+		GRO:                true,
+		ClosedFunc: func(*tcpip.Error) {
+			close(done)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create FD endpoint: %v", err)
+	}
+	delayed := &delayedAttachEndpoint{LinkEndpoint: ep}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocol{ipv4.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{tcp.NewProtocol()},
+	})
+	if err := s.CreateNIC(nicID, delayed); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, dstAddr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, dstAddr, err)
+	}
+	var wq waiter.Queue
+	listener, tcpErr := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if tcpErr != nil {
+		t.Fatalf("NewEndpoint(%d, %d, _): %s", tcp.ProtocolNumber, ipv4.ProtocolNumber, tcpErr)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Addr: dstAddr, Port: dstPort}); err != nil {
+		t.Fatalf("Bind(_): %s", err)
+	}
+	if err := listener.Listen(1); err != nil {
+		t.Fatalf("Listen(1): %s", err)
+	}
+
+	// Write the segments before the endpoint is attached so that they are read
+	// in a single batch, then close the peer so that the endpoint stops once it
+	// has dispatched them.
+	seq := uint32(1000)
+	for i, payload := range []string{"abc", "defg", "h"} {
+		pkt := buffer.NewView(header.IPv4MinimumSize + header.TCPMinimumSize + len(payload))
+		ip := header.IPv4(pkt)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(pkt)),
+			ID:          uint16(i),
+			TTL:         64,
+			Protocol:    uint8(header.TCPProtocolNumber),
+			SrcAddr:     srcAddr,
+			DstAddr:     dstAddr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		tcpHdr := header.TCP(ip.Payload())
+		tcpHdr.Encode(&header.TCPFields{
+			SrcPort:    srcPort,
+			DstPort:    dstPort,
+			SeqNum:     seq,
+			AckNum:     1,
+			DataOffset: header.TCPMinimumSize,
+			Flags:      header.TCPFlagAck,
+			WindowSize: 65535,
+		})
+		copy(tcpHdr.Payload(), payload)
+		xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, srcAddr, dstAddr, uint16(len(tcpHdr)))
+		xsum = header.Checksum(tcpHdr.Payload(), xsum)
+		tcpHdr.SetChecksum(^tcpHdr.CalculateChecksum(xsum))
+		if err := rawfile.NonBlockingWrite(fds[0], pkt); err != nil {
+			t.Fatalf("NonBlockingWrite(%d, _): %s", fds[0], err)
+		}
+		seq += uint32(len(payload))
+	}
+	syscall.Close(fds[0])
+	delayed.attach()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the endpoint to stop")
+	}
+	ep.Wait()
+
+	if got := s.Stats().IP.PacketsReceived.Value(); got != 1 {
+		t.Errorf("got IP.PacketsReceived = %d, want = 1", got)
+	}
+	if got := s.Stats().TCP.ValidSegmentsReceived.Value(); got != 1 {
+		t.Errorf("got TCP.ValidSegmentsReceived = %d, want = 1", got)
+	}
+	if got := s.Stats().TCP.ChecksumErrors.Value(); got != 0 {
+		t.Errorf("got TCP.ChecksumErrors = %d, want = 0", got)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/gro"
 	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
@@ -179,6 +180,11 @@ type recvMMsgDispatcher struct {
 	// array is passed as the parameter to recvmmsg call to retrieve
 	// potentially more than 1 packet per syscall.
 	msgHdrs []rawfile.MMsgHdr
+
+	// gro, if set, coalesces the TCP segments of a batch before handing them
+	// to the endpoint's dispatcher. It is created on the first dispatch, as
+	// the endpoint's dispatcher is only known once it is attached.
+	gro *gro.Dispatcher
 }
 
 const (
@@ -262,6 +268,17 @@ func (d *recvMMsgDispatcher) dispatch() (bool, *tcpip.Error) {
 	if err != nil {
 		return false, err
 	}
+
+	dispatcher := d.e.dispatcher
+	if d.e.gro {
+		if d.gro == nil {
+			d.gro = gro.New(d.e.dispatcher)
+		}
+		dispatcher = d.gro
+		// Don't hold the last segment of the batch until the next one.
+		defer d.gro.Flush()
+	}
+
 	// Process each of received packets.
 	for k := 0; k < nMsgs; k++ {
 		n := int(d.msgHdrs[k].Len)
@@ -301,7 +318,7 @@ func (d *recvMMsgDispatcher) dispatch() (bool, *tcpip.Error) {
 			LinkHeader: buffer.View(eth),
 		}
 		pkt.Data.TrimFront(d.e.hdrSize)
-		d.e.dispatcher.DeliverNetworkPacket(d.e, remote, local, p, pkt)
+		dispatcher.DeliverNetworkPacket(d.e, remote, local, p, pkt)
 
 		// Prepare e.views for another packet: release used views.
 		for i := 0; i < used; i++ {
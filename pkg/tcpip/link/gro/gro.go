@@ -0,0 +1,311 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gro provides a network dispatcher that coalesces consecutive TCP
+// segments of the same flow before handing them to the stack, in the spirit of
+// Generic Receive Offload, so that the stack processes fewer, larger packets.
+//
+// Link-layer endpoints which receive packets in batches can use it by passing
+// each packet of a batch to Dispatcher.DeliverNetworkPacket instead of their
+// dispatcher's, and calling Dispatcher.Flush at the end of the batch.
+package gro
+
+import (
+	"bytes"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// maxCoalescedSize is the maximum size of a coalesced packet, bounded by the
+// IPv4 total length field.
+const maxCoalescedSize = 0xffff
+
+// segment is a TCP segment held by a Dispatcher, along with the segments
+// coalesced into it.
+type segment struct {
+	linkEP        stack.LinkEndpoint
+	remote, local tcpip.LinkAddress
+
+	// pkt is the first segment, delivered as is if nothing was coalesced into
+	// it.
+	pkt stack.PacketBuffer
+
+	// hdr holds a copy of the IPv4 and TCP headers of the first segment. The
+	// IPv4 header never has options.
+	hdr buffer.View
+
+	// payload holds the payloads of all the segments, in order.
+	payload buffer.VectorisedView
+
+	// payloadXsum is the checksum of payload, combined from the checksums of
+	// the payloads of the segments computed when they were verified.
+	payloadXsum uint16
+
+	// nextSeq is the sequence number of the next segment of the flow.
+	nextSeq uint32
+
+	// count is the number of segments coalesced together.
+	count int
+}
+
+// Dispatcher is a stack.NetworkDispatcher which coalesces consecutive TCP
+// segments of the same flow before handing them to another dispatcher.
+//
+// Only IPv4 segments without IP options which only have the ACK and PSH flags
+// set, and whose checksums are valid, are coalesced. A segment is coalesced
+// into the previous one if it continues its sequence space and IP ID, and has
+// the same Don't Fragment flag, TCP options, acknowledgement number and
+// window. Any other packet is handed to the other dispatcher unchanged, after
+// the segment being held.
+//
+// Nothing is coalesced while the stack the other dispatcher belongs to, if
+// any, forwards packets: a coalesced packet keeps the Don't Fragment flag of
+// its first segment, so it could not be forwarded out of a NIC whose MTU the
+// original segments fit in.
+//
+// A segment with the PSH flag set ends the packet it is coalesced into, which
+// is handed to the other dispatcher right away with the PSH flag set, so that
+// the data the sender pushed is not delayed.
+//
+// A Dispatcher holds at most one segment, until Flush is called or a packet
+// which cannot be coalesced into it arrives. It must not be used concurrently.
+type Dispatcher struct {
+	dispatcher stack.NetworkDispatcher
+	held       *segment
+
+	// stack is the stack dispatcher belongs to, or nil if it is unknown.
+	stack *stack.Stack
+}
+
+var _ stack.NetworkDispatcher = (*Dispatcher)(nil)
+
+// stackDispatcher is a stack.NetworkDispatcher which belongs to a stack, such
+// as a stack.NIC.
+type stackDispatcher interface {
+	stack.NetworkDispatcher
+	Stack() *stack.Stack
+}
+
+// New creates a new Dispatcher which hands packets to dispatcher.
+func New(dispatcher stack.NetworkDispatcher) *Dispatcher {
+	d := &Dispatcher{
+		dispatcher: dispatcher,
+	}
+	if sd, ok := dispatcher.(stackDispatcher); ok {
+		d.stack = sd.Stack()
+	}
+	return d
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.DeliverNetworkPacket.
+func (d *Dispatcher) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBuffer) {
+	if d.stack != nil && d.stack.Forwarding() {
+		d.Flush()
+		d.dispatcher.DeliverNetworkPacket(linkEP, remote, local, protocol, pkt)
+		return
+	}
+
+	ip, tcp, payload, payloadXsum, ok := parse(protocol, &pkt)
+	if !ok {
+		d.Flush()
+		d.dispatcher.DeliverNetworkPacket(linkEP, remote, local, protocol, pkt)
+		return
+	}
+	push := tcp.Flags()&header.TCPFlagPsh != 0
+
+	if s := d.held; s != nil && s.linkEP == linkEP && s.remote == remote && s.local == local && s.canCoalesce(ip, tcp, payload.Size()) {
+		s.append(payload, payloadXsum)
+		if push {
+			heldTCP := header.TCP(s.hdr[header.IPv4MinimumSize:])
+			heldTCP.SetFlags(heldTCP.Flags() | header.TCPFlagPsh)
+			d.Flush()
+		}
+		return
+	}
+
+	d.Flush()
+	if push {
+		// Nothing can be coalesced into a pushed segment.
+		d.dispatcher.DeliverNetworkPacket(linkEP, remote, local, protocol, pkt)
+		return
+	}
+	hdr := make(buffer.View, header.IPv4MinimumSize+int(tcp.DataOffset()))
+	copy(hdr, ip)
+	copy(hdr[header.IPv4MinimumSize:], tcp)
+	d.held = &segment{
+		linkEP:      linkEP,
+		remote:      remote,
+		local:       local,
+		pkt:         pkt,
+		hdr:         hdr,
+		payload:     payload,
+		payloadXsum: payloadXsum,
+		nextSeq:     tcp.SequenceNumber() + uint32(payload.Size()),
+		count:       1,
+	}
+}
+
+// append coalesces the payload of the next segment of the flow into s, given
+// the checksum of the payload.
+func (s *segment) append(payload buffer.VectorisedView, payloadXsum uint16) {
+	// The checksum of data starting at an odd offset has its bytes swapped.
+	if s.payload.Size()%2 != 0 {
+		payloadXsum = payloadXsum<<8 | payloadXsum>>8
+	}
+	s.payloadXsum = header.ChecksumCombine(s.payloadXsum, payloadXsum)
+	s.nextSeq += uint32(payload.Size())
+	s.payload.Append(payload)
+	s.count++
+}
+
+// Flush hands the segment being held, if any, to the other dispatcher.
+func (d *Dispatcher) Flush() {
+	s := d.held
+	if s == nil {
+		return
+	}
+	d.held = nil
+
+	if s.count == 1 {
+		d.dispatcher.DeliverNetworkPacket(s.linkEP, s.remote, s.local, header.IPv4ProtocolNumber, s.pkt)
+		return
+	}
+
+	ip := header.IPv4(s.hdr)
+	ip.SetTotalLength(uint16(len(s.hdr) + s.payload.Size()))
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	tcp := header.TCP(s.hdr[header.IPv4MinimumSize:])
+	tcp.SetChecksum(0)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(tcp)+s.payload.Size()))
+	xsum = header.ChecksumCombine(xsum, s.payloadXsum)
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum))
+
+	data := s.hdr.ToVectorisedView()
+	data.Append(s.payload)
+	d.dispatcher.DeliverNetworkPacket(s.linkEP, s.remote, s.local, header.IPv4ProtocolNumber, stack.PacketBuffer{
+		Data:       data,
+		LinkHeader: s.pkt.LinkHeader,
+	})
+}
+
+// canCoalesce returns true if the segment with the given headers and payload
+// size continues s and may be coalesced into it. Apart from their IP IDs,
+// which must follow each other, the segments may only differ in their PSH
+// flag, which s never has set.
+func (s *segment) canCoalesce(ip header.IPv4, tcp header.TCP, payloadSize int) bool {
+	heldIP := header.IPv4(s.hdr)
+	heldTCP := header.TCP(s.hdr[header.IPv4MinimumSize:])
+	heldTOS, _ := heldIP.TOS()
+	tos, _ := ip.TOS()
+	return len(s.hdr)+s.payload.Size()+payloadSize <= maxCoalescedSize &&
+		ip.SourceAddress() == heldIP.SourceAddress() &&
+		ip.DestinationAddress() == heldIP.DestinationAddress() &&
+		tos == heldTOS &&
+		ip.TTL() == heldIP.TTL() &&
+		ip.Flags()&header.IPv4FlagDontFragment == heldIP.Flags()&header.IPv4FlagDontFragment &&
+		ip.ID() == heldIP.ID()+uint16(s.count) &&
+		tcp.SourcePort() == heldTCP.SourcePort() &&
+		tcp.DestinationPort() == heldTCP.DestinationPort() &&
+		tcp.SequenceNumber() == s.nextSeq &&
+		tcp.AckNumber() == heldTCP.AckNumber() &&
+		tcp.WindowSize() == heldTCP.WindowSize() &&
+		tcp.Flags()&^header.TCPFlagPsh == heldTCP.Flags() &&
+		bytes.Equal(tcp.Options(), heldTCP.Options())
+}
+
+// parse returns the IPv4 and TCP headers, and the payload and its checksum, of
+// pkt if it is a TCP segment that may be coalesced with others.
+//
+// The headers are made contiguous in pkt.Data if they aren't already.
+func parse(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) (header.IPv4, header.TCP, buffer.VectorisedView, uint16, bool) {
+	if protocol != header.IPv4ProtocolNumber {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+
+	v, ok := pullUp(&pkt.Data, header.IPv4MinimumSize)
+	if !ok {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+	ip := header.IPv4(v)
+	size := pkt.Data.Size()
+	if !ip.IsValid(size) || ip.HeaderLength() != header.IPv4MinimumSize || ip.TransportProtocol() != header.TCPProtocolNumber {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+	if ip.Flags()&header.IPv4FlagMoreFragments != 0 || ip.FragmentOffset() != 0 {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+	if ip.CalculateChecksum() != 0xffff {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+
+	totalLen := int(ip.TotalLength())
+	v, ok = pullUp(&pkt.Data, header.IPv4MinimumSize+header.TCPMinimumSize)
+	if !ok || totalLen < len(v) {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+	tcpHdrLen := int(header.TCP(v[header.IPv4MinimumSize:]).DataOffset())
+	if tcpHdrLen < header.TCPMinimumSize || header.IPv4MinimumSize+tcpHdrLen > totalLen {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+	v, ok = pullUp(&pkt.Data, header.IPv4MinimumSize+tcpHdrLen)
+	if !ok {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+	ip = header.IPv4(v)
+	tcp := header.TCP(v[header.IPv4MinimumSize:])
+
+	// Only segments carrying data with no flag other than ACK and PSH set may be
+	// coalesced; any other flag must be seen by the stack as is.
+	if flags := tcp.Flags(); flags&header.TCPFlagAck == 0 || flags&^(header.TCPFlagAck|header.TCPFlagPsh) != 0 {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+
+	payload := pkt.Data.Clone(nil)
+	payload.CapLength(totalLen)
+	payload.TrimFront(len(v))
+	if payload.Size() == 0 {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+
+	// Don't let a corrupted segment be hidden in a coalesced packet with a valid
+	// checksum. The checksum of the payload is kept to compute the checksum of
+	// the coalesced packet without going over the payload again.
+	payloadXsum := header.ChecksumVV(payload, 0)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(totalLen-header.IPv4MinimumSize))
+	xsum = header.ChecksumCombine(xsum, payloadXsum)
+	if tcp.CalculateChecksum(xsum) != 0xffff {
+		return nil, nil, buffer.VectorisedView{}, 0, false
+	}
+
+	return ip, tcp, payload, payloadXsum, true
+}
+
+// pullUp returns the first n bytes of vv, making them contiguous if they
+// aren't already. It returns false if vv holds fewer than n bytes.
+func pullUp(vv *buffer.VectorisedView, n int) (buffer.View, bool) {
+	if first := vv.First(); len(first) >= n {
+		return first[:n], true
+	}
+	if vv.Size() < n {
+		return nil, false
+	}
+	v := vv.ToView()
+	*vv = v.ToVectorisedView()
+	return v[:n], true
+}
@@ -0,0 +1,326 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gro
+
+import (
+	"bytes"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	srcAddr = tcpip.Address("\x0a\x00\x00\x01")
+	dstAddr = tcpip.Address("\x0a\x00\x00\x02")
+	srcPort = 1234
+	dstPort = 80
+	ackNum  = 5000
+)
+
+type recordingDispatcher struct {
+	pkts []buffer.View
+}
+
+func (d *recordingDispatcher) DeliverNetworkPacket(_ stack.LinkEndpoint, _, _ tcpip.LinkAddress, _ tcpip.NetworkProtocolNumber, pkt stack.PacketBuffer) {
+	d.pkts = append(d.pkts, pkt.Data.ToView())
+}
+
+// makeSegment returns an IPv4 packet with the given ID and the Don't Fragment
+// flag set, holding a TCP segment with the given sequence number, flags and
+// payload. The headers are split across two views.
+func makeSegment(id uint16, port uint16, seq uint32, flags uint8, payload []byte) stack.PacketBuffer {
+	hdr := make(buffer.View, header.IPv4MinimumSize+header.TCPMinimumSize)
+	ip := header.IPv4(hdr)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(hdr) + len(payload)),
+		ID:          id,
+		Flags:       header.IPv4FlagDontFragment,
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     srcAddr,
+		DstAddr:     dstAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	tcp := header.TCP(hdr[header.IPv4MinimumSize:])
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    port,
+		DstPort:    dstPort,
+		SeqNum:     seq,
+		AckNum:     ackNum,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, srcAddr, dstAddr, uint16(len(tcp)+len(payload)))
+	xsum = header.Checksum(payload, xsum)
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum))
+
+	return stack.PacketBuffer{
+		Data: buffer.NewVectorisedView(len(hdr)+len(payload), []buffer.View{
+			hdr[:header.IPv4MinimumSize],
+			hdr[header.IPv4MinimumSize:],
+			buffer.View(payload),
+		}),
+	}
+}
+
+// checkSegment checks that pkt is a valid TCP segment starting at seq and
+// carrying payload.
+func checkSegment(t *testing.T, pkt buffer.View, seq uint32, payload []byte) {
+	t.Helper()
+
+	ip := header.IPv4(pkt)
+	if !ip.IsValid(len(pkt)) {
+		t.Fatalf("got invalid IPv4 packet %x", pkt)
+	}
+	if got := ip.CalculateChecksum(); got != 0xffff {
+		t.Errorf("got IPv4 checksum = %#x, want = 0xffff", got)
+	}
+	tcp := header.TCP(ip.Payload())
+	if got := tcp.SequenceNumber(); got != seq {
+		t.Errorf("got SequenceNumber() = %d, want = %d", got, seq)
+	}
+	if got := tcp.Payload(); !bytes.Equal(got, payload) {
+		t.Errorf("got payload = %q, want = %q", got, payload)
+	}
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, srcAddr, dstAddr, uint16(len(tcp)))
+	xsum = header.Checksum(tcp.Payload(), xsum)
+	if got := tcp.CalculateChecksum(xsum); got != 0xffff {
+		t.Errorf("got TCP checksum = %#x, want = 0xffff", got)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var rec recordingDispatcher
+	d := New(&rec)
+
+	d.DeliverNetworkPacket(nil, "", "", header.IPv4ProtocolNumber, makeSegment(1, srcPort, 1000, header.TCPFlagAck, []byte("abc")))
+	d.DeliverNetworkPacket(nil, "", "", header.IPv4ProtocolNumber, makeSegment(2, srcPort, 1003, header.TCPFlagAck, []byte("defg")))
+	d.DeliverNetworkPacket(nil, "", "", header.IPv4ProtocolNumber, makeSegment(3, srcPort, 1007, header.TCPFlagAck, []byte("h")))
+	if len(rec.pkts) != 0 {
+		t.Fatalf("got %d packets delivered before Flush, want = 0", len(rec.pkts))
+	}
+
+	d.Flush()
+	if len(rec.pkts) != 1 {
+		t.Fatalf("got %d packets delivered, want = 1", len(rec.pkts))
+	}
+	checkSegment(t, rec.pkts[0], 1000, []byte("abcdefgh"))
+
+	// Nothing is left to flush.
+	d.Flush()
+	if len(rec.pkts) != 1 {
+		t.Fatalf("got %d packets delivered after the second Flush, want = 1", len(rec.pkts))
+	}
+}
+
+func TestCoalescePush(t *testing.T) {
+	var rec recordingDispatcher
+	d := New(&rec)
+
+	d.DeliverNetworkPacket(nil, "", "", header.IPv4ProtocolNumber, makeSegment(1, srcPort, 1000, header.TCPFlagAck, []byte("abc")))
+	d.DeliverNetworkPacket(nil, "", "", header.IPv4ProtocolNumber, makeSegment(2, srcPort, 1003, header.TCPFlagAck, []byte("defg")))
+	d.DeliverNetworkPacket(nil, "", "", header.IPv4ProtocolNumber, makeSegment(3, srcPort, 1007, header.TCPFlagAck|header.TCPFlagPsh, []byte("h")))
+
+	// The pushed segment ends the coalesced packet, which is delivered without
+	// waiting for Flush.
+	if len(rec.pkts) != 1 {
+		t.Fatalf("got %d packets delivered, want = 1", len(rec.pkts))
+	}
+	checkSegment(t, rec.pkts[0], 1000, []byte("abcdefgh"))
+	if got, want := header.TCP(header.IPv4(rec.pkts[0]).Payload()).Flags(), uint8(header.TCPFlagAck|header.TCPFlagPsh); got != want {
+		t.Errorf("got Flags() = %#x, want = %#x", got, want)
+	}
+
+	// A pushed segment which starts a flow is delivered right away.
+	pushed := makeSegment(4, srcPort, 1008, header.TCPFlagAck|header.TCPFlagPsh, []byte("ijk"))
+	want := pushed.Data.ToView()
+	d.DeliverNetworkPacket(nil, "", "", header.IPv4ProtocolNumber, pushed)
+	if len(rec.pkts) != 2 {
+		t.Fatalf("got %d packets delivered, want = 2", len(rec.pkts))
+	}
+	if !bytes.Equal(rec.pkts[1], want) {
+		t.Errorf("got packet #1 = %x, want = %x", rec.pkts[1], want)
+	}
+}
+
+func TestNoCoalesce(t *testing.T) {
+	tests := []struct {
+		name   string
+		second stack.PacketBuffer
+	}{
+		{
+			name:   "FIN",
+			second: makeSegment(2, srcPort, 1003, header.TCPFlagAck|header.TCPFlagFin, []byte("def")),
+		},
+		{
+			name:   "Not contiguous",
+			second: makeSegment(2, srcPort, 1004, header.TCPFlagAck, []byte("def")),
+		},
+		{
+			name:   "Other flow",
+			second: makeSegment(2, srcPort+1, 1003, header.TCPFlagAck, []byte("def")),
+		},
+		{
+			name:   "Not consecutive IP ID",
+			second: makeSegment(3, srcPort, 1003, header.TCPFlagAck, []byte("def")),
+		},
+		{
+			name: "No DF",
+			second: func() stack.PacketBuffer {
+				pkt := makeSegment(2, srcPort, 1003, header.TCPFlagAck, []byte("def"))
+				ip := header.IPv4(pkt.Data.Views()[0])
+				ip.SetFlagsFragmentOffset(0, 0)
+				ip.SetChecksum(0)
+				ip.SetChecksum(^ip.CalculateChecksum())
+				return pkt
+			}(),
+		},
+		{
+			name: "Bad checksum",
+			second: func() stack.PacketBuffer {
+				pkt := makeSegment(2, srcPort, 1003, header.TCPFlagAck, []byte("def"))
+				pkt.Data.Views()[2][0] = 'x'
+				return pkt
+			}(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rec recordingDispatcher
+			d := New(&rec)
+
+			first := makeSegment(1, srcPort, 1000, header.TCPFlagAck, []byte("abc"))
+			want := []buffer.View{first.Data.ToView(), test.second.Data.ToView()}
+			d.DeliverNetworkPacket(nil, "", "", header.IPv4ProtocolNumber, first)
+			d.DeliverNetworkPacket(nil, "", "", header.IPv4ProtocolNumber, test.second)
+			d.Flush()
+
+			if len(rec.pkts) != len(want) {
+				t.Fatalf("got %d packets delivered, want = %d", len(rec.pkts), len(want))
+			}
+			for i := range want {
+				if !bytes.Equal(rec.pkts[i], want[i]) {
+					t.Errorf("got packet #%d = %x, want = %x", i, rec.pkts[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+// attachRecorder is a link endpoint which records the dispatcher it is
+// attached to.
+type attachRecorder struct {
+	*channel.Endpoint
+	dispatcher stack.NetworkDispatcher
+}
+
+func (e *attachRecorder) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.Endpoint.Attach(dispatcher)
+}
+
+// TestForwarding tests that segments are handed to a stack which forwards
+// packets as they are, as a coalesced packet may not fit in the MTU of the NIC
+// it is forwarded out of.
+func TestForwarding(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+	})
+	s.SetForwarding(true)
+
+	ep1 := &attachRecorder{Endpoint: channel.New(10, 1500, "")}
+	if err := s.CreateNIC(nicID1, ep1); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID1, err)
+	}
+	if err := s.AddAddress(nicID1, ipv4.ProtocolNumber, "\x0a\x00\x00\x03"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 10.0.0.3): %s", nicID1, ipv4.ProtocolNumber, err)
+	}
+	// The MTU of NIC 2 only fits one of the segments.
+	ep2 := channel.New(10, header.IPv4MinimumSize+header.TCPMinimumSize+3, "")
+	if err := s.CreateNIC(nicID2, ep2); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID2, err)
+	}
+	if err := s.AddAddress(nicID2, ipv4.ProtocolNumber, "\x0a\x00\x01\x01"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 10.0.1.1): %s", nicID2, ipv4.ProtocolNumber, err)
+	}
+	subnet, err := tcpip.NewSubnet(dstAddr, "\xff\xff\xff\xff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: subnet, NIC: nicID2}})
+
+	d := New(ep1.dispatcher)
+	d.DeliverNetworkPacket(ep1, "", "", header.IPv4ProtocolNumber, makeSegment(1, srcPort, 1000, header.TCPFlagAck, []byte("abc")))
+	d.DeliverNetworkPacket(ep1, "", "", header.IPv4ProtocolNumber, makeSegment(2, srcPort, 1003, header.TCPFlagAck, []byte("def")))
+	d.Flush()
+
+	for _, want := range []struct {
+		seq     uint32
+		payload []byte
+	}{
+		{1000, []byte("abc")},
+		{1003, []byte("def")},
+	} {
+		p, ok := ep2.Read()
+		if !ok {
+			t.Fatalf("expected segment %d to be forwarded", want.seq)
+		}
+		pkt := append(buffer.View(nil), p.Pkt.Header.View()...)
+		checkSegment(t, append(pkt, p.Pkt.Data.ToView()...), want.seq, want.payload)
+	}
+	if p, ok := ep2.Read(); ok {
+		t.Errorf("got unexpected packet forwarded = %+v", p)
+	}
+}
+
+func BenchmarkDeliverNetworkPacket(b *testing.B) {
+	const (
+		batchSize   = 64
+		payloadSize = 1448
+	)
+
+	payload := make([]byte, payloadSize)
+	pkts := make([]stack.PacketBuffer, batchSize)
+	for i := range pkts {
+		pkts[i] = makeSegment(uint16(i), srcPort, uint32(i*payloadSize), header.TCPFlagAck, payload)
+	}
+
+	var rec recordingDispatcher
+	d := New(&rec)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pkt := range pkts {
+			d.DeliverNetworkPacket(nil, "", "", header.IPv4ProtocolNumber, stack.PacketBuffer{
+				Data: pkt.Data.Clone(nil),
+			})
+		}
+		d.Flush()
+		rec.pkts = rec.pkts[:0]
+	}
+}
@@ -45,6 +45,7 @@ type endpoint struct {
 	nicID         tcpip.NICID
 	linkEP        stack.LinkEndpoint
 	linkAddrCache stack.LinkAddressCache
+	stack         *stack.Stack
 }
 
 // DefaultTTL is unused for ARP. It implements stack.NetworkEndpoint.
@@ -105,6 +106,9 @@ func (e *endpoint) HandlePacket(r *stack.Route, pkt stack.PacketBuffer) {
 		if e.linkAddrCache.CheckLocalAddress(e.nicID, header.IPv4ProtocolNumber, localAddr) == 0 {
 			return // we have no useful answer, ignore the request
 		}
+		if e.stack != nil && !e.stack.AnswersARP(e.nicID, localAddr) {
+			return // the NIC doesn't answer for this address
+		}
 		hdr := buffer.NewPrependable(int(e.linkEP.MaxHeaderLength()) + header.ARPSize)
 		packet := header.ARP(hdr.Prepend(header.ARPSize))
 		packet.SetIPv4OverEthernet()
@@ -145,6 +149,7 @@ func (p *protocol) NewEndpoint(nicID tcpip.NICID, addrWithPrefix tcpip.AddressWi
 		nicID:         nicID,
 		linkEP:        sender,
 		linkAddrCache: linkAddrCache,
+		stack:         st,
 	}, nil
 }
 
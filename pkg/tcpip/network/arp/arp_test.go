@@ -144,3 +144,55 @@ func TestDirectRequest(t *testing.T) {
 		t.Errorf("stackAddrBad: unexpected packet sent, Proto=%v", pkt.Proto)
 	}
 }
+
+func TestPrimaryOnlyRequest(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	if err := c.s.SetARPPrimaryOnly(1, true); err != nil {
+		t.Fatalf("SetARPPrimaryOnly(1, true): %s", err)
+	}
+
+	const senderMAC = "\x01\x02\x03\x04\x05\x06"
+	const senderIPv4 = "\x0a\x00\x00\x04"
+
+	v := make(buffer.View, header.ARPSize)
+	h := header.ARP(v)
+	h.SetIPv4OverEthernet()
+	h.SetOp(header.ARPRequest)
+	copy(h.HardwareAddressSender(), senderMAC)
+	copy(h.ProtocolAddressSender(), senderIPv4)
+
+	for _, test := range []struct {
+		name      string
+		addr      tcpip.Address
+		wantReply bool
+	}{
+		{name: "primary", addr: stackAddr1, wantReply: true},
+		{name: "secondary", addr: stackAddr2, wantReply: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			copy(h.ProtocolAddressTarget(), test.addr)
+			c.linkEP.InjectInbound(arp.ProtocolNumber, stack.PacketBuffer{
+				Data: v.ToVectorisedView(),
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			pi, ok := c.linkEP.ReadContext(ctx)
+			if ok != test.wantReply {
+				t.Fatalf("got reply = %t, want = %t", ok, test.wantReply)
+			}
+			if !ok {
+				return
+			}
+			rep := header.ARP(pi.Pkt.Header.View())
+			if !rep.IsValid() {
+				t.Fatalf("invalid ARP response pi.Pkt.Header.UsedLength()=%d", pi.Pkt.Header.UsedLength())
+			}
+			if got := tcpip.Address(rep.ProtocolAddressSender()); got != test.addr {
+				t.Errorf("got ProtocolAddressSender = %s, want = %s", got, test.addr)
+			}
+		})
+	}
+}
@@ -13,15 +13,18 @@
 // limitations under the License.
 
 // Package fragmentation contains the implementation of IP fragmentation.
-// It is based on RFC 791 and RFC 815.
+// It is based on RFC 791 and RFC 815, and is used for both IPv4 and IPv6
+// (RFC 8200 section 4.5) reassembly.
 package fragmentation
 
 import (
-	"fmt"
-	"log"
+	"errors"
+	"sync/atomic"
 	"time"
 
+	"gvisor.dev/gvisor/pkg/log"
 	"gvisor.dev/gvisor/pkg/sync"
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 )
 
@@ -40,9 +43,77 @@ const HighFragThreshold = 4 << 20 // 4MB
 // net.ipv4.ipfrag_low_thresh for more information.
 const LowFragThreshold = 3 << 20 // 3MB
 
+// DefaultMaxPerSource is the default limit on the number of packets from a
+// single source the IP protocols reassemble concurrently. At the default
+// thresholds, it lets a source reassemble as many maximum-sized datagrams as
+// fit in HighFragThreshold. See SetMaxPerSource.
+const DefaultMaxPerSource = HighFragThreshold / (1 << 16)
+
+// DefaultMaxSourceShare is the default share of HighFragThreshold the
+// fragments of the packets from a single source may take in the IP protocols,
+// so that a source cannot starve the others of reassembly memory.
+const DefaultMaxSourceShare = 0.5
+
+var (
+	// ErrInvalidFragmentLength is returned by Process when the range of a
+	// fragment is empty or does not match the size of its data.
+	ErrInvalidFragmentLength = errors.New("invalid fragment length")
+
+	// ErrFragmentConflict is returned by Process when a fragment disagrees
+	// with the packet size set by the last fragment, i.e. when it extends past
+	// the end of the packet or is another last fragment ending elsewhere.
+	ErrFragmentConflict = errors.New("fragment conflicts with the packet size")
+
+	// ErrFragmentOverlap is returned by Process when a fragment overlaps
+	// another fragment of the packet in a way the overlap mode does not allow.
+	// See SetOverlapMode.
+	ErrFragmentOverlap = errors.New("fragments overlap")
+)
+
+// OverlapMode is how a Fragmentation handles fragments which overlap
+// fragments of the same packet received before them.
+type OverlapMode int
+
+const (
+	// OverlapRejectConflicting discards packets whose fragments overlap with
+	// different data. Fragments which overlap with the same data are
+	// accepted. This is the default.
+	OverlapRejectConflicting OverlapMode = iota
+
+	// OverlapLastWins accepts all overlapping fragments. Where they overlap,
+	// the data of the last fragment received replaces the data received
+	// before it.
+	OverlapLastWins
+
+	// OverlapReject discards packets with any overlapping fragments other
+	// than exact duplicates, as RFC 5722 requires for IPv6.
+	OverlapReject
+)
+
 // Fragmentation is the main structure that other modules
 // of the stack should use to implement IP Fragmentation.
+//
+// A Fragmentation does not know which network protocol its fragments belong
+// to, so it must only be used for a single protocol; the IPv4 and IPv6
+// endpoints each own one. This keeps the ids of IPv4 and IPv6 packets from
+// colliding even when they have the same numeric value.
 type Fragmentation struct {
+	// The following fields can be read without holding mu, so that reassembly
+	// pressure can be monitored cheaply. They are only updated with mu held,
+	// and must be accessed atomically.
+	//
+	// memoryConsumed and numReassemblers mirror size and the number of
+	// reassemblers. completed, timedOut, evicted and sourceEvicted count the
+	// packets which were reassembled, discarded by the reassembly timeout,
+	// evicted to bring memory consumption down and evicted because of the
+	// per-source limits, respectively.
+	memoryConsumed  int64
+	numReassemblers int64
+	completed       uint64
+	timedOut        uint64
+	evicted         uint64
+	sourceEvicted   uint64
+
 	mu           sync.Mutex
 	highLimit    int
 	lowLimit     int
@@ -50,8 +121,142 @@ type Fragmentation struct {
 	rList        reassemblerList
 	size         int
 	timeout      time.Duration
+
+	// clock is used to age the reassemblers and measure reassembly latencies.
+	clock tcpip.Clock
+
+	// onEvict, if set, is called for each reassembler evicted because the
+	// memory limits were exceeded.
+	onEvict EvictionHandler
+
+	// onTimeout, if set, is called for each reassembler discarded because it
+	// was not reassembled within the reassembly timeout.
+	onTimeout TimeoutHandler
+
+	// logger, if set, reports internal errors, such as accounting bugs,
+	// instead of the global logger.
+	logger log.Logger
+
+	// stats holds the counters reported by Stats which are not kept
+	// atomically above.
+	stats Stats
+
+	// maxPerSource is the maximum number of packets from a single source
+	// that may be reassembled concurrently. Zero means no limit.
+	maxPerSource int
+
+	// sources holds the number of packets being reassembled per source, for
+	// the packets whose source is known.
+	sources map[tcpip.Address]int
+
+	// maxSourceShare is the maximum share of highLimit that the fragments of
+	// the packets from a single source may take. Zero means no limit. It is
+	// immutable.
+	maxSourceShare float64
+
+	// sourceSizes holds the number of bytes of fragments held per source,
+	// for the packets whose source is known.
+	sourceSizes map[tcpip.Address]int
+
+	// checkDSCP is true if packets whose fragments carry different DSCP
+	// values are discarded.
+	checkDSCP bool
+
+	// overlapMode is how fragments which overlap are handled.
+	overlapMode OverlapMode
+
+	// latencies holds the number of reassembled packets per latency bucket.
+	// The last bucket counts the latencies above the last bound of
+	// latencyBuckets.
+	latencies [len(latencyBuckets) + 1]uint64
+
+	// maxLatency is the highest reassembly latency observed.
+	maxLatency time.Duration
+}
+
+// latencyBuckets are the upper bounds of the buckets reassembly latencies are
+// counted in.
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	DefaultReassembleTimeout,
+}
+
+// Stats holds statistics about the packets reassembled by a Fragmentation.
+type Stats struct {
+	// Reassembled is the number of packets that were successfully
+	// reassembled.
+	Reassembled uint64
+
+	// Malformed is the number of packets discarded because their fragments
+	// could not be reassembled.
+	Malformed uint64
+
+	// TimedOut is the number of incomplete packets discarded because they
+	// were not reassembled within the reassembly timeout.
+	TimedOut uint64
+
+	// Evicted is the number of incomplete packets discarded because the
+	// memory limits or the per-source limits were exceeded.
+	Evicted uint64
+
+	// InconsistentDSCP is the number of packets discarded because their
+	// fragments carried different DSCP values. See SetDSCPCheck.
+	InconsistentDSCP uint64
+
+	// Overlapping is the number of packets discarded because their fragments
+	// overlapped. See SetOverlapMode.
+	Overlapping uint64
+
+	// Pending is the number of packets currently being reassembled.
+	Pending int
+
+	// PendingBytes is the number of bytes of fragments currently held for
+	// packets being reassembled.
+	PendingBytes int
+
+	// Latency holds percentiles of the time taken to reassemble packets,
+	// from the arrival of their first fragment to the arrival of the
+	// fragment that completed them.
+	Latency LatencyPercentiles
 }
 
+// LatencyPercentiles holds percentiles of reassembly latencies.
+//
+// Latencies are counted in buckets, so each percentile is reported as the
+// upper bound of the bucket it falls in: a P99 of 5ms means that 99% of the
+// packets were reassembled within 5ms. Percentiles falling above the last
+// bucket are reported as the highest latency observed. All the percentiles are
+// zero until a packet is reassembled.
+type LatencyPercentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+// EvictionHandler is called when an incomplete packet is evicted from a
+// Fragmentation because the high memory limit or a per-source limit was
+// exceeded. id identifies the evicted packet and size is the number of bytes of
+// fragments that were freed.
+type EvictionHandler func(id uint32, size int)
+
+// TimeoutHandler is called when an incomplete packet is discarded from a
+// Fragmentation because it was not reassembled within the reassembly timeout.
+// id identifies the packet and holes holds the byte ranges that were still
+// missing, sorted by offset, to help diagnose lossy paths.
+type TimeoutHandler func(id uint32, holes []Hole)
+
 // NewFragmentation creates a new Fragmentation.
 //
 // highMemoryLimit specifies the limit on the memory consumed
@@ -62,9 +267,18 @@ type Fragmentation struct {
 // fragments after reaching highMemoryLimit.
 //
 // reassemblingTimeout specifies the maximum time allowed to reassemble a packet.
-// Fragments are lazily evicted only when a new a packet with an
-// already existing fragmentation-id arrives after the timeout.
-func NewFragmentation(highMemoryLimit, lowMemoryLimit int, reassemblingTimeout time.Duration) *Fragmentation {
+// Each packet has a single timer, started when its first fragment arrives,
+// that discards it if it is still incomplete when the timeout expires. A zero
+// or negative timeout disables the timer, so that packets are only discarded
+// when the memory limits are exceeded.
+//
+// maxSourceShare limits the memory taken by the fragments of the packets from a
+// single source to that share of highMemoryLimit, so that one source cannot use
+// up the reassembly memory and starve the others. When a source exceeds its
+// share, its packets are evicted, oldest first, until it is back within it.
+// Only packets whose fragments were processed with a source address are
+// accounted. A share of zero or less, or of one or more, disables the limit.
+func NewFragmentation(highMemoryLimit, lowMemoryLimit int, reassemblingTimeout time.Duration, maxSourceShare float64) *Fragmentation {
 	if lowMemoryLimit >= highMemoryLimit {
 		lowMemoryLimit = highMemoryLimit
 	}
@@ -73,72 +287,512 @@ func NewFragmentation(highMemoryLimit, lowMemoryLimit int, reassemblingTimeout t
 		lowMemoryLimit = 0
 	}
 
+	if maxSourceShare < 0 || maxSourceShare >= 1 {
+		maxSourceShare = 0
+	}
+
 	return &Fragmentation{
-		reassemblers: make(map[uint32]*reassembler),
-		highLimit:    highMemoryLimit,
-		lowLimit:     lowMemoryLimit,
-		timeout:      reassemblingTimeout,
+		reassemblers:   make(map[uint32]*reassembler),
+		sources:        make(map[tcpip.Address]int),
+		sourceSizes:    make(map[tcpip.Address]int),
+		highLimit:      highMemoryLimit,
+		lowLimit:       lowMemoryLimit,
+		timeout:        reassemblingTimeout,
+		clock:          &tcpip.StdClock{},
+		maxSourceShare: maxSourceShare,
 	}
 }
 
+// SetEvictionHandler sets the handler invoked for every incomplete packet
+// evicted when the high memory limit or a per-source limit is exceeded. A nil
+// handler disables notifications.
+func (f *Fragmentation) SetEvictionHandler(h EvictionHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onEvict = h
+}
+
+// SetTimeoutHandler sets the handler invoked for every incomplete packet
+// discarded because it was not reassembled within the reassembly timeout. A nil
+// handler disables notifications.
+func (f *Fragmentation) SetTimeoutHandler(h TimeoutHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onTimeout = h
+}
+
+// SetMaxPerSource limits the number of packets from a single source that may
+// be reassembled concurrently, so that one source cannot hold all the
+// reassembly memory by starting many packets. When a fragment of a new packet
+// arrives from a source at the limit, the oldest incomplete packet from that
+// source is evicted. Only packets whose fragments were processed with a source
+// address are counted. A limit of zero or less disables it.
+func (f *Fragmentation) SetMaxPerSource(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxPerSource = n
+}
+
+// SetDSCPCheck sets whether packets whose fragments carry different DSCP
+// values are discarded. The fragments of a packet should all carry the same
+// DSCP, so a mismatch may indicate that fragments of different packets, e.g.
+// forged ones, are being mixed. The check is disabled by default and only
+// applies to packets whose first fragment arrives after it is set.
+func (f *Fragmentation) SetDSCPCheck(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checkDSCP = enabled
+}
+
+// DSCPCheck returns whether packets whose fragments carry different DSCP values
+// are discarded. See SetDSCPCheck.
+func (f *Fragmentation) DSCPCheck() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checkDSCP
+}
+
+// SetOverlapMode sets how fragments which overlap fragments of the same packet
+// received before them are handled. It only applies to packets whose first
+// fragment arrives after it is set.
+func (f *Fragmentation) SetOverlapMode(mode OverlapMode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overlapMode = mode
+}
+
+// SetLogger sets the logger used to report internal errors, such as
+// accounting bugs, so they can be captured or suppressed. A nil logger
+// restores the default of reporting them to the global logger.
+func (f *Fragmentation) SetLogger(l log.Logger) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logger = l
+}
+
+// Stats returns statistics about the packets reassembled by f.
+func (f *Fragmentation) Stats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.stats
+	s.Reassembled = atomic.LoadUint64(&f.completed)
+	s.TimedOut = atomic.LoadUint64(&f.timedOut)
+	s.Evicted = atomic.LoadUint64(&f.evicted) + atomic.LoadUint64(&f.sourceEvicted)
+	s.Pending = len(f.reassemblers)
+	s.PendingBytes = f.size
+	s.Latency = LatencyPercentiles{
+		P50: f.latencyPercentileLocked(50),
+		P90: f.latencyPercentileLocked(90),
+		P99: f.latencyPercentileLocked(99),
+	}
+	return s
+}
+
+// MemoryConsumed returns the number of bytes of fragments held by f for the
+// packets being reassembled. Unlike Stats, it does not lock f.
+func (f *Fragmentation) MemoryConsumed() int {
+	return int(atomic.LoadInt64(&f.memoryConsumed))
+}
+
+// NumReassemblers returns the number of packets being reassembled by f.
+// Unlike Stats, it does not lock f.
+func (f *Fragmentation) NumReassemblers() int {
+	return int(atomic.LoadInt64(&f.numReassemblers))
+}
+
+// ReassembliesCompleted returns the number of packets reassembled by f.
+func (f *Fragmentation) ReassembliesCompleted() uint64 {
+	return atomic.LoadUint64(&f.completed)
+}
+
+// ReassembliesTimedOut returns the number of incomplete packets discarded by f
+// because they were not reassembled within the reassembly timeout.
+func (f *Fragmentation) ReassembliesTimedOut() uint64 {
+	return atomic.LoadUint64(&f.timedOut)
+}
+
+// ReassembliesEvicted returns the number of incomplete packets evicted by f to
+// bring its memory consumption down, because the high memory limit was
+// exceeded or Trim was called. Unlike Stats.Evicted, it does not count the
+// packets evicted because of the per-source limits.
+func (f *Fragmentation) ReassembliesEvicted() uint64 {
+	return atomic.LoadUint64(&f.evicted)
+}
+
+// recordLatencyLocked counts a packet reassembled in d.
+//
+// Precondition: f.mu must be locked.
+func (f *Fragmentation) recordLatencyLocked(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	f.latencies[i]++
+	if d > f.maxLatency {
+		f.maxLatency = d
+	}
+}
+
+// latencyPercentileLocked returns the p-th percentile of the reassembly
+// latencies, as described in LatencyPercentiles.
+//
+// Precondition: f.mu must be locked.
+func (f *Fragmentation) latencyPercentileLocked(p uint64) time.Duration {
+	var total uint64
+	for _, n := range f.latencies {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	// rank is the number of latencies at or below the percentile, rounded up.
+	rank := (total*p + 99) / 100
+	var seen uint64
+	for i, n := range f.latencies[:len(latencyBuckets)] {
+		if seen += n; seen >= rank {
+			return latencyBuckets[i]
+		}
+	}
+	return f.maxLatency
+}
+
+// Hole is a range of a packet under reassembly for which no fragment has been
+// received.
+type Hole struct {
+	// First and Last are the offsets of the first and last missing bytes.
+	// Until the last fragment of the packet is received, the length of the
+	// packet is unknown and the last hole ends at math.MaxUint16.
+	First uint16
+	Last  uint16
+}
+
+// HolesFor returns the holes of the packet being reassembled under id, sorted
+// by offset. It returns false if no packet is being reassembled under id. It is
+// meant for diagnosing reassemblies which do not complete.
+func (f *Fragmentation) HolesFor(id uint32) ([]Hole, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.reassemblers[id]
+	if !ok {
+		return nil, false
+	}
+	return r.missing(), true
+}
+
+// ReassemblyInfo describes how a packet was reassembled.
+type ReassemblyInfo struct {
+	// ECN is the ECN codepoint of the reassembled packet. It is CE if any of
+	// the fragments were marked CE.
+	ECN uint8
+
+	// Fragments is the number of fragments the packet was reassembled from.
+	// Fragments that did not fill any hole, such as duplicates, are not
+	// counted.
+	Fragments int
+
+	// HolesFilled is the number of holes in the packet that were filled by
+	// its fragments, including the holes left between fragments that
+	// arrived out of order.
+	HolesFilled int
+}
+
 // Process processes an incoming fragment belonging to an ID
 // and returns a complete packet when all the packets belonging to that ID have been received.
-func (f *Fragmentation) Process(id uint32, first, last uint16, more bool, vv buffer.VectorisedView) (buffer.VectorisedView, bool, error) {
+//
+// id must identify the packet among those reassembled by f, e.g. a hash of
+// the addresses and the identification field of the IPv4 header or of the
+// IPv6 Fragment extension header. src is the source address of the fragment,
+// which is subject to the limit set with SetMaxPerSource. An empty src is not
+// subject to the limit.
+//
+// tos is the whole IPv4 TOS or IPv6 Traffic Class octet of the fragment. Its
+// DSCP is checked as per SetDSCPCheck, and packets whose fragments were marked
+// both Not-ECT and CE are discarded. When a packet is reassembled, information
+// about its reassembly, including its ECN codepoint, is returned as well.
+//
+// When the fragment is invalid, the packet is discarded and one of
+// ErrInvalidFragmentLength, ErrFragmentConflict or ErrFragmentOverlap is
+// returned, so that callers can tell the failures apart.
+func (f *Fragmentation) Process(src tcpip.Address, id uint32, first, last uint16, more bool, tos uint8, vv buffer.VectorisedView) (buffer.VectorisedView, ReassemblyInfo, bool, error) {
 	f.mu.Lock()
+	now := f.clock.NowMonotonic()
 	r, ok := f.reassemblers[id]
-	if ok && r.tooOld(f.timeout) {
+	var timedOut *reassembler
+	if ok && r.tooOld(now, f.timeout) {
 		// This is very likely to be an id-collision or someone performing a slow-rate attack.
-		f.release(r)
-		ok = false
+		// If r is done, it is being completed and its completer will remove it,
+		// so it must keep its slot until then; the fragment is dropped by
+		// r.process.
+		if f.release(r) {
+			atomic.AddUint64(&f.timedOut, 1)
+			timedOut = r
+			ok = false
+		}
 	}
+	var srcEvicted []*reassembler
 	if !ok {
-		r = newReassembler(id)
+		if src != "" && f.maxPerSource > 0 && f.sources[src] >= f.maxPerSource {
+			srcEvicted = f.evictOldestFromLocked(src)
+		}
+		r = newReassembler(id, now)
+		r.source = src
+		r.checkDSCP = f.checkDSCP
+		r.overlapMode = f.overlapMode
+		if f.timeout > 0 {
+			r.timer = time.AfterFunc(f.timeout, func() { f.handleTimeout(r) })
+		}
 		f.reassemblers[id] = r
+		atomic.StoreInt64(&f.numReassemblers, int64(len(f.reassemblers)))
 		f.rList.PushFront(r)
+		if src != "" {
+			f.sources[src]++
+		}
 	}
+	onEvict := f.onEvict
+	onTimeout := f.onTimeout
 	f.mu.Unlock()
 
-	res, done, consumed, err := r.process(first, last, more, vv)
+	if timedOut != nil {
+		notifyTimedOut(onTimeout, timedOut)
+	}
+	notifyEvicted(onEvict, srcEvicted)
+
+	res, info, done, consumed, err := r.process(first, last, more, tos, vv)
 	if err != nil {
 		// We probably got an invalid sequence of fragments. Just
 		// discard the reassembler and move on.
 		f.mu.Lock()
-		f.release(r)
+		if f.release(r) {
+			switch err {
+			case errInconsistentDSCP:
+				f.stats.InconsistentDSCP++
+			case ErrFragmentOverlap:
+				f.stats.Overlapping++
+			default:
+				f.stats.Malformed++
+			}
+		}
 		f.mu.Unlock()
-		return buffer.VectorisedView{}, false, fmt.Errorf("fragmentation processing error: %v", err)
+		return buffer.VectorisedView{}, ReassemblyInfo{}, false, err
 	}
 	f.mu.Lock()
-	f.size += consumed
+	// r may have been released, e.g. evicted, while the fragment was being
+	// processed, in which case its fragments are no longer accounted for.
+	if f.reassemblers[r.id] == r {
+		r.size += consumed
+		f.size += consumed
+		atomic.StoreInt64(&f.memoryConsumed, int64(f.size))
+		if src != "" {
+			f.sourceSizes[src] += consumed
+		}
+	}
 	if done {
-		f.release(r)
+		// r was marked done when it completed the packet so it cannot have
+		// been released by anyone else; the reassembled packet is r's own.
+		f.remove(r)
+		atomic.AddUint64(&f.completed, 1)
+		f.recordLatencyLocked(time.Duration(f.clock.NowMonotonic() - r.creationTime))
+	}
+	// Evict reassemblers of src if it holds more than its share of highLimit.
+	var evicted []*reassembler
+	if src != "" && f.maxSourceShare > 0 {
+		evicted = f.evictFromSourceLocked(src, int(f.maxSourceShare*float64(f.highLimit)))
 	}
 	// Evict reassemblers if we are consuming more memory than highLimit until
 	// we reach lowLimit.
 	if f.size > f.highLimit {
-		for f.size > f.lowLimit {
-			tail := f.rList.Back()
-			if tail == nil {
-				break
+		evicted = append(evicted, f.evictLocked(f.lowLimit)...)
+	}
+	onEvict = f.onEvict
+	f.mu.Unlock()
+
+	notifyEvicted(onEvict, evicted)
+	return res, info, done, nil
+}
+
+// Trim evicts incomplete packets, oldest first, until the fragments held by f
+// take at most target bytes. It lets reassembly memory be reclaimed ahead of
+// the high memory limit, e.g. under memory pressure.
+func (f *Fragmentation) Trim(target int) {
+	if target < 0 {
+		target = 0
+	}
+
+	f.mu.Lock()
+	evicted := f.evictLocked(target)
+	onEvict := f.onEvict
+	f.mu.Unlock()
+
+	notifyEvicted(onEvict, evicted)
+}
+
+// Release discards all the packets being reassembled by f, without counting
+// them in the statistics nor notifying the eviction and timeout handlers. It
+// stops their reassembly timers, which would otherwise keep f alive until they
+// fire, so it should be called when f is no longer used.
+func (f *Fragmentation) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for r := f.rList.Front(); r != nil; {
+		next := r.Next()
+		f.release(r)
+		r = next
+	}
+}
+
+// evictLocked evicts reassemblers, oldest first, until f.size is at most
+// target. It returns the evicted reassemblers if an eviction handler is set.
+//
+// Precondition: f.mu must be locked.
+func (f *Fragmentation) evictLocked(target int) []*reassembler {
+	var evicted []*reassembler
+	for r := f.rList.Back(); r != nil && f.size > target; {
+		// Releasing r unlinks it, so its predecessor must be read first. A
+		// reassembler which is done is being completed and will be removed
+		// shortly, so it is skipped.
+		prev := r.Prev()
+		if f.release(r) {
+			atomic.AddUint64(&f.evicted, 1)
+			if f.onEvict != nil {
+				evicted = append(evicted, r)
+			}
+		}
+		r = prev
+	}
+	return evicted
+}
+
+// evictOldestFromLocked evicts the oldest reassembler of packets from src. It
+// returns the evicted reassembler if an eviction handler is set.
+//
+// Precondition: f.mu must be locked.
+func (f *Fragmentation) evictOldestFromLocked(src tcpip.Address) []*reassembler {
+	for r := f.rList.Back(); r != nil; r = r.Prev() {
+		if r.source != src {
+			continue
+		}
+		if !f.release(r) {
+			// r is being completed and will be removed shortly.
+			continue
+		}
+		atomic.AddUint64(&f.sourceEvicted, 1)
+		if f.onEvict != nil {
+			return []*reassembler{r}
+		}
+		return nil
+	}
+	return nil
+}
+
+// evictFromSourceLocked evicts the reassemblers of packets from src, oldest
+// first, until the fragments held for them take at most target bytes. It
+// returns the evicted reassemblers if an eviction handler is set.
+//
+// Precondition: f.mu must be locked.
+func (f *Fragmentation) evictFromSourceLocked(src tcpip.Address, target int) []*reassembler {
+	var evicted []*reassembler
+	for r := f.rList.Back(); r != nil && f.sourceSizes[src] > target; {
+		// Releasing r unlinks it, so its predecessor must be read first.
+		prev := r.Prev()
+		if r.source == src && f.release(r) {
+			atomic.AddUint64(&f.sourceEvicted, 1)
+			if f.onEvict != nil {
+				evicted = append(evicted, r)
 			}
-			f.release(tail)
 		}
+		r = prev
+	}
+	return evicted
+}
+
+// handleTimeout discards r because it was not reassembled within the
+// reassembly timeout, unless it was completed or released in the meantime.
+func (f *Fragmentation) handleTimeout(r *reassembler) {
+	f.mu.Lock()
+	released := f.release(r)
+	if released {
+		atomic.AddUint64(&f.timedOut, 1)
 	}
+	onTimeout := f.onTimeout
 	f.mu.Unlock()
-	return res, done, nil
+
+	if released {
+		notifyTimedOut(onTimeout, r)
+	}
+}
+
+// notifyTimedOut calls onTimeout, if set, for r, a reassembler discarded
+// because of the reassembly timeout. It must be called without holding f.mu so
+// the handler may call back into f.
+func notifyTimedOut(onTimeout TimeoutHandler, r *reassembler) {
+	if onTimeout != nil {
+		onTimeout(r.id, r.missing())
+	}
 }
 
-func (f *Fragmentation) release(r *reassembler) {
+// notifyEvicted calls onEvict for each of the evicted reassemblers. It must be
+// called without holding f.mu so the handler may call back into f.
+func notifyEvicted(onEvict EvictionHandler, evicted []*reassembler) {
+	for _, r := range evicted {
+		onEvict(r.id, r.size)
+	}
+}
+
+// release removes r from f unless it was already marked as done. It returns
+// true if r was removed.
+func (f *Fragmentation) release(r *reassembler) bool {
 	// Before releasing a fragment we need to check if r is already marked as done.
 	// Otherwise, we would delete it twice.
 	if r.checkDoneOrMark() {
+		return false
+	}
+	f.remove(r)
+	return true
+}
+
+// remove removes r from f. It must be called exactly once per reassembler, by
+// whoever marked it as done.
+//
+// Precondition: f.mu must be locked.
+func (f *Fragmentation) remove(r *reassembler) {
+	// A reassembler is only ever removed from f.reassemblers by remove, so a
+	// different reassembler being registered under r's id means r was removed
+	// twice. This is a bug, but not one worth crashing on packet input for.
+	if got := f.reassemblers[r.id]; got != r {
+		f.warningf("reassembler for id %d is %p, want %p, this is a bug that requires investigation", r.id, got, r)
 		return
 	}
 
 	delete(f.reassemblers, r.id)
 	f.rList.Remove(r)
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.source != "" {
+		if f.sources[r.source]--; f.sources[r.source] == 0 {
+			delete(f.sources, r.source)
+		}
+		if f.sourceSizes[r.source] -= r.size; f.sourceSizes[r.source] <= 0 {
+			delete(f.sourceSizes, r.source)
+		}
+	}
 	f.size -= r.size
 	if f.size < 0 {
-		log.Printf("memory counter < 0 (%d), this is an accounting bug that requires investigation", f.size)
+		f.warningf("memory counter < 0 (%d), this is an accounting bug that requires investigation", f.size)
 		f.size = 0
 	}
+	atomic.StoreInt64(&f.memoryConsumed, int64(f.size))
+	atomic.StoreInt64(&f.numReassemblers, int64(len(f.reassemblers)))
+}
+
+// warningf logs a warning to f's logger.
+//
+// Precondition: f.mu must be locked.
+func (f *Fragmentation) warningf(format string, v ...interface{}) {
+	if f.logger != nil {
+		f.logger.Warningf(format, v...)
+		return
+	}
+	log.Warningf(format, v...)
 }
@@ -15,11 +15,18 @@
 package fragmentation
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
 
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 )
 
 // vv is a helper to build VectorisedView from different strings.
@@ -76,16 +83,50 @@ var processTestCases = []struct {
 			{vv: vv(4, "01", "23"), done: true},
 		},
 	},
+	{
+		comment: "Two IDs interleaved",
+		in: []processInput{
+			{id: 0, first: 0, last: 1, more: true, vv: vv(2, "01")},
+			{id: 1, first: 0, last: 1, more: true, vv: vv(2, "ab")},
+			{id: 0, first: 2, last: 3, more: true, vv: vv(2, "23")},
+			{id: 1, first: 2, last: 3, more: true, vv: vv(2, "cd")},
+			{id: 1, first: 4, last: 5, more: false, vv: vv(2, "ef")},
+			{id: 0, first: 4, last: 5, more: false, vv: vv(2, "45")},
+		},
+		out: []processOutput{
+			{vv: buffer.VectorisedView{}, done: false},
+			{vv: buffer.VectorisedView{}, done: false},
+			{vv: buffer.VectorisedView{}, done: false},
+			{vv: buffer.VectorisedView{}, done: false},
+			{vv: vv(6, "ab", "cd", "ef"), done: true},
+			{vv: vv(6, "01", "23", "45"), done: true},
+		},
+	},
+	{
+		comment: "ID reused after completion",
+		in: []processInput{
+			{id: 0, first: 0, last: 1, more: true, vv: vv(2, "01")},
+			{id: 0, first: 2, last: 3, more: false, vv: vv(2, "23")},
+			{id: 0, first: 2, last: 3, more: false, vv: vv(2, "cd")},
+			{id: 0, first: 0, last: 1, more: true, vv: vv(2, "ab")},
+		},
+		out: []processOutput{
+			{vv: buffer.VectorisedView{}, done: false},
+			{vv: vv(4, "01", "23"), done: true},
+			{vv: buffer.VectorisedView{}, done: false},
+			{vv: vv(4, "ab", "cd"), done: true},
+		},
+	},
 }
 
 func TestFragmentationProcess(t *testing.T) {
 	for _, c := range processTestCases {
 		t.Run(c.comment, func(t *testing.T) {
-			f := NewFragmentation(1024, 512, DefaultReassembleTimeout)
+			f := NewFragmentation(1024, 512, DefaultReassembleTimeout, 0)
 			for i, in := range c.in {
-				vv, done, err := f.Process(in.id, in.first, in.last, in.more, in.vv)
+				vv, _, done, err := f.Process("", in.id, in.first, in.last, in.more, 0, in.vv)
 				if err != nil {
-					t.Fatalf("f.Process(%+v, %+d, %+d, %t, %+v) failed: %v", in.id, in.first, in.last, in.more, in.vv, err)
+					t.Fatalf("f.Process(\"\", %+v, %+d, %+d, %t, 0, %+v) failed: %v", in.id, in.first, in.last, in.more, in.vv, err)
 				}
 				if !reflect.DeepEqual(vv, c.out[i].vv) {
 					t.Errorf("got Process(%d) = %+v, want = %+v", i, vv, c.out[i].vv)
@@ -108,36 +149,582 @@ func TestFragmentationProcess(t *testing.T) {
 	}
 }
 
+func TestProcessErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []processInput
+		wantErr error
+	}{
+		{
+			name: "Empty range",
+			in: []processInput{
+				{first: 2, last: 1, more: true, vv: vv(1, "0")},
+			},
+			wantErr: ErrInvalidFragmentLength,
+		},
+		{
+			name: "Data longer than range",
+			in: []processInput{
+				{first: 0, last: 1, more: true, vv: vv(3, "012")},
+			},
+			wantErr: ErrInvalidFragmentLength,
+		},
+		{
+			name: "Past the end of the packet",
+			in: []processInput{
+				{first: 2, last: 3, more: false, vv: vv(2, "23")},
+				{first: 4, last: 5, more: true, vv: vv(2, "45")},
+			},
+			wantErr: ErrFragmentConflict,
+		},
+		{
+			name: "Last fragment before received data",
+			in: []processInput{
+				{first: 2, last: 3, more: true, vv: vv(2, "23")},
+				{first: 0, last: 1, more: false, vv: vv(2, "01")},
+			},
+			wantErr: ErrFragmentConflict,
+		},
+		{
+			name: "Two last fragments",
+			in: []processInput{
+				{first: 2, last: 3, more: false, vv: vv(2, "23")},
+				{first: 2, last: 4, more: false, vv: vv(3, "234")},
+			},
+			wantErr: ErrFragmentConflict,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := NewFragmentation(1024, 512, DefaultReassembleTimeout, 0)
+			last := len(test.in) - 1
+			for i, in := range test.in[:last] {
+				if _, _, done, err := f.Process("", 0, in.first, in.last, in.more, 0, in.vv); err != nil || done {
+					t.Fatalf("got f.Process(\"\", 0, %d, %d, %t, 0, _) = (_, _, %t, %v) for fragment #%d, want = (_, _, false, nil)", in.first, in.last, in.more, done, err, i)
+				}
+			}
+			in := test.in[last]
+			if _, _, done, err := f.Process("", 0, in.first, in.last, in.more, 0, in.vv); !errors.Is(err, test.wantErr) || done {
+				t.Errorf("got f.Process(\"\", 0, %d, %d, %t, 0, _) = (_, _, %t, %v), want = (_, _, false, %v)", in.first, in.last, in.more, done, err, test.wantErr)
+			}
+			if got := f.Stats().Malformed; got != 1 {
+				t.Errorf("got f.Stats().Malformed = %d, want = 1", got)
+			}
+			if _, ok := f.reassemblers[0]; ok {
+				t.Error("reassembler was not removed after an error")
+			}
+		})
+	}
+}
+
+func TestOverlapMode(t *testing.T) {
+	modes := []struct {
+		name string
+		mode OverlapMode
+	}{
+		{name: "RejectConflicting", mode: OverlapRejectConflicting},
+		{name: "LastWins", mode: OverlapLastWins},
+		{name: "Reject", mode: OverlapReject},
+	}
+
+	tests := []struct {
+		name string
+		in   []processInput
+		// want holds the reassembled packet for the modes in which the packet
+		// is not discarded.
+		want map[OverlapMode]string
+	}{
+		{
+			name: "Duplicate",
+			in: []processInput{
+				{first: 0, last: 1, more: true, vv: vv(2, "01")},
+				{first: 0, last: 1, more: true, vv: vv(2, "01")},
+				{first: 2, last: 3, more: false, vv: vv(2, "23")},
+			},
+			want: map[OverlapMode]string{
+				OverlapRejectConflicting: "0123",
+				OverlapLastWins:          "0123",
+				OverlapReject:            "0123",
+			},
+		},
+		{
+			name: "Duplicate with different data",
+			in: []processInput{
+				{first: 0, last: 1, more: true, vv: vv(2, "01")},
+				{first: 0, last: 1, more: true, vv: vv(2, "ab")},
+				{first: 2, last: 3, more: false, vv: vv(2, "23")},
+			},
+			want: map[OverlapMode]string{
+				OverlapLastWins: "ab23",
+			},
+		},
+		{
+			name: "Overlap with same data",
+			in: []processInput{
+				{first: 0, last: 1, more: true, vv: vv(2, "01")},
+				{first: 1, last: 2, more: false, vv: vv(2, "12")},
+			},
+			want: map[OverlapMode]string{
+				OverlapRejectConflicting: "012",
+				OverlapLastWins:          "012",
+			},
+		},
+		{
+			name: "Overlap with different data",
+			in: []processInput{
+				{first: 0, last: 1, more: true, vv: vv(2, "01")},
+				{first: 1, last: 2, more: false, vv: vv(2, "x2")},
+			},
+			want: map[OverlapMode]string{
+				OverlapLastWins: "0x2",
+			},
+		},
+		{
+			name: "Covered by earlier fragments",
+			in: []processInput{
+				{first: 0, last: 1, more: true, vv: vv(2, "01")},
+				{first: 2, last: 3, more: true, vv: vv(2, "23")},
+				{first: 1, last: 2, more: true, vv: vv(2, "xy")},
+				{first: 4, last: 4, more: false, vv: vv(1, "4")},
+			},
+			want: map[OverlapMode]string{
+				OverlapLastWins: "0xy34",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for _, mode := range modes {
+			t.Run(fmt.Sprintf("%s/%s", test.name, mode.name), func(t *testing.T) {
+				f := NewFragmentation(1024, 512, DefaultReassembleTimeout, 0)
+				f.SetOverlapMode(mode.mode)
+				want, ok := test.want[mode.mode]
+
+				var res buffer.VectorisedView
+				var done bool
+				var err error
+				for _, in := range test.in {
+					res, _, done, err = f.Process("", 0, in.first, in.last, in.more, 0, in.vv)
+					if err != nil {
+						break
+					}
+				}
+
+				if !ok {
+					if !errors.Is(err, ErrFragmentOverlap) {
+						t.Fatalf("got f.Process(...) = (_, _, _, %v), want = (_, _, _, %v)", err, ErrFragmentOverlap)
+					}
+					if got := f.Stats().Overlapping; got != 1 {
+						t.Errorf("got f.Stats().Overlapping = %d, want = 1", got)
+					}
+					return
+				}
+				if err != nil || !done {
+					t.Fatalf("got f.Process(...) = (_, _, %t, %v), want = (_, _, true, nil)", done, err)
+				}
+				if got := string(res.ToView()); got != want {
+					t.Errorf("got reassembled packet = %q, want = %q", got, want)
+				}
+				if got := f.Stats().Overlapping; got != 0 {
+					t.Errorf("got f.Stats().Overlapping = %d, want = 0", got)
+				}
+			})
+		}
+	}
+}
+
+func TestFragmentationProcessECN(t *testing.T) {
+	const (
+		notECT = 0x0
+		ect1   = 0x1
+		ect0   = 0x2
+		ce     = header.ECNCE
+	)
+
+	tests := []struct {
+		name    string
+		ecns    []uint8
+		wantECN uint8
+
+		// wantErr is true if the last fragment must be rejected.
+		wantErr bool
+	}{
+		{
+			name:    "All Not-ECT",
+			ecns:    []uint8{notECT, notECT, notECT},
+			wantECN: notECT,
+		},
+		{
+			name:    "All ECT(0)",
+			ecns:    []uint8{ect0, ect0, ect0},
+			wantECN: ect0,
+		},
+		{
+			name:    "First fragment CE",
+			ecns:    []uint8{ce, ect0, ect0},
+			wantECN: ce,
+		},
+		{
+			name:    "Middle fragment CE",
+			ecns:    []uint8{ect1, ce, ect1},
+			wantECN: ce,
+		},
+		{
+			name:    "Last fragment CE",
+			ecns:    []uint8{ect0, ect0, ce},
+			wantECN: ce,
+		},
+		{
+			name:    "Non-ECN bits ignored",
+			ecns:    []uint8{0xfc | ect0, ect0, ect0},
+			wantECN: ect0,
+		},
+		{
+			name:    "Not-ECT then CE",
+			ecns:    []uint8{notECT, notECT, ce},
+			wantErr: true,
+		},
+		{
+			name:    "CE then Not-ECT",
+			ecns:    []uint8{ce, ect0, notECT},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := NewFragmentation(1024, 512, DefaultReassembleTimeout, 0)
+			for i, ecn := range test.ecns {
+				first := uint16(i * 2)
+				more := i != len(test.ecns)-1
+				_, info, done, err := f.Process("", 0, first, first+1, more, ecn, vv(2, "01"))
+				if test.wantErr && !more {
+					if err != errInconsistentECN {
+						t.Fatalf("got f.Process(\"\", 0, %d, %d, %t, %d, _) = (_, _, _, %v), want = (_, _, _, %s)", first, first+1, more, ecn, err, errInconsistentECN)
+					}
+					if got, want := f.Stats().Malformed, uint64(1); got != want {
+						t.Errorf("got f.Stats().Malformed = %d, want = %d", got, want)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatalf("f.Process(\"\", 0, %d, %d, %t, %d, _): %s", first, first+1, more, ecn, err)
+				}
+				if done == more {
+					t.Fatalf("got f.Process(\"\", 0, %d, %d, %t, %d, _) = (_, _, %t, nil), want = (_, _, %t, nil)", first, first+1, more, ecn, done, !more)
+				}
+				if done && info.ECN != test.wantECN {
+					t.Errorf("got reassembled ECN = %d, want = %d", info.ECN, test.wantECN)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessReassemblyInfo(t *testing.T) {
+	type fragment struct {
+		first uint16
+		more  bool
+	}
+	tests := []struct {
+		name      string
+		fragments []fragment
+		want      ReassemblyInfo
+	}{
+		{
+			name:      "In order",
+			fragments: []fragment{{0, true}, {2, true}, {4, false}},
+			want:      ReassemblyInfo{Fragments: 3, HolesFilled: 3},
+		},
+		{
+			name:      "Out of order",
+			fragments: []fragment{{4, false}, {0, true}, {2, true}},
+			want:      ReassemblyInfo{Fragments: 3, HolesFilled: 3},
+		},
+		{
+			name:      "Duplicate",
+			fragments: []fragment{{0, true}, {0, true}, {2, true}, {4, false}},
+			want:      ReassemblyInfo{Fragments: 3, HolesFilled: 3},
+		},
+		{
+			name:      "Single",
+			fragments: []fragment{{0, false}},
+			want:      ReassemblyInfo{Fragments: 1, HolesFilled: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := NewFragmentation(1024, 512, DefaultReassembleTimeout, 0)
+			for i, frag := range test.fragments {
+				_, info, done, err := f.Process("", 0, frag.first, frag.first+1, frag.more, 0, vv(2, "01"))
+				if err != nil {
+					t.Fatalf("f.Process(\"\", 0, %d, %d, %t, 0, _): %s", frag.first, frag.first+1, frag.more, err)
+				}
+				if last := i == len(test.fragments)-1; done != last {
+					t.Fatalf("got f.Process(\"\", 0, %d, %d, %t, 0, _) = (_, _, %t, nil), want = (_, _, %t, nil)", frag.first, frag.first+1, frag.more, done, last)
+				}
+				if done && info != test.want {
+					t.Errorf("got reassembly info = %+v, want = %+v", info, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDSCPCheck(t *testing.T) {
+	const (
+		// dscpA and dscpB are TOS octets carrying different DSCP values.
+		dscpA = 0x28
+		dscpB = 0xb8
+	)
+
+	tests := []struct {
+		name      string
+		checkDSCP bool
+		tos       [2]uint8
+		wantDone  bool
+		wantStats Stats
+	}{
+		{
+			name:      "Disabled",
+			checkDSCP: false,
+			tos:       [2]uint8{dscpA, dscpB},
+			wantDone:  true,
+			wantStats: Stats{Reassembled: 1},
+		},
+		{
+			name:      "Consistent",
+			checkDSCP: true,
+			tos:       [2]uint8{dscpA, dscpA},
+			wantDone:  true,
+			wantStats: Stats{Reassembled: 1},
+		},
+		{
+			name:      "DifferentECN",
+			checkDSCP: true,
+			tos:       [2]uint8{dscpA | header.ECNECT0, dscpA | header.ECNCE},
+			wantDone:  true,
+			wantStats: Stats{Reassembled: 1},
+		},
+		{
+			name:      "Inconsistent",
+			checkDSCP: true,
+			tos:       [2]uint8{dscpA, dscpB},
+			wantDone:  false,
+			wantStats: Stats{InconsistentDSCP: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := NewFragmentation(1024, 512, DefaultReassembleTimeout, 0)
+			f.SetDSCPCheck(test.checkDSCP)
+			if _, _, done, err := f.Process("", 0, 0, 0, true, test.tos[0], vv(1, "0")); err != nil || done {
+				t.Fatalf("got f.Process(\"\", 0, 0, 0, true, %#x, _) = (_, _, %t, %v), want = (_, _, false, nil)", test.tos[0], done, err)
+			}
+			_, _, done, err := f.Process("", 0, 1, 1, false, test.tos[1], vv(1, "1"))
+			if done != test.wantDone || (err != nil) == test.wantDone {
+				t.Errorf("got f.Process(\"\", 0, 1, 1, false, %#x, _) = (_, _, %t, %v), want done = %t", test.tos[1], done, err, test.wantDone)
+			}
+			got := f.Stats()
+			// Reassembly latencies are checked by TestReassemblyLatency.
+			got.Latency = LatencyPercentiles{}
+			if got != test.wantStats {
+				t.Errorf("got f.Stats() = %+v, want = %+v", got, test.wantStats)
+			}
+		})
+	}
+}
+
+func TestHolesFor(t *testing.T) {
+	type fragment struct {
+		first uint16
+		last  uint16
+		more  bool
+	}
+	tests := []struct {
+		name      string
+		fragments []fragment
+		want      []Hole
+	}{
+		{
+			name: "None received",
+			want: nil,
+		},
+		{
+			name:      "First only",
+			fragments: []fragment{{0, 7, true}},
+			want:      []Hole{{First: 8, Last: math.MaxUint16}},
+		},
+		{
+			name:      "Last only",
+			fragments: []fragment{{16, 23, false}},
+			want:      []Hole{{First: 0, Last: 15}},
+		},
+		{
+			name:      "Middle missing",
+			fragments: []fragment{{0, 7, true}, {16, 23, false}},
+			want:      []Hole{{First: 8, Last: 15}},
+		},
+		{
+			name:      "Several missing",
+			fragments: []fragment{{8, 15, true}, {24, 31, false}},
+			want:      []Hole{{First: 0, Last: 7}, {First: 16, Last: 23}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			const id = 5
+			f := NewFragmentation(1024, 512, DefaultReassembleTimeout, 0)
+			for _, frag := range test.fragments {
+				if _, _, done, err := f.Process("", id, frag.first, frag.last, frag.more, 0, vv(int(frag.last-frag.first)+1, "01234567")); err != nil || done {
+					t.Fatalf("got f.Process(\"\", %d, %d, %d, %t, 0, _) = (_, _, %t, %v), want = (_, _, false, nil)", id, frag.first, frag.last, frag.more, done, err)
+				}
+			}
+
+			holes, ok := f.HolesFor(id)
+			if wantOK := len(test.fragments) != 0; ok != wantOK {
+				t.Fatalf("got f.HolesFor(%d) = (_, %t), want = (_, %t)", id, ok, wantOK)
+			}
+			if !reflect.DeepEqual(holes, test.want) {
+				t.Errorf("got f.HolesFor(%d) = (%v, _), want = (%v, _)", id, holes, test.want)
+			}
+		})
+	}
+}
+
 func TestReassemblingTimeout(t *testing.T) {
 	timeout := time.Millisecond
-	f := NewFragmentation(1024, 512, timeout)
+	f := NewFragmentation(1024, 512, timeout, 0)
 	// Send first fragment with id = 0, first = 0, last = 0, and more = true.
-	f.Process(0, 0, 0, true, vv(1, "0"))
+	f.Process("", 0, 0, 0, true, 0, vv(1, "0"))
 	// Sleep more than the timeout.
 	time.Sleep(2 * timeout)
 	// Send another fragment that completes a packet.
 	// However, no packet should be reassembled because the fragment arrived after the timeout.
-	_, done, err := f.Process(0, 1, 1, false, vv(1, "1"))
+	_, _, done, err := f.Process("", 0, 1, 1, false, 0, vv(1, "1"))
 	if err != nil {
-		t.Fatalf("f.Process(0, 1, 1, false, vv(1, \"1\")) failed: %v", err)
+		t.Fatalf("f.Process(\"\", 0, 1, 1, false, 0, vv(1, \"1\")) failed: %v", err)
 	}
 	if done {
 		t.Errorf("Fragmentation does not respect the reassembling timeout.")
 	}
 }
 
+func TestReassemblyTimer(t *testing.T) {
+	const timeout = time.Millisecond
+	f := NewFragmentation(1024, 512, timeout, 0)
+	// Reassemble a packet with id = 0 before its timer expires.
+	f.Process("", 0, 0, 0, true, 0, vv(1, "0"))
+	if _, _, done, err := f.Process("", 0, 1, 1, false, 0, vv(1, "1")); err != nil || !done {
+		t.Fatalf("got f.Process(\"\", 0, 1, 1, false, 0, _) = (_, _, %t, %v), want = (_, _, true, nil)", done, err)
+	}
+	// Leave the packet with id = 1 incomplete.
+	f.Process("", 1, 0, 0, true, 0, vv(1, "1"))
+
+	// Sleep well past the timeout. The timer of the incomplete packet must
+	// discard it without waiting for another fragment, and the timer of the
+	// reassembled packet must not count it as timed out.
+	time.Sleep(100 * timeout)
+
+	want := Stats{
+		Reassembled: 1,
+		TimedOut:    1,
+	}
+	got := f.Stats()
+	// Reassembly latencies are checked by TestReassemblyLatency.
+	got.Latency = LatencyPercentiles{}
+	if got != want {
+		t.Errorf("got f.Stats() = %+v, want = %+v", got, want)
+	}
+}
+
+func TestReassemblyTimerUsesConfiguredTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	f := NewFragmentation(1024, 512, timeout, 0)
+	start := time.Now()
+	f.Process("", 0, 0, 0, true, 0, vv(1, "0"))
+
+	// The packet must be discarded after the configured timeout, long before
+	// DefaultReassembleTimeout.
+	for f.Stats().TimedOut == 0 {
+		if elapsed := time.Since(start); elapsed > 10*timeout {
+			t.Fatalf("packet not discarded %s after its first fragment, want about %s", elapsed, timeout)
+		}
+		time.Sleep(timeout / 10)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("packet discarded %s after its first fragment, want at least %s", elapsed, timeout)
+	}
+}
+
+func TestTimeoutHandler(t *testing.T) {
+	type timeout struct {
+		id    uint32
+		holes []Hole
+	}
+
+	const (
+		id = 5
+		// Use a long timeout so the timer cannot fire before the fragments
+		// are processed.
+		reassemblyTimeout = 100 * time.Millisecond
+	)
+	f := NewFragmentation(1024, 512, reassemblyTimeout, 0)
+	ch := make(chan timeout, 1)
+	f.SetTimeoutHandler(func(id uint32, holes []Hole) {
+		ch <- timeout{id: id, holes: holes}
+	})
+
+	// Leave a gap between the first and the last fragments.
+	f.Process("", id, 0, 7, true, 0, vv(8, "01234567"))
+	f.Process("", id, 16, 23, false, 0, vv(8, "01234567"))
+
+	select {
+	case got := <-ch:
+		want := timeout{id: id, holes: []Hole{{First: 8, Last: 15}}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got timeout = %+v, want = %+v", got, want)
+		}
+	case <-time.After(10 * reassemblyTimeout):
+		t.Fatal("timeout handler not called")
+	}
+	if got := f.Stats().TimedOut; got != 1 {
+		t.Errorf("got TimedOut = %d, want = 1", got)
+	}
+}
+
+func TestReassemblyWithoutTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		t.Run(timeout.String(), func(t *testing.T) {
+			f := NewFragmentation(1024, 512, timeout, 0)
+			f.Process("", 0, 0, 0, true, 0, vv(1, "0"))
+			time.Sleep(10 * time.Millisecond)
+			if _, _, done, err := f.Process("", 0, 1, 1, false, 0, vv(1, "1")); err != nil || !done {
+				t.Errorf("got f.Process(\"\", 0, 1, 1, false, 0, _) = (_, _, %t, %v), want = (_, _, true, nil)", done, err)
+			}
+			if got := f.Stats().TimedOut; got != 0 {
+				t.Errorf("got TimedOut = %d, want = 0", got)
+			}
+		})
+	}
+}
+
 func TestMemoryLimits(t *testing.T) {
-	f := NewFragmentation(3, 1, DefaultReassembleTimeout)
+	f := NewFragmentation(3, 1, DefaultReassembleTimeout, 0)
 	// Send first fragment with id = 0.
-	f.Process(0, 0, 0, true, vv(1, "0"))
+	f.Process("", 0, 0, 0, true, 0, vv(1, "0"))
 	// Send first fragment with id = 1.
-	f.Process(1, 0, 0, true, vv(1, "1"))
+	f.Process("", 1, 0, 0, true, 0, vv(1, "1"))
 	// Send first fragment with id = 2.
-	f.Process(2, 0, 0, true, vv(1, "2"))
+	f.Process("", 2, 0, 0, true, 0, vv(1, "2"))
 
 	// Send first fragment with id = 3. This should caused id = 0 and id = 1 to be
 	// evicted.
-	f.Process(3, 0, 0, true, vv(1, "3"))
+	f.Process("", 3, 0, 0, true, 0, vv(1, "3"))
 
 	if _, ok := f.reassemblers[0]; ok {
 		t.Errorf("Memory limits are not respected: id=0 has not been evicted.")
@@ -150,12 +737,393 @@ func TestMemoryLimits(t *testing.T) {
 	}
 }
 
+func TestEvictionHandler(t *testing.T) {
+	type eviction struct {
+		id   uint32
+		size int
+	}
+
+	f := NewFragmentation(3, 1, DefaultReassembleTimeout, 0)
+	var got []eviction
+	f.SetEvictionHandler(func(id uint32, size int) {
+		got = append(got, eviction{id: id, size: size})
+	})
+
+	f.Process("", 0, 0, 0, true, 0, vv(1, "0"))
+	f.Process("", 1, 0, 1, true, 0, vv(2, "11"))
+	if len(got) != 0 {
+		t.Fatalf("got evictions = %+v before the high limit was exceeded, want none", got)
+	}
+
+	// Exceeding the high limit should evict the oldest reassemblers until we
+	// are at the low limit.
+	f.Process("", 2, 0, 0, true, 0, vv(1, "2"))
+	want := []eviction{{id: 0, size: 1}, {id: 1, size: 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got evictions = %+v, want = %+v", got, want)
+	}
+}
+
+func TestMaxPerSource(t *testing.T) {
+	const (
+		srcA = tcpip.Address("\x0a\x00\x00\x01")
+		srcB = tcpip.Address("\x0a\x00\x00\x02")
+	)
+
+	f := NewFragmentation(1024, 512, DefaultReassembleTimeout, 0)
+	f.SetMaxPerSource(2)
+	var evicted []uint32
+	f.SetEvictionHandler(func(id uint32, _ int) {
+		evicted = append(evicted, id)
+	})
+
+	// Each packet is left incomplete by only sending its first fragment.
+	start := func(src tcpip.Address, id uint32) {
+		t.Helper()
+		if _, _, done, err := f.Process(src, id, 0, 1, true, 0, vv(2, "01")); err != nil || done {
+			t.Fatalf("got f.Process(%s, %d, 0, 1, true, 0, _) = (_, _, %t, %v), want = (_, _, false, nil)", src, id, done, err)
+		}
+	}
+	start(srcB, 10)
+	for id := uint32(1); id <= 4; id++ {
+		start(srcA, id)
+	}
+
+	// Only the two most recent packets from srcA are left.
+	for _, test := range []struct {
+		id   uint32
+		want bool
+	}{
+		{id: 1, want: false},
+		{id: 2, want: false},
+		{id: 3, want: true},
+		{id: 4, want: true},
+		{id: 10, want: true},
+	} {
+		if _, got := f.HolesFor(test.id); got != test.want {
+			t.Errorf("got f.HolesFor(%d) = (_, %t), want = (_, %t)", test.id, got, test.want)
+		}
+	}
+	if want := []uint32{1, 2}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("got evicted IDs = %v, want = %v", evicted, want)
+	}
+	if got, want := f.Stats().Evicted, uint64(2); got != want {
+		t.Errorf("got Stats().Evicted = %d, want = %d", got, want)
+	}
+
+	// Completing a packet frees up room for its source.
+	if _, _, done, err := f.Process(srcA, 3, 2, 3, false, 0, vv(2, "23")); err != nil || !done {
+		t.Fatalf("got f.Process(%s, 3, 2, 3, false, 0, _) = (_, _, %t, %v), want = (_, _, true, nil)", srcA, done, err)
+	}
+	start(srcA, 5)
+	if _, ok := f.HolesFor(4); !ok {
+		t.Errorf("got f.HolesFor(4) = (_, false), want = (_, true)")
+	}
+	if want := []uint32{1, 2}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("got evicted IDs = %v after a packet completed, want = %v", evicted, want)
+	}
+}
+
+func TestMaxSourceShare(t *testing.T) {
+	const (
+		srcA = tcpip.Address("\x0a\x00\x00\x01")
+		srcB = tcpip.Address("\x0a\x00\x00\x02")
+		// highLimit lets srcA hold 4 incomplete packets of 16 bytes.
+		highLimit = 256
+		share     = 0.25
+		// floodID is the id of the first packet srcA floods with.
+		floodID = 100
+	)
+
+	f := NewFragmentation(highLimit, highLimit/2, DefaultReassembleTimeout, share)
+	first := vv(16, "0123456789abcdef")
+
+	// srcB starts a packet, then srcA floods with many more incomplete
+	// packets than the memory limits allow.
+	if _, _, done, err := f.Process(srcB, 0, 0, 15, true, 0, first); err != nil || done {
+		t.Fatalf("got f.Process(%s, 0, 0, 15, true, 0, _) = (_, _, %t, %v), want = (_, _, false, nil)", srcB, done, err)
+	}
+	for id := uint32(floodID); id < floodID+100; id++ {
+		if _, _, done, err := f.Process(srcA, id, 0, 15, true, 0, first); err != nil || done {
+			t.Fatalf("got f.Process(%s, %d, 0, 15, true, 0, _) = (_, _, %t, %v), want = (_, _, false, nil)", srcA, id, done, err)
+		}
+	}
+
+	// srcA is held within its share, keeping its most recent packets.
+	if got, want := f.Stats().PendingBytes, int(highLimit*share)+16; got != want {
+		t.Errorf("got Stats().PendingBytes = %d, want = %d", got, want)
+	}
+	if _, ok := f.HolesFor(floodID + 99); !ok {
+		t.Errorf("got f.HolesFor(%d) = (_, false), want = (_, true)", floodID+99)
+	}
+	if _, ok := f.HolesFor(floodID); ok {
+		t.Errorf("got f.HolesFor(%d) = (_, true), want = (_, false)", floodID)
+	}
+
+	// The packet from srcB still reassembles.
+	res, _, done, err := f.Process(srcB, 0, 16, 16, false, 0, vv(1, "g"))
+	if err != nil || !done {
+		t.Fatalf("got f.Process(%s, 0, 16, 16, false, 0, _) = (_, _, %t, %v), want = (_, _, true, nil)", srcB, done, err)
+	}
+	if got, want := string(res.ToView()), "0123456789abcdefg"; got != want {
+		t.Errorf("got reassembled payload = %q, want = %q", got, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	f := NewFragmentation(3, 1, DefaultReassembleTimeout, 0)
+	// Reassemble a packet with id = 0.
+	f.Process("", 0, 0, 0, true, 0, vv(1, "0"))
+	f.Process("", 0, 1, 1, false, 0, vv(1, "1"))
+	// Send the first fragments with ids 1 to 4. The last one should cause ids 1
+	// to 3 to be evicted.
+	f.Process("", 1, 0, 0, true, 0, vv(1, "1"))
+	f.Process("", 2, 0, 0, true, 0, vv(1, "2"))
+	f.Process("", 3, 0, 0, true, 0, vv(1, "3"))
+	f.Process("", 4, 0, 0, true, 0, vv(1, "4"))
+
+	want := Stats{
+		Reassembled:  1,
+		Evicted:      3,
+		Pending:      1,
+		PendingBytes: 1,
+	}
+	got := f.Stats()
+	// Reassembly latencies are checked by TestReassemblyLatency.
+	got.Latency = LatencyPercentiles{}
+	if got != want {
+		t.Errorf("got f.Stats() = %+v, want = %+v", got, want)
+	}
+
+	timeout := time.Millisecond
+	f = NewFragmentation(1024, 512, timeout, 0)
+	f.Process("", 0, 0, 0, true, 0, vv(1, "0"))
+	// Sleep more than the timeout so the next fragment discards the packet.
+	time.Sleep(2 * timeout)
+	f.Process("", 0, 1, 1, false, 0, vv(1, "1"))
+
+	want = Stats{
+		TimedOut:     1,
+		Pending:      1,
+		PendingBytes: 1,
+	}
+	if got := f.Stats(); got != want {
+		t.Errorf("got f.Stats() = %+v, want = %+v", got, want)
+	}
+}
+
+// fakeClock is a tcpip.Clock whose time only moves when advanced.
+type fakeClock struct {
+	now int64
+}
+
+func (c *fakeClock) NowNanoseconds() int64 {
+	return c.now
+}
+
+func (c *fakeClock) NowMonotonic() int64 {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now += d.Nanoseconds()
+}
+
+func TestReassemblyLatency(t *testing.T) {
+	const (
+		numPackets  = 10
+		slowDelay   = 25 * time.Millisecond
+		slowerDelay = 120 * time.Millisecond
+	)
+
+	f := NewFragmentation(HighFragThreshold, LowFragThreshold, DefaultReassembleTimeout, 0)
+	clock := &fakeClock{}
+	f.clock = clock
+	if got, want := f.Stats().Latency, (LatencyPercentiles{}); got != want {
+		t.Errorf("got f.Stats().Latency = %+v before reassembling any packet, want = %+v", got, want)
+	}
+
+	complete := func(id uint32) {
+		t.Helper()
+		if _, _, done, err := f.Process("", id, 1, 1, false, 0, vv(1, "1")); err != nil || !done {
+			t.Fatalf("got f.Process(\"\", %d, 1, 1, false, 0, _) = (_, _, %t, %v), want = (_, _, true, nil)", id, done, err)
+		}
+	}
+
+	// Start all the packets at once, then complete all of them but the last
+	// two right away, the next to last after slowDelay and the last after
+	// slowerDelay.
+	for id := uint32(0); id < numPackets; id++ {
+		f.Process("", id, 0, 0, true, 0, vv(1, "0"))
+	}
+	for id := uint32(0); id < numPackets-2; id++ {
+		complete(id)
+	}
+	clock.advance(slowDelay)
+	complete(numPackets - 2)
+	clock.advance(slowerDelay - slowDelay)
+	complete(numPackets - 1)
+
+	// The median falls in the first bucket, the 90th percentile in the
+	// bucket of slowDelay and the 99th in the bucket of slowerDelay.
+	want := LatencyPercentiles{
+		P50: time.Millisecond,
+		P90: 50 * time.Millisecond,
+		P99: 200 * time.Millisecond,
+	}
+	if got := f.Stats().Latency; got != want {
+		t.Errorf("got f.Stats().Latency = %+v, want = %+v", got, want)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	f := NewFragmentation(HighFragThreshold, LowFragThreshold, DefaultReassembleTimeout, 0)
+	var evicted []uint32
+	f.SetEvictionHandler(func(id uint32, size int) {
+		evicted = append(evicted, id)
+	})
+
+	// Send the first fragments with ids 0 to 3, 2 bytes each.
+	for id := uint32(0); id < 4; id++ {
+		f.Process("", id, 0, 1, true, 0, vv(2, "01"))
+	}
+	if got, want := f.size, 8; got != want {
+		t.Fatalf("got f.size = %d, want = %d", got, want)
+	}
+
+	// Trimming to a target above the current usage does nothing.
+	f.Trim(10)
+	if got, want := f.size, 8; got != want {
+		t.Errorf("got f.size = %d after f.Trim(10), want = %d", got, want)
+	}
+
+	// Trimming to a lower target evicts the oldest packets.
+	f.Trim(3)
+	if got, want := f.size, 2; got != want {
+		t.Errorf("got f.size = %d after f.Trim(3), want = %d", got, want)
+	}
+	if want := []uint32{0, 1, 2}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("got evicted ids = %v, want = %v", evicted, want)
+	}
+	if _, ok := f.reassemblers[3]; !ok {
+		t.Errorf("id=3 was evicted, want it to be kept")
+	}
+
+	f.Trim(0)
+	if got := f.size; got != 0 {
+		t.Errorf("got f.size = %d after f.Trim(0), want = 0", got)
+	}
+}
+
+func TestTrimSkipsCompletingReassemblers(t *testing.T) {
+	f := NewFragmentation(HighFragThreshold, LowFragThreshold, DefaultReassembleTimeout, 0)
+	f.Process("", 0, 0, 1, true, 0, vv(2, "01"))
+	f.Process("", 1, 0, 1, true, 0, vv(2, "01"))
+
+	// Mark the oldest reassembler as done, as if a concurrent Process call had
+	// just completed it but not removed it yet.
+	completing := f.reassemblers[0]
+	completing.done = true
+
+	trimmed := make(chan struct{})
+	go func() {
+		f.Trim(0)
+		close(trimmed)
+	}()
+	select {
+	case <-trimmed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("f.Trim(0) did not return with a reassembler being completed")
+	}
+	if _, ok := f.reassemblers[1]; ok {
+		t.Errorf("id=1 was kept, want it to be evicted")
+	}
+
+	// The completer can still remove its reassembler.
+	f.mu.Lock()
+	f.remove(completing)
+	f.mu.Unlock()
+	if got := f.size; got != 0 {
+		t.Errorf("got f.size = %d after removing all the reassemblers, want = 0", got)
+	}
+}
+
+func TestTimeoutKeepsCompletingReassembler(t *testing.T) {
+	const timeout = time.Millisecond
+	f := NewFragmentation(HighFragThreshold, LowFragThreshold, timeout, 0)
+	var l captureLogger
+	f.SetLogger(&l)
+	f.Process("", 0, 0, 1, true, 0, vv(2, "01"))
+
+	// Mark the reassembler as done, as if a concurrent Process call had just
+	// completed it, and let it grow too old.
+	completing := f.reassemblers[0]
+	completing.done = true
+	completing.creationTime -= (2 * timeout).Nanoseconds()
+
+	// A fragment with the same id must not replace the reassembler being
+	// completed.
+	if _, _, done, err := f.Process("", 0, 0, 1, true, 0, vv(2, "ab")); err != nil || done {
+		t.Fatalf("got f.Process(\"\", 0, 0, 1, true, 0, _) = (_, _, %t, %v), want = (_, _, false, nil)", done, err)
+	}
+	if got := f.reassemblers[0]; got != completing {
+		t.Fatalf("got reassembler %p for id=0, want %p", got, completing)
+	}
+
+	f.mu.Lock()
+	f.remove(completing)
+	f.mu.Unlock()
+	if len(l.warnings) != 0 {
+		t.Errorf("got warnings = %q, want = []", l.warnings)
+	}
+	if got := f.NumReassemblers(); got != 0 {
+		t.Errorf("got f.NumReassemblers() = %d, want = 0", got)
+	}
+}
+
+// captureLogger is a log.Logger that records the warnings it is given.
+type captureLogger struct {
+	warnings []string
+}
+
+func (*captureLogger) Debugf(string, ...interface{}) {}
+
+func (*captureLogger) Infof(string, ...interface{}) {}
+
+func (l *captureLogger) Warningf(format string, v ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, v...))
+}
+
+func (*captureLogger) IsLogging(log.Level) bool {
+	return true
+}
+
+func TestLogger(t *testing.T) {
+	f := NewFragmentation(HighFragThreshold, LowFragThreshold, DefaultReassembleTimeout, 0)
+	var l captureLogger
+	f.SetLogger(&l)
+
+	f.Process("", 0, 0, 1, true, 0, vv(2, "01"))
+
+	// Corrupt the memory counter so that releasing the fragments makes it
+	// negative.
+	f.size = 1
+	f.Trim(0)
+	if got := f.size; got != 0 {
+		t.Errorf("got f.size = %d after f.Trim(0), want = 0", got)
+	}
+	want := []string{"memory counter < 0 (-1), this is an accounting bug that requires investigation"}
+	if !reflect.DeepEqual(l.warnings, want) {
+		t.Errorf("got warnings = %q, want = %q", l.warnings, want)
+	}
+}
+
 func TestMemoryLimitsIgnoresDuplicates(t *testing.T) {
-	f := NewFragmentation(1, 0, DefaultReassembleTimeout)
+	f := NewFragmentation(1, 0, DefaultReassembleTimeout, 0)
 	// Send first fragment with id = 0.
-	f.Process(0, 0, 0, true, vv(1, "0"))
+	f.Process("", 0, 0, 0, true, 0, vv(1, "0"))
 	// Send the same packet again.
-	f.Process(0, 0, 0, true, vv(1, "0"))
+	f.Process("", 0, 0, 0, true, 0, vv(1, "0"))
 
 	got := f.size
 	want := 1
@@ -163,3 +1131,157 @@ func TestMemoryLimitsIgnoresDuplicates(t *testing.T) {
 		t.Errorf("Wrong size, duplicates are not handled correctly: got=%d, want=%d.", got, want)
 	}
 }
+
+func TestReassemblyMetrics(t *testing.T) {
+	type metrics struct {
+		memoryConsumed  int
+		numReassemblers int
+		completed       uint64
+		timedOut        uint64
+		evicted         uint64
+	}
+	check := func(t *testing.T, f *Fragmentation, want metrics) {
+		t.Helper()
+		got := metrics{
+			memoryConsumed:  f.MemoryConsumed(),
+			numReassemblers: f.NumReassemblers(),
+			completed:       f.ReassembliesCompleted(),
+			timedOut:        f.ReassembliesTimedOut(),
+			evicted:         f.ReassembliesEvicted(),
+		}
+		if got != want {
+			t.Errorf("got metrics = %+v, want = %+v", got, want)
+		}
+	}
+
+	t.Run("Completion and timeout", func(t *testing.T) {
+		const timeout = time.Millisecond
+		f := NewFragmentation(1024, 512, timeout, 0)
+
+		f.Process("", 0, 0, 1, true, 0, vv(2, "01"))
+		check(t, f, metrics{memoryConsumed: 2, numReassemblers: 1})
+		if _, _, done, err := f.Process("", 0, 2, 2, false, 0, vv(1, "2")); err != nil || !done {
+			t.Fatalf("got f.Process(\"\", 0, 2, 2, false, 0, _) = (_, _, %t, %v), want = (_, _, true, nil)", done, err)
+		}
+		check(t, f, metrics{completed: 1})
+
+		// Leave the packet with id = 1 incomplete and sleep well past the
+		// timeout.
+		f.Process("", 1, 0, 0, true, 0, vv(1, "0"))
+		time.Sleep(100 * timeout)
+		check(t, f, metrics{completed: 1, timedOut: 1})
+	})
+
+	t.Run("Eviction", func(t *testing.T) {
+		f := NewFragmentation(3, 1, DefaultReassembleTimeout, 0)
+		for id := uint32(0); id < 3; id++ {
+			f.Process("", id, 0, 0, true, 0, vv(1, "0"))
+		}
+		check(t, f, metrics{memoryConsumed: 3, numReassemblers: 3})
+
+		// Exceeding the high limit evicts the oldest packets until the low limit
+		// is reached.
+		f.Process("", 3, 0, 0, true, 0, vv(1, "0"))
+		check(t, f, metrics{memoryConsumed: 1, numReassemblers: 1, evicted: 3})
+	})
+}
+
+// TestReassemblyTimerFreesMemory tests that the memory held for incomplete
+// packets is reclaimed once they time out, without waiting for another
+// fragment to arrive.
+func TestReassemblyTimerFreesMemory(t *testing.T) {
+	const timeout = 10 * time.Millisecond
+	f := NewFragmentation(HighFragThreshold, LowFragThreshold, timeout, 0)
+	for id := uint32(0); id < 4; id++ {
+		f.Process("", id, 0, 1, true, 0, vv(2, "01"))
+	}
+	if got, want := f.MemoryConsumed(), 8; got != want {
+		t.Fatalf("got f.MemoryConsumed() = %d, want = %d", got, want)
+	}
+
+	time.Sleep(10 * timeout)
+	if got := f.MemoryConsumed(); got != 0 {
+		t.Errorf("got f.MemoryConsumed() = %d after the timeout, want = 0", got)
+	}
+	if got := f.NumReassemblers(); got != 0 {
+		t.Errorf("got f.NumReassemblers() = %d after the timeout, want = 0", got)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	const timeout = 10 * time.Millisecond
+	f := NewFragmentation(HighFragThreshold, LowFragThreshold, timeout, 0)
+	var timedOut []uint32
+	f.SetTimeoutHandler(func(id uint32, _ []Hole) {
+		timedOut = append(timedOut, id)
+	})
+	for id := uint32(0); id < 4; id++ {
+		f.Process("", id, 0, 1, true, 0, vv(2, "01"))
+	}
+
+	f.Release()
+	if got := f.MemoryConsumed(); got != 0 {
+		t.Errorf("got f.MemoryConsumed() = %d after f.Release(), want = 0", got)
+	}
+	if got := f.NumReassemblers(); got != 0 {
+		t.Errorf("got f.NumReassemblers() = %d after f.Release(), want = 0", got)
+	}
+
+	// The reassembly timers were stopped.
+	time.Sleep(10 * timeout)
+	if len(timedOut) != 0 {
+		t.Errorf("got timed out ids = %v after f.Release(), want = []", timedOut)
+	}
+	if got := f.Stats().TimedOut; got != 0 {
+		t.Errorf("got f.Stats().TimedOut = %d, want = 0", got)
+	}
+}
+
+// TestEvictionDuringProcess tests that a fragment is not accounted for if its
+// packet is evicted while the fragment is being processed.
+func TestEvictionDuringProcess(t *testing.T) {
+	const src = tcpip.Address("\x0a\x00\x00\x01")
+
+	f := NewFragmentation(HighFragThreshold, LowFragThreshold, DefaultReassembleTimeout, 0)
+	f.SetMaxPerSource(1)
+	f.Process(src, 0, 0, 1, true, 0, vv(2, "01"))
+
+	// Processing the first fragment of packet 1 evicts packet 0, which calls
+	// the eviction handler after the reassembler of packet 1 is created but
+	// before the fragment is processed. Lock f there, so that packet 1 can be
+	// evicted once its fragment is processed but before it is accounted for.
+	evicting := make(chan struct{})
+	f.SetEvictionHandler(func(uint32, int) {
+		f.mu.Lock()
+		close(evicting)
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Process(src, 1, 0, 1, true, 0, vv(2, "01"))
+	}()
+	<-evicting
+
+	r := f.reassemblers[1]
+	for {
+		r.mu.Lock()
+		processed := len(r.heap) != 0
+		r.mu.Unlock()
+		if processed {
+			break
+		}
+		runtime.Gosched()
+	}
+	if !f.release(r) {
+		t.Fatal("got f.release(_) = false for packet 1, want = true")
+	}
+	f.mu.Unlock()
+	<-done
+
+	if got := f.MemoryConsumed(); got != 0 {
+		t.Errorf("got f.MemoryConsumed() = %d after evicting all packets, want = 0", got)
+	}
+	if got := f.sourceSizes[src]; got != 0 {
+		t.Errorf("got f.sourceSizes[%s] = %d after evicting all packets, want = 0", src, got)
+	}
+}
@@ -15,13 +15,27 @@
 package fragmentation
 
 import (
+	"bytes"
 	"container/heap"
-	"fmt"
+	"errors"
 	"math"
+	"sort"
 	"time"
 
 	"gvisor.dev/gvisor/pkg/sync"
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+var (
+	// errInconsistentDSCP is returned by reassembler.process when the DSCP of
+	// a fragment differs from the DSCP of the first fragment received.
+	errInconsistentDSCP = errors.New("fragments carry different DSCP values")
+
+	// errInconsistentECN is returned by reassembler.process when the
+	// fragments of a packet are marked both Not-ECT and CE.
+	errInconsistentECN = errors.New("fragments marked both Not-ECT and CE")
 )
 
 type hole struct {
@@ -33,22 +47,61 @@ type hole struct {
 type reassembler struct {
 	reassemblerEntry
 	id           uint32
-	size         int
+	source       tcpip.Address
 	mu           sync.Mutex
 	holes        []hole
 	deleted      int
 	heap         fragHeap
 	done         bool
-	creationTime time.Time
+	creationTime int64
+
+	// size is the number of bytes of the fragments of the packet accounted
+	// for by the Fragmentation. It is protected by the Fragmentation's lock.
+	size int
+
+	// timer discards the packet if it is not reassembled within the
+	// reassembly timeout. It is stopped when the reassembler is removed.
+	timer *time.Timer
+
+	// ecn is the ECN codepoint of the reassembled packet. It holds the ECN
+	// codepoint of the first fragment received, unless any fragment was marked
+	// CE.
+	ecn uint8
+
+	// ecnSet is true once ecn has been set from a fragment.
+	ecnSet bool
+
+	// notECT and ce are true once a fragment marked Not-ECT and CE,
+	// respectively, has been received.
+	notECT bool
+	ce     bool
+
+	// checkDSCP is true if all fragments must carry the same DSCP as the
+	// first fragment received, which is held in dscp once dscpSet is true.
+	checkDSCP bool
+	dscp      uint8
+	dscpSet   bool
+
+	// overlapMode is how fragments which overlap are handled.
+	overlapMode OverlapMode
+
+	// end is the offset of the last byte of the packet, which is known once
+	// its last fragment is received and endSet is true. highest is the offset
+	// of the last byte received so far.
+	end     uint16
+	endSet  bool
+	highest uint16
 }
 
-func newReassembler(id uint32) *reassembler {
+// newReassembler returns a reassembler for the packet id created at the
+// monotonic time creationTime, in nanoseconds.
+func newReassembler(id uint32, creationTime int64) *reassembler {
 	r := &reassembler{
 		id:           id,
 		holes:        make([]hole, 0, 16),
 		deleted:      0,
 		heap:         make(fragHeap, 0, 8),
-		creationTime: time.Now(),
+		creationTime: creationTime,
 	}
 	r.holes = append(r.holes, hole{
 		first:   0,
@@ -78,7 +131,100 @@ func (r *reassembler) updateHoles(first, last uint16, more bool) bool {
 	return used
 }
 
-func (r *reassembler) process(first, last uint16, more bool, vv buffer.VectorisedView) (buffer.VectorisedView, bool, int, error) {
+// updateECN combines the ECN codepoint ecn of an incoming fragment with the
+// codepoint of the fragments received so far. As per RFC 3168 section 5.3, the
+// reassembled packet is marked CE if any of its fragments were marked CE, and
+// updateECN returns false if the packet must be discarded because some of its
+// fragments were marked Not-ECT and others CE.
+func (r *reassembler) updateECN(ecn uint8) bool {
+	ecn &= header.ECNMask
+	switch ecn {
+	case header.ECNNotECT:
+		r.notECT = true
+	case header.ECNCE:
+		r.ce = true
+	}
+	if r.notECT && r.ce {
+		return false
+	}
+	if !r.ecnSet || ecn == header.ECNCE {
+		r.ecn = ecn
+		r.ecnSet = true
+	}
+	return true
+}
+
+// updateDSCP records the DSCP of the first fragment received, from its TOS
+// octet tos. It returns false if DSCP checking is enabled and the DSCP of an
+// incoming fragment differs from that of the first one.
+func (r *reassembler) updateDSCP(tos uint8) bool {
+	dscp := tos &^ header.ECNMask
+	if !r.dscpSet {
+		r.dscp = dscp
+		r.dscpSet = true
+		return true
+	}
+	return !r.checkDSCP || dscp == r.dscp
+}
+
+// updateEnd records the end of the packet from an incoming fragment ending at
+// last, which is the last fragment of the packet if more is false. It returns
+// false if the fragment conflicts with the end of the packet.
+func (r *reassembler) updateEnd(last uint16, more bool) bool {
+	if r.endSet {
+		return (more && last < r.end) || last == r.end
+	}
+	if !more {
+		if last < r.highest {
+			return false
+		}
+		r.end = last
+		r.endSet = true
+	}
+	if last > r.highest {
+		r.highest = last
+	}
+	return true
+}
+
+// updateOverlaps handles the overlaps of an incoming fragment spanning first to
+// last and holding v with the fragments received so far, according to the
+// overlap mode. It returns false if the packet must be discarded.
+func (r *reassembler) updateOverlaps(first, last uint16, v buffer.View) bool {
+	for i := range r.heap {
+		f := &r.heap[i]
+		fLast := f.offset + uint16(f.vv.Size()) - 1
+		if first > fLast || last < f.offset {
+			continue
+		}
+		if r.overlapMode == OverlapReject && (first != f.offset || last != fLast) {
+			return false
+		}
+		lo, hi := f.offset, fLast
+		if first > lo {
+			lo = first
+		}
+		if last < hi {
+			hi = last
+		}
+		old := f.vv.ToView()
+		overlap := v[lo-first : hi-first+1]
+		if bytes.Equal(old[lo-f.offset:hi-f.offset+1], overlap) {
+			continue
+		}
+		if r.overlapMode != OverlapLastWins {
+			return false
+		}
+		// Replace the data of f with a copy holding the new data, as the views
+		// of f may be shared with the packet f was received in.
+		updated := buffer.NewViewFromBytes(old)
+		copy(updated[lo-f.offset:], overlap)
+		f.vv = updated.ToVectorisedView()
+	}
+	return true
+}
+
+func (r *reassembler) process(first, last uint16, more bool, tos uint8, vv buffer.VectorisedView) (buffer.VectorisedView, ReassemblyInfo, bool, int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	consumed := 0
@@ -86,27 +232,65 @@ func (r *reassembler) process(first, last uint16, more bool, vv buffer.Vectorise
 		// A concurrent goroutine might have already reassembled
 		// the packet and emptied the heap while this goroutine
 		// was waiting on the mutex. We don't have to do anything in this case.
-		return buffer.VectorisedView{}, false, consumed, nil
+		return buffer.VectorisedView{}, ReassemblyInfo{}, false, consumed, nil
+	}
+	if last < first || vv.Size() != int(last-first)+1 {
+		return buffer.VectorisedView{}, ReassemblyInfo{}, false, consumed, ErrInvalidFragmentLength
+	}
+	if !r.updateDSCP(tos) {
+		return buffer.VectorisedView{}, ReassemblyInfo{}, false, consumed, errInconsistentDSCP
+	}
+	if !r.updateEnd(last, more) {
+		return buffer.VectorisedView{}, ReassemblyInfo{}, false, consumed, ErrFragmentConflict
+	}
+	if len(r.heap) != 0 && !r.updateOverlaps(first, last, vv.ToView()) {
+		return buffer.VectorisedView{}, ReassemblyInfo{}, false, consumed, ErrFragmentOverlap
+	}
+	if !r.updateECN(tos) {
+		return buffer.VectorisedView{}, ReassemblyInfo{}, false, consumed, errInconsistentECN
 	}
 	if r.updateHoles(first, last, more) {
 		// We store the incoming packet only if it filled some holes.
 		heap.Push(&r.heap, fragment{offset: first, vv: vv.Clone(nil)})
 		consumed = vv.Size()
-		r.size += consumed
 	}
 	// Check if all the holes have been deleted and we are ready to reassamble.
 	if r.deleted < len(r.holes) {
-		return buffer.VectorisedView{}, false, consumed, nil
+		return buffer.VectorisedView{}, ReassemblyInfo{}, false, consumed, nil
+	}
+	info := ReassemblyInfo{
+		ECN:         r.ecn,
+		Fragments:   len(r.heap),
+		HolesFilled: r.deleted,
 	}
 	res, err := r.heap.reassemble()
 	if err != nil {
-		return buffer.VectorisedView{}, false, consumed, fmt.Errorf("fragment reassembly failed: %v", err)
+		return buffer.VectorisedView{}, ReassemblyInfo{}, false, consumed, err
+	}
+	// Mark r as done so that no other fragment can be reassembled into it. The
+	// caller is responsible for removing r from its Fragmentation.
+	r.done = true
+	return res, info, true, consumed, nil
+}
+
+// missing returns the holes that have not been filled yet, sorted by offset.
+func (r *reassembler) missing() []Hole {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	holes := make([]Hole, 0, len(r.holes)-r.deleted)
+	for _, h := range r.holes {
+		if !h.deleted {
+			holes = append(holes, Hole{First: h.first, Last: h.last})
+		}
 	}
-	return res, true, consumed, nil
+	sort.Slice(holes, func(i, j int) bool { return holes[i].First < holes[j].First })
+	return holes
 }
 
-func (r *reassembler) tooOld(timeout time.Duration) bool {
-	return time.Now().Sub(r.creationTime) > timeout
+// tooOld returns true if r was created more than timeout before the monotonic
+// time now. A zero or negative timeout never expires.
+func (r *reassembler) tooOld(now int64, timeout time.Duration) bool {
+	return timeout > 0 && time.Duration(now-r.creationTime) > timeout
 }
 
 func (r *reassembler) checkDoneOrMark() bool {
@@ -20,6 +20,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/link/loopback"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
@@ -653,3 +654,93 @@ func TestIPv6ReceiveControl(t *testing.T) {
 		})
 	}
 }
+
+// TestInterleavedIPv4AndIPv6Fragments tests that IPv4 and IPv6 packets
+// fragmented with the same identification are reassembled independently when
+// their fragments arrive interleaved.
+func TestInterleavedIPv4AndIPv6Fragments(t *testing.T) {
+	const (
+		nicID = 1
+		// unknownProto is reserved for experimentation by RFC 3692 so no
+		// transport protocol implements it.
+		unknownProto = 253
+		id           = 1
+		fragmentLen  = 8
+	)
+
+	ipv4Fragment := func(offset uint16, more bool) buffer.View {
+		var flags uint8
+		if more {
+			flags = header.IPv4FlagMoreFragments
+		}
+		buf := buffer.NewView(header.IPv4MinimumSize + fragmentLen)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:            header.IPv4MinimumSize,
+			TotalLength:    uint16(len(buf)),
+			ID:             id,
+			Flags:          flags,
+			FragmentOffset: offset,
+			TTL:            64,
+			Protocol:       unknownProto,
+			SrcAddr:        remoteIpv4Addr,
+			DstAddr:        localIpv4Addr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		return buf
+	}
+
+	ipv6Fragment := func(offset uint16, more bool) buffer.View {
+		buf := buffer.NewView(header.IPv6MinimumSize + header.IPv6FragmentHeaderSize + fragmentLen)
+		header.IPv6(buf).Encode(&header.IPv6Fields{
+			PayloadLength: uint16(header.IPv6FragmentHeaderSize + fragmentLen),
+			NextHeader:    uint8(header.IPv6FragmentHeader),
+			HopLimit:      64,
+			SrcAddr:       remoteIpv6Addr,
+			DstAddr:       localIpv6Addr,
+		})
+		header.IPv6Fragment(buf[header.IPv6MinimumSize:]).Encode(&header.IPv6FragmentFields{
+			NextHeader: unknownProto,
+			// The fragment offset is in units of 8 bytes.
+			FragmentOffset: offset / 8,
+			M:              more,
+			Identification: id,
+		})
+		return buf
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol(), ipv6.NewProtocol()},
+	})
+	e := channel.New(0, 1500, "")
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, localIpv4Addr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, localIpv4Addr, err)
+	}
+	if err := s.AddAddress(nicID, ipv6.ProtocolNumber, localIpv6Addr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv6.ProtocolNumber, localIpv6Addr, err)
+	}
+
+	for i, frag := range []struct {
+		proto         tcpip.NetworkProtocolNumber
+		buf           buffer.View
+		wantDelivered uint64
+	}{
+		{proto: ipv4.ProtocolNumber, buf: ipv4Fragment(0, true), wantDelivered: 0},
+		{proto: ipv6.ProtocolNumber, buf: ipv6Fragment(0, true), wantDelivered: 0},
+		{proto: ipv4.ProtocolNumber, buf: ipv4Fragment(fragmentLen, false), wantDelivered: 1},
+		{proto: ipv6.ProtocolNumber, buf: ipv6Fragment(fragmentLen, false), wantDelivered: 2},
+	} {
+		e.InjectInbound(frag.proto, stack.PacketBuffer{
+			Data: frag.buf.ToVectorisedView(),
+		})
+		if got := s.Stats().IP.PacketsDelivered.Value(); got != frag.wantDelivered {
+			t.Errorf("got PacketsDelivered = %d after fragment %d, want = %d", got, i, frag.wantDelivered)
+		}
+	}
+	if got := s.Stats().IP.MalformedFragmentsReceived.Value(); got != 0 {
+		t.Errorf("got MalformedFragmentsReceived = %d, want = 0", got)
+	}
+}
@@ -15,6 +15,10 @@
 package ipv4
 
 import (
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
@@ -52,6 +56,142 @@ func (e *endpoint) handleControl(typ stack.ControlType, extra uint32, pkt stack.
 	e.dispatcher.DeliverTransportControlPacket(e.id.LocalAddress, h.DestinationAddress(), ProtocolNumber, p, typ, extra, pkt)
 }
 
+// handleRedirect updates the route table to reach the destination of the
+// packet that caused an ICMP redirect through the gateway the redirect names,
+// if the protocol is configured to accept redirects. See RFC 1122 section
+// 3.2.2.2.
+func (e *endpoint) handleRedirect(r *stack.Route, h header.ICMPv4, pkt stack.PacketBuffer) {
+	if !e.protocol.acceptsRedirects() {
+		return
+	}
+
+	pkt.Data.TrimFront(header.ICMPv4MinimumSize)
+	ip := header.IPv4(pkt.Data.First())
+	// Only the IP header of the original packet is needed. Drop the redirect if
+	// the original packet wasn't sent by this endpoint.
+	if len(ip) < header.IPv4MinimumSize || ip.SourceAddress() != e.id.LocalAddress {
+		return
+	}
+	dst := ip.DestinationAddress()
+	gateway := h.Gateway()
+	if gateway == header.IPv4Any || gateway == header.IPv4Broadcast || gateway == e.id.LocalAddress || header.IsV4MulticastAddress(gateway) {
+		return
+	}
+	// As per RFC 1122 section 3.2.2.2, the new gateway must be on a network
+	// directly connected to the NIC.
+	if !e.isOnLink(gateway) {
+		return
+	}
+
+	if e.protocol.acceptsRedirectsFromGatewayOnly() {
+		// Find the gateway that the route table currently uses to reach dst
+		// through this NIC.
+		var firstHop tcpip.Address
+		for _, route := range e.stack.GetRouteTable() {
+			if route.NIC == e.nicID && route.Destination.Contains(dst) {
+				firstHop = route.Gateway
+				break
+			}
+		}
+		if len(firstHop) == 0 || firstHop != r.RemoteAddress {
+			return
+		}
+	}
+
+	subnet, err := tcpip.NewSubnet(dst, tcpip.AddressMask(header.IPv4Broadcast))
+	if err != nil {
+		return
+	}
+	e.protocol.installRedirectRoute(e.stack, tcpip.Route{
+		Destination: subnet,
+		Gateway:     gateway,
+		NIC:         e.nicID,
+	})
+}
+
+// isOnLink returns true if addr is on a network directly connected to the NIC
+// of e, i.e. in the subnet of one of its addresses or reachable through a
+// route of the NIC without a gateway.
+func (e *endpoint) isOnLink(addr tcpip.Address) bool {
+	for _, a := range e.stack.AllAddresses()[e.nicID] {
+		if a.Protocol != ProtocolNumber {
+			continue
+		}
+		if subnet := a.AddressWithPrefix.Subnet(); subnet.Contains(addr) {
+			return true
+		}
+	}
+	for _, route := range e.stack.GetRouteTable() {
+		if route.NIC == e.nicID && len(route.Gateway) == 0 && route.Destination.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectRoute is a route installed by an accepted ICMP redirect.
+type redirectRoute struct {
+	route tcpip.Route
+
+	// seq orders the routes by the time they were installed.
+	seq uint64
+
+	// timer removes the route once it ages out.
+	timer tcpip.CancellableTimer
+}
+
+// installRedirectRoute installs route, a host route to the destination of an
+// accepted ICMP redirect, in the route table of s. It replaces the route
+// installed by an earlier redirect for the same destination, and the oldest
+// route installed by a redirect if there are already MaxRedirectRoutes. The
+// route is removed once the redirect timeout expires.
+func (p *protocol) installRedirectRoute(s *stack.Stack, route tcpip.Route) {
+	dst := route.Destination.ID()
+
+	p.redirects.Lock()
+	defer p.redirects.Unlock()
+
+	if p.redirects.routes == nil {
+		p.redirects.routes = make(map[tcpip.Address]*redirectRoute)
+	}
+	if old, ok := p.redirects.routes[dst]; ok {
+		p.removeRedirectRouteLocked(s, old)
+	} else if len(p.redirects.routes) >= MaxRedirectRoutes {
+		var oldest *redirectRoute
+		for _, rr := range p.redirects.routes {
+			if oldest == nil || rr.seq < oldest.seq {
+				oldest = rr
+			}
+		}
+		p.removeRedirectRouteLocked(s, oldest)
+	}
+
+	s.ReplaceRoute(route)
+	p.redirects.seq++
+	rr := &redirectRoute{
+		route: route,
+		seq:   p.redirects.seq,
+	}
+	rr.timer = tcpip.MakeCancellableTimer(&p.redirects, func() {
+		p.removeRedirectRouteLocked(s, rr)
+	})
+	rr.timer.Reset(time.Duration(atomic.LoadInt64(&p.redirectTimeout)))
+	p.redirects.routes[dst] = rr
+}
+
+// removeRedirectRouteLocked removes rr, a route installed by an ICMP redirect,
+// from the route table of s.
+//
+// p.redirects must be locked.
+func (p *protocol) removeRedirectRouteLocked(s *stack.Stack, rr *redirectRoute) {
+	rr.timer.StopLocked()
+	dst := rr.route.Destination.ID()
+	if p.redirects.routes[dst] == rr {
+		delete(p.redirects.routes, dst)
+	}
+	s.RemoveRoute(rr.route)
+}
+
 func (e *endpoint) handleICMP(r *stack.Route, pkt stack.PacketBuffer) {
 	stats := r.Stats()
 	received := stats.ICMP.V4PacketsReceived
@@ -61,6 +201,7 @@ func (e *endpoint) handleICMP(r *stack.Route, pkt stack.PacketBuffer) {
 		return
 	}
 	h := header.ICMPv4(v)
+	r.CountICMPReceived(uint8(h.Type()))
 
 	// TODO(b/112892170): Meaningfully handle all ICMP types.
 	switch h.Type() {
@@ -89,6 +230,10 @@ func (e *endpoint) handleICMP(r *stack.Route, pkt stack.PacketBuffer) {
 			NetworkHeader: append(buffer.View(nil), pkt.NetworkHeader...),
 		})
 
+		if r.ICMPRepliesSuppressed() {
+			return
+		}
+
 		vv := pkt.Data.Clone(nil)
 		vv.TrimFront(header.ICMPv4MinimumSize)
 		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()) + header.ICMPv4MinimumSize)
@@ -123,6 +268,12 @@ func (e *endpoint) handleICMP(r *stack.Route, pkt stack.PacketBuffer) {
 
 		case header.ICMPv4FragmentationNeeded:
 			mtu := uint32(h.MTU())
+			// The MTU is not authenticated, so never lower the path MTU below the
+			// minimum MTU of IPv4 (RFC 791 section 3.2); this also keeps the
+			// payload MTU from underflowing.
+			if mtu < header.IPv4MinimumMTU {
+				mtu = header.IPv4MinimumMTU
+			}
 			e.handleControl(stack.ControlPacketTooBig, calculateMTU(mtu), pkt)
 		}
 
@@ -132,6 +283,8 @@ func (e *endpoint) handleICMP(r *stack.Route, pkt stack.PacketBuffer) {
 	case header.ICMPv4Redirect:
 		received.Redirect.Increment()
 
+		e.handleRedirect(r, h, pkt)
+
 	case header.ICMPv4TimeExceeded:
 		received.TimeExceeded.Increment()
 
@@ -154,3 +307,48 @@ func (e *endpoint) handleICMP(r *stack.Route, pkt stack.PacketBuffer) {
 		received.Invalid.Increment()
 	}
 }
+
+// ReportPacketTooBig implements stack.PacketTooBigReporter. It sends an ICMP
+// Destination Unreachable message with the Fragmentation Needed code, as per
+// RFC 1191 section 4.
+func (*protocol) ReportPacketTooBig(r *stack.Route, mtu uint32, pkt stack.PacketBuffer) {
+	src := r.RemoteAddress
+	if src == header.IPv4Any || src == header.IPv4Broadcast || header.IsV4MulticastAddress(src) {
+		return
+	}
+	if r.ICMPRepliesSuppressed() {
+		return
+	}
+
+	sent := r.Stats().ICMP.V4PacketsSent
+	if !r.Stack().AllowICMPMessage() {
+		sent.RateLimited.Increment()
+		return
+	}
+
+	// The message holds as much of the packet as fits in the minimum
+	// datagram size, as per RFC 1812 section 4.3.2.3.
+	hdr := pkt.Header.View()
+	invoking := buffer.NewVectorisedView(len(hdr), []buffer.View{hdr})
+	invoking.Append(pkt.Data)
+	headerLen := int(r.MaxHeaderLength()) + header.ICMPv4MinimumSize
+	if available := header.IPv4MinimumProcessableDatagramSize - headerLen; invoking.Size() > available {
+		invoking.CapLength(available)
+	}
+
+	icmpHdr := buffer.NewPrependable(headerLen)
+	icmp := header.ICMPv4(icmpHdr.Prepend(header.ICMPv4MinimumSize))
+	icmp.SetType(header.ICMPv4DstUnreachable)
+	icmp.SetCode(header.ICMPv4FragmentationNeeded)
+	icmp.SetMTU(uint16(mtu))
+	icmp.SetChecksum(header.ICMPv4Checksum(icmp, invoking))
+	if err := r.WritePacket(nil /* gso */, stack.NetworkHeaderParams{Protocol: header.ICMPv4ProtocolNumber, TTL: r.DefaultTTL(), TOS: stack.DefaultTOS}, stack.PacketBuffer{
+		Header: icmpHdr,
+		Data:   invoking,
+	}); err != nil {
+		sent.Dropped.Increment()
+		return
+	}
+	sent.DstUnreachable.Increment()
+	sent.PacketTooBig.Increment()
+}
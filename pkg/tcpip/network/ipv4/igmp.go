@@ -0,0 +1,35 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipv4
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// ReportGroupLeave implements stack.GroupLeaveReporter. It sends an IGMPv2
+// Leave Group message, as per RFC 2236 section 3.
+func (*protocol) ReportGroupLeave(r *stack.Route, group tcpip.Address) {
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()) + header.IGMPMinimumSize)
+	igmp := header.IGMP(hdr.Prepend(header.IGMPMinimumSize))
+	igmp.SetType(header.IGMPLeaveGroup)
+	igmp.SetGroupAddress(group)
+	igmp.SetChecksum(^header.Checksum(igmp, 0))
+	r.WritePacket(nil /* gso */, stack.NetworkHeaderParams{Protocol: header.IGMPProtocolNumber, TTL: header.IGMPTTL, TOS: stack.DefaultTOS}, stack.PacketBuffer{
+		Header: hdr,
+	})
+}
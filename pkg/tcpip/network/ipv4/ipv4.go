@@ -22,7 +22,9 @@ package ipv4
 
 import (
 	"sync/atomic"
+	"time"
 
+	"gvisor.dev/gvisor/pkg/sync"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
@@ -44,30 +46,58 @@ const (
 
 	// buckets is the number of identifier buckets.
 	buckets = 2048
+
+	// DefaultRedirectTimeout is the default time after which a route
+	// installed by an ICMP redirect is removed.
+	DefaultRedirectTimeout = 5 * time.Minute
+
+	// MaxRedirectRoutes is the maximum number of routes installed by ICMP
+	// redirects. Once it is reached, the oldest of them is removed to make
+	// room for a new one.
+	MaxRedirectRoutes = 256
 )
 
+// RejectReservedFlagOption is used by SetOption and Option to set and get
+// whether received packets with the reserved flag set are dropped. By default,
+// the reserved flag is ignored and such packets are accepted.
+type RejectReservedFlagOption bool
+
+// AcceptRedirectsOption is used by SetOption and Option to set and get
+// whether ICMP redirects are used to update the route table, like Linux's
+// accept_redirects. By default, ICMP redirects are ignored.
+type AcceptRedirectsOption bool
+
+// RedirectsFromGatewayOnlyOption is used by SetOption and Option to set and get
+// whether accepted ICMP redirects must come from the gateway currently used
+// to reach the redirected destination, as RFC 1122 section 3.2.2.2 requires.
+// By default, redirects from any source are accepted.
+type RedirectsFromGatewayOnlyOption bool
+
+// RedirectTimeoutOption is used by SetOption and Option to set and get the
+// time after which a route installed by an ICMP redirect is removed. It must
+// be positive and defaults to DefaultRedirectTimeout.
+type RedirectTimeoutOption time.Duration
+
 type endpoint struct {
-	nicID         tcpip.NICID
-	id            stack.NetworkEndpointID
-	prefixLen     int
-	linkEP        stack.LinkEndpoint
-	dispatcher    stack.TransportDispatcher
-	fragmentation *fragmentation.Fragmentation
-	protocol      *protocol
-	stack         *stack.Stack
+	nicID      tcpip.NICID
+	id         stack.NetworkEndpointID
+	prefixLen  int
+	linkEP     stack.LinkEndpoint
+	dispatcher stack.TransportDispatcher
+	protocol   *protocol
+	stack      *stack.Stack
 }
 
 // NewEndpoint creates a new ipv4 endpoint.
 func (p *protocol) NewEndpoint(nicID tcpip.NICID, addrWithPrefix tcpip.AddressWithPrefix, linkAddrCache stack.LinkAddressCache, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint, st *stack.Stack) (stack.NetworkEndpoint, *tcpip.Error) {
 	e := &endpoint{
-		nicID:         nicID,
-		id:            stack.NetworkEndpointID{LocalAddress: addrWithPrefix.Address},
-		prefixLen:     addrWithPrefix.PrefixLen,
-		linkEP:        linkEP,
-		dispatcher:    dispatcher,
-		fragmentation: fragmentation.NewFragmentation(fragmentation.HighFragThreshold, fragmentation.LowFragThreshold, fragmentation.DefaultReassembleTimeout),
-		protocol:      p,
-		stack:         st,
+		nicID:      nicID,
+		id:         stack.NetworkEndpointID{LocalAddress: addrWithPrefix.Address},
+		prefixLen:  addrWithPrefix.PrefixLen,
+		linkEP:     linkEP,
+		dispatcher: dispatcher,
+		protocol:   p,
+		stack:      st,
 	}
 
 	return e, nil
@@ -384,6 +414,10 @@ func (e *endpoint) HandlePacket(r *stack.Route, pkt stack.PacketBuffer) {
 		r.Stats().IP.MalformedPacketsReceived.Increment()
 		return
 	}
+	if h.Flags()&header.IPv4FlagReserved != 0 && e.protocol.rejectsReservedFlag() {
+		r.Stats().IP.MalformedPacketsReceived.Increment()
+		return
+	}
 	pkt.NetworkHeader = headerView[:h.HeaderLength()]
 
 	hlen := int(h.HeaderLength())
@@ -418,9 +452,18 @@ func (e *endpoint) HandlePacket(r *stack.Route, pkt stack.PacketBuffer) {
 			r.Stats().IP.MalformedFragmentsReceived.Increment()
 			return
 		}
+		// Packets for transport protocols the stack does not support are dropped
+		// once reassembled so, if configured to, don't spend memory buffering
+		// their fragments.
+		if p := h.TransportProtocol(); e.stack.RejectUnknownProtocolFragments() && p != header.ICMPv4ProtocolNumber && !e.stack.CheckTransportProtocol(p) {
+			r.Stats().UnknownProtocolRcvdPackets.Increment()
+			return
+		}
 		var ready bool
 		var err error
-		pkt.Data, ready, err = e.fragmentation.Process(hash.IPv4FragmentHash(h), h.FragmentOffset(), last, more, pkt.Data)
+		var info fragmentation.ReassemblyInfo
+		tos, _ := h.TOS()
+		pkt.Data, info, ready, err = e.protocol.fragmentation.Process(h.SourceAddress(), hash.IPv4FragmentHash(h), h.FragmentOffset(), last, more, tos, pkt.Data)
 		if err != nil {
 			r.Stats().IP.MalformedPacketsReceived.Increment()
 			r.Stats().IP.MalformedFragmentsReceived.Increment()
@@ -429,6 +472,14 @@ func (e *endpoint) HandlePacket(r *stack.Route, pkt stack.PacketBuffer) {
 		if !ready {
 			return
 		}
+		// The reassembled packet carries the header of the last fragment
+		// received, so update it to hold the ECN codepoint for the whole
+		// packet.
+		if ecn := info.ECN; tos&header.ECNMask != ecn {
+			h.SetTOS(tos&^header.ECNMask|ecn, 0)
+			h.SetChecksum(0)
+			h.SetChecksum(^h.CalculateChecksum())
+		}
 	}
 	p := h.TransportProtocol()
 	if p == header.ICMPv4ProtocolNumber {
@@ -443,6 +494,29 @@ func (e *endpoint) HandlePacket(r *stack.Route, pkt stack.PacketBuffer) {
 // Close cleans up resources associated with the endpoint.
 func (e *endpoint) Close() {}
 
+// FragmentationStats implements stack.FragmentationStatsReporter.
+func (p *protocol) FragmentationStats() stack.FragmentationStats {
+	s := p.fragmentation.Stats()
+	return stack.FragmentationStats{
+		Reassembled:          s.Reassembled,
+		Malformed:            s.Malformed,
+		TimedOut:             s.TimedOut,
+		TimedOutMissingFirst: atomic.LoadUint64(&p.timedOutMissingFirst),
+		Evicted:              s.Evicted,
+		InconsistentDSCP:     s.InconsistentDSCP,
+		Pending:              s.Pending,
+		PendingBytes:         s.PendingBytes,
+	}
+}
+
+// handleReassemblyTimeout implements fragmentation.TimeoutHandler. It counts
+// the packets that timed out without their first fragment.
+func (p *protocol) handleReassemblyTimeout(_ uint32, holes []fragmentation.Hole) {
+	if len(holes) != 0 && holes[0].First == 0 {
+		atomic.AddUint64(&p.timedOutMissingFirst, 1)
+	}
+}
+
 type protocol struct {
 	ids    []uint32
 	hashIV uint32
@@ -451,6 +525,42 @@ type protocol struct {
 	// uint8 portion of it is meaningful and it must be accessed
 	// atomically.
 	defaultTTL uint32
+
+	// rejectReservedFlag is 1 if received packets with the reserved flag
+	// set are dropped, and 0 otherwise. It must be accessed atomically.
+	rejectReservedFlag uint32
+
+	// acceptRedirects is 1 if ICMP redirects are used to update the route
+	// table, and 0 otherwise. It must be accessed atomically.
+	acceptRedirects uint32
+
+	// redirectsFromGatewayOnly is 1 if accepted ICMP redirects must come from
+	// the current first-hop gateway, and 0 otherwise. It must be accessed
+	// atomically.
+	redirectsFromGatewayOnly uint32
+
+	// redirectTimeout is the time.Duration after which a route installed by
+	// an ICMP redirect is removed. It must be accessed atomically.
+	redirectTimeout int64
+
+	// redirects holds the routes installed by accepted ICMP redirects, by
+	// destination.
+	redirects struct {
+		sync.Mutex
+		routes map[tcpip.Address]*redirectRoute
+
+		// seq is incremented for every route installed, to order them by age.
+		seq uint64
+	}
+
+	// timedOutMissingFirst is the number of packets that were not reassembled
+	// within the reassembly timeout and whose first fragment was never
+	// received. It must be accessed atomically.
+	timedOutMissingFirst uint64
+
+	// fragmentation reassembles the fragments received by all endpoints, so
+	// that the fragments of a packet can arrive on different NICs.
+	fragmentation *fragmentation.Fragmentation
 }
 
 // Number returns the ipv4 protocol number.
@@ -480,6 +590,36 @@ func (p *protocol) SetOption(option interface{}) *tcpip.Error {
 	case tcpip.DefaultTTLOption:
 		p.SetDefaultTTL(uint8(v))
 		return nil
+	case RejectReservedFlagOption:
+		var r uint32
+		if v {
+			r = 1
+		}
+		atomic.StoreUint32(&p.rejectReservedFlag, r)
+		return nil
+	case AcceptRedirectsOption:
+		var r uint32
+		if v {
+			r = 1
+		}
+		atomic.StoreUint32(&p.acceptRedirects, r)
+		return nil
+	case RedirectsFromGatewayOnlyOption:
+		var r uint32
+		if v {
+			r = 1
+		}
+		atomic.StoreUint32(&p.redirectsFromGatewayOnly, r)
+		return nil
+	case RedirectTimeoutOption:
+		if v <= 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		atomic.StoreInt64(&p.redirectTimeout, int64(v))
+		return nil
+	case tcpip.FragmentDSCPCheckOption:
+		p.fragmentation.SetDSCPCheck(bool(v))
+		return nil
 	default:
 		return tcpip.ErrUnknownProtocolOption
 	}
@@ -491,6 +631,21 @@ func (p *protocol) Option(option interface{}) *tcpip.Error {
 	case *tcpip.DefaultTTLOption:
 		*v = tcpip.DefaultTTLOption(p.DefaultTTL())
 		return nil
+	case *RejectReservedFlagOption:
+		*v = RejectReservedFlagOption(p.rejectsReservedFlag())
+		return nil
+	case *AcceptRedirectsOption:
+		*v = AcceptRedirectsOption(p.acceptsRedirects())
+		return nil
+	case *RedirectsFromGatewayOnlyOption:
+		*v = RedirectsFromGatewayOnlyOption(p.acceptsRedirectsFromGatewayOnly())
+		return nil
+	case *RedirectTimeoutOption:
+		*v = RedirectTimeoutOption(atomic.LoadInt64(&p.redirectTimeout))
+		return nil
+	case *tcpip.FragmentDSCPCheckOption:
+		*v = tcpip.FragmentDSCPCheckOption(p.fragmentation.DSCPCheck())
+		return nil
 	default:
 		return tcpip.ErrUnknownProtocolOption
 	}
@@ -506,6 +661,24 @@ func (p *protocol) DefaultTTL() uint8 {
 	return uint8(atomic.LoadUint32(&p.defaultTTL))
 }
 
+// rejectsReservedFlag returns true if received packets with the reserved flag
+// set are dropped.
+func (p *protocol) rejectsReservedFlag() bool {
+	return atomic.LoadUint32(&p.rejectReservedFlag) == 1
+}
+
+// acceptsRedirects returns true if ICMP redirects are used to update the route
+// table.
+func (p *protocol) acceptsRedirects() bool {
+	return atomic.LoadUint32(&p.acceptRedirects) == 1
+}
+
+// acceptsRedirectsFromGatewayOnly returns true if accepted ICMP redirects must
+// come from the current first-hop gateway.
+func (p *protocol) acceptsRedirectsFromGatewayOnly() bool {
+	return atomic.LoadUint32(&p.redirectsFromGatewayOnly) == 1
+}
+
 // Close implements stack.TransportProtocol.Close.
 func (*protocol) Close() {}
 
@@ -543,5 +716,19 @@ func NewProtocol() stack.NetworkProtocol {
 	}
 	hashIV := r[buckets]
 
-	return &protocol{ids: ids, hashIV: hashIV, defaultTTL: DefaultTTL}
+	// Overlapping fragments are accepted, as they are by most IPv4
+	// implementations.
+	f := fragmentation.NewFragmentation(fragmentation.HighFragThreshold, fragmentation.LowFragThreshold, fragmentation.DefaultReassembleTimeout, fragmentation.DefaultMaxSourceShare)
+	f.SetOverlapMode(fragmentation.OverlapLastWins)
+	f.SetMaxPerSource(fragmentation.DefaultMaxPerSource)
+
+	p := &protocol{
+		ids:             ids,
+		hashIV:          hashIV,
+		defaultTTL:      DefaultTTL,
+		redirectTimeout: int64(DefaultRedirectTimeout),
+		fragmentation:   f,
+	}
+	f.SetTimeoutHandler(p.handleReassemblyTimeout)
+	return p
 }
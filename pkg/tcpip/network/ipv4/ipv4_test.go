@@ -17,14 +17,17 @@ package ipv4_test
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"math/rand"
 	"testing"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/link/sniffer"
+	"gvisor.dev/gvisor/pkg/tcpip/network/fragmentation"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
@@ -473,3 +476,922 @@ func TestInvalidFragments(t *testing.T) {
 		})
 	}
 }
+
+// TestRejectUnknownProtocolFragments tests that fragments of packets for
+// unsupported transport protocols are only dropped before reassembly when the
+// stack is configured to do so.
+func TestRejectUnknownProtocolFragments(t *testing.T) {
+	const (
+		nicID = 1
+		// unknownProto is reserved for experimentation by RFC 3692 so no
+		// transport protocol implements it.
+		unknownProto = 253
+		addr         = tcpip.Address("\x0a\x00\x00\x01")
+		remoteAddr   = tcpip.Address("\x0a\x00\x00\x02")
+		fragmentLen  = 8
+	)
+
+	fragment := func(offset uint16, more bool) buffer.View {
+		var flags uint8
+		if more {
+			flags = header.IPv4FlagMoreFragments
+		}
+		buf := buffer.NewView(header.IPv4MinimumSize + fragmentLen)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:            header.IPv4MinimumSize,
+			TotalLength:    uint16(len(buf)),
+			ID:             1,
+			Flags:          flags,
+			FragmentOffset: offset,
+			TTL:            64,
+			Protocol:       unknownProto,
+			SrcAddr:        remoteAddr,
+			DstAddr:        addr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		return buf
+	}
+
+	tests := []struct {
+		name string
+		// reject is the value of stack.Options.RejectUnknownProtocolFragments.
+		reject bool
+		// wantUnknown is the number of packets counted as having an unknown
+		// protocol after each fragment is received.
+		wantUnknown []uint64
+	}{
+		{
+			name:        "Reassemble",
+			reject:      false,
+			wantUnknown: []uint64{0, 1},
+		},
+		{
+			name:        "Reject",
+			reject:      true,
+			wantUnknown: []uint64{1, 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := stack.New(stack.Options{
+				NetworkProtocols:               []stack.NetworkProtocol{ipv4.NewProtocol()},
+				RejectUnknownProtocolFragments: test.reject,
+			})
+			e := channel.New(0, 1500, "")
+			if err := s.CreateNIC(nicID, e); err != nil {
+				t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+			}
+			if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr); err != nil {
+				t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, addr, err)
+			}
+
+			for i, frag := range []buffer.View{fragment(0, true), fragment(fragmentLen, false)} {
+				e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+					Data: frag.ToVectorisedView(),
+				})
+				if got, want := s.Stats().UnknownProtocolRcvdPackets.Value(), test.wantUnknown[i]; got != want {
+					t.Errorf("got UnknownProtocolRcvdPackets = %d after fragment %d, want = %d", got, i, want)
+				}
+			}
+			if got := s.Stats().IP.MalformedFragmentsReceived.Value(); got != 0 {
+				t.Errorf("got MalformedFragmentsReceived = %d, want = 0", got)
+			}
+		})
+	}
+}
+
+// TestCrossNICFragments tests that the fragments of a packet are reassembled
+// when they are received by different NICs.
+func TestCrossNICFragments(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+		// unknownProto is reserved for experimentation by RFC 3692 so no
+		// transport protocol implements it.
+		unknownProto = 253
+		addr         = tcpip.Address("\x0a\x00\x00\x01")
+		remoteAddr   = tcpip.Address("\x0a\x00\x00\x02")
+		fragmentLen  = 8
+	)
+
+	fragment := func(offset uint16, more bool) buffer.View {
+		var flags uint8
+		if more {
+			flags = header.IPv4FlagMoreFragments
+		}
+		buf := buffer.NewView(header.IPv4MinimumSize + fragmentLen)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:            header.IPv4MinimumSize,
+			TotalLength:    uint16(len(buf)),
+			ID:             1,
+			Flags:          flags,
+			FragmentOffset: offset,
+			TTL:            64,
+			Protocol:       unknownProto,
+			SrcAddr:        remoteAddr,
+			DstAddr:        addr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		return buf
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+	})
+	e1 := channel.New(0, 1500, "")
+	e2 := channel.New(0, 1500, "")
+	for nicID, e := range map[tcpip.NICID]*channel.Endpoint{nicID1: e1, nicID2: e2} {
+		if err := s.CreateNIC(nicID, e); err != nil {
+			t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+		}
+		if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, addr, err)
+		}
+	}
+
+	e1.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+		Data: fragment(0, true).ToVectorisedView(),
+	})
+	e2.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+		Data: fragment(fragmentLen, false).ToVectorisedView(),
+	})
+
+	// The reassembled packet is delivered, and dropped as it is for an unknown
+	// transport protocol.
+	if got := s.Stats().UnknownProtocolRcvdPackets.Value(); got != 1 {
+		t.Errorf("got UnknownProtocolRcvdPackets = %d, want = 1", got)
+	}
+	if got := s.Stats().IP.MalformedFragmentsReceived.Value(); got != 0 {
+		t.Errorf("got MalformedFragmentsReceived = %d, want = 0", got)
+	}
+	want := stack.FragmentationStats{Reassembled: 1}
+	if got := s.FragmentationStats().PerProtocol[ipv4.ProtocolNumber]; got != want {
+		t.Errorf("got FragmentationStats().PerProtocol[%d] = %+v, want = %+v", ipv4.ProtocolNumber, got, want)
+	}
+}
+
+// TestFragmentsPerSourceLimit tests that a source reassembling more packets
+// than allowed has its oldest packet evicted, while the packets of other
+// sources are unaffected.
+func TestFragmentsPerSourceLimit(t *testing.T) {
+	const (
+		nicID = 1
+		// unknownProto is reserved for experimentation by RFC 3692 so no
+		// transport protocol implements it.
+		unknownProto = 253
+		addr         = tcpip.Address("\x0a\x00\x00\x01")
+		floodAddr    = tcpip.Address("\x0a\x00\x00\x02")
+		otherAddr    = tcpip.Address("\x0a\x00\x00\x03")
+		fragmentLen  = 8
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+	})
+	e := channel.New(0, 1500, "")
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, addr, err)
+	}
+
+	sendFragment := func(src tcpip.Address, id uint16, offset uint16, more bool) {
+		var flags uint8
+		if more {
+			flags = header.IPv4FlagMoreFragments
+		}
+		buf := buffer.NewView(header.IPv4MinimumSize + fragmentLen)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:            header.IPv4MinimumSize,
+			TotalLength:    uint16(len(buf)),
+			ID:             id,
+			Flags:          flags,
+			FragmentOffset: offset,
+			TTL:            64,
+			Protocol:       unknownProto,
+			SrcAddr:        src,
+			DstAddr:        addr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+			Data: buf.ToVectorisedView(),
+		})
+	}
+
+	// Another source starts a packet, then one source starts more packets
+	// than it may reassemble concurrently.
+	sendFragment(otherAddr, 0, 0, true)
+	for id := uint16(0); id <= fragmentation.DefaultMaxPerSource; id++ {
+		sendFragment(floodAddr, id, 0, true)
+	}
+
+	// Only the oldest packet of the flooding source was evicted, so its newest
+	// packet and the packet of the other source still complete.
+	sendFragment(floodAddr, fragmentation.DefaultMaxPerSource, fragmentLen, false)
+	sendFragment(otherAddr, 0, fragmentLen, false)
+
+	want := stack.FragmentationStats{
+		Reassembled:  2,
+		Evicted:      1,
+		Pending:      fragmentation.DefaultMaxPerSource - 1,
+		PendingBytes: (fragmentation.DefaultMaxPerSource - 1) * fragmentLen,
+	}
+	if got := s.FragmentationStats().PerProtocol[ipv4.ProtocolNumber]; got != want {
+		t.Errorf("got FragmentationStats().PerProtocol[%d] = %+v, want = %+v", ipv4.ProtocolNumber, got, want)
+	}
+}
+
+// TestFragmentsDSCPCheck tests that a packet whose fragments carry different
+// DSCP values is only discarded when the DSCP check is enabled.
+func TestFragmentsDSCPCheck(t *testing.T) {
+	const (
+		nicID = 1
+		// unknownProto is reserved for experimentation by RFC 3692 so no
+		// transport protocol implements it.
+		unknownProto = 253
+		addr         = tcpip.Address("\x0a\x00\x00\x01")
+		remoteAddr   = tcpip.Address("\x0a\x00\x00\x02")
+		fragmentLen  = 8
+		// The DSCPs are in the high 6 bits of the TOS octet, and the fragments
+		// carry the same ECN codepoint.
+		firstTOS  = 0x28<<2 | 1
+		secondTOS = 0x2e<<2 | 1
+	)
+
+	fragment := func(tos uint8, offset uint16, more bool) buffer.View {
+		var flags uint8
+		if more {
+			flags = header.IPv4FlagMoreFragments
+		}
+		buf := buffer.NewView(header.IPv4MinimumSize + fragmentLen)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:            header.IPv4MinimumSize,
+			TOS:            tos,
+			TotalLength:    uint16(len(buf)),
+			ID:             1,
+			Flags:          flags,
+			FragmentOffset: offset,
+			TTL:            64,
+			Protocol:       unknownProto,
+			SrcAddr:        remoteAddr,
+			DstAddr:        addr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		return buf
+	}
+
+	tests := []struct {
+		name  string
+		check bool
+		want  stack.FragmentationStats
+	}{
+		{
+			name:  "disabled",
+			check: false,
+			want:  stack.FragmentationStats{Reassembled: 1},
+		},
+		{
+			name:  "enabled",
+			check: true,
+			want:  stack.FragmentationStats{InconsistentDSCP: 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := stack.New(stack.Options{
+				NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+			})
+			e := channel.New(0, 1500, "")
+			if err := s.CreateNIC(nicID, e); err != nil {
+				t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+			}
+			if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr); err != nil {
+				t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, addr, err)
+			}
+			opt := tcpip.FragmentDSCPCheckOption(test.check)
+			if err := s.SetNetworkProtocolOption(ipv4.ProtocolNumber, opt); err != nil {
+				t.Fatalf("SetNetworkProtocolOption(%d, %t): %s", ipv4.ProtocolNumber, opt, err)
+			}
+
+			e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+				Data: fragment(firstTOS, 0, true).ToVectorisedView(),
+			})
+			e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+				Data: fragment(secondTOS, fragmentLen, false).ToVectorisedView(),
+			})
+
+			if got := s.FragmentationStats().PerProtocol[ipv4.ProtocolNumber]; got != test.want {
+				t.Errorf("got FragmentationStats().PerProtocol[%d] = %+v, want = %+v", ipv4.ProtocolNumber, got, test.want)
+			}
+		})
+	}
+}
+
+// TestExternalLoopbackTraffic tests that packets destined to a loopback
+// address are dropped when received by a NIC that is not a loopback NIC, unless
+// the stack is configured to accept them.
+func TestExternalLoopbackTraffic(t *testing.T) {
+	const (
+		nicID   = 1
+		nicName = "nic1"
+		// unknownProto is reserved for experimentation by RFC 3692 so no
+		// transport protocol implements it.
+		unknownProto = 253
+		loopbackAddr = tcpip.Address("\x7f\x00\x00\x01")
+		remoteAddr   = tcpip.Address("\x0a\x00\x00\x02")
+	)
+
+	tests := []struct {
+		name string
+		// allow is the value of stack.Options.AllowExternalLoopbackTraffic.
+		allow            bool
+		wantDelivered    uint64
+		wantInvalidDst   uint64
+		wantLoopbackDrop uint64
+	}{
+		{
+			name:             "Drop",
+			allow:            false,
+			wantDelivered:    0,
+			wantInvalidDst:   1,
+			wantLoopbackDrop: 1,
+		},
+		{
+			name:             "Allow",
+			allow:            true,
+			wantDelivered:    1,
+			wantInvalidDst:   0,
+			wantLoopbackDrop: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := stack.New(stack.Options{
+				NetworkProtocols:             []stack.NetworkProtocol{ipv4.NewProtocol()},
+				AllowExternalLoopbackTraffic: test.allow,
+			})
+			e := channel.New(0, 1500, "")
+			if err := s.CreateNICWithOptions(nicID, e, stack.NICOptions{Name: nicName}); err != nil {
+				t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+			}
+			nic, ok := s.GetNICByName(nicName)
+			if !ok {
+				t.Fatalf("GetNICByName(%q) = (_, false), want = (_, true)", nicName)
+			}
+			// Assign the loopback address to the NIC so that the packet is not
+			// dropped only for being destined elsewhere.
+			if err := s.AddAddress(nicID, ipv4.ProtocolNumber, loopbackAddr); err != nil {
+				t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, loopbackAddr, err)
+			}
+
+			buf := buffer.NewView(header.IPv4MinimumSize)
+			ip := header.IPv4(buf)
+			ip.Encode(&header.IPv4Fields{
+				IHL:         header.IPv4MinimumSize,
+				TotalLength: uint16(len(buf)),
+				TTL:         64,
+				Protocol:    unknownProto,
+				SrcAddr:     remoteAddr,
+				DstAddr:     loopbackAddr,
+			})
+			ip.SetChecksum(^ip.CalculateChecksum())
+			e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+				Data: buf.ToVectorisedView(),
+			})
+
+			if got := s.Stats().IP.PacketsDelivered.Value(); got != test.wantDelivered {
+				t.Errorf("got PacketsDelivered = %d, want = %d", got, test.wantDelivered)
+			}
+			if got := s.Stats().IP.InvalidDestinationAddressesReceived.Value(); got != test.wantInvalidDst {
+				t.Errorf("got InvalidDestinationAddressesReceived = %d, want = %d", got, test.wantInvalidDst)
+			}
+			if got := nic.DropStats().LoopbackDestination; got != test.wantLoopbackDrop {
+				t.Errorf("got DropStats().LoopbackDestination = %d, want = %d", got, test.wantLoopbackDrop)
+			}
+		})
+	}
+}
+
+// TestReservedFlag tests that fragments with the reserved flag set are
+// reassembled or dropped as configured by RejectReservedFlagOption.
+func TestReservedFlag(t *testing.T) {
+	const (
+		nicID = 1
+		// unknownProto is reserved for experimentation by RFC 3692 so no
+		// transport protocol implements it.
+		unknownProto = 253
+		addr         = tcpip.Address("\x0a\x00\x00\x01")
+		remoteAddr   = tcpip.Address("\x0a\x00\x00\x02")
+		fragmentLen  = 8
+	)
+
+	fragment := func(t *testing.T, offset uint16, more bool) buffer.View {
+		t.Helper()
+		flags := uint8(header.IPv4FlagReserved)
+		if more {
+			flags |= header.IPv4FlagMoreFragments
+		}
+		buf := buffer.NewView(header.IPv4MinimumSize + fragmentLen)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:            header.IPv4MinimumSize,
+			TotalLength:    uint16(len(buf)),
+			ID:             1,
+			Flags:          flags,
+			FragmentOffset: offset,
+			TTL:            64,
+			Protocol:       unknownProto,
+			SrcAddr:        remoteAddr,
+			DstAddr:        addr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		if got := ip.Flags(); got != flags {
+			t.Fatalf("got ip.Flags() = %#x, want = %#x", got, flags)
+		}
+		if got := ip.FragmentOffset(); got != offset {
+			t.Fatalf("got ip.FragmentOffset() = %d, want = %d", got, offset)
+		}
+		return buf
+	}
+
+	tests := []struct {
+		name string
+		// reject is the value of RejectReservedFlagOption.
+		reject        bool
+		wantDelivered uint64
+		wantMalformed uint64
+	}{
+		{
+			name:          "Accept",
+			reject:        false,
+			wantDelivered: 1,
+			wantMalformed: 0,
+		},
+		{
+			name:          "Reject",
+			reject:        true,
+			wantDelivered: 0,
+			wantMalformed: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := stack.New(stack.Options{
+				NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+			})
+			if err := s.SetNetworkProtocolOption(ipv4.ProtocolNumber, ipv4.RejectReservedFlagOption(test.reject)); err != nil {
+				t.Fatalf("SetNetworkProtocolOption(%d, %t): %s", ipv4.ProtocolNumber, test.reject, err)
+			}
+			var reject ipv4.RejectReservedFlagOption
+			if err := s.NetworkProtocolOption(ipv4.ProtocolNumber, &reject); err != nil {
+				t.Fatalf("NetworkProtocolOption(%d, _): %s", ipv4.ProtocolNumber, err)
+			}
+			if bool(reject) != test.reject {
+				t.Fatalf("got RejectReservedFlagOption = %t, want = %t", reject, test.reject)
+			}
+			e := channel.New(0, 1500, "")
+			if err := s.CreateNIC(nicID, e); err != nil {
+				t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+			}
+			if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr); err != nil {
+				t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, addr, err)
+			}
+
+			for _, frag := range []buffer.View{fragment(t, 0, true), fragment(t, fragmentLen, false)} {
+				e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+					Data: frag.ToVectorisedView(),
+				})
+			}
+			if got := s.Stats().IP.PacketsDelivered.Value(); got != test.wantDelivered {
+				t.Errorf("got PacketsDelivered = %d, want = %d", got, test.wantDelivered)
+			}
+			if got := s.Stats().IP.MalformedPacketsReceived.Value(); got != test.wantMalformed {
+				t.Errorf("got MalformedPacketsReceived = %d, want = %d", got, test.wantMalformed)
+			}
+			if got := s.Stats().IP.MalformedFragmentsReceived.Value(); got != 0 {
+				t.Errorf("got MalformedFragmentsReceived = %d, want = 0", got)
+			}
+		})
+	}
+}
+
+// TestSuppressICMPReplies tests that no ICMP replies or errors are sent in
+// response to packets received by a NIC configured to suppress them.
+func TestSuppressICMPReplies(t *testing.T) {
+	const (
+		nicID      = 1
+		addr       = tcpip.Address("\x0a\x00\x00\x01")
+		remoteAddr = tcpip.Address("\x0a\x00\x00\x02")
+		closedPort = 1234
+	)
+
+	ipPacket := func(proto tcpip.TransportProtocolNumber, payload buffer.View) buffer.View {
+		buf := buffer.NewView(header.IPv4MinimumSize + len(payload))
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(buf)),
+			TTL:         64,
+			Protocol:    uint8(proto),
+			SrcAddr:     remoteAddr,
+			DstAddr:     addr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		copy(buf[header.IPv4MinimumSize:], payload)
+		return buf
+	}
+
+	echoRequest := func() buffer.View {
+		icmp := header.ICMPv4(buffer.NewView(header.ICMPv4MinimumSize))
+		icmp.SetType(header.ICMPv4Echo)
+		icmp.SetChecksum(^header.Checksum(icmp, 0))
+		return ipPacket(header.ICMPv4ProtocolNumber, buffer.View(icmp))
+	}
+
+	udpToClosedPort := func() buffer.View {
+		u := header.UDP(buffer.NewView(header.UDPMinimumSize))
+		u.Encode(&header.UDPFields{
+			SrcPort: 5555,
+			DstPort: closedPort,
+			Length:  header.UDPMinimumSize,
+		})
+		xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, remoteAddr, addr, header.UDPMinimumSize)
+		u.SetChecksum(^u.CalculateChecksum(xsum))
+		return ipPacket(udp.ProtocolNumber, buffer.View(u))
+	}
+
+	for _, suppress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SuppressICMPReplies=%t", suppress), func(t *testing.T) {
+			s := stack.New(stack.Options{
+				NetworkProtocols:   []stack.NetworkProtocol{ipv4.NewProtocol()},
+				TransportProtocols: []stack.TransportProtocol{udp.NewProtocol()},
+			})
+			e := channel.New(10, 1500, "")
+			if err := s.CreateNICWithOptions(nicID, e, stack.NICOptions{SuppressICMPReplies: suppress}); err != nil {
+				t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+			}
+			if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr); err != nil {
+				t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, addr, err)
+			}
+			s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+			wantReplies := 1
+			if suppress {
+				wantReplies = 0
+			}
+			for _, test := range []struct {
+				name string
+				pkt  buffer.View
+			}{
+				{name: "Echo Request", pkt: echoRequest()},
+				{name: "UDP to closed port", pkt: udpToClosedPort()},
+			} {
+				e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+					Data: test.pkt.ToVectorisedView(),
+				})
+				if got := e.Drain(); got != wantReplies {
+					t.Errorf("got %d packets sent in response to %s, want = %d", got, test.name, wantReplies)
+				}
+			}
+		})
+	}
+}
+
+// TestICMPNICStats tests that the ICMP messages sent and received by a NIC are
+// counted in its stats, by type.
+func TestICMPNICStats(t *testing.T) {
+	const (
+		nicID      = 1
+		addr       = tcpip.Address("\x0a\x00\x00\x01")
+		remoteAddr = tcpip.Address("\x0a\x00\x00\x02")
+		closedPort = 1234
+	)
+
+	ipPacket := func(proto tcpip.TransportProtocolNumber, payload buffer.View) buffer.View {
+		buf := buffer.NewView(header.IPv4MinimumSize + len(payload))
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(buf)),
+			TTL:         64,
+			Protocol:    uint8(proto),
+			SrcAddr:     remoteAddr,
+			DstAddr:     addr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		copy(buf[header.IPv4MinimumSize:], payload)
+		return buf
+	}
+
+	icmpPacket := func(typ header.ICMPv4Type) buffer.View {
+		icmp := header.ICMPv4(buffer.NewView(header.ICMPv4MinimumSize))
+		icmp.SetType(typ)
+		icmp.SetChecksum(^header.Checksum(icmp, 0))
+		return ipPacket(header.ICMPv4ProtocolNumber, buffer.View(icmp))
+	}
+
+	udpToClosedPort := func() buffer.View {
+		u := header.UDP(buffer.NewView(header.UDPMinimumSize))
+		u.Encode(&header.UDPFields{
+			SrcPort: 5555,
+			DstPort: closedPort,
+			Length:  header.UDPMinimumSize,
+		})
+		xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, remoteAddr, addr, header.UDPMinimumSize)
+		u.SetChecksum(^u.CalculateChecksum(xsum))
+		return ipPacket(udp.ProtocolNumber, buffer.View(u))
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocol{ipv4.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{udp.NewProtocol()},
+	})
+	e := channel.New(10, 1500, "")
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, addr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	for _, pkt := range []buffer.View{
+		icmpPacket(header.ICMPv4Echo),
+		icmpPacket(header.ICMPv4DstUnreachable),
+		icmpPacket(header.ICMPv4TimeExceeded),
+		udpToClosedPort(),
+	} {
+		e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+			Data: pkt.ToVectorisedView(),
+		})
+	}
+	if got, want := e.Drain(), 2; got != want {
+		t.Errorf("got %d packets sent, want = %d", got, want)
+	}
+
+	icmp := s.NICInfo()[nicID].Stats.ICMP
+	for _, stat := range []struct {
+		name string
+		stat *tcpip.StatCounter
+		want uint64
+	}{
+		{name: "V4Received.Echo", stat: icmp.V4Received.Echo, want: 1},
+		{name: "V4Received.EchoReply", stat: icmp.V4Received.EchoReply, want: 0},
+		{name: "V4Received.DstUnreachable", stat: icmp.V4Received.DstUnreachable, want: 1},
+		{name: "V4Received.TimeExceeded", stat: icmp.V4Received.TimeExceeded, want: 1},
+		{name: "V4Sent.Echo", stat: icmp.V4Sent.Echo, want: 0},
+		{name: "V4Sent.EchoReply", stat: icmp.V4Sent.EchoReply, want: 1},
+		{name: "V4Sent.DstUnreachable", stat: icmp.V4Sent.DstUnreachable, want: 1},
+		{name: "V6Received.EchoRequest", stat: icmp.V6Received.EchoRequest, want: 0},
+	} {
+		if got := stat.stat.Value(); got != stat.want {
+			t.Errorf("got %s = %d, want = %d", stat.name, got, stat.want)
+		}
+	}
+}
+
+// icmpRedirect returns an ICMP redirect sent from src to addr, naming gateway
+// as the gateway to reach origDst.
+func icmpRedirect(src, addr, origDst, gateway tcpip.Address) buffer.View {
+	const origLen = header.IPv4MinimumSize + 8
+	buf := buffer.NewView(header.IPv4MinimumSize + header.ICMPv4MinimumSize + origLen)
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     addr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(buf[header.IPv4MinimumSize:])
+	icmp.SetType(header.ICMPv4Redirect)
+	icmp.SetCode(1)
+	icmp.SetGateway(gateway)
+	orig := header.IPv4(icmp[header.ICMPv4MinimumSize:])
+	orig.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: origLen,
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     addr,
+		DstAddr:     origDst,
+	})
+	icmp.SetChecksum(^header.Checksum(icmp, 0))
+	return buf
+}
+
+// newRedirectTestStack returns a stack accepting ICMP redirects, with a NIC
+// holding addr in 10.0.0.0/24 and a default route through gateway.
+func newRedirectTestStack(t *testing.T, nicID tcpip.NICID, addr, gateway tcpip.Address) (*stack.Stack, *channel.Endpoint) {
+	t.Helper()
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+	})
+	if err := s.SetNetworkProtocolOption(ipv4.ProtocolNumber, ipv4.AcceptRedirectsOption(true)); err != nil {
+		t.Fatalf("SetNetworkProtocolOption(%d, AcceptRedirectsOption(true)): %s", ipv4.ProtocolNumber, err)
+	}
+	e := channel.New(0, 1500, "")
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   addr,
+			PrefixLen: 24,
+		},
+	}
+	if err := s.AddProtocolAddress(nicID, protocolAddr); err != nil {
+		t.Fatalf("AddProtocolAddress(%d, %+v): %s", nicID, protocolAddr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: header.IPv4EmptySubnet,
+		Gateway:     gateway,
+		NIC:         nicID,
+	}})
+	return s, e
+}
+
+// TestRedirect tests that ICMP redirects update the route table only when
+// the protocol accepts them, when the new gateway is on-link and, if required,
+// when they come from the current first-hop gateway.
+func TestRedirect(t *testing.T) {
+	const (
+		nicID          = 1
+		addr           = tcpip.Address("\x0a\x00\x00\x01")
+		gateway        = tcpip.Address("\x0a\x00\x00\x02")
+		newGateway     = tcpip.Address("\x0a\x00\x00\x03")
+		spoofed        = tcpip.Address("\x0a\x00\x00\x04")
+		offLinkGateway = tcpip.Address("\x0a\x00\x01\x03")
+		dst            = tcpip.Address("\xc0\xa8\x00\x01")
+	)
+
+	tests := []struct {
+		name        string
+		accept      bool
+		gatewayOnly bool
+		src         tcpip.Address
+		newGateway  tcpip.Address
+		wantNextHop tcpip.Address
+	}{
+		{
+			name:        "Ignored",
+			accept:      false,
+			src:         gateway,
+			newGateway:  newGateway,
+			wantNextHop: gateway,
+		},
+		{
+			name:        "Accepted",
+			accept:      true,
+			src:         gateway,
+			newGateway:  newGateway,
+			wantNextHop: newGateway,
+		},
+		{
+			name:        "AcceptedFromGateway",
+			accept:      true,
+			gatewayOnly: true,
+			src:         gateway,
+			newGateway:  newGateway,
+			wantNextHop: newGateway,
+		},
+		{
+			name:        "SpoofedSource",
+			accept:      true,
+			gatewayOnly: true,
+			src:         spoofed,
+			newGateway:  newGateway,
+			wantNextHop: gateway,
+		},
+		{
+			name:        "OffLinkGateway",
+			accept:      true,
+			src:         gateway,
+			newGateway:  offLinkGateway,
+			wantNextHop: gateway,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, e := newRedirectTestStack(t, nicID, addr, gateway)
+			if err := s.SetNetworkProtocolOption(ipv4.ProtocolNumber, ipv4.AcceptRedirectsOption(test.accept)); err != nil {
+				t.Fatalf("SetNetworkProtocolOption(%d, AcceptRedirectsOption(%t)): %s", ipv4.ProtocolNumber, test.accept, err)
+			}
+			if err := s.SetNetworkProtocolOption(ipv4.ProtocolNumber, ipv4.RedirectsFromGatewayOnlyOption(test.gatewayOnly)); err != nil {
+				t.Fatalf("SetNetworkProtocolOption(%d, RedirectsFromGatewayOnlyOption(%t)): %s", ipv4.ProtocolNumber, test.gatewayOnly, err)
+			}
+			var gatewayOnly ipv4.RedirectsFromGatewayOnlyOption
+			if err := s.NetworkProtocolOption(ipv4.ProtocolNumber, &gatewayOnly); err != nil {
+				t.Fatalf("NetworkProtocolOption(%d, _): %s", ipv4.ProtocolNumber, err)
+			}
+			if bool(gatewayOnly) != test.gatewayOnly {
+				t.Fatalf("got RedirectsFromGatewayOnlyOption = %t, want = %t", gatewayOnly, test.gatewayOnly)
+			}
+
+			e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+				Data: icmpRedirect(test.src, addr, dst, test.newGateway).ToVectorisedView(),
+			})
+			if got := s.Stats().ICMP.V4PacketsReceived.Redirect.Value(); got != 1 {
+				t.Errorf("got Redirect = %d, want = 1", got)
+			}
+
+			r, err := s.FindRoute(nicID, addr, dst, ipv4.ProtocolNumber, false /* multicastLoop */)
+			if err != nil {
+				t.Fatalf("FindRoute(%d, %s, %s, %d, false): %s", nicID, addr, dst, ipv4.ProtocolNumber, err)
+			}
+			defer r.Release()
+			if r.NextHop != test.wantNextHop {
+				t.Errorf("got r.NextHop = %s, want = %s", r.NextHop, test.wantNextHop)
+			}
+		})
+	}
+}
+
+// TestRedirectRoutesLimit tests that the oldest route installed by an ICMP
+// redirect is removed when MaxRedirectRoutes is reached.
+func TestRedirectRoutesLimit(t *testing.T) {
+	const (
+		nicID      = 1
+		addr       = tcpip.Address("\x0a\x00\x00\x01")
+		gateway    = tcpip.Address("\x0a\x00\x00\x02")
+		newGateway = tcpip.Address("\x0a\x00\x00\x03")
+	)
+
+	s, e := newRedirectTestStack(t, nicID, addr, gateway)
+	dst := func(i int) tcpip.Address {
+		return tcpip.Address([]byte{192, 168, byte(i >> 8), byte(i)})
+	}
+	for i := 0; i <= ipv4.MaxRedirectRoutes; i++ {
+		e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+			Data: icmpRedirect(gateway, addr, dst(i), newGateway).ToVectorisedView(),
+		})
+	}
+
+	// The redirect routes come first, followed by the default route.
+	if got, want := len(s.GetRouteTable()), ipv4.MaxRedirectRoutes+1; got != want {
+		t.Errorf("got len(GetRouteTable()) = %d, want = %d", got, want)
+	}
+	for i, want := range map[int]tcpip.Address{0: gateway, 1: newGateway, ipv4.MaxRedirectRoutes: newGateway} {
+		r, err := s.FindRoute(nicID, addr, dst(i), ipv4.ProtocolNumber, false /* multicastLoop */)
+		if err != nil {
+			t.Fatalf("FindRoute(%d, %s, %s, %d, false): %s", nicID, addr, dst(i), ipv4.ProtocolNumber, err)
+		}
+		if r.NextHop != want {
+			t.Errorf("got r.NextHop = %s for %s, want = %s", r.NextHop, dst(i), want)
+		}
+		r.Release()
+	}
+}
+
+// TestRedirectRouteExpiry tests that a route installed by an ICMP redirect is
+// removed once the redirect timeout expires.
+func TestRedirectRouteExpiry(t *testing.T) {
+	const (
+		nicID      = 1
+		addr       = tcpip.Address("\x0a\x00\x00\x01")
+		gateway    = tcpip.Address("\x0a\x00\x00\x02")
+		newGateway = tcpip.Address("\x0a\x00\x00\x03")
+		dst        = tcpip.Address("\xc0\xa8\x00\x01")
+		timeout    = time.Millisecond
+	)
+
+	s, e := newRedirectTestStack(t, nicID, addr, gateway)
+	if err := s.SetNetworkProtocolOption(ipv4.ProtocolNumber, ipv4.RedirectTimeoutOption(0)); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("got SetNetworkProtocolOption(%d, RedirectTimeoutOption(0)) = %v, want = %s", ipv4.ProtocolNumber, err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := s.SetNetworkProtocolOption(ipv4.ProtocolNumber, ipv4.RedirectTimeoutOption(timeout)); err != nil {
+		t.Fatalf("SetNetworkProtocolOption(%d, RedirectTimeoutOption(%s)): %s", ipv4.ProtocolNumber, timeout, err)
+	}
+	var got ipv4.RedirectTimeoutOption
+	if err := s.NetworkProtocolOption(ipv4.ProtocolNumber, &got); err != nil {
+		t.Fatalf("NetworkProtocolOption(%d, _): %s", ipv4.ProtocolNumber, err)
+	}
+	if time.Duration(got) != timeout {
+		t.Fatalf("got RedirectTimeoutOption = %s, want = %s", time.Duration(got), timeout)
+	}
+
+	e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+		Data: icmpRedirect(gateway, addr, dst, newGateway).ToVectorisedView(),
+	})
+
+	// The redirect route is removed by a timer, so wait for the route table to
+	// only hold the default route again.
+	for deadline := time.Now().Add(5 * time.Second); len(s.GetRouteTable()) != 1; time.Sleep(timeout) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got GetRouteTable() = %+v after the redirect timeout, want only the default route", s.GetRouteTable())
+		}
+	}
+}
@@ -85,6 +85,7 @@ func (e *endpoint) handleICMP(r *stack.Route, netHeader buffer.View, pkt stack.P
 		received.Invalid.Increment()
 		return
 	}
+	r.CountICMPReceived(uint8(h.Type()))
 
 	isNDPValid := func() bool {
 		// As per RFC 4861 sections 4.1 - 4.5, 6.1.1, 6.1.2, 7.1.1, 7.1.2 and
@@ -107,6 +108,11 @@ func (e *endpoint) handleICMP(r *stack.Route, netHeader buffer.View, pkt stack.P
 		}
 		pkt.Data.TrimFront(header.ICMPv6PacketTooBigMinimumSize)
 		mtu := h.MTU()
+		// As per RFC 8201 section 4, a Packet Too Big message reporting an MTU
+		// below the minimum IPv6 link MTU must not lower the path MTU below it.
+		if mtu < header.IPv6MinimumMTU {
+			mtu = header.IPv6MinimumMTU
+		}
 		e.handleControl(stack.ControlPacketTooBig, calculateMTU(mtu), pkt)
 
 	case header.ICMPv6DstUnreachable:
@@ -367,13 +373,41 @@ func (e *endpoint) handleICMP(r *stack.Route, netHeader buffer.View, pkt stack.P
 			received.Invalid.Increment()
 			return
 		}
+
+		if r.ICMPRepliesSuppressed() {
+			return
+		}
 		pkt.Data.TrimFront(header.ICMPv6EchoMinimumSize)
-		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()) + header.ICMPv6EchoMinimumSize)
+
+		replyRoute := r
+		if header.IsV6MulticastAddress(r.LocalAddress) {
+			// The request was sent to a multicast group we have joined. Replies to
+			// such requests are rate limited as a single request may be answered by
+			// every node in the group.
+			if !r.Stack().AllowICMPMessage() {
+				sent.RateLimited.Increment()
+				return
+			}
+
+			// As per RFC 4291 section 2.7, multicast addresses must not be used as
+			// source addresses in IPv6 packets so reply from a unicast address
+			// assigned to the NIC the request was received on.
+			mr, err := r.Stack().FindRoute(r.NICID(), "", r.RemoteAddress, ProtocolNumber, false /* multicastLoop */)
+			if err != nil {
+				sent.Dropped.Increment()
+				return
+			}
+			defer mr.Release()
+			mr.RemoteLinkAddress = r.RemoteLinkAddress
+			replyRoute = &mr
+		}
+
+		hdr := buffer.NewPrependable(int(replyRoute.MaxHeaderLength()) + header.ICMPv6EchoMinimumSize)
 		packet := header.ICMPv6(hdr.Prepend(header.ICMPv6EchoMinimumSize))
 		copy(packet, h)
 		packet.SetType(header.ICMPv6EchoReply)
-		packet.SetChecksum(header.ICMPv6Checksum(packet, r.LocalAddress, r.RemoteAddress, pkt.Data))
-		if err := r.WritePacket(nil /* gso */, stack.NetworkHeaderParams{Protocol: header.ICMPv6ProtocolNumber, TTL: r.DefaultTTL(), TOS: stack.DefaultTOS}, stack.PacketBuffer{
+		packet.SetChecksum(header.ICMPv6Checksum(packet, replyRoute.LocalAddress, replyRoute.RemoteAddress, pkt.Data))
+		if err := replyRoute.WritePacket(nil /* gso */, stack.NetworkHeaderParams{Protocol: header.ICMPv6ProtocolNumber, TTL: replyRoute.DefaultTTL(), TOS: stack.DefaultTOS}, stack.PacketBuffer{
 			Header: hdr,
 			Data:   pkt.Data,
 		}); err != nil {
@@ -522,3 +556,60 @@ func (*protocol) ResolveStaticAddress(addr tcpip.Address) (tcpip.LinkAddress, bo
 	}
 	return tcpip.LinkAddress([]byte(nil)), false
 }
+
+// ReportPacketTooBig implements stack.PacketTooBigReporter. It sends an ICMPv6
+// Packet Too Big message, as per RFC 4443 section 3.2.
+func (*protocol) ReportPacketTooBig(r *stack.Route, mtu uint32, pkt stack.PacketBuffer) {
+	src := r.RemoteAddress
+	if src == header.IPv6Any || header.IsV6MulticastAddress(src) {
+		return
+	}
+	if r.ICMPRepliesSuppressed() {
+		return
+	}
+
+	sent := r.Stats().ICMP.V6PacketsSent
+	if !r.Stack().AllowICMPMessage() {
+		sent.RateLimited.Increment()
+		return
+	}
+
+	// The message holds as much of the packet as fits in the minimum MTU, as
+	// per RFC 4443 section 2.4.
+	hdr := pkt.Header.View()
+	invoking := buffer.NewVectorisedView(len(hdr), []buffer.View{hdr})
+	invoking.Append(pkt.Data)
+	headerLen := int(r.MaxHeaderLength()) + header.ICMPv6PacketTooBigMinimumSize
+	if available := header.IPv6MinimumMTU - headerLen; invoking.Size() > available {
+		invoking.CapLength(available)
+	}
+
+	icmpHdr := buffer.NewPrependable(headerLen)
+	icmp := header.ICMPv6(icmpHdr.Prepend(header.ICMPv6PacketTooBigMinimumSize))
+	icmp.SetType(header.ICMPv6PacketTooBig)
+	icmp.SetMTU(mtu)
+	icmp.SetChecksum(header.ICMPv6Checksum(icmp, r.LocalAddress, r.RemoteAddress, invoking))
+	if err := r.WritePacket(nil /* gso */, stack.NetworkHeaderParams{Protocol: header.ICMPv6ProtocolNumber, TTL: r.DefaultTTL(), TOS: stack.DefaultTOS}, stack.PacketBuffer{
+		Header: icmpHdr,
+		Data:   invoking,
+	}); err != nil {
+		sent.Dropped.Increment()
+		return
+	}
+	sent.PacketTooBig.Increment()
+}
+
+// ReportGroupLeave implements stack.GroupLeaveReporter. It sends an MLD
+// Multicast Listener Done message, as per RFC 2710 section 4.
+func (*protocol) ReportGroupLeave(r *stack.Route, group tcpip.Address) {
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()) + header.ICMPv6MLDMinimumSize)
+	icmp := header.ICMPv6(hdr.Prepend(header.ICMPv6MLDMinimumSize))
+	icmp.SetType(header.ICMPv6MulticastListenerDone)
+	header.MLD(icmp.NDPPayload()).SetMulticastAddress(group)
+	icmp.SetChecksum(header.ICMPv6Checksum(icmp, r.LocalAddress, r.RemoteAddress, buffer.VectorisedView{}))
+	if err := r.WritePacket(nil /* gso */, stack.NetworkHeaderParams{Protocol: header.ICMPv6ProtocolNumber, TTL: header.MLDHopLimit, TOS: stack.DefaultTOS}, stack.PacketBuffer{
+		Header: hdr,
+	}); err != nil {
+		r.Stats().ICMP.V6PacketsSent.Dropped.Increment()
+	}
+}
@@ -22,6 +22,7 @@ import (
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/checker"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/link/sniffer"
@@ -53,6 +54,10 @@ func (*stubLinkEndpoint) MaxHeaderLength() uint16 {
 	return 0
 }
 
+func (*stubLinkEndpoint) MTU() uint32 {
+	return 0
+}
+
 func (*stubLinkEndpoint) LinkAddress() tcpip.LinkAddress {
 	return ""
 }
@@ -215,6 +220,18 @@ func TestICMPCounts(t *testing.T) {
 			t.Errorf("got %s = %d, want = %d", name, got, want)
 		}
 	})
+
+	// The NIC counts the valid messages it received by type, and the echo
+	// reply it sent.
+	nicStats := s.NICInfo()[1].Stats.ICMP
+	visitStats(reflect.ValueOf(&nicStats.V6Received).Elem(), func(name string, s *tcpip.StatCounter) {
+		if got, want := s.Value(), uint64(1); got != want {
+			t.Errorf("got NIC V6Received.%s = %d, want = %d", name, got, want)
+		}
+	})
+	if got, want := nicStats.V6Sent.EchoReply.Value(), uint64(1); got != want {
+		t.Errorf("got NIC V6Sent.EchoReply = %d, want = %d", got, want)
+	}
 	if t.Failed() {
 		t.Logf("stats:\n%+v", s.Stats())
 	}
@@ -957,3 +974,65 @@ func TestICMPChecksumValidationWithPayloadMultipleViews(t *testing.T) {
 		})
 	}
 }
+
+// TestEchoRequestToMulticastGroup tests that an Echo Request sent to a
+// multicast group the NIC has joined is replied to from a unicast address.
+func TestEchoRequestToMulticastGroup(t *testing.T) {
+	const nicID = 1
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{NewProtocol()},
+	})
+	e := channel.New(1, 1280, linkAddr0)
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, ProtocolNumber, lladdr0); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ProtocolNumber, lladdr0, err)
+	}
+
+	const ident = 5
+	hdr := buffer.NewPrependable(header.IPv6MinimumSize + header.ICMPv6EchoMinimumSize)
+	pkt := header.ICMPv6(hdr.Prepend(header.ICMPv6EchoMinimumSize))
+	pkt.SetType(header.ICMPv6EchoRequest)
+	pkt.SetIdent(ident)
+	pkt.SetChecksum(header.ICMPv6Checksum(pkt, lladdr1, header.IPv6AllNodesMulticastAddress, buffer.VectorisedView{}))
+	ip := header.IPv6(hdr.Prepend(header.IPv6MinimumSize))
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength: header.ICMPv6EchoMinimumSize,
+		NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+		HopLimit:      64,
+		SrcAddr:       lladdr1,
+		DstAddr:       header.IPv6AllNodesMulticastAddress,
+	})
+	e.InjectLinkAddr(ProtocolNumber, linkAddr1, stack.PacketBuffer{
+		Data: hdr.View().ToVectorisedView(),
+	})
+
+	if got := s.Stats().ICMP.V6PacketsReceived.EchoRequest.Value(); got != 1 {
+		t.Fatalf("got EchoRequest received = %d, want = 1", got)
+	}
+	if got := s.Stats().ICMP.V6PacketsSent.EchoReply.Value(); got != 1 {
+		t.Fatalf("got EchoReply sent = %d, want = 1", got)
+	}
+
+	p, ok := e.Read()
+	if !ok {
+		t.Fatal("expected an Echo Reply to be sent")
+	}
+	if p.Proto != ProtocolNumber {
+		t.Errorf("got p.Proto = %d, want = %d", p.Proto, ProtocolNumber)
+	}
+	if p.Route.RemoteLinkAddress != linkAddr1 {
+		t.Errorf("got p.Route.RemoteLinkAddress = %s, want = %s", p.Route.RemoteLinkAddress, linkAddr1)
+	}
+	checker.IPv6(t, p.Pkt.Header.View(),
+		checker.SrcAddr(lladdr0),
+		checker.DstAddr(lladdr1),
+		checker.ICMPv6(
+			checker.ICMPv6Type(header.ICMPv6EchoReply),
+			checker.ICMPv6Code(0)))
+	if got := header.ICMPv6(p.Pkt.Header.View()[header.IPv6MinimumSize:]).Ident(); got != ident {
+		t.Errorf("got reply ident = %d, want = %d", got, ident)
+	}
+}
@@ -52,7 +52,6 @@ type endpoint struct {
 	linkEP        stack.LinkEndpoint
 	linkAddrCache stack.LinkAddressCache
 	dispatcher    stack.TransportDispatcher
-	fragmentation *fragmentation.Fragmentation
 	protocol      *protocol
 }
 
@@ -340,8 +339,18 @@ func (e *endpoint) HandlePacket(r *stack.Route, pkt stack.PacketBuffer) {
 				return
 			}
 
+			// Packets for transport protocols the stack does not support are
+			// dropped once reassembled so, if configured to, don't spend memory
+			// buffering their fragments.
+			if s := r.Stack(); s.RejectUnknownProtocolFragments() && !isSupportedNextHeader(s, rawPayload.Identifier) {
+				r.Stats().UnknownProtocolRcvdPackets.Increment()
+				return
+			}
+
 			var ready bool
-			pkt.Data, ready, err = e.fragmentation.Process(hash.IPv6FragmentHash(h, extHdr.ID()), start, last, more, rawPayload.Buf)
+			var info fragmentation.ReassemblyInfo
+			tc, flowLabel := h.TOS()
+			pkt.Data, info, ready, err = e.protocol.fragmentation.Process(h.SourceAddress(), hash.IPv6FragmentHash(h, extHdr.ID()), start, last, more, tc, rawPayload.Buf)
 			if err != nil {
 				r.Stats().IP.MalformedPacketsReceived.Increment()
 				r.Stats().IP.MalformedFragmentsReceived.Increment()
@@ -349,6 +358,11 @@ func (e *endpoint) HandlePacket(r *stack.Route, pkt stack.PacketBuffer) {
 			}
 
 			if ready {
+				// The reassembled packet carries the header of the last fragment
+				// received, so update it to hold the ECN codepoint for the whole
+				// packet.
+				h.SetTOS(tc&^header.ECNMask|info.ECN, flowLabel)
+
 				// We create a new iterator with the reassembled packet because we could
 				// have more extension headers in the reassembled payload, as per RFC
 				// 8200 section 4.5.
@@ -413,14 +427,63 @@ func (e *endpoint) HandlePacket(r *stack.Route, pkt stack.PacketBuffer) {
 	}
 }
 
+// isSupportedNextHeader returns true if a packet whose payload starts with a
+// header identified by id may be handled, either because id is an extension
+// header or an upper layer protocol that s supports.
+func isSupportedNextHeader(s *stack.Stack, id header.IPv6ExtensionHeaderIdentifier) bool {
+	switch id {
+	case header.IPv6HopByHopOptionsExtHdrIdentifier,
+		header.IPv6RoutingExtHdrIdentifier,
+		header.IPv6FragmentExtHdrIdentifier,
+		header.IPv6DestinationOptionsExtHdrIdentifier,
+		header.IPv6NoNextHeaderIdentifier:
+		return true
+	}
+
+	p := tcpip.TransportProtocolNumber(id)
+	return p == header.ICMPv6ProtocolNumber || s.CheckTransportProtocol(p)
+}
+
 // Close cleans up resources associated with the endpoint.
 func (*endpoint) Close() {}
 
+// FragmentationStats implements stack.FragmentationStatsReporter.
+func (p *protocol) FragmentationStats() stack.FragmentationStats {
+	s := p.fragmentation.Stats()
+	return stack.FragmentationStats{
+		Reassembled:          s.Reassembled,
+		Malformed:            s.Malformed,
+		TimedOut:             s.TimedOut,
+		TimedOutMissingFirst: atomic.LoadUint64(&p.timedOutMissingFirst),
+		Evicted:              s.Evicted,
+		InconsistentDSCP:     s.InconsistentDSCP,
+		Pending:              s.Pending,
+		PendingBytes:         s.PendingBytes,
+	}
+}
+
+// handleReassemblyTimeout implements fragmentation.TimeoutHandler. It counts
+// the packets that timed out without their first fragment.
+func (p *protocol) handleReassemblyTimeout(_ uint32, holes []fragmentation.Hole) {
+	if len(holes) != 0 && holes[0].First == 0 {
+		atomic.AddUint64(&p.timedOutMissingFirst, 1)
+	}
+}
+
 type protocol struct {
 	// defaultTTL is the current default TTL for the protocol. Only the
 	// uint8 portion of it is meaningful and it must be accessed
 	// atomically.
 	defaultTTL uint32
+
+	// timedOutMissingFirst is the number of packets that were not reassembled
+	// within the reassembly timeout and whose first fragment was never
+	// received. It must be accessed atomically.
+	timedOutMissingFirst uint64
+
+	// fragmentation reassembles the fragments received by all endpoints, so
+	// that the fragments of a packet can arrive on different NICs.
+	fragmentation *fragmentation.Fragmentation
 }
 
 // Number returns the ipv6 protocol number.
@@ -453,7 +516,6 @@ func (p *protocol) NewEndpoint(nicID tcpip.NICID, addrWithPrefix tcpip.AddressWi
 		linkEP:        linkEP,
 		linkAddrCache: linkAddrCache,
 		dispatcher:    dispatcher,
-		fragmentation: fragmentation.NewFragmentation(fragmentation.HighFragThreshold, fragmentation.LowFragThreshold, fragmentation.DefaultReassembleTimeout),
 		protocol:      p,
 	}, nil
 }
@@ -464,6 +526,9 @@ func (p *protocol) SetOption(option interface{}) *tcpip.Error {
 	case tcpip.DefaultTTLOption:
 		p.SetDefaultTTL(uint8(v))
 		return nil
+	case tcpip.FragmentDSCPCheckOption:
+		p.fragmentation.SetDSCPCheck(bool(v))
+		return nil
 	default:
 		return tcpip.ErrUnknownProtocolOption
 	}
@@ -475,6 +540,9 @@ func (p *protocol) Option(option interface{}) *tcpip.Error {
 	case *tcpip.DefaultTTLOption:
 		*v = tcpip.DefaultTTLOption(p.DefaultTTL())
 		return nil
+	case *tcpip.FragmentDSCPCheckOption:
+		*v = tcpip.FragmentDSCPCheckOption(p.fragmentation.DSCPCheck())
+		return nil
 	default:
 		return tcpip.ErrUnknownProtocolOption
 	}
@@ -508,5 +576,16 @@ func calculateMTU(mtu uint32) uint32 {
 
 // NewProtocol returns an IPv6 network protocol.
 func NewProtocol() stack.NetworkProtocol {
-	return &protocol{defaultTTL: DefaultTTL}
+	// As per RFC 5722 section 4, packets with overlapping fragments are
+	// silently discarded.
+	f := fragmentation.NewFragmentation(fragmentation.HighFragThreshold, fragmentation.LowFragThreshold, fragmentation.DefaultReassembleTimeout, fragmentation.DefaultMaxSourceShare)
+	f.SetOverlapMode(fragmentation.OverlapReject)
+	f.SetMaxPerSource(fragmentation.DefaultMaxPerSource)
+
+	p := &protocol{
+		defaultTTL:    DefaultTTL,
+		fragmentation: f,
+	}
+	f.SetTimeoutHandler(p.handleReassemblyTimeout)
+	return p
 }
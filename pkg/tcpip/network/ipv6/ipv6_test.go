@@ -15,6 +15,7 @@
 package ipv6
 
 import (
+	"math"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -22,6 +23,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/fragmentation"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
@@ -784,6 +786,88 @@ func TestReceiveIPv6Fragments(t *testing.T) {
 			},
 			expectedPayloads: [][]byte{udpPayload1},
 		},
+		{
+			name: "Two overlapping fragments",
+			fragments: []fragmentData{
+				{
+					nextHdr: fragmentExtHdrID,
+					data: buffer.NewVectorisedView(
+						fragmentExtHdrLen+64,
+						[]buffer.View{
+							// Fragment extension header.
+							//
+							// Fragment offset = 0, More = true, ID = 1
+							buffer.View([]byte{uint8(header.UDPProtocolNumber), 0, 0, 1, 0, 0, 0, 1}),
+
+							ipv6Payload1[:64],
+						},
+					),
+				},
+				{
+					nextHdr: fragmentExtHdrID,
+					data: buffer.NewVectorisedView(
+						fragmentExtHdrLen+len(ipv6Payload1)-56,
+						[]buffer.View{
+							// Fragment extension header.
+							//
+							// Fragment offset = 7, More = false, ID = 1
+							buffer.View([]byte{uint8(header.UDPProtocolNumber), 0, 0, 56, 0, 0, 0, 1}),
+
+							ipv6Payload1[56:],
+						},
+					),
+				},
+			},
+			expectedPayloads: nil,
+		},
+		{
+			name: "Two last fragments ending at different offsets",
+			fragments: []fragmentData{
+				{
+					nextHdr: fragmentExtHdrID,
+					data: buffer.NewVectorisedView(
+						fragmentExtHdrLen+len(ipv6Payload1)-64,
+						[]buffer.View{
+							// Fragment extension header.
+							//
+							// Fragment offset = 8, More = false, ID = 1
+							buffer.View([]byte{uint8(header.UDPProtocolNumber), 0, 0, 64, 0, 0, 0, 1}),
+
+							ipv6Payload1[64:],
+						},
+					),
+				},
+				{
+					nextHdr: fragmentExtHdrID,
+					data: buffer.NewVectorisedView(
+						fragmentExtHdrLen+len(ipv6Payload1)-65,
+						[]buffer.View{
+							// Fragment extension header.
+							//
+							// Fragment offset = 8, More = false, ID = 1
+							buffer.View([]byte{uint8(header.UDPProtocolNumber), 0, 0, 64, 0, 0, 0, 1}),
+
+							ipv6Payload1[64 : len(ipv6Payload1)-1],
+						},
+					),
+				},
+				{
+					nextHdr: fragmentExtHdrID,
+					data: buffer.NewVectorisedView(
+						fragmentExtHdrLen+64,
+						[]buffer.View{
+							// Fragment extension header.
+							//
+							// Fragment offset = 0, More = true, ID = 1
+							buffer.View([]byte{uint8(header.UDPProtocolNumber), 0, 0, 1, 0, 0, 0, 1}),
+
+							ipv6Payload1[:64],
+						},
+					),
+				},
+			},
+			expectedPayloads: nil,
+		},
 		{
 			name: "Two fragments with different IDs",
 			fragments: []fragmentData{
@@ -1263,3 +1347,37 @@ func TestReceiveIPv6Fragments(t *testing.T) {
 		})
 	}
 }
+
+func TestReassemblyTimeoutMissingFirst(t *testing.T) {
+	tests := []struct {
+		name  string
+		holes []fragmentation.Hole
+		want  uint64
+	}{
+		{
+			name:  "first fragment missing",
+			holes: []fragmentation.Hole{{First: 0, Last: 7}},
+			want:  1,
+		},
+		{
+			name:  "first and last fragments missing",
+			holes: []fragmentation.Hole{{First: 0, Last: 7}, {First: 16, Last: math.MaxUint16}},
+			want:  1,
+		},
+		{
+			name:  "last fragment missing",
+			holes: []fragmentation.Hole{{First: 8, Last: math.MaxUint16}},
+			want:  0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewProtocol().(*protocol)
+			p.handleReassemblyTimeout(1, test.holes)
+			if got := p.FragmentationStats().TimedOutMissingFirst; got != test.want {
+				t.Errorf("got FragmentationStats().TimedOutMissingFirst = %d, want = %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"encoding/binary"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// ClassifierVerdict is the action a Classifier decides to take on a packet.
+type ClassifierVerdict int
+
+const (
+	// ClassifierAccept lets the packet go through the NIC's normal delivery.
+	ClassifierAccept ClassifierVerdict = iota
+
+	// ClassifierDrop drops the packet.
+	ClassifierDrop
+
+	// ClassifierRedirect delivers the packet as if it had been received by
+	// another NIC, bypassing that NIC's classifier.
+	ClassifierRedirect
+)
+
+// ClassifierResult is the result of a Classifier's evaluation of a packet.
+type ClassifierResult struct {
+	// Verdict is the action to take on the packet.
+	Verdict ClassifierVerdict
+
+	// Mark, if not zero, tags the packet. It is set in PacketBuffer.Mark of
+	// accepted and redirected packets.
+	Mark uint32
+
+	// RedirectNIC is the NIC redirected packets are delivered to. Packets
+	// redirected to a NIC that does not exist are dropped.
+	RedirectNIC tcpip.NICID
+}
+
+// ClassifierPacket holds the fields of an inbound packet a Classifier
+// evaluates. Fields which could not be parsed out of the packet are left
+// zero.
+type ClassifierPacket struct {
+	// NICID is the ID of the NIC the packet was received on.
+	NICID tcpip.NICID
+
+	// NetworkProtocol is the network protocol of the packet.
+	NetworkProtocol tcpip.NetworkProtocolNumber
+
+	// Src and Dst are the source and destination network addresses of the
+	// packet.
+	Src, Dst tcpip.Address
+
+	// TransportProtocol is the transport protocol of IPv4 and IPv6 packets.
+	// For IPv6 packets with extension headers, it holds the type of the first
+	// extension header instead.
+	TransportProtocol tcpip.TransportProtocolNumber
+
+	// SrcPort and DstPort are the source and destination ports of TCP and UDP
+	// packets. They are not set for fragments other than the first one.
+	SrcPort, DstPort uint16
+
+	// Size is the size of the packet, starting at its network header.
+	Size int
+}
+
+// Classifier is a filter program attached to the input of a NIC. It is called
+// with the fields of every packet the NIC receives, before the packet is
+// delivered, and decides whether to accept, drop or redirect it.
+//
+// It is called synchronously from the link endpoint's dispatch path, so it
+// must not block nor call into the stack.
+type Classifier func(pkt *ClassifierPacket) ClassifierResult
+
+// parseClassifierPacket returns the fields of pkt, an inbound packet of the
+// given network protocol with the given addresses, which a Classifier
+// evaluates.
+func parseClassifierPacket(nicID tcpip.NICID, protocol tcpip.NetworkProtocolNumber, src, dst tcpip.Address, pkt *PacketBuffer) ClassifierPacket {
+	cp := ClassifierPacket{
+		NICID:           nicID,
+		NetworkProtocol: protocol,
+		Src:             src,
+		Dst:             dst,
+		Size:            pkt.Data.Size(),
+	}
+
+	// Network headers are never split across views.
+	hdr := pkt.Data.First()
+	var transportOffset int
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if len(hdr) < header.IPv4MinimumSize {
+			return cp
+		}
+		ip := header.IPv4(hdr)
+		cp.TransportProtocol = ip.TransportProtocol()
+		if ip.FragmentOffset() != 0 {
+			return cp
+		}
+		transportOffset = int(ip.HeaderLength())
+	case header.IPv6ProtocolNumber:
+		if len(hdr) < header.IPv6MinimumSize {
+			return cp
+		}
+		cp.TransportProtocol = header.IPv6(hdr).TransportProtocol()
+		transportOffset = header.IPv6MinimumSize
+	default:
+		return cp
+	}
+
+	switch cp.TransportProtocol {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+	default:
+		return cp
+	}
+
+	// The ports are the first 4 bytes of both the TCP and UDP headers, which
+	// may be in a view of their own.
+	ports := hdr
+	if len(ports) < transportOffset+4 {
+		if pkt.Data.Size() < transportOffset+4 {
+			return cp
+		}
+		ports = pkt.Data.ToView()
+	}
+	ports = ports[transportOffset:]
+	cp.SrcPort = binary.BigEndian.Uint16(ports)
+	cp.DstPort = binary.BigEndian.Uint16(ports[2:])
+	return cp
+}
@@ -33,6 +33,10 @@ type pendingPacket struct {
 	route *Route
 	proto tcpip.NetworkProtocolNumber
 	pkt   PacketBuffer
+
+	// event is the forwarding decision to log once the packet is sent or
+	// dropped.
+	event ForwardEvent
 }
 
 type forwardQueue struct {
@@ -50,7 +54,7 @@ func newForwardQueue() *forwardQueue {
 	return &forwardQueue{packets: make(map[<-chan struct{}][]*pendingPacket)}
 }
 
-func (f *forwardQueue) enqueue(ch <-chan struct{}, n *NIC, r *Route, protocol tcpip.NetworkProtocolNumber, pkt PacketBuffer) {
+func (f *forwardQueue) enqueue(ch <-chan struct{}, n *NIC, r *Route, protocol tcpip.NetworkProtocolNumber, pkt PacketBuffer, ev ForwardEvent) {
 	shouldWait := false
 
 	f.Lock()
@@ -63,6 +67,8 @@ func (f *forwardQueue) enqueue(ch <-chan struct{}, n *NIC, r *Route, protocol tc
 		packets = packets[1:]
 		p.nic.stack.stats.IP.OutgoingPacketErrors.Increment()
 		p.route.Release()
+		p.event.Result = ForwardLinkResolutionFailed
+		p.nic.stack.recordForward(p.event)
 	}
 	if l := len(packets); l >= maxPendingPacketsPerResolution {
 		panic(fmt.Sprintf("max pending packets for resolution reached; got %d packets, max = %d", l, maxPendingPacketsPerResolution))
@@ -72,6 +78,7 @@ func (f *forwardQueue) enqueue(ch <-chan struct{}, n *NIC, r *Route, protocol tc
 		route: r,
 		proto: protocol,
 		pkt:   pkt,
+		event: ev,
 	})
 	f.Unlock()
 
@@ -99,12 +106,15 @@ func (f *forwardQueue) enqueue(ch <-chan struct{}, n *NIC, r *Route, protocol tc
 		for _, p := range packets {
 			if cancelled {
 				p.nic.stack.stats.IP.OutgoingPacketErrors.Increment()
+				p.event.Result = ForwardLinkResolutionFailed
 			} else if _, err := p.route.Resolve(nil); err != nil {
 				p.nic.stack.stats.IP.OutgoingPacketErrors.Increment()
+				p.event.Result = ForwardLinkResolutionFailed
 			} else {
-				p.nic.forwardPacket(p.route, p.proto, p.pkt)
+				p.event.Result = p.nic.forwardPacket(p.route, p.proto, p.pkt)
 			}
 			p.route.Release()
+			p.nic.stack.recordForward(p.event)
 		}
 	}()
 }
@@ -374,6 +374,11 @@ func TestForwardingWithStaticResolver(t *testing.T) {
 	if p.LocalLinkAddress != "b" {
 		t.Fatalf("got p.LocalLinkAddress = %s, want = b", p.LocalLinkAddress)
 	}
+
+	// The forwarded packet is recorded as the last one written out of NIC 2.
+	if got := ep2.dispatcher.(*NIC).LastEgressLinkAddress(); got != "b" {
+		t.Errorf("got LastEgressLinkAddress() = %s on NIC 2, want = b", got)
+	}
 }
 
 func TestForwardingWithFakeResolver(t *testing.T) {
@@ -0,0 +1,151 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/sync"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// ForwardResult is the outcome of a forwarding decision.
+type ForwardResult int
+
+const (
+	// ForwardSent indicates that the packet was sent out of the outgoing NIC.
+	ForwardSent ForwardResult = iota
+
+	// ForwardDeliveredLocally indicates that the packet was destined to an
+	// address assigned to the outgoing NIC and was delivered to it.
+	ForwardDeliveredLocally
+
+	// ForwardNoRoute indicates that no route to the packet's destination
+	// was found.
+	ForwardNoRoute
+
+	// ForwardLinkResolutionFailed indicates that the link address of the
+	// packet's next hop could not be resolved.
+	ForwardLinkResolutionFailed
+
+	// ForwardTTLExpired indicates that the packet's TTL (or hop limit)
+	// expired.
+	ForwardTTLExpired
+
+	// ForwardWriteError indicates that the outgoing NIC failed to write the
+	// packet.
+	ForwardWriteError
+
+	// ForwardPacketTooBig indicates that the packet exceeded the MTU of the
+	// outgoing NIC and could not be fragmented.
+	ForwardPacketTooBig
+)
+
+// String implements fmt.Stringer.
+func (r ForwardResult) String() string {
+	switch r {
+	case ForwardSent:
+		return "sent"
+	case ForwardDeliveredLocally:
+		return "delivered locally"
+	case ForwardNoRoute:
+		return "no route"
+	case ForwardLinkResolutionFailed:
+		return "link resolution failed"
+	case ForwardTTLExpired:
+		return "TTL expired"
+	case ForwardWriteError:
+		return "write error"
+	case ForwardPacketTooBig:
+		return "packet too big"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
+}
+
+// ForwardEvent is a record of a forwarding decision.
+type ForwardEvent struct {
+	// Timestamp is the time the decision was made, in nanoseconds, as
+	// reported by the stack's clock.
+	Timestamp int64
+
+	// InNIC is the NIC the packet was received on.
+	InNIC tcpip.NICID
+
+	// OutNIC is the NIC the packet was routed to. It is zero if no route
+	// was found.
+	OutNIC tcpip.NICID
+
+	// Src and Dst are the source and destination addresses of the packet.
+	Src tcpip.Address
+	Dst tcpip.Address
+
+	// Result is the outcome of the decision.
+	Result ForwardResult
+}
+
+// forwardingLog is a fixed-sized log of the most recent forwarding decisions.
+//
+// The events are stored in a ring buffer, oldest event replaced first.
+//
+// This struct is safe for concurrent use.
+type forwardingLog struct {
+	mu sync.Mutex
+
+	// events is the ring buffer of events. Its length is the capacity of the
+	// log.
+	events []ForwardEvent
+
+	// next is the index in events the next event will be stored at.
+	next int
+
+	// full is true if events has wrapped around at least once.
+	full bool
+}
+
+// newForwardingLog returns a forwarding log holding at most size events, or
+// nil if size is not positive.
+func newForwardingLog(size int) *forwardingLog {
+	if size <= 0 {
+		return nil
+	}
+	return &forwardingLog{events: make([]ForwardEvent, size)}
+}
+
+// record adds e to the log, replacing the oldest event if the log is full.
+func (l *forwardingLog) record(e ForwardEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events[l.next] = e
+	l.next++
+	if l.next == len(l.events) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// snapshot returns the events in the log, oldest first.
+func (l *forwardingLog) snapshot() []ForwardEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]ForwardEvent(nil), l.events[:l.next]...)
+	}
+	events := make([]ForwardEvent, 0, len(l.events))
+	events = append(events, l.events[l.next:]...)
+	return append(events, l.events[:l.next]...)
+}
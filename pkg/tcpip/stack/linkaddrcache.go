@@ -34,10 +34,24 @@ type linkAddrCache struct {
 	// ageLimit is how long a cache entry is valid for.
 	ageLimit time.Duration
 
+	// nicAgeLimits holds the age limits learned for the entries of a NIC,
+	// e.g. from the Reachable Time of NDP Router Advertisements, which
+	// override ageLimit.
+	//
+	// nicAgeLimits is protected by the cache's lock.
+	nicAgeLimits map[tcpip.NICID]time.Duration
+
 	// resolutionTimeout is the amount of time to wait for a link request to
 	// resolve an address.
 	resolutionTimeout time.Duration
 
+	// resolverResolutionTimeouts holds the resolution timeouts learned for
+	// a network protocol on a NIC, e.g. from the Retrans Timer of NDP Router
+	// Advertisements, which override resolutionTimeout.
+	//
+	// resolverResolutionTimeouts is protected by the cache's lock.
+	resolverResolutionTimeouts map[resolverKey]time.Duration
+
 	// resolutionAttempts is the number of times an address is attempted to be
 	// resolved before failing.
 	resolutionAttempts int
@@ -46,9 +60,40 @@ type linkAddrCache struct {
 		sync.Mutex
 		table map[tcpip.FullAddress]*linkAddrEntry
 		lru   linkAddrEntryList
+
+		// hits, misses and evictions are counters reported by stats.
+		hits      uint64
+		misses    uint64
+		evictions uint64
 	}
 }
 
+// resolverKey identifies the link address resolver of a network protocol on a
+// NIC.
+type resolverKey struct {
+	nicID    tcpip.NICID
+	protocol tcpip.NetworkProtocolNumber
+}
+
+// LinkCacheStats holds statistics about a link address cache.
+type LinkCacheStats struct {
+	// Entries is the number of entries currently held in the cache, including
+	// entries that are still being resolved or that failed resolution.
+	Entries int
+
+	// Hits is the number of lookups that were answered with a resolved link
+	// address held in the cache.
+	Hits uint64
+
+	// Misses is the number of lookups that could not be answered with a
+	// resolved link address held in the cache.
+	Misses uint64
+
+	// Evictions is the number of entries removed from the cache to make room
+	// for new entries.
+	Evictions uint64
+}
+
 // entryState controls the state of a single entry in the cache.
 type entryState int
 
@@ -128,12 +173,13 @@ func (e *linkAddrEntry) removeWaker(w *sleep.Waker) {
 
 // add adds a k -> v mapping to the cache.
 func (c *linkAddrCache) add(k tcpip.FullAddress, v tcpip.LinkAddress) {
-	// Calculate expiration time before acquiring the lock, since expiration is
+	// Get the current time before acquiring the lock, since expiration is
 	// relative to the time when information was learned, rather than when it
 	// happened to be inserted into the cache.
-	expiration := time.Now().Add(c.ageLimit)
+	now := time.Now()
 
 	c.cache.Lock()
+	expiration := now.Add(c.ageLimitForLocked(k.NIC))
 	entry := c.getOrCreateEntryLocked(k)
 	entry.linkAddr = v
 
@@ -141,6 +187,57 @@ func (c *linkAddrCache) add(k tcpip.FullAddress, v tcpip.LinkAddress) {
 	c.cache.Unlock()
 }
 
+// setAgeLimit sets how long new or refreshed cache entries of the NIC nicID
+// are valid for.
+func (c *linkAddrCache) setAgeLimit(nicID tcpip.NICID, ageLimit time.Duration) {
+	c.cache.Lock()
+	c.nicAgeLimits[nicID] = ageLimit
+	c.cache.Unlock()
+}
+
+// ageLimitForLocked returns how long new or refreshed cache entries of the NIC
+// nicID are valid for.
+//
+// Precondition: c.cache must be locked.
+func (c *linkAddrCache) ageLimitForLocked(nicID tcpip.NICID) time.Duration {
+	if ageLimit, ok := c.nicAgeLimits[nicID]; ok {
+		return ageLimit
+	}
+	return c.ageLimit
+}
+
+// setResolutionTimeout sets the amount of time to wait for a link request to
+// resolve an address of the given network protocol on the NIC nicID.
+func (c *linkAddrCache) setResolutionTimeout(nicID tcpip.NICID, protocol tcpip.NetworkProtocolNumber, timeout time.Duration) {
+	c.cache.Lock()
+	c.resolverResolutionTimeouts[resolverKey{nicID: nicID, protocol: protocol}] = timeout
+	c.cache.Unlock()
+}
+
+// resolutionTimeoutFor returns the amount of time to wait for a link request to
+// resolve an address of the given network protocol on the NIC nicID.
+func (c *linkAddrCache) resolutionTimeoutFor(nicID tcpip.NICID, protocol tcpip.NetworkProtocolNumber) time.Duration {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	if timeout, ok := c.resolverResolutionTimeouts[resolverKey{nicID: nicID, protocol: protocol}]; ok {
+		return timeout
+	}
+	return c.resolutionTimeout
+}
+
+// removeNIC forgets the age limits and resolution timeouts learned for the
+// NIC nicID, so that a NIC created later with the same ID uses the defaults.
+func (c *linkAddrCache) removeNIC(nicID tcpip.NICID) {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	delete(c.nicAgeLimits, nicID)
+	for k := range c.resolverResolutionTimeouts {
+		if k.nicID == nicID {
+			delete(c.resolverResolutionTimeouts, k)
+		}
+	}
+}
+
 // getOrCreateEntryLocked retrieves a cache entry associated with k. The
 // returned entry is always refreshed in the cache (it is reachable via the
 // map, and its place is bumped in LRU).
@@ -158,6 +255,7 @@ func (c *linkAddrCache) getOrCreateEntryLocked(k tcpip.FullAddress) *linkAddrEnt
 	}
 	var entry *linkAddrEntry
 	if len(c.cache.table) == linkAddrCacheSize {
+		c.cache.evictions++
 		entry = c.cache.lru.Back()
 
 		delete(c.cache.table, entry.addr)
@@ -196,8 +294,10 @@ func (c *linkAddrCache) get(k tcpip.FullAddress, linkRes LinkAddressResolver, lo
 			// Not expired.
 			switch s {
 			case ready:
+				c.cache.hits++
 				return entry.linkAddr, nil, nil
 			case failed:
+				c.cache.misses++
 				return entry.linkAddr, nil, tcpip.ErrNoLinkAddress
 			default:
 				panic(fmt.Sprintf("invalid cache entry state: %s", s))
@@ -207,6 +307,7 @@ func (c *linkAddrCache) get(k tcpip.FullAddress, linkRes LinkAddressResolver, lo
 		entry.changeState(incomplete, time.Time{})
 		fallthrough
 	case incomplete:
+		c.cache.misses++
 		if waker != nil {
 			if entry.wakers == nil {
 				entry.wakers = make(map[*sleep.Waker]struct{})
@@ -230,6 +331,19 @@ func (c *linkAddrCache) get(k tcpip.FullAddress, linkRes LinkAddressResolver, lo
 	}
 }
 
+// stats returns a snapshot of the cache's statistics.
+func (c *linkAddrCache) stats() LinkCacheStats {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+
+	return LinkCacheStats{
+		Entries:   len(c.cache.table),
+		Hits:      c.cache.hits,
+		Misses:    c.cache.misses,
+		Evictions: c.cache.evictions,
+	}
+}
+
 // removeWaker removes a waker previously added through get().
 func (c *linkAddrCache) removeWaker(k tcpip.FullAddress, waker *sleep.Waker) {
 	c.cache.Lock()
@@ -241,13 +355,14 @@ func (c *linkAddrCache) removeWaker(k tcpip.FullAddress, waker *sleep.Waker) {
 }
 
 func (c *linkAddrCache) startAddressResolution(k tcpip.FullAddress, linkRes LinkAddressResolver, localAddr tcpip.Address, linkEP LinkEndpoint, done <-chan struct{}) {
+	protocol := linkRes.LinkAddressProtocol()
 	for i := 0; ; i++ {
 		// Send link request, then wait for the timeout limit and check
 		// whether the request succeeded.
 		linkRes.LinkAddressRequest(k.Addr, localAddr, linkEP)
 
 		select {
-		case now := <-time.After(c.resolutionTimeout):
+		case now := <-time.After(c.resolutionTimeoutFor(k.NIC, protocol)):
 			if stop := c.checkLinkRequest(now, k, i); stop {
 				return
 			}
@@ -277,7 +392,7 @@ func (c *linkAddrCache) checkLinkRequest(now time.Time, k tcpip.FullAddress, att
 			return false
 		}
 		// Max number of retries reached, mark entry as failed.
-		entry.changeState(failed, now.Add(c.ageLimit))
+		entry.changeState(failed, now.Add(c.ageLimitForLocked(k.NIC)))
 	default:
 		panic(fmt.Sprintf("invalid cache entry state: %s", s))
 	}
@@ -291,5 +406,7 @@ func newLinkAddrCache(ageLimit, resolutionTimeout time.Duration, resolutionAttem
 		resolutionAttempts: resolutionAttempts,
 	}
 	c.cache.table = make(map[tcpip.FullAddress]*linkAddrEntry, linkAddrCacheSize)
+	c.nicAgeLimits = make(map[tcpip.NICID]time.Duration)
+	c.resolverResolutionTimeouts = make(map[resolverKey]time.Duration)
 	return c
 }
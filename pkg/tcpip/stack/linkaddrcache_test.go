@@ -190,6 +190,48 @@ func TestCacheReplace(t *testing.T) {
 	}
 }
 
+func TestCacheStats(t *testing.T) {
+	c := newLinkAddrCache(1<<63-1, 1*time.Second, 3)
+	linkRes := &testLinkAddressResolver{cache: c}
+
+	if got, want := c.stats(), (LinkCacheStats{}); got != want {
+		t.Fatalf("got c.stats() = %+v, want = %+v", got, want)
+	}
+
+	// The first lookup misses and triggers resolution, after which the lookup
+	// is retried and hits.
+	e := testAddrs[0]
+	if got, err := getBlocking(c, e.addr, linkRes); err != nil || got != e.linkAddr {
+		t.Fatalf("getBlocking(_, %q, _) = (%q, %v), want = (%q, nil)", string(e.addr.Addr), got, err, e.linkAddr)
+	}
+	if got, want := c.stats(), (LinkCacheStats{Entries: 1, Hits: 1, Misses: 1}); got != want {
+		t.Fatalf("got c.stats() = %+v, want = %+v", got, want)
+	}
+
+	if _, _, err := c.get(e.addr, linkRes, "", nil, nil); err != nil {
+		t.Fatalf("c.get(%q, _, _, _, _): %s", string(e.addr.Addr), err)
+	}
+	if got, want := c.stats(), (LinkCacheStats{Entries: 1, Hits: 2, Misses: 1}); got != want {
+		t.Fatalf("got c.stats() = %+v, want = %+v", got, want)
+	}
+
+	// Static resolution does not use the cache.
+	if _, _, err := c.get(tcpip.FullAddress{NIC: 1, Addr: "broadcast"}, linkRes, "", nil, nil); err != nil {
+		t.Fatalf("c.get(broadcast, _, _, _, _): %s", err)
+	}
+	if got, want := c.stats(), (LinkCacheStats{Entries: 1, Hits: 2, Misses: 1}); got != want {
+		t.Fatalf("got c.stats() = %+v, want = %+v", got, want)
+	}
+
+	// Filling the cache should evict the oldest entry.
+	for _, e := range testAddrs[1 : linkAddrCacheSize+1] {
+		c.add(e.addr, e.linkAddr)
+	}
+	if got, want := c.stats(), (LinkCacheStats{Entries: linkAddrCacheSize, Hits: 2, Misses: 1, Evictions: 1}); got != want {
+		t.Fatalf("got c.stats() = %+v, want = %+v", got, want)
+	}
+}
+
 func TestCacheResolution(t *testing.T) {
 	c := newLinkAddrCache(1<<63-1, 250*time.Millisecond, 1)
 	linkRes := &testLinkAddressResolver{cache: c}
@@ -89,6 +89,13 @@ const (
 	// Advertisement is milliseconds.
 	minimumRetransmitTimer = time.Millisecond
 
+	// minRandomFactor and maxRandomFactor bound the random factor that a
+	// BaseReachableTime is multiplied by to compute a ReachableTime.
+	//
+	// Default = 0.5 and 1.5 (from RFC 4861 section 10)
+	minRandomFactor = 0.5
+	maxRandomFactor = 1.5
+
 	// minimumRtrSolicitationInterval is the minimum amount of time to wait
 	// between sending Router Solicitation messages. This limit is imposed
 	// to make sure that Router Solicitation messages are not sent all at
@@ -169,7 +176,9 @@ type NDPDispatcher interface {
 	// during DAD, err will be set and resolved must be ignored.
 	//
 	// This function is not permitted to block indefinitely. This function
-	// is also not permitted to call into the stack.
+	// is also not permitted to call into the stack, except when DAD
+	// resolved after transmitting DAD messages or failed because addr was
+	// detected to be a duplicate; the stack is not locked in those cases.
 	OnDuplicateAddressDetectionStatus(nicID tcpip.NICID, addr tcpip.Address, resolved bool, err *tcpip.Error)
 
 	// OnDefaultRouterDiscovered will be called when a new default router is
@@ -270,6 +279,14 @@ type NDPConfigurations struct {
 	// Note, a value of zero effectively disables DAD.
 	DupAddrDetectTransmits uint8
 
+	// The maximum number of addresses Duplicate Address Detection is
+	// performed on at the same time. DAD on further addresses is queued until
+	// DAD completes on another address, to limit bursts of Neighbor
+	// Solicitation messages when many addresses are added at once.
+	//
+	// A value of zero means no limit.
+	MaxConcurrentDAD int
+
 	// The amount of time to wait between sending Neighbor solicitation
 	// messages.
 	//
@@ -378,6 +395,14 @@ type ndpState struct {
 	// The DAD state to send the next NS message, or resolve the address.
 	dad map[tcpip.Address]dadState
 
+	// The number of addresses DAD is being performed on, i.e. the DAD states
+	// in dad which have a timer.
+	dadRunning int
+
+	// The addresses waiting for DAD to start because configs.MaxConcurrentDAD
+	// addresses are already performing it, in the order they were added.
+	dadQueue []queuedDAD
+
 	// The default routers discovered through Router Advertisements.
 	defaultRouters map[tcpip.Address]defaultRouterState
 
@@ -394,6 +419,16 @@ type ndpState struct {
 
 	// The last learned DHCPv6 configuration from an NDP RA.
 	dhcpv6Configuration DHCPv6ConfigurationFromNDPRA
+
+	// The last BaseReachableTime learned from an NDP RA.
+	baseReachableTime time.Duration
+}
+
+// randomReachableTime returns a ReachableTime for the given BaseReachableTime,
+// as per RFC 4861 section 6.3.2.
+func randomReachableTime(base time.Duration) time.Duration {
+	factor := minRandomFactor + rand.Float64()*(maxRandomFactor-minRandomFactor)
+	return time.Duration(factor * float64(base))
 }
 
 // dadState holds the Duplicate Address Detection timer and channel to signal
@@ -409,6 +444,12 @@ type dadState struct {
 	done *bool
 }
 
+// queuedDAD is an address waiting for Duplicate Address Detection to start.
+type queuedDAD struct {
+	addr tcpip.Address
+	ref  *referencedNetworkEndpoint
+}
+
 // defaultRouterState holds data associated with a default router discovered by
 // a Router Advertisement (RA).
 type defaultRouterState struct {
@@ -484,13 +525,29 @@ func (ndp *ndpState) startDuplicateAddressDetection(addr tcpip.Address, ref *ref
 
 		// Consider DAD to have resolved even if no DAD messages were actually
 		// transmitted.
-		if ndpDisp := ndp.nic.stack.ndpDisp; ndpDisp != nil {
+		if ndpDisp := ndp.nic.ndpDispatcher(); ndpDisp != nil {
 			ndpDisp.OnDuplicateAddressDetectionStatus(ndp.nic.ID(), addr, true, nil)
 		}
 
 		return nil
 	}
 
+	if max := ndp.configs.MaxConcurrentDAD; max > 0 && ndp.dadRunning >= max {
+		// A DAD state without a timer marks addr as queued.
+		ndp.dad[addr] = dadState{}
+		ndp.dadQueue = append(ndp.dadQueue, queuedDAD{addr: addr, ref: ref})
+		return nil
+	}
+
+	ndp.performDuplicateAddressDetection(addr, ref, remaining)
+	return nil
+}
+
+// performDuplicateAddressDetection starts sending the remaining DAD messages
+// for addr.
+//
+// The NIC that ndp belongs to MUST be locked.
+func (ndp *ndpState) performDuplicateAddressDetection(addr tcpip.Address, ref *referencedNetworkEndpoint, remaining uint8) {
 	var done bool
 	var timer *time.Timer
 	// We initially start a timer to fire immediately because some of the DAD work
@@ -537,7 +594,7 @@ func (ndp *ndpState) startDuplicateAddressDetection(addr tcpip.Address, ref *ref
 			// DAD is not done and we had no errors when sending the last NDP NS,
 			// schedule the next DAD timer.
 			remaining--
-			timer.Reset(ndp.nic.stack.ndpConfigs.RetransmitTimer)
+			timer.Reset(ndp.configs.RetransmitTimer)
 
 			ndp.nic.mu.Unlock()
 			return
@@ -547,13 +604,15 @@ func (ndp *ndpState) startDuplicateAddressDetection(addr tcpip.Address, ref *ref
 		// the last NDP NS. Either way, clean up addr's DAD state and let the
 		// integrator know DAD has completed.
 		delete(ndp.dad, addr)
+		ndp.dadRunning--
+		ndp.startQueuedDuplicateAddressDetection()
 		ndp.nic.mu.Unlock()
 
 		if err != nil {
 			log.Printf("ndpdad: error occured during DAD iteration for addr (%s) on NIC(%d); err = %s", addr, ndp.nic.ID(), err)
 		}
 
-		if ndpDisp := ndp.nic.stack.ndpDisp; ndpDisp != nil {
+		if ndpDisp := ndp.nic.ndpDispatcher(); ndpDisp != nil {
 			ndpDisp.OnDuplicateAddressDetectionStatus(ndp.nic.ID(), addr, dadDone, err)
 		}
 	})
@@ -562,8 +621,22 @@ func (ndp *ndpState) startDuplicateAddressDetection(addr tcpip.Address, ref *ref
 		timer: timer,
 		done:  &done,
 	}
+	ndp.dadRunning++
+}
 
-	return nil
+// startQueuedDuplicateAddressDetection starts DAD on queued addresses until
+// configs.MaxConcurrentDAD addresses are performing it.
+//
+// The NIC that ndp belongs to MUST be locked.
+func (ndp *ndpState) startQueuedDuplicateAddressDetection() {
+	for len(ndp.dadQueue) != 0 {
+		if max := ndp.configs.MaxConcurrentDAD; max > 0 && ndp.dadRunning >= max {
+			return
+		}
+		q := ndp.dadQueue[0]
+		ndp.dadQueue = ndp.dadQueue[1:]
+		ndp.performDuplicateAddressDetection(q.addr, q.ref, ndp.configs.DupAddrDetectTransmits)
+	}
 }
 
 // sendDADPacket sends a NS message to see if any nodes on ndp's NIC's link owns
@@ -620,26 +693,50 @@ func (ndp *ndpState) sendDADPacket(addr tcpip.Address) *tcpip.Error {
 //
 // The NIC that ndp belongs to MUST be locked.
 func (ndp *ndpState) stopDuplicateAddressDetection(addr tcpip.Address) {
-	dad, ok := ndp.dad[addr]
-	if !ok {
+	if !ndp.cancelDuplicateAddressDetection(addr) {
 		// Not currently performing DAD on addr, just return.
 		return
 	}
 
+	// Let the integrator know DAD did not resolve.
+	if ndpDisp := ndp.nic.ndpDispatcher(); ndpDisp != nil {
+		ndpDisp.OnDuplicateAddressDetectionStatus(ndp.nic.ID(), addr, false, nil)
+	}
+}
+
+// cancelDuplicateAddressDetection is like stopDuplicateAddressDetection but
+// does not inform the integrator, so that the caller can do it once the NIC is
+// unlocked. It returns true if DAD was being performed on addr.
+//
+// The NIC that ndp belongs to MUST be locked.
+func (ndp *ndpState) cancelDuplicateAddressDetection(addr tcpip.Address) bool {
+	dad, ok := ndp.dad[addr]
+	if !ok {
+		return false
+	}
+
 	if dad.timer != nil {
 		dad.timer.Stop()
 		dad.timer = nil
 
 		*dad.done = true
 		dad.done = nil
+
+		delete(ndp.dad, addr)
+		ndp.dadRunning--
+		ndp.startQueuedDuplicateAddressDetection()
+		return true
 	}
 
+	// DAD is queued on addr.
 	delete(ndp.dad, addr)
-
-	// Let the integrator know DAD did not resolve.
-	if ndpDisp := ndp.nic.stack.ndpDisp; ndpDisp != nil {
-		ndpDisp.OnDuplicateAddressDetectionStatus(ndp.nic.ID(), addr, false, nil)
+	for i, q := range ndp.dadQueue {
+		if q.addr == addr {
+			ndp.dadQueue = append(ndp.dadQueue[:i], ndp.dadQueue[i+1:]...)
+			break
+		}
 	}
+	return true
 }
 
 // handleRA handles a Router Advertisement message that arrived on the NIC
@@ -660,7 +757,7 @@ func (ndp *ndpState) handleRA(ip tcpip.Address, ra header.NDPRouterAdvert) {
 	// Only worry about the DHCPv6 configuration if we have an NDPDispatcher as we
 	// only inform the dispatcher on configuration changes. We do nothing else
 	// with the information.
-	if ndpDisp := ndp.nic.stack.ndpDisp; ndpDisp != nil {
+	if ndpDisp := ndp.nic.ndpDispatcher(); ndpDisp != nil {
 		var configuration DHCPv6ConfigurationFromNDPRA
 		switch {
 		case ra.ManagedAddrConfFlag():
@@ -707,8 +804,21 @@ func (ndp *ndpState) handleRA(ip tcpip.Address, ra header.NDPRouterAdvert) {
 		}
 	}
 
-	// TODO(b/141556115): Do (RetransTimer, ReachableTime)) Parameter
-	//                    Discovery.
+	// Adopt the router's RetransTimer, if it specified one, for DAD and
+	// address resolution. A value of zero means the router left it
+	// unspecified, as per RFC 4861 section 6.3.4.
+	if rt := ra.RetransTimer(); rt != 0 {
+		ndp.configs.RetransmitTimer = rt
+		ndp.nic.stack.linkAddrCache.setResolutionTimeout(ndp.nic.ID(), header.IPv6ProtocolNumber, rt)
+	}
+
+	// Adopt the router's ReachableTime for the neighbors on this NIC, if it
+	// specified one. As per RFC 4861 section 6.3.4, a new random
+	// ReachableTime is only computed when the BaseReachableTime changes.
+	if rt := ra.ReachableTime(); rt != 0 && rt != ndp.baseReachableTime {
+		ndp.baseReachableTime = rt
+		ndp.nic.stack.linkAddrCache.setAgeLimit(ndp.nic.ID(), randomReachableTime(rt))
+	}
 
 	// We know the options is valid as far as wire format is concerned since
 	// we got the Router Advertisement, as documented by this fn. Given this
@@ -717,20 +827,22 @@ func (ndp *ndpState) handleRA(ip tcpip.Address, ra header.NDPRouterAdvert) {
 	for opt, done, _ := it.Next(); !done; opt, done, _ = it.Next() {
 		switch opt := opt.(type) {
 		case header.NDPRecursiveDNSServer:
-			if ndp.nic.stack.ndpDisp == nil {
+			ndpDisp := ndp.nic.ndpDispatcher()
+			if ndpDisp == nil {
 				continue
 			}
 
 			addrs, _ := opt.Addresses()
-			ndp.nic.stack.ndpDisp.OnRecursiveDNSServerOption(ndp.nic.ID(), addrs, opt.Lifetime())
+			ndpDisp.OnRecursiveDNSServerOption(ndp.nic.ID(), addrs, opt.Lifetime())
 
 		case header.NDPDNSSearchList:
-			if ndp.nic.stack.ndpDisp == nil {
+			ndpDisp := ndp.nic.ndpDispatcher()
+			if ndpDisp == nil {
 				continue
 			}
 
 			domainNames, _ := opt.DomainNames()
-			ndp.nic.stack.ndpDisp.OnDNSSearchListOption(ndp.nic.ID(), domainNames, opt.Lifetime())
+			ndpDisp.OnDNSSearchListOption(ndp.nic.ID(), domainNames, opt.Lifetime())
 
 		case header.NDPPrefixInformation:
 			prefix := opt.Subnet()
@@ -779,7 +891,7 @@ func (ndp *ndpState) invalidateDefaultRouter(ip tcpip.Address) {
 	delete(ndp.defaultRouters, ip)
 
 	// Let the integrator know a discovered default router is invalidated.
-	if ndpDisp := ndp.nic.stack.ndpDisp; ndpDisp != nil {
+	if ndpDisp := ndp.nic.ndpDispatcher(); ndpDisp != nil {
 		ndpDisp.OnDefaultRouterInvalidated(ndp.nic.ID(), ip)
 	}
 }
@@ -791,7 +903,7 @@ func (ndp *ndpState) invalidateDefaultRouter(ip tcpip.Address) {
 //
 // The NIC that ndp belongs to MUST be locked.
 func (ndp *ndpState) rememberDefaultRouter(ip tcpip.Address, rl time.Duration) {
-	ndpDisp := ndp.nic.stack.ndpDisp
+	ndpDisp := ndp.nic.ndpDispatcher()
 	if ndpDisp == nil {
 		return
 	}
@@ -821,7 +933,7 @@ func (ndp *ndpState) rememberDefaultRouter(ip tcpip.Address, rl time.Duration) {
 //
 // The NIC that ndp belongs to MUST be locked.
 func (ndp *ndpState) rememberOnLinkPrefix(prefix tcpip.Subnet, l time.Duration) {
-	ndpDisp := ndp.nic.stack.ndpDisp
+	ndpDisp := ndp.nic.ndpDispatcher()
 	if ndpDisp == nil {
 		return
 	}
@@ -863,7 +975,7 @@ func (ndp *ndpState) invalidateOnLinkPrefix(prefix tcpip.Subnet) {
 	delete(ndp.onLinkPrefixes, prefix)
 
 	// Let the integrator know a discovered on-link prefix is invalidated.
-	if ndpDisp := ndp.nic.stack.ndpDisp; ndpDisp != nil {
+	if ndpDisp := ndp.nic.ndpDispatcher(); ndpDisp != nil {
 		ndpDisp.OnOnLinkPrefixInvalidated(ndp.nic.ID(), prefix)
 	}
 }
@@ -994,6 +1106,10 @@ func (ndp *ndpState) doSLAAC(prefix tcpip.Subnet, pl, vl time.Duration) {
 			}
 
 			ndp.invalidateSLAACPrefix(prefix, state)
+
+			// The timer holds the NIC's lock until it returns, so notify the
+			// removal of the prefix's addresses asynchronously.
+			go ndp.nic.flushAddressRemovals()
 		}),
 		maxGenerationAttempts: ndp.configs.AutoGenAddressConflictRetries + 1,
 	}
@@ -1087,8 +1203,13 @@ func (ndp *ndpState) generateSLAACAddr(prefix tcpip.Subnet, state *slaacPrefixSt
 		return false
 	}
 
+	// Nor if the nic cannot hold another address.
+	if err := ndp.nic.checkMaxAddressesLocked(generatedAddr); err != nil {
+		return false
+	}
+
 	// Inform the integrator that we have a new SLAAC address.
-	ndpDisp := ndp.nic.stack.ndpDisp
+	ndpDisp := ndp.nic.ndpDispatcher()
 	if ndpDisp == nil {
 		return false
 	}
@@ -1223,7 +1344,7 @@ func (ndp *ndpState) deprecateSLAACAddress(ref *referencedNetworkEndpoint) {
 	}
 
 	ref.deprecated = true
-	if ndpDisp := ndp.nic.stack.ndpDisp; ndpDisp != nil {
+	if ndpDisp := ndp.nic.ndpDispatcher(); ndpDisp != nil {
 		ndpDisp.OnAutoGenAddressDeprecated(ndp.nic.ID(), ref.addrWithPrefix())
 	}
 }
@@ -1248,7 +1369,7 @@ func (ndp *ndpState) invalidateSLAACPrefix(prefix tcpip.Subnet, state slaacPrefi
 //
 // The NIC that ndp belongs to MUST be locked.
 func (ndp *ndpState) cleanupSLAACAddrResourcesAndNotify(addr tcpip.AddressWithPrefix, invalidatePrefix bool) {
-	if ndpDisp := ndp.nic.stack.ndpDisp; ndpDisp != nil {
+	if ndpDisp := ndp.nic.ndpDispatcher(); ndpDisp != nil {
 		ndpDisp.OnAutoGenAddressInvalidated(ndp.nic.ID(), addr)
 	}
 
@@ -349,6 +349,63 @@ func TestDADDisabled(t *testing.T) {
 	}
 }
 
+// TestPerNICNDPDispatcher tests that the NDP events of a NIC with its own NDP
+// dispatcher are sent to it, and that the events of other NICs are sent to the
+// stack's dispatcher.
+func TestPerNICNDPDispatcher(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	stackDisp := ndpDispatcher{
+		dadC: make(chan ndpDADEvent, 1),
+	}
+	nicDisp := ndpDispatcher{
+		dadC: make(chan ndpDADEvent, 1),
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv6.NewProtocol()},
+		NDPDisp:          &stackDisp,
+	})
+	if err := s.CreateNICWithOptions(nicID1, channel.New(0, 1280, linkAddr1), stack.NICOptions{NDPDisp: &nicDisp}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _) = %s", nicID1, err)
+	}
+	if err := s.CreateNIC(nicID2, channel.New(0, 1280, linkAddr2)); err != nil {
+		t.Fatalf("CreateNIC(%d, _) = %s", nicID2, err)
+	}
+
+	tests := []struct {
+		nicID    tcpip.NICID
+		addr     tcpip.Address
+		wantDisp *ndpDispatcher
+		noDisp   *ndpDispatcher
+	}{
+		{nicID: nicID1, addr: addr1, wantDisp: &nicDisp, noDisp: &stackDisp},
+		{nicID: nicID2, addr: addr2, wantDisp: &stackDisp, noDisp: &nicDisp},
+	}
+	for _, test := range tests {
+		if err := s.AddAddress(test.nicID, header.IPv6ProtocolNumber, test.addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s) = %s", test.nicID, header.IPv6ProtocolNumber, test.addr, err)
+		}
+
+		// DAD is disabled, so the address resolves immediately.
+		select {
+		case e := <-test.wantDisp.dadC:
+			if diff := checkDADEvent(e, test.nicID, test.addr, true, nil); diff != "" {
+				t.Errorf("dad event mismatch (-want +got):\n%s", diff)
+			}
+		default:
+			t.Fatalf("expected DAD event for %s on NIC(%d)", test.addr, test.nicID)
+		}
+		select {
+		case e := <-test.noDisp.dadC:
+			t.Errorf("unexpected DAD event on the other dispatcher = %+v", e)
+		default:
+		}
+	}
+}
+
 // TestDADResolve tests that an address successfully resolves after performing
 // DAD for various values of DupAddrDetectTransmits and RetransmitTimer.
 // Included in the subtests is a test to make sure that an invalid
@@ -652,6 +709,98 @@ func TestDADFail(t *testing.T) {
 	}
 }
 
+// lockCheckingNDPDispatcher is an ndpDispatcher that queries the stack when
+// DAD completes, to make sure that the stack is not locked at that point.
+type lockCheckingNDPDispatcher struct {
+	ndpDispatcher
+	s       *stack.Stack
+	lockedC chan bool
+}
+
+// Implements stack.NDPDispatcher.OnDuplicateAddressDetectionStatus.
+func (n *lockCheckingNDPDispatcher) OnDuplicateAddressDetectionStatus(nicID tcpip.NICID, addr tcpip.Address, resolved bool, err *tcpip.Error) {
+	done := make(chan struct{})
+	go func() {
+		n.s.AllAddresses()
+		close(done)
+	}()
+	select {
+	case <-done:
+		n.lockedC <- false
+	case <-time.After(time.Second):
+		n.lockedC <- true
+	}
+	n.ndpDispatcher.OnDuplicateAddressDetectionStatus(nicID, addr, resolved, err)
+}
+
+// TestDADFailNotifiesUnlocked tests that the integrator is informed of a DAD
+// failure caused by an NA for the tentative address without the stack being
+// locked.
+func TestDADFailNotifiesUnlocked(t *testing.T) {
+	const nicID = 1
+
+	ndpDisp := lockCheckingNDPDispatcher{
+		ndpDispatcher: ndpDispatcher{
+			dadC: make(chan ndpDADEvent, 1),
+		},
+		lockedC: make(chan bool, 1),
+	}
+	opts := stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv6.NewProtocol()},
+		NDPConfigs:       stack.DefaultNDPConfigurations(),
+		NDPDisp:          &ndpDisp,
+	}
+	opts.NDPConfigs.RetransmitTimer = time.Hour
+
+	e := channel.New(0, 1280, linkAddr1)
+	s := stack.New(opts)
+	ndpDisp.s = s
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _) = %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, header.IPv6ProtocolNumber, addr1); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s) = %s", nicID, header.IPv6ProtocolNumber, addr1, err)
+	}
+
+	// Receive an NA for the tentative address from the node that owns it.
+	naSize := header.ICMPv6NeighborAdvertMinimumSize + header.NDPLinkLayerAddressSize
+	hdr := buffer.NewPrependable(header.IPv6MinimumSize + naSize)
+	pkt := header.ICMPv6(hdr.Prepend(naSize))
+	pkt.SetType(header.ICMPv6NeighborAdvert)
+	na := header.NDPNeighborAdvert(pkt.NDPPayload())
+	na.SetSolicitedFlag(true)
+	na.SetOverrideFlag(true)
+	na.SetTargetAddress(addr1)
+	na.Options().Serialize(header.NDPOptionsSerializer{
+		header.NDPTargetLinkLayerAddressOption(linkAddr1),
+	})
+	pkt.SetChecksum(header.ICMPv6Checksum(pkt, addr1, header.IPv6AllNodesMulticastAddress, buffer.VectorisedView{}))
+	payloadLength := hdr.UsedLength()
+	ip := header.IPv6(hdr.Prepend(header.IPv6MinimumSize))
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength: uint16(payloadLength),
+		NextHeader:    uint8(icmp.ProtocolNumber6),
+		HopLimit:      255,
+		SrcAddr:       addr1,
+		DstAddr:       header.IPv6AllNodesMulticastAddress,
+	})
+	e.InjectInbound(header.IPv6ProtocolNumber, stack.PacketBuffer{
+		Data: hdr.View().ToVectorisedView(),
+	})
+
+	select {
+	case e := <-ndpDisp.dadC:
+		if diff := checkDADEvent(e, nicID, addr1, false, nil); diff != "" {
+			t.Errorf("dad event mismatch (-want +got):\n%s", diff)
+		}
+	default:
+		t.Fatal("expected DAD failure event")
+	}
+	if locked := <-ndpDisp.lockedC; locked {
+		t.Error("stack was locked when informing the integrator of the DAD failure")
+	}
+}
+
 func TestDADStop(t *testing.T) {
 	const nicID = 1
 
@@ -760,6 +909,63 @@ func TestDADStop(t *testing.T) {
 	}
 }
 
+// TestTentativeAddresses tests that an address is reported as tentative by
+// NIC.TentativeAddresses while DAD is being performed on it, and no longer once
+// DAD resolves.
+func TestTentativeAddresses(t *testing.T) {
+	const (
+		nicID   = 1
+		nicName = "nic1"
+	)
+
+	ndpDisp := ndpDispatcher{
+		dadC: make(chan ndpDADEvent, 1),
+	}
+	opts := stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv6.NewProtocol()},
+		NDPDisp:          &ndpDisp,
+	}
+	opts.NDPConfigs.RetransmitTimer = time.Second
+	opts.NDPConfigs.DupAddrDetectTransmits = 1
+
+	e := channel.New(1, 1280, linkAddr1)
+	s := stack.New(opts)
+	if err := s.CreateNICWithOptions(nicID, e, stack.NICOptions{Name: nicName}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, %+v) = %s", nicID, stack.NICOptions{Name: nicName}, err)
+	}
+	nic, ok := s.GetNICByName(nicName)
+	if !ok {
+		t.Fatalf("GetNICByName(%q) = (_, false), want = (_, true)", nicName)
+	}
+
+	if got := nic.TentativeAddresses(); len(got) != 0 {
+		t.Fatalf("got nic.TentativeAddresses() = %s, want = []", got)
+	}
+
+	if err := s.AddAddress(nicID, header.IPv6ProtocolNumber, addr1); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s) = %s", nicID, header.IPv6ProtocolNumber, addr1, err)
+	}
+
+	// DAD is ongoing so the address should be tentative.
+	if diff := cmp.Diff([]tcpip.Address{addr1}, nic.TentativeAddresses()); diff != "" {
+		t.Fatalf("tentative addresses mismatch (-want +got):\n%s", diff)
+	}
+
+	// Wait for DAD to resolve.
+	select {
+	case <-time.After(opts.NDPConfigs.RetransmitTimer + defaultAsyncEventTimeout):
+		t.Fatal("timed out waiting for DAD resolution")
+	case e := <-ndpDisp.dadC:
+		if diff := checkDADEvent(e, nicID, addr1, true, nil); diff != "" {
+			t.Errorf("dad event mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	if got := nic.TentativeAddresses(); len(got) != 0 {
+		t.Fatalf("got nic.TentativeAddresses() = %s after DAD resolved, want = []", got)
+	}
+}
+
 // TestSetNDPConfigurationFailsForBadNICID tests to make sure we get an error if
 // we attempt to update NDP configurations using an invalid NICID.
 func TestSetNDPConfigurationFailsForBadNICID(t *testing.T) {
@@ -776,6 +982,73 @@ func TestSetNDPConfigurationFailsForBadNICID(t *testing.T) {
 // TestSetNDPConfigurations tests that we can update and use per-interface NDP
 // configurations without affecting the default NDP configurations or other
 // interfaces' configurations.
+// TestDADMaxConcurrent tests that DAD is performed on at most
+// NDPConfigurations.MaxConcurrentDAD addresses at a time, the others being
+// queued.
+func TestDADMaxConcurrent(t *testing.T) {
+	const (
+		nicID         = 1
+		numAddrs      = 5
+		maxConcurrent = 2
+		retransTimer  = 200 * time.Millisecond
+	)
+
+	ndpDisp := ndpDispatcher{
+		dadC: make(chan ndpDADEvent, numAddrs),
+	}
+	opts := stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv6.NewProtocol()},
+		NDPDisp:          &ndpDisp,
+	}
+	opts.NDPConfigs.RetransmitTimer = retransTimer
+	opts.NDPConfigs.DupAddrDetectTransmits = 1
+	opts.NDPConfigs.MaxConcurrentDAD = maxConcurrent
+
+	e := channel.New(numAddrs, 1280, linkAddr1)
+	s := stack.New(opts)
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _) = %s", nicID, err)
+	}
+
+	start := time.Now()
+	for i := 0; i < numAddrs; i++ {
+		addr := []byte(addr1)
+		addr[len(addr)-1] = byte(i + 1)
+		if err := s.AddAddress(nicID, header.IPv6ProtocolNumber, tcpip.Address(addr)); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s) = %s", nicID, header.IPv6ProtocolNumber, tcpip.Address(addr), err)
+		}
+	}
+
+	// DAD starts on maxConcurrent addresses at a time, the others starting
+	// as the first ones resolve. Check the number of NS messages sent halfway
+	// through the DAD of each batch of addresses.
+	const batches = (numAddrs + maxConcurrent - 1) / maxConcurrent
+	for i := 0; i < batches; i++ {
+		time.Sleep(time.Until(start.Add(time.Duration(2*i+1) * retransTimer / 2)))
+		want := uint64((i + 1) * maxConcurrent)
+		if want > numAddrs {
+			want = numAddrs
+		}
+		if got := s.Stats().ICMP.V6PacketsSent.NeighborSolicit.Value(); got != want {
+			t.Errorf("got NeighborSolicit = %d during batch #%d, want = %d", got, i, want)
+		}
+	}
+
+	for i := 0; i < numAddrs; i++ {
+		select {
+		case <-time.After(retransTimer + defaultAsyncEventTimeout):
+			t.Fatalf("timed out waiting for DAD resolution of address #%d", i)
+		case e := <-ndpDisp.dadC:
+			if !e.resolved || e.err != nil {
+				t.Errorf("got DAD event = %+v, want resolved without error", e)
+			}
+		}
+	}
+	if got := s.Stats().ICMP.V6PacketsSent.NeighborSolicit.Value(); got != numAddrs {
+		t.Errorf("got NeighborSolicit = %d, want = %d", got, numAddrs)
+	}
+}
+
 func TestSetNDPConfigurations(t *testing.T) {
 	const nicID1 = 1
 	const nicID2 = 2
@@ -936,6 +1209,12 @@ func TestSetNDPConfigurations(t *testing.T) {
 // raBufWithOptsAndDHCPv6 returns a valid NDP Router Advertisement with options
 // and DHCPv6 configurations specified.
 func raBufWithOptsAndDHCPv6(ip tcpip.Address, rl uint16, managedAddress, otherConfigurations bool, optSer header.NDPOptionsSerializer) stack.PacketBuffer {
+	return raBufWithOptsDHCPv6AndTimers(ip, rl, managedAddress, otherConfigurations, 0, 0, optSer)
+}
+
+// raBufWithOptsDHCPv6AndTimers returns a valid NDP Router Advertisement with
+// options, DHCPv6 configurations, Reachable Time and Retrans Timer specified.
+func raBufWithOptsDHCPv6AndTimers(ip tcpip.Address, rl uint16, managedAddress, otherConfigurations bool, reachableTime, retransTimer time.Duration, optSer header.NDPOptionsSerializer) stack.PacketBuffer {
 	icmpSize := header.ICMPv6HeaderSize + header.NDPRAMinimumSize + int(optSer.Length())
 	hdr := buffer.NewPrependable(header.IPv6MinimumSize + icmpSize)
 	pkt := header.ICMPv6(hdr.Prepend(icmpSize))
@@ -957,6 +1236,9 @@ func raBufWithOptsAndDHCPv6(ip tcpip.Address, rl uint16, managedAddress, otherCo
 		// (0-indexing) of the RA payload.
 		raPayload[1] |= (1 << 6)
 	}
+	// Populate the Reachable Time and Retrans Timer fields, in milliseconds.
+	binary.BigEndian.PutUint32(raPayload[4:], uint32(reachableTime/time.Millisecond))
+	binary.BigEndian.PutUint32(raPayload[8:], uint32(retransTimer/time.Millisecond))
 	opts := ra.Options()
 	opts.Serialize(optSer)
 	pkt.SetChecksum(header.ICMPv6Checksum(pkt, ip, header.IPv6AllNodesMulticastAddress, buffer.VectorisedView{}))
@@ -990,6 +1272,15 @@ func raBufWithDHCPv6(ip tcpip.Address, managedAddresses, otherConfiguratiosns bo
 	return raBufWithOptsAndDHCPv6(ip, 0, managedAddresses, otherConfiguratiosns, header.NDPOptionsSerializer{})
 }
 
+// raBufWithTimers returns a valid NDP Router Advertisement with the Reachable
+// Time and Retrans Timer fields set.
+//
+// Note, raBufWithTimers does not populate any of the RA fields other than the
+// Router Lifetime, Reachable Time and Retrans Timer.
+func raBufWithTimers(ip tcpip.Address, rl uint16, reachableTime, retransTimer time.Duration) stack.PacketBuffer {
+	return raBufWithOptsDHCPv6AndTimers(ip, rl, false, false, reachableTime, retransTimer, header.NDPOptionsSerializer{})
+}
+
 // raBuf returns a valid NDP Router Advertisement.
 //
 // Note, raBuf does not populate any of the RA fields other than the
@@ -1276,6 +1567,205 @@ func TestRouterDiscoveryMaxRouters(t *testing.T) {
 	}
 }
 
+// TestRAUpdatesRetransmitTimer tests that a non-zero Retrans Timer in a
+// received RA is used as the time between DAD NS retransmissions.
+func TestRAUpdatesRetransmitTimer(t *testing.T) {
+	const (
+		nicID                  = 1
+		dupAddrDetectTransmits = 2
+		retransTimer           = 100 * time.Millisecond
+	)
+
+	ndpDisp := ndpDispatcher{
+		dadC: make(chan ndpDADEvent, 1),
+	}
+	e := channel.New(10, 1280, linkAddr1)
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv6.NewProtocol()},
+		NDPConfigs: stack.NDPConfigurations{
+			HandleRAs: true,
+			// Much larger than the RA's Retrans Timer so that DAD would time
+			// out below if the RA's value was not adopted.
+			RetransmitTimer:        time.Minute,
+			DupAddrDetectTransmits: dupAddrDetectTransmits,
+		},
+		NDPDisp: &ndpDisp,
+	})
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _) = %s", nicID, err)
+	}
+
+	// Rx an RA with a Retrans Timer.
+	e.InjectInbound(header.IPv6ProtocolNumber, raBufWithTimers(llAddr2, 0, 0, retransTimer))
+
+	if err := s.AddAddress(nicID, header.IPv6ProtocolNumber, addr1); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s) = %s", nicID, header.IPv6ProtocolNumber, addr1, err)
+	}
+
+	// DAD should resolve after dupAddrDetectTransmits NS messages spaced
+	// retransTimer apart.
+	select {
+	case <-time.After(dupAddrDetectTransmits*retransTimer + defaultAsyncEventTimeout):
+		t.Fatal("timed out waiting for DAD resolution")
+	case e := <-ndpDisp.dadC:
+		if diff := checkDADEvent(e, nicID, addr1, true, nil); diff != "" {
+			t.Errorf("dad event mismatch (-want +got):\n%s", diff)
+		}
+	}
+	if got := s.Stats().ICMP.V6PacketsSent.NeighborSolicit.Value(); got != dupAddrDetectTransmits {
+		t.Errorf("got NeighborSolicit = %d, want = %d", got, dupAddrDetectTransmits)
+	}
+}
+
+// TestRAUpdatesResolutionRetransmitTimer tests that a non-zero Retrans Timer in
+// a received RA is used as the time between NS retransmissions for address
+// resolution.
+func TestRAUpdatesResolutionRetransmitTimer(t *testing.T) {
+	const (
+		nicID        = 1
+		retransTimer = 100 * time.Millisecond
+		// wantNS is the number of NS messages sent for an address which does
+		// not resolve.
+		wantNS = 3
+	)
+
+	e := channel.New(10, 1280, linkAddr1)
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv6.NewProtocol()},
+		NDPConfigs: stack.NDPConfigurations{
+			HandleRAs: true,
+		},
+	})
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _) = %s", nicID, err)
+	}
+
+	// Rx an RA with a Retrans Timer.
+	e.InjectInbound(header.IPv6ProtocolNumber, raBufWithTimers(llAddr2, 0, 0, retransTimer))
+
+	if _, _, err := s.GetLinkAddress(nicID, llAddr3, llAddr1, header.IPv6ProtocolNumber, nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got s.GetLinkAddress(%d, %s, %s, %d, nil) = (_, _, %v), want = (_, _, %s)", nicID, llAddr3, llAddr1, header.IPv6ProtocolNumber, err, tcpip.ErrWouldBlock)
+	}
+
+	// Each NS should be sent retransTimer after the previous one, well before
+	// the default retransmission timer of one second would expire.
+	for i := 0; i < wantNS; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), retransTimer+defaultAsyncEventTimeout/2)
+		p, ok := e.ReadContext(ctx)
+		cancel()
+		if !ok {
+			t.Fatalf("timed out waiting for NS #%d", i+1)
+		}
+		b := append(buffer.View(nil), p.Pkt.Header.View()...)
+		b = append(b, p.Pkt.Data.ToView()...)
+		checker.IPv6(t, b, checker.NDPNS(checker.NDPNSTargetAddress(llAddr3)))
+	}
+}
+
+// TestRATimersForgottenOnNICRemoval tests that the Reachable Time and Retrans
+// Timer learned from an RA do not apply to a NIC created with the ID of the NIC
+// which received the RA after it was removed.
+func TestRATimersForgottenOnNICRemoval(t *testing.T) {
+	const (
+		nicID         = 1
+		reachableTime = 100 * time.Millisecond
+		retransTimer  = 100 * time.Millisecond
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv6.NewProtocol()},
+		NDPConfigs: stack.NDPConfigurations{
+			HandleRAs: true,
+		},
+	})
+	e := channel.New(10, 1280, linkAddr1)
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _) = %s", nicID, err)
+	}
+
+	// Rx an RA with a Reachable Time and a Retrans Timer, then recreate the
+	// NIC.
+	e.InjectInbound(header.IPv6ProtocolNumber, raBufWithTimers(llAddr2, 0, reachableTime, retransTimer))
+	if err := s.RemoveNIC(nicID); err != nil {
+		t.Fatalf("RemoveNIC(%d) = %s", nicID, err)
+	}
+	e = channel.New(10, 1280, linkAddr1)
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _) = %s", nicID, err)
+	}
+
+	s.AddLinkAddress(nicID, llAddr3, linkAddr3)
+	if _, _, err := s.GetLinkAddress(nicID, llAddr4, llAddr1, header.IPv6ProtocolNumber, nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got s.GetLinkAddress(%d, %s, %s, %d, nil) = (_, _, %v), want = (_, _, %s)", nicID, llAddr4, llAddr1, header.IPv6ProtocolNumber, err, tcpip.ErrWouldBlock)
+	}
+
+	// The first NS is sent right away and the next one only after the default
+	// retransmission timer of one second.
+	ctx, cancel := context.WithTimeout(context.Background(), defaultAsyncEventTimeout)
+	defer cancel()
+	if _, ok := e.ReadContext(ctx); !ok {
+		t.Fatal("timed out waiting for the first NS")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 3*retransTimer)
+	defer cancel()
+	if p, ok := e.ReadContext(ctx); ok {
+		t.Fatalf("got unexpected packet = %+v within %s of the first NS", p, 3*retransTimer)
+	}
+
+	// More than 1.5 times the advertised Reachable Time has passed, but the
+	// entry uses the default age limit.
+	if got, _, err := s.GetLinkAddress(nicID, llAddr3, "", header.IPv6ProtocolNumber, nil); err != nil || got != linkAddr3 {
+		t.Fatalf("got s.GetLinkAddress(%d, %s, '', %d, nil) = (%s, _, %v), want = (%s, _, nil)", nicID, llAddr3, header.IPv6ProtocolNumber, got, err, linkAddr3)
+	}
+}
+
+// TestRAUpdatesReachableTime tests that a non-zero Reachable Time in a
+// received RA, with the random factor applied, determines how long neighbor
+// link addresses on the NIC it was received on are considered reachable.
+func TestRAUpdatesReachableTime(t *testing.T) {
+	const (
+		nicID1        = 1
+		nicID2        = 2
+		reachableTime = 200 * time.Millisecond
+	)
+
+	e1 := channel.New(10, 1280, linkAddr1)
+	e2 := channel.New(10, 1280, linkAddr2)
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv6.NewProtocol()},
+		NDPConfigs: stack.NDPConfigurations{
+			HandleRAs: true,
+		},
+	})
+	if err := s.CreateNIC(nicID1, e1); err != nil {
+		t.Fatalf("CreateNIC(%d, _) = %s", nicID1, err)
+	}
+	if err := s.CreateNIC(nicID2, e2); err != nil {
+		t.Fatalf("CreateNIC(%d, _) = %s", nicID2, err)
+	}
+
+	// Rx an RA with a Reachable Time on the first NIC only.
+	e1.InjectInbound(header.IPv6ProtocolNumber, raBufWithTimers(llAddr2, 0, reachableTime, 0))
+
+	for _, nicID := range []tcpip.NICID{nicID1, nicID2} {
+		s.AddLinkAddress(nicID, llAddr3, linkAddr3)
+		if got, _, err := s.GetLinkAddress(nicID, llAddr3, "", header.IPv6ProtocolNumber, nil); err != nil || got != linkAddr3 {
+			t.Fatalf("got s.GetLinkAddress(%d, %s, '', %d, nil) = (%s, _, %v), want = (%s, _, nil)", nicID, llAddr3, header.IPv6ProtocolNumber, got, err, linkAddr3)
+		}
+	}
+
+	// The entry of the first NIC should no longer be reachable after the
+	// largest possible randomized Reachable Time (1.5 times the advertised
+	// value), while the entry of the second NIC keeps the default age limit.
+	time.Sleep(reachableTime*3/2 + defaultAsyncEventTimeout)
+	if _, _, err := s.GetLinkAddress(nicID1, llAddr3, "", header.IPv6ProtocolNumber, nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got s.GetLinkAddress(%d, %s, '', %d, nil) = (_, _, %v), want = (_, _, %s)", nicID1, llAddr3, header.IPv6ProtocolNumber, err, tcpip.ErrWouldBlock)
+	}
+	if got, _, err := s.GetLinkAddress(nicID2, llAddr3, "", header.IPv6ProtocolNumber, nil); err != nil || got != linkAddr3 {
+		t.Fatalf("got s.GetLinkAddress(%d, %s, '', %d, nil) = (%s, _, %v), want = (%s, _, nil)", nicID2, llAddr3, header.IPv6ProtocolNumber, got, err, linkAddr3)
+	}
+}
+
 // TestNoPrefixDiscovery tests that prefix discovery will not be performed if
 // configured not to.
 func TestNoPrefixDiscovery(t *testing.T) {
@@ -2706,6 +3196,84 @@ func TestAutoGenAddrStaticConflict(t *testing.T) {
 	}
 }
 
+// TestAutoGenAddrMaxAddresses tests that SLAAC does not generate an address
+// for a NIC which already holds the maximum number of addresses it was
+// configured with.
+func TestAutoGenAddrMaxAddresses(t *testing.T) {
+	const (
+		nicID   = 1
+		nicName = "nic1"
+	)
+	prefix1, _, addr1 := prefixSubnetAddr(0, linkAddr1)
+	prefix2, _, addr2 := prefixSubnetAddr(1, linkAddr1)
+
+	tests := []struct {
+		name     string
+		opts     stack.NICOptions
+		setLimit func(*stack.NIC)
+	}{
+		{
+			name: "NIC limit",
+			opts: stack.NICOptions{Name: nicName, MaxAddresses: 1},
+		},
+		{
+			name: "IPv6 limit",
+			opts: stack.NICOptions{Name: nicName},
+			setLimit: func(nic *stack.NIC) {
+				nic.SetMaxAddresses(header.IPv6ProtocolNumber, 1)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ndpDisp := ndpDispatcher{
+				autoGenAddrC: make(chan ndpAutoGenAddrEvent, 1),
+			}
+			e := channel.New(0, 1280, linkAddr1)
+			s := stack.New(stack.Options{
+				NetworkProtocols: []stack.NetworkProtocol{ipv6.NewProtocol()},
+				NDPConfigs: stack.NDPConfigurations{
+					HandleRAs:              true,
+					AutoGenGlobalAddresses: true,
+				},
+				NDPDisp: &ndpDisp,
+			})
+
+			if err := s.CreateNICWithOptions(nicID, e, test.opts); err != nil {
+				t.Fatalf("CreateNICWithOptions(%d, _, %+v) = %s", nicID, test.opts, err)
+			}
+			if test.setLimit != nil {
+				nic, ok := s.GetNICByName(nicName)
+				if !ok {
+					t.Fatalf("got GetNICByName(%q) = (_, false), want = (_, true)", nicName)
+				}
+				test.setLimit(nic)
+			}
+
+			e.InjectInbound(header.IPv6ProtocolNumber, raBufWithPI(llAddr2, 0, prefix1, true, true, 100, 0))
+			select {
+			case e := <-ndpDisp.autoGenAddrC:
+				if diff := checkAutoGenAddrEvent(e, addr1, newAddr); diff != "" {
+					t.Errorf("auto-gen addr event mismatch (-want +got):\n%s", diff)
+				}
+			default:
+				t.Fatal("expected addr auto gen event")
+			}
+
+			// The NIC is full, so no address is generated for another prefix.
+			e.InjectInbound(header.IPv6ProtocolNumber, raBufWithPI(llAddr2, 0, prefix2, true, true, 100, 0))
+			select {
+			case <-ndpDisp.autoGenAddrC:
+				t.Fatal("unexpectedly auto-generated an address beyond the NIC's limit")
+			default:
+			}
+			if containsV6Addr(s.NICInfo()[nicID].ProtocolAddresses, addr2) {
+				t.Fatalf("Should not have %s in the list of addresses", addr2)
+			}
+		})
+	}
+}
+
 // TestAutoGenAddrWithOpaqueIID tests that SLAAC generated addresses will use
 // opaque interface identifiers when configured to do so.
 func TestAutoGenAddrWithOpaqueIID(t *testing.T) {
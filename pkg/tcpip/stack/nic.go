@@ -21,6 +21,7 @@ import (
 	"strings"
 	"sync/atomic"
 
+	"golang.org/x/time/rate"
 	"gvisor.dev/gvisor/pkg/sync"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
@@ -38,19 +39,90 @@ var ipv4BroadcastAddr = tcpip.ProtocolAddress{
 // NIC represents a "network interface card" to which the networking stack is
 // attached.
 type NIC struct {
-	stack   *Stack
-	id      tcpip.NICID
+	stack *Stack
+	id    tcpip.NICID
+	// name is protected by mu, as it may be changed with Stack.RenameNIC.
 	name    string
 	linkEP  LinkEndpoint
 	context NICContext
 
+	// mtu is the MTU set with SetMTU, or zero if the link endpoint's MTU is
+	// used. It is accessed atomically.
+	mtu uint32
+
+	// maxAddresses is the maximum number of permanent addresses the NIC may
+	// hold. Zero means no limit.
+	maxAddresses int
+
+	// suppressICMPReplies indicates whether the stack refrains from sending
+	// ICMP replies and errors in response to packets received by the NIC.
+	suppressICMPReplies bool
+
+	// onModeChanged, if set, is called whenever promiscuous or spoofing mode
+	// is enabled or disabled.
+	onModeChanged func(promiscuous, spoofing bool)
+
+	// tcpMSSClamp is the maximum TCP MSS advertised on routes through the
+	// NIC. Zero means no clamping.
+	tcpMSSClamp uint16
+
+	// tcpInitialCwnd is the initial TCP congestion window on routes through
+	// the NIC. Zero means the TCP default.
+	tcpInitialCwnd int
+
+	// ecn is the ECN codepoint set on the packets of TCP connections which
+	// negotiated ECN, or zero if ECN is disabled.
+	ecn uint8
+
+	// tempEPLimiter, if set, limits the rate at which temporary endpoints
+	// are created. See NICOptions.TempEndpointRateLimit.
+	tempEPLimiter *rate.Limiter
+
+	// ndpDisp, if set, receives the NDP related events of the NIC instead of
+	// the stack's NDP dispatcher.
+	ndpDisp NDPDispatcher
+
+	// acceptDirectedBroadcast is 1 if packets sent to the broadcast address of
+	// one of the NIC's address ranges are delivered locally. It is accessed
+	// atomically.
+	acceptDirectedBroadcast uint32
+
+	// directedBroadcasts holds the broadcast addresses of the NIC's address
+	// ranges as a []tcpip.Address, so that they can be looked up without
+	// taking mu. It is replaced, never modified, when the ranges change.
+	directedBroadcasts atomic.Value
+
 	stats NICStats
 
+	// drops holds the number of packets dropped by the NIC, by reason.
+	drops struct {
+		sync.Mutex
+		stats DropStats
+	}
+
+	// egressLinkAddr holds the local link address used by the most recently
+	// written outgoing packet as a tcpip.LinkAddress, so that it can be
+	// recorded without locking on the write path.
+	egressLinkAddr atomic.Value
+
+	// onAddressRemoved, if set, is called for every address endpoint removal.
+	// See NICOptions.OnAddressRemoved.
+	onAddressRemoved func(addr tcpip.Address, kind string)
+
+	// addressRemovals holds the address endpoint removals which have not been
+	// notified yet. It has its own lock as endpoints may be removed with mu only
+	// read locked.
+	addressRemovals struct {
+		sync.Mutex
+		pending []addressRemoval
+	}
+
 	mu struct {
 		sync.RWMutex
 		enabled       bool
 		spoofing      bool
 		promiscuous   bool
+		preserveTTL   bool
 		primary       map[tcpip.NetworkProtocolNumber][]*referencedNetworkEndpoint
 		endpoints     map[NetworkEndpointID]*referencedNetworkEndpoint
 		addressRanges []tcpip.Subnet
@@ -59,15 +131,87 @@ type NIC struct {
 		// values are not.
 		packetEPs map[tcpip.NetworkProtocolNumber][]PacketEndpoint
 		ndp       ndpState
+
+		// captureTap, if not nil, puts the NIC in capture mode: every
+		// received packet is handed to it and not processed any further.
+		captureTap CaptureTap
+
+		// maxProtocolAddresses holds the maximum number of permanent
+		// addresses the NIC may hold per network protocol, for the protocols
+		// with a limit.
+		maxProtocolAddresses map[tcpip.NetworkProtocolNumber]int
+
+		// arpPrimaryOnly indicates whether ARP requests are only answered for
+		// the NIC's primary IPv4 address.
+		arpPrimaryOnly bool
+
+		// classifier, if not nil, is evaluated for every received packet
+		// before it is delivered.
+		classifier Classifier
 	}
 }
 
+// CaptureTap receives the packets of a NIC in capture mode. It is called with
+// the ID of the NIC, the link addresses and network protocol of the packet as
+// given to DeliverNetworkPacket, and the packet itself, which it takes
+// ownership of.
+//
+// It is called synchronously from the link endpoint's dispatch path, so it
+// must not block.
+type CaptureTap func(nicID tcpip.NICID, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt PacketBuffer)
+
 // NICStats includes transmitted and received stats.
 type NICStats struct {
 	Tx DirectionStats
 	Rx DirectionStats
 
+	// DisabledRx counts the packets received while the NIC was disabled.
+	// Such packets are dropped and are not counted in Rx.
 	DisabledRx DirectionStats
+
+	// Delivered is the number of received packets delivered to a local
+	// network endpoint, including endpoints of other NICs.
+	Delivered *tcpip.StatCounter
+
+	// Forwarded is the number of received packets forwarded out of another
+	// NIC. Multicast packets are counted once per outgoing NIC.
+	Forwarded *tcpip.StatCounter
+
+	// Dropped is the number of packets dropped by the NIC, including packets
+	// that could not be forwarded out of it. DropStats breaks most of these
+	// down by reason.
+	Dropped *tcpip.StatCounter
+
+	// SpoofedTx counts the packets sent with a source address that is not
+	// assigned to the NIC, which requires spoofing to be enabled. Packets
+	// written with their network header included are not counted.
+	SpoofedTx DirectionStats
+
+	// TempEndpointErrors is the number of times a temporary endpoint could
+	// not be created, for an address of a packet received in promiscuous
+	// mode, sent under spoofing or in one of the NIC's address ranges.
+	TempEndpointErrors *tcpip.StatCounter
+
+	// TempEndpointsCreated is the number of temporary endpoints created.
+	TempEndpointsCreated *tcpip.StatCounter
+
+	// TempEndpointsThrottled is the number of times a temporary endpoint was
+	// not created because NICOptions.TempEndpointRateLimit was exceeded.
+	TempEndpointsThrottled *tcpip.StatCounter
+
+	// ICMP counts the ICMP messages sent and received through the NIC's
+	// routes, by type. Messages written with their network header included
+	// are not counted.
+	ICMP NICICMPStats
+}
+
+// NICICMPStats holds the number of ICMP messages of each type sent and
+// received by a NIC.
+type NICICMPStats struct {
+	V4Sent     tcpip.ICMPv4PacketStats
+	V4Received tcpip.ICMPv4PacketStats
+	V6Sent     tcpip.ICMPv6PacketStats
+	V6Received tcpip.ICMPv6PacketStats
 }
 
 func makeNICStats() NICStats {
@@ -76,12 +220,109 @@ func makeNICStats() NICStats {
 	return s
 }
 
+// countICMP counts an ICMP message of type typ, for the given network
+// protocol, in v4 or v6. Messages of unknown types are not counted.
+func countICMP(protocol tcpip.NetworkProtocolNumber, typ uint8, v4 tcpip.ICMPv4PacketStats, v6 tcpip.ICMPv6PacketStats) {
+	var c *tcpip.StatCounter
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		switch header.ICMPv4Type(typ) {
+		case header.ICMPv4Echo:
+			c = v4.Echo
+		case header.ICMPv4EchoReply:
+			c = v4.EchoReply
+		case header.ICMPv4DstUnreachable:
+			c = v4.DstUnreachable
+		case header.ICMPv4SrcQuench:
+			c = v4.SrcQuench
+		case header.ICMPv4Redirect:
+			c = v4.Redirect
+		case header.ICMPv4TimeExceeded:
+			c = v4.TimeExceeded
+		case header.ICMPv4ParamProblem:
+			c = v4.ParamProblem
+		case header.ICMPv4Timestamp:
+			c = v4.Timestamp
+		case header.ICMPv4TimestampReply:
+			c = v4.TimestampReply
+		case header.ICMPv4InfoRequest:
+			c = v4.InfoRequest
+		case header.ICMPv4InfoReply:
+			c = v4.InfoReply
+		}
+	case header.IPv6ProtocolNumber:
+		switch header.ICMPv6Type(typ) {
+		case header.ICMPv6EchoRequest:
+			c = v6.EchoRequest
+		case header.ICMPv6EchoReply:
+			c = v6.EchoReply
+		case header.ICMPv6DstUnreachable:
+			c = v6.DstUnreachable
+		case header.ICMPv6PacketTooBig:
+			c = v6.PacketTooBig
+		case header.ICMPv6TimeExceeded:
+			c = v6.TimeExceeded
+		case header.ICMPv6ParamProblem:
+			c = v6.ParamProblem
+		case header.ICMPv6RouterSolicit:
+			c = v6.RouterSolicit
+		case header.ICMPv6RouterAdvert:
+			c = v6.RouterAdvert
+		case header.ICMPv6NeighborSolicit:
+			c = v6.NeighborSolicit
+		case header.ICMPv6NeighborAdvert:
+			c = v6.NeighborAdvert
+		case header.ICMPv6RedirectMsg:
+			c = v6.RedirectMsg
+		}
+	}
+	if c != nil {
+		c.Increment()
+	}
+}
+
 // DirectionStats includes packet and byte counts.
 type DirectionStats struct {
 	Packets *tcpip.StatCounter
 	Bytes   *tcpip.StatCounter
 }
 
+// DropStats holds the number of packets dropped by a NIC, by reason.
+type DropStats struct {
+	// Disabled is the number of packets dropped because the NIC was
+	// disabled.
+	Disabled uint64
+
+	// UnknownNetworkProtocol is the number of packets dropped because their
+	// network protocol is not supported by the stack.
+	UnknownNetworkProtocol uint64
+
+	// Malformed is the number of packets dropped because they were too
+	// short to hold a network header.
+	Malformed uint64
+
+	// InvalidSource is the number of packets dropped because their source
+	// address is one of the stack's own addresses.
+	InvalidSource uint64
+
+	// InvalidDestination is the number of packets dropped because they
+	// were not destined to the stack and could not be forwarded.
+	InvalidDestination uint64
+
+	// TTLExpired is the number of forwarded packets dropped because their
+	// TTL (or hop limit) expired.
+	TTLExpired uint64
+
+	// LoopbackDestination is the number of packets dropped because they were
+	// destined to a loopback address but were received by a NIC that is not
+	// a loopback NIC.
+	LoopbackDestination uint64
+
+	// Classifier is the number of packets dropped by the NIC's classifier,
+	// or redirected by it to a NIC that does not exist.
+	Classifier uint64
+}
+
 // PrimaryEndpointBehavior is an enumeration of an endpoint's primacy behavior.
 type PrimaryEndpointBehavior int
 
@@ -102,7 +343,7 @@ const (
 )
 
 // newNIC returns a new NIC using the default NDP configurations from stack.
-func newNIC(stack *Stack, id tcpip.NICID, name string, ep LinkEndpoint, ctx NICContext) *NIC {
+func newNIC(stack *Stack, id tcpip.NICID, ep LinkEndpoint, opts NICOptions) *NIC {
 	// TODO(b/141011931): Validate a LinkEndpoint (ep) is valid. For
 	// example, make sure that the link address it provides is a valid
 	// unicast ethernet address.
@@ -112,13 +353,28 @@ func newNIC(stack *Stack, id tcpip.NICID, name string, ep LinkEndpoint, ctx NICC
 	// of IPv6 is supported on this endpoint's LinkEndpoint.
 
 	nic := &NIC{
-		stack:   stack,
-		id:      id,
-		name:    name,
-		linkEP:  ep,
-		context: ctx,
-		stats:   makeNICStats(),
+		stack:               stack,
+		id:                  id,
+		name:                opts.Name,
+		linkEP:              ep,
+		context:             opts.Context,
+		maxAddresses:        opts.MaxAddresses,
+		suppressICMPReplies: opts.SuppressICMPReplies,
+		onModeChanged:       opts.OnModeChanged,
+		tcpMSSClamp:         opts.TCPMSSClamp,
+		tcpInitialCwnd:      opts.TCPInitialCwnd,
+		ecn:                 opts.ECN,
+		ndpDisp:             opts.NDPDisp,
+		stats:               makeNICStats(),
+	}
+	if opts.TempEndpointRateLimit != 0 {
+		burst := opts.TempEndpointBurst
+		if burst < 1 {
+			burst = 1
+		}
+		nic.tempEPLimiter = rate.NewLimiter(opts.TempEndpointRateLimit, burst)
 	}
+	nic.onAddressRemoved = opts.OnAddressRemoved
 	nic.mu.primary = make(map[tcpip.NetworkProtocolNumber][]*referencedNetworkEndpoint)
 	nic.mu.endpoints = make(map[NetworkEndpointID]*referencedNetworkEndpoint)
 	nic.mu.mcastJoins = make(map[NetworkEndpointID]uint32)
@@ -145,18 +401,21 @@ func newNIC(stack *Stack, id tcpip.NICID, name string, ep LinkEndpoint, ctx NICC
 	return nic
 }
 
-// enabled returns true if n is enabled.
-func (n *NIC) enabled() bool {
+// Enabled returns true if n is enabled.
+func (n *NIC) Enabled() bool {
 	n.mu.RLock()
 	enabled := n.mu.enabled
 	n.mu.RUnlock()
 	return enabled
 }
 
-// disable disables n.
+// Disable disables n without removing it from the stack.
 //
-// It undoes the work done by enable.
-func (n *NIC) disable() *tcpip.Error {
+// It undoes the work done by Enable. While n is disabled, packets delivered
+// to it by the link endpoint are dropped and no temporary endpoints are
+// created, but its addresses and routes are kept so that traffic resumes
+// once n is enabled again.
+func (n *NIC) Disable() *tcpip.Error {
 	n.mu.RLock()
 	enabled := n.mu.enabled
 	n.mu.RUnlock()
@@ -164,15 +423,20 @@ func (n *NIC) disable() *tcpip.Error {
 		return nil
 	}
 
+	// The groups are not left, but the routers must not expect n to listen to
+	// them while it is disabled.
+	n.reportGroupLeaves()
+
 	n.mu.Lock()
 	err := n.disableLocked()
 	n.mu.Unlock()
+	n.flushAddressRemovals()
 	return err
 }
 
 // disableLocked disables n.
 //
-// It undoes the work done by enable.
+// It undoes the work done by Enable.
 //
 // n MUST be locked.
 func (n *NIC) disableLocked() *tcpip.Error {
@@ -214,13 +478,13 @@ func (n *NIC) disableLocked() *tcpip.Error {
 	return nil
 }
 
-// enable enables n.
+// Enable enables n.
 //
-// If the stack has IPv6 enabled, enable will join the IPv6 All-Nodes Multicast
+// If the stack has IPv6 enabled, Enable will join the IPv6 All-Nodes Multicast
 // address (ff02::1), start DAD for permanent addresses, and start soliciting
 // routers if the stack is not operating as a router. If the stack is also
 // configured to auto-generate a link-local address, one will be generated.
-func (n *NIC) enable() *tcpip.Error {
+func (n *NIC) Enable() *tcpip.Error {
 	n.mu.RLock()
 	enabled := n.mu.enabled
 	n.mu.RUnlock()
@@ -310,7 +574,12 @@ func (n *NIC) enable() *tcpip.Error {
 // remove detaches NIC from the link endpoint, and marks existing referenced
 // network endpoints expired. This guarantees no packets between this NIC and
 // the network stack.
-func (n *NIC) remove() *tcpip.Error {
+//
+// The address endpoint removals it causes are returned so that the caller may
+// notify them with notifyAddressRemovals once it no longer holds any lock.
+func (n *NIC) remove() ([]addressRemoval, *tcpip.Error) {
+	n.reportGroupLeaves()
+
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
@@ -321,10 +590,8 @@ func (n *NIC) remove() *tcpip.Error {
 	var err *tcpip.Error
 
 	// Forcefully leave multicast groups.
-	for nid := range n.mu.mcastJoins {
-		if tempErr := n.leaveGroupLocked(nid.LocalAddress, true /* force */); tempErr != nil && err == nil {
-			err = tempErr
-		}
+	if tempErr := n.leaveAllGroupsLocked(); tempErr != nil {
+		err = tempErr
 	}
 
 	// Remove permanent and permanentTentative addresses, so no packet goes out.
@@ -340,14 +607,16 @@ func (n *NIC) remove() *tcpip.Error {
 	// Detach from link endpoint, so no packet comes in.
 	n.linkEP.Attach(nil)
 
-	return err
+	return n.takeAddressRemovals(), err
 }
 
 // becomeIPv6Router transitions n into an IPv6 router.
 //
 // When transitioning into an IPv6 router, host-only state (NDP discovered
 // routers, discovered on-link prefixes, and auto-generated addresses) will
-// be cleaned up/invalidated and NDP router solicitations will be stopped.
+// be cleaned up/invalidated and NDP router solicitations will be stopped. The
+// removals of the auto-generated addresses are left for the caller to notify
+// with flushAddressRemovals once it no longer holds any lock.
 func (n *NIC) becomeIPv6Router() {
 	n.mu.Lock()
 	defer n.mu.Unlock()
@@ -370,11 +639,61 @@ func (n *NIC) becomeIPv6Host() {
 // setPromiscuousMode enables or disables promiscuous mode.
 func (n *NIC) setPromiscuousMode(enable bool) {
 	n.mu.Lock()
+	changed := n.mu.promiscuous != enable
 	n.mu.promiscuous = enable
+	spoofing := n.mu.spoofing
+	n.mu.Unlock()
+
+	if changed && n.onModeChanged != nil {
+		n.onModeChanged(enable, spoofing)
+	}
+}
+
+// setARPPrimaryOnly sets whether n only answers ARP requests for its primary
+// IPv4 address.
+func (n *NIC) setARPPrimaryOnly(enable bool) {
+	n.mu.Lock()
+	n.mu.arpPrimaryOnly = enable
 	n.mu.Unlock()
 }
 
-func (n *NIC) isPromiscuousMode() bool {
+// answersARP returns true if n answers ARP requests for addr, one of its IPv4
+// addresses.
+func (n *NIC) answersARP(addr tcpip.Address) bool {
+	n.mu.RLock()
+	primaryOnly := n.mu.arpPrimaryOnly
+	n.mu.RUnlock()
+
+	return !primaryOnly || n.primaryAddress(header.IPv4ProtocolNumber).Address == addr
+}
+
+// ndpDispatcher returns the dispatcher the NDP related events of n are sent
+// to: n's own dispatcher if it has one, or the stack's. It may return nil.
+func (n *NIC) ndpDispatcher() NDPDispatcher {
+	if n.ndpDisp != nil {
+		return n.ndpDisp
+	}
+	return n.stack.ndpDisp
+}
+
+// setClassifier attaches c to n's input, or detaches n's classifier if c is
+// nil.
+func (n *NIC) setClassifier(c Classifier) {
+	n.mu.Lock()
+	n.mu.classifier = c
+	n.mu.Unlock()
+}
+
+// setCaptureTap puts n in capture mode, handing every packet it receives to
+// tap, or takes it out of capture mode if tap is nil.
+func (n *NIC) setCaptureTap(tap CaptureTap) {
+	n.mu.Lock()
+	n.mu.captureTap = tap
+	n.mu.Unlock()
+}
+
+// Promiscuous returns true if n is in promiscuous mode.
+func (n *NIC) Promiscuous() bool {
 	n.mu.RLock()
 	rv := n.mu.promiscuous
 	n.mu.RUnlock()
@@ -385,13 +704,152 @@ func (n *NIC) isLoopback() bool {
 	return n.linkEP.Capabilities()&CapabilityLoopback != 0
 }
 
+// isLoopbackAddress returns true if addr is a loopback address of the network
+// protocol identified by protocol.
+func isLoopbackAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		return header.IsV4LoopbackAddress(addr)
+	case header.IPv6ProtocolNumber:
+		return addr == header.IPv6Loopback
+	default:
+		return false
+	}
+}
+
 // setSpoofing enables or disables address spoofing.
 func (n *NIC) setSpoofing(enable bool) {
 	n.mu.Lock()
+	changed := n.mu.spoofing != enable
 	n.mu.spoofing = enable
+	promiscuous := n.mu.promiscuous
+	n.mu.Unlock()
+
+	if changed && n.onModeChanged != nil {
+		n.onModeChanged(promiscuous, enable)
+	}
+}
+
+// Spoofing returns true if n allows address spoofing.
+func (n *NIC) Spoofing() bool {
+	n.mu.RLock()
+	rv := n.mu.spoofing
+	n.mu.RUnlock()
+	return rv
+}
+
+// setPreserveTTL enables or disables preserving the TTL (or hop limit) of
+// packets forwarded out of n.
+func (n *NIC) setPreserveTTL(enable bool) {
+	n.mu.Lock()
+	n.mu.preserveTTL = enable
 	n.mu.Unlock()
 }
 
+// isPreserveTTL returns true if n preserves the TTL (or hop limit) of packets
+// forwarded out of it.
+func (n *NIC) isPreserveTTL() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.mu.preserveTTL
+}
+
+// setAcceptDirectedBroadcast enables or disables the local delivery of packets
+// sent to the broadcast address of one of n's address ranges.
+func (n *NIC) setAcceptDirectedBroadcast(enable bool) {
+	var v uint32
+	if enable {
+		v = 1
+	}
+	atomic.StoreUint32(&n.acceptDirectedBroadcast, v)
+}
+
+// updateDirectedBroadcastsLocked updates the broadcast addresses looked up by
+// isDirectedBroadcast after n's address ranges changed.
+//
+// n.mu must be locked.
+func (n *NIC) updateDirectedBroadcastsLocked() {
+	var addrs []tcpip.Address
+	for _, sn := range n.mu.addressRanges {
+		if bcast := sn.Broadcast(); len(bcast) == header.IPv4AddressSize && bcast != header.IPv4Broadcast {
+			addrs = append(addrs, bcast)
+		}
+	}
+	n.directedBroadcasts.Store(addrs)
+}
+
+// isDirectedBroadcast returns true if addr is the broadcast address of one of
+// n's IPv4 address ranges and n accepts directed broadcasts.
+//
+// It is called for every packet that is not addressed to n, so it doesn't take
+// n.mu.
+func (n *NIC) isDirectedBroadcast(addr tcpip.Address) bool {
+	if atomic.LoadUint32(&n.acceptDirectedBroadcast) == 0 || len(addr) != header.IPv4AddressSize {
+		return false
+	}
+	addrs, _ := n.directedBroadcasts.Load().([]tcpip.Address)
+	for _, bcast := range addrs {
+		if addr == bcast {
+			return true
+		}
+	}
+	return false
+}
+
+// directedBroadcastRef returns a reference to n's IPv4 broadcast endpoint if
+// dst is a directed broadcast address accepted by n, along with the unicast
+// address replies to packets sent to dst are sent from. Packets sent to dst are
+// handled by that endpoint, with their original destination kept as the local
+// address of the route they are delivered on.
+//
+// As per RFC 1122 section 3.2.1.3, a broadcast address must never be used as a
+// source address, so directed broadcasts are only accepted while n has a
+// unicast IPv4 address, preferably within the address range of dst.
+func (n *NIC) directedBroadcastRef(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address) (*referencedNetworkEndpoint, tcpip.Address) {
+	if protocol != header.IPv4ProtocolNumber || !n.isDirectedBroadcast(dst) {
+		return nil, ""
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var unicast tcpip.Address
+	for _, r := range n.mu.primary[header.IPv4ProtocolNumber] {
+		if r.getKind() != permanent {
+			continue
+		}
+		addr := r.ep.ID().LocalAddress
+		if unicast == "" {
+			unicast = addr
+		}
+		if inRangeOfBroadcast(n.mu.addressRanges, addr, dst) {
+			unicast = addr
+			break
+		}
+	}
+	if unicast == "" {
+		return nil, ""
+	}
+
+	ref, ok := n.mu.endpoints[NetworkEndpointID{header.IPv4Broadcast}]
+	if !ok || !ref.tryIncRef() {
+		return nil, ""
+	}
+	return ref, unicast
+}
+
+// inRangeOfBroadcast returns true if addr is within one of the address ranges
+// whose broadcast address is bcast.
+func inRangeOfBroadcast(ranges []tcpip.Subnet, addr, bcast tcpip.Address) bool {
+	for _, sn := range ranges {
+		if sn.Broadcast() == bcast && sn.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // primaryEndpoint will return the first non-deprecated endpoint if such an
 // endpoint exists for the given protocol and remoteAddr. If no non-deprecated
 // endpoint exists, the first deprecated endpoint will be returned.
@@ -617,17 +1075,20 @@ func (n *NIC) getRefOrCreateTemp(protocol tcpip.NetworkProtocolNumber, address t
 	}
 
 	// A usable reference was not found, create a temporary one if requested by
-	// the caller or if the address is found in the NIC's subnets.
-	createTempEP := spoofingOrPromiscuous
-	if !createTempEP {
+	// the caller or if the address is found in the NIC's subnets. A disabled NIC
+	// never creates temporary endpoints.
+	createTempEP := spoofingOrPromiscuous && n.mu.enabled
+	if !createTempEP && n.mu.enabled {
 		for _, sn := range n.mu.addressRanges {
 			// Skip the subnet address.
 			if address == sn.ID() {
 				continue
 			}
-			// For now just skip the broadcast address, until we support it.
-			// FIXME(b/137608825): Add support for sending/receiving directed
-			// (subnet) broadcast.
+			// Skip the broadcast address. Directed broadcast packets are
+			// received by the NIC's IPv4 broadcast endpoint, see
+			// directedBroadcastRef.
+			// FIXME(b/137608825): Add support for sending directed (subnet)
+			// broadcast.
 			if address == sn.Broadcast() {
 				continue
 			}
@@ -640,6 +1101,13 @@ func (n *NIC) getRefOrCreateTemp(protocol tcpip.NetworkProtocolNumber, address t
 
 	n.mu.RUnlock()
 
+	// Under the weak host model, incoming packets are also accepted for the
+	// addresses of other NICs. They are handled by a temporary endpoint of n,
+	// so that replies to them are sent through n.
+	if !createTempEP && tempRef == promiscuous && n.stack.isWeakHostAddress(n, protocol, address) {
+		createTempEP = true
+	}
+
 	if !createTempEP {
 		return nil
 	}
@@ -665,9 +1133,15 @@ func (n *NIC) getRefOrCreateTemp(protocol tcpip.NetworkProtocolNumber, address t
 	netProto, ok := n.stack.networkProtocols[protocol]
 	if !ok {
 		n.mu.Unlock()
+		n.tempEndpointFailed(protocol, address, tcpip.ErrUnknownProtocol)
 		return nil
 	}
-	ref, _ := n.addAddressLocked(tcpip.ProtocolAddress{
+	if n.tempEPLimiter != nil && !n.tempEPLimiter.Allow() {
+		n.mu.Unlock()
+		n.stats.TempEndpointsThrottled.Increment()
+		return nil
+	}
+	ref, err := n.addAddressLocked(tcpip.ProtocolAddress{
 		Protocol: protocol,
 		AddressWithPrefix: tcpip.AddressWithPrefix{
 			Address:   address,
@@ -676,17 +1150,43 @@ func (n *NIC) getRefOrCreateTemp(protocol tcpip.NetworkProtocolNumber, address t
 	}, peb, temporary, static, false)
 
 	n.mu.Unlock()
+	if err != nil {
+		n.tempEndpointFailed(protocol, address, err)
+		return nil
+	}
+	n.stats.TempEndpointsCreated.Increment()
 	return ref
 }
 
+// tempEndpointFailed records the failure to create a temporary endpoint for
+// address and reports it to the stack's TempEndpointErrorHandler, if any.
+//
+// n.mu must not be held.
+func (n *NIC) tempEndpointFailed(protocol tcpip.NetworkProtocolNumber, address tcpip.Address, err *tcpip.Error) {
+	n.stats.TempEndpointErrors.Increment()
+	if h := n.stack.tempEndpointErrorHandler; h != nil {
+		h(n.id, protocol, address, err)
+	}
+}
+
 // addAddressLocked adds a new protocolAddress to n.
 //
 // If n already has the address in a non-permanent state, and the kind given is
 // permanent, that address will be promoted in place and its properties set to
 // the properties provided. Otherwise, it returns tcpip.ErrDuplicateAddress.
+//
+// Returns tcpip.ErrNoBufferSpace if a permanent address is added while n
+// already holds the maximum number of permanent addresses it was configured
+// with.
 func (n *NIC) addAddressLocked(protocolAddress tcpip.ProtocolAddress, peb PrimaryEndpointBehavior, kind networkEndpointKind, configType networkEndpointConfigType, deprecated bool) (*referencedNetworkEndpoint, *tcpip.Error) {
 	// TODO(b/141022673): Validate IP addresses before adding them.
 
+	if kind == permanent {
+		if err := n.checkMaxAddressesLocked(protocolAddress); err != nil {
+			return nil, err
+		}
+	}
+
 	// Sanity check.
 	id := NetworkEndpointID{LocalAddress: protocolAddress.AddressWithPrefix.Address}
 	if ref, ok := n.mu.endpoints[id]; ok {
@@ -744,7 +1244,7 @@ func (n *NIC) addAddressLocked(protocolAddress tcpip.ProtocolAddress, peb Primar
 	}
 
 	// Create the new network endpoint.
-	ep, err := netProto.NewEndpoint(n.id, protocolAddress.AddressWithPrefix, n.stack, n, n.linkEP, n.stack)
+	ep, err := netProto.NewEndpoint(n.id, protocolAddress.AddressWithPrefix, n.stack, n, &mtuLinkEndpoint{LinkEndpoint: n.linkEP, nic: n}, n.stack)
 	if err != nil {
 		return nil, err
 	}
@@ -801,37 +1301,198 @@ func (n *NIC) addAddressLocked(protocolAddress tcpip.ProtocolAddress, peb Primar
 
 // AddAddress adds a new address to n, so that it starts accepting packets
 // targeted at the given address (and network protocol).
+//
+// Returns tcpip.ErrNoBufferSpace if n already holds the maximum number of
+// permanent addresses it was configured with.
 func (n *NIC) AddAddress(protocolAddress tcpip.ProtocolAddress, peb PrimaryEndpointBehavior) *tcpip.Error {
-	// Add the endpoint.
+	return n.addAddress(protocolAddress, peb, false /* deprecated */)
+}
+
+// AddDeprecatedAddress is like AddAddress, but the address is added in the
+// deprecated state. A deprecated address keeps accepting packets but is only
+// used as the source address of new outgoing traffic when no preferred
+// address is available.
+func (n *NIC) AddDeprecatedAddress(protocolAddress tcpip.ProtocolAddress, peb PrimaryEndpointBehavior) *tcpip.Error {
+	return n.addAddress(protocolAddress, peb, true /* deprecated */)
+}
+
+func (n *NIC) addAddress(protocolAddress tcpip.ProtocolAddress, peb PrimaryEndpointBehavior, deprecated bool) *tcpip.Error {
 	n.mu.Lock()
-	_, err := n.addAddressLocked(protocolAddress, peb, permanent, static, false /* deprecated */)
-	n.mu.Unlock()
+	defer n.mu.Unlock()
 
+	// Add the endpoint.
+	_, err := n.addAddressLocked(protocolAddress, peb, permanent, static, deprecated)
 	return err
 }
 
+// checkMaxAddressesLocked returns tcpip.ErrNoBufferSpace if adding
+// protocolAddress as a permanent address would take n beyond its limit of
+// permanent addresses, or beyond its limit of permanent addresses of the
+// protocol of protocolAddress.
+//
+// Precondition: n.mu must be read locked.
+func (n *NIC) checkMaxAddressesLocked(protocolAddress tcpip.ProtocolAddress) *tcpip.Error {
+	addr := protocolAddress.AddressWithPrefix.Address
+	if !countsTowardsMaxAddresses(addr) || n.hasPermanentAddrLocked(addr) {
+		return nil
+	}
+	if n.maxAddresses > 0 && n.numPermanentAddressesLocked() >= n.maxAddresses {
+		return tcpip.ErrNoBufferSpace
+	}
+	if max, ok := n.mu.maxProtocolAddresses[protocolAddress.Protocol]; ok && n.numProtocolPermanentAddressesLocked(protocolAddress.Protocol) >= max {
+		return tcpip.ErrNoBufferSpace
+	}
+	return nil
+}
+
+// countsTowardsMaxAddresses returns true if addr counts towards a NIC's limit
+// of permanent addresses. Multicast group memberships and the IPv4 broadcast
+// address are exempt.
+func countsTowardsMaxAddresses(addr tcpip.Address) bool {
+	return addr != header.IPv4Broadcast && !header.IsV4MulticastAddress(addr) && !header.IsV6MulticastAddress(addr)
+}
+
+// numPermanentAddressesLocked returns the number of permanent addresses
+// counting towards n's limit of permanent addresses.
+//
+// Precondition: n.mu must be read locked.
+func (n *NIC) numPermanentAddressesLocked() int {
+	count := 0
+	for nid, ref := range n.mu.endpoints {
+		switch ref.getKind() {
+		case permanent, permanentTentative:
+			if countsTowardsMaxAddresses(nid.LocalAddress) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// numProtocolPermanentAddressesLocked is like numPermanentAddressesLocked but
+// only counts the addresses of the given protocol.
+//
+// Precondition: n.mu must be read locked.
+func (n *NIC) numProtocolPermanentAddressesLocked(protocol tcpip.NetworkProtocolNumber) int {
+	count := 0
+	for nid, ref := range n.mu.endpoints {
+		if ref.protocol != protocol {
+			continue
+		}
+		switch ref.getKind() {
+		case permanent, permanentTentative:
+			if countsTowardsMaxAddresses(nid.LocalAddress) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// SetMaxAddresses limits the number of permanent addresses of the given
+// protocol n may hold to max, in addition to the limit set with
+// NICOptions.MaxAddresses. Adding an address beyond the limit fails with
+// tcpip.ErrNoBufferSpace; addresses already held are kept. Temporary
+// addresses, multicast group memberships and the IPv4 broadcast address are
+// not counted. A max of zero or less removes the limit, which is the default.
+func (n *NIC) SetMaxAddresses(protocol tcpip.NetworkProtocolNumber, max int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if max <= 0 {
+		delete(n.mu.maxProtocolAddresses, protocol)
+		return
+	}
+	if n.mu.maxProtocolAddresses == nil {
+		n.mu.maxProtocolAddresses = make(map[tcpip.NetworkProtocolNumber]int)
+	}
+	n.mu.maxProtocolAddresses[protocol] = max
+}
+
 // AllAddresses returns all addresses (primary and non-primary) associated with
-// this NIC.
+// this NIC, including tentative ones.
 func (n *NIC) AllAddresses() []tcpip.ProtocolAddress {
+	n.mu.RLock()
+	addrs := make([]tcpip.ProtocolAddress, 0, len(n.mu.endpoints))
+	n.mu.RUnlock()
+
+	n.forEachAddress(true /* includeTentative */, func(addr tcpip.ProtocolAddress) bool {
+		addrs = append(addrs, addr)
+		return true
+	})
+	return addrs
+}
+
+// ForEachAddress calls f for each of n's permanent addresses, in no particular
+// order, until f returns false. Tentative addresses are skipped. Unlike
+// AllAddresses, it does not allocate, so it suits callers which poll n's
+// addresses frequently.
+//
+// f is called with n's lock held for reading, so it must not modify n.
+func (n *NIC) ForEachAddress(f func(tcpip.ProtocolAddress) bool) {
+	n.forEachAddress(false /* includeTentative */, f)
+}
+
+// forEachAddress calls f for each of n's permanent addresses, including the
+// tentative ones if includeTentative is true, until f returns false.
+func (n *NIC) forEachAddress(includeTentative bool, f func(tcpip.ProtocolAddress) bool) {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 
-	addrs := make([]tcpip.ProtocolAddress, 0, len(n.mu.endpoints))
 	for nid, ref := range n.mu.endpoints {
-		// Don't include tentative, expired or temporary endpoints to
-		// avoid confusion and prevent the caller from using those.
+		// Don't include expired or temporary endpoints to avoid confusion and
+		// prevent the caller from using those.
 		switch ref.getKind() {
 		case permanentExpired, temporary:
 			continue
+		case permanentTentative:
+			if !includeTentative {
+				continue
+			}
 		}
 
-		addrs = append(addrs, tcpip.ProtocolAddress{
+		if !f(tcpip.ProtocolAddress{
 			Protocol: ref.protocol,
 			AddressWithPrefix: tcpip.AddressWithPrefix{
 				Address:   nid.LocalAddress,
 				PrefixLen: ref.ep.PrefixLen(),
 			},
-		})
+		}) {
+			return
+		}
+	}
+}
+
+// AddressKindCounts returns the number of n's endpoints of each kind, keyed by
+// "permanent", "tentative", "expired" and "temporary".
+func (n *NIC) AddressKindCounts() map[string]int {
+	counts := map[string]int{
+		permanent.String():          0,
+		permanentTentative.String(): 0,
+		permanentExpired.String():   0,
+		temporary.String():          0,
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, ref := range n.mu.endpoints {
+		counts[ref.getKind().String()]++
+	}
+	return counts
+}
+
+// TentativeAddresses returns the addresses associated with this NIC that are
+// still tentative (DAD is being performed on them).
+func (n *NIC) TentativeAddresses() []tcpip.Address {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var addrs []tcpip.Address
+	for nid, ref := range n.mu.endpoints {
+		if ref.getKind() == permanentTentative {
+			addrs = append(addrs, nid.LocalAddress)
+		}
 	}
 	return addrs
 }
@@ -864,6 +1525,34 @@ func (n *NIC) PrimaryAddresses() []tcpip.ProtocolAddress {
 	return addrs
 }
 
+// PrimaryAddressesFor returns the primary addresses of the given protocol
+// associated with this NIC, in the order primary endpoints are considered
+// in: addresses added with FirstPrimaryEndpoint first, most recent first,
+// then addresses added with CanBePrimaryEndpoint in the order they were
+// added. Addresses added with NeverPrimaryEndpoint are never included, nor
+// are tentative, expired or temporary ones.
+//
+// It lets source address selection be implemented, or debugged, outside of
+// the stack.
+func (n *NIC) PrimaryAddressesFor(protocol tcpip.NetworkProtocolNumber) []tcpip.AddressWithPrefix {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var addrs []tcpip.AddressWithPrefix
+	for _, ref := range n.mu.primary[protocol] {
+		switch ref.getKind() {
+		case permanentTentative, permanentExpired, temporary:
+			continue
+		}
+
+		addrs = append(addrs, tcpip.AddressWithPrefix{
+			Address:   ref.ep.ID().LocalAddress,
+			PrefixLen: ref.ep.PrefixLen(),
+		})
+	}
+	return addrs
+}
+
 // primaryAddress returns the primary address associated with this NIC.
 //
 // primaryAddress will return the first non-deprecated address if such an
@@ -909,14 +1598,34 @@ func (n *NIC) primaryAddress(proto tcpip.NetworkProtocolNumber) tcpip.AddressWit
 	return tcpip.AddressWithPrefix{}
 }
 
-// AddAddressRange adds a range of addresses to n, so that it starts accepting
-// packets targeted at the given addresses and network protocol. The range is
-// given by a subnet address, and all addresses contained in the subnet are
-// used except for the subnet address itself and the subnet's broadcast
-// address.
+// PrimaryAddress returns the address n would use as the source address for
+// packets of the given network protocol when no destination is taken into
+// account. It follows the same rules as GetMainNICAddress and does not hold a
+// reference to the returned address.
+//
+// Returns tcpip.ErrUnknownProtocol if the stack does not support proto, or
+// tcpip.ErrBadLocalAddress if n has no address that can be used.
+func (n *NIC) PrimaryAddress(proto tcpip.NetworkProtocolNumber) (tcpip.AddressWithPrefix, *tcpip.Error) {
+	if _, ok := n.stack.networkProtocols[proto]; !ok {
+		return tcpip.AddressWithPrefix{}, tcpip.ErrUnknownProtocol
+	}
+
+	addr := n.primaryAddress(proto)
+	if addr.Address == "" {
+		return tcpip.AddressWithPrefix{}, tcpip.ErrBadLocalAddress
+	}
+	return addr, nil
+}
+
+// AddAddressRange adds a range of addresses to n, so that it starts accepting
+// packets targeted at the given addresses and network protocol. The range is
+// given by a subnet address, and all addresses contained in the subnet are
+// used except for the subnet address itself and the subnet's broadcast
+// address.
 func (n *NIC) AddAddressRange(protocol tcpip.NetworkProtocolNumber, subnet tcpip.Subnet) {
 	n.mu.Lock()
 	n.mu.addressRanges = append(n.mu.addressRanges, subnet)
+	n.updateDirectedBroadcastsLocked()
 	n.mu.Unlock()
 }
 
@@ -932,10 +1641,24 @@ func (n *NIC) RemoveAddressRange(subnet tcpip.Subnet) {
 		}
 	}
 	n.mu.addressRanges = tmp
+	n.updateDirectedBroadcastsLocked()
 
 	n.mu.Unlock()
 }
 
+// HasAddressRange returns true if subnet has been added to n as an address
+// range with AddAddressRange.
+func (n *NIC) HasAddressRange(subnet tcpip.Subnet) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, sub := range n.mu.addressRanges {
+		if sub == subnet {
+			return true
+		}
+	}
+	return false
+}
+
 // AddressRanges returns the Subnets associated with this NIC.
 func (n *NIC) AddressRanges() []tcpip.Subnet {
 	n.mu.RLock()
@@ -993,12 +1716,22 @@ func (n *NIC) removeEndpointLocked(r *referencedNetworkEndpoint) {
 	}
 
 	r.ep.Close()
+
+	kind := r.getKind()
+	if kind == permanentExpired {
+		kind = r.expiredFrom
+	}
+	n.queueAddressRemoval(id.LocalAddress, kind)
 }
 
 func (n *NIC) removeEndpoint(r *referencedNetworkEndpoint) {
 	n.mu.Lock()
 	n.removeEndpointLocked(r)
 	n.mu.Unlock()
+
+	// The endpoint may also have been removed by whoever held the lock, for it
+	// to be replaced; notify that removal as well.
+	n.flushAddressRemovals()
 }
 
 func (n *NIC) removePermanentAddressLocked(addr tcpip.Address) *tcpip.Error {
@@ -1021,6 +1754,56 @@ func (n *NIC) removePermanentAddressLocked(addr tcpip.Address) *tcpip.Error {
 	}
 }
 
+// RemoveAllAddresses removes all of n's permanent unicast addresses, except
+// for the auto-generated IPv6 link-local address. Multicast group memberships
+// and the IPv4 broadcast address are preserved as well, unless all is true in
+// which case they are removed too.
+//
+// The removal of every address is attempted; the first error encountered, if
+// any, is returned.
+func (n *NIC) RemoveAllAddresses(all bool) *tcpip.Error {
+	if all {
+		n.reportGroupLeaves()
+	}
+
+	// Deferred before n is locked so that the removals are notified once n is
+	// unlocked.
+	defer n.flushAddressRemovals()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var err *tcpip.Error
+	if all {
+		err = n.leaveAllGroupsLocked()
+	}
+
+	for nid, ref := range n.mu.endpoints {
+		switch ref.getKind() {
+		case permanent, permanentTentative:
+		default:
+			continue
+		}
+
+		if !all {
+			if _, ok := n.mu.mcastJoins[nid]; ok {
+				continue
+			}
+			if nid.LocalAddress == header.IPv4Broadcast {
+				continue
+			}
+			if ref.configType == slaac && header.IsV6LinkLocalAddress(nid.LocalAddress) {
+				continue
+			}
+		}
+
+		if tempErr := n.removePermanentAddressLocked(nid.LocalAddress); tempErr != nil && err == nil {
+			err = tempErr
+		}
+	}
+	return err
+}
+
 func (n *NIC) removePermanentIPv6EndpointLocked(r *referencedNetworkEndpoint, allowSLAACPrefixInvalidation bool) *tcpip.Error {
 	addr := r.addrWithPrefix()
 
@@ -1058,8 +1841,10 @@ func (n *NIC) removePermanentIPv6EndpointLocked(r *referencedNetworkEndpoint, al
 // RemoveAddress removes an address from n.
 func (n *NIC) RemoveAddress(addr tcpip.Address) *tcpip.Error {
 	n.mu.Lock()
-	defer n.mu.Unlock()
-	return n.removePermanentAddressLocked(addr)
+	err := n.removePermanentAddressLocked(addr)
+	n.mu.Unlock()
+	n.flushAddressRemovals()
+	return err
 }
 
 // joinGroup adds a new endpoint for the given multicast address, if none
@@ -1105,9 +1890,10 @@ func (n *NIC) joinGroupLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.A
 // reaches zero removes the endpoint for this address.
 func (n *NIC) leaveGroup(addr tcpip.Address) *tcpip.Error {
 	n.mu.Lock()
-	defer n.mu.Unlock()
-
-	return n.leaveGroupLocked(addr, false /* force */)
+	err := n.leaveGroupLocked(addr, false /* force */)
+	n.mu.Unlock()
+	n.flushAddressRemovals()
+	return err
 }
 
 // leaveGroupLocked decrements the count for the given multicast address, and
@@ -1135,6 +1921,103 @@ func (n *NIC) leaveGroupLocked(addr tcpip.Address, force bool) *tcpip.Error {
 	return nil
 }
 
+// leaveAllGroupsLocked forcefully leaves all the multicast groups n joined,
+// including the IPv6 all-nodes multicast group joined when n was enabled. It
+// returns the first error encountered, if any, but always leaves all the
+// groups. n MUST be locked before leaveAllGroupsLocked is called.
+//
+// No packet can be sent while n is locked, so the reports that the groups were
+// left must be sent beforehand with reportGroupLeaves.
+func (n *NIC) leaveAllGroupsLocked() *tcpip.Error {
+	var err *tcpip.Error
+	for nid := range n.mu.mcastJoins {
+		// The group's endpoint may already have been removed; it is left all the
+		// same.
+		if tempErr := n.leaveGroupLocked(nid.LocalAddress, true /* force */); tempErr != nil && tempErr != tcpip.ErrBadLocalAddress && err == nil {
+			err = tempErr
+		}
+	}
+	return err
+}
+
+// reportGroupLeaves reports to the multicast routers of n's link that n left
+// all the multicast groups it joined, through the network protocols which can
+// report it. No report is sent for the all-systems and all-nodes groups, as per
+// RFC 2236 section 3 and RFC 2710 section 5, nor while n is disabled.
+//
+// n MUST NOT be locked, as the reports are sent through n.
+func (n *NIC) reportGroupLeaves() {
+	n.mu.RLock()
+	if !n.mu.enabled {
+		n.mu.RUnlock()
+		return
+	}
+	var refs []*referencedNetworkEndpoint
+	srcs := make(map[tcpip.NetworkProtocolNumber]tcpip.Address)
+	for id := range n.mu.mcastJoins {
+		ref, ok := n.mu.endpoints[id]
+		if !ok {
+			continue
+		}
+		if _, ok := n.stack.networkProtocols[ref.protocol].(GroupLeaveReporter); !ok {
+			continue
+		}
+		if group := id.LocalAddress; group == header.IPv4AllSystems || group == header.IPv6AllNodesMulticastAddress {
+			continue
+		}
+		if !ref.tryIncRef() {
+			continue
+		}
+		refs = append(refs, ref)
+		if _, ok := srcs[ref.protocol]; !ok {
+			srcs[ref.protocol] = n.groupReportSourceRLocked(ref.protocol)
+		}
+	}
+	n.mu.RUnlock()
+
+	for _, ref := range refs {
+		var dst tcpip.Address
+		var dstLinkAddr tcpip.LinkAddress
+		switch ref.protocol {
+		case header.IPv4ProtocolNumber:
+			dst = header.IPv4AllRoutersGroup
+			dstLinkAddr = header.EthernetAddressFromMulticastIPv4Address(dst)
+		case header.IPv6ProtocolNumber:
+			dst = header.IPv6AllRoutersMulticastAddress
+			dstLinkAddr = header.EthernetAddressFromMulticastIPv6Address(dst)
+		default:
+			ref.decRef()
+			continue
+		}
+		r := makeRoute(ref.protocol, srcs[ref.protocol], dst, n.linkEP.LinkAddress(), ref, false /* handleLocal */, false /* multicastLoop */)
+		r.RemoteLinkAddress = dstLinkAddr
+		n.stack.networkProtocols[ref.protocol].(GroupLeaveReporter).ReportGroupLeave(&r, ref.ep.ID().LocalAddress)
+		r.Release()
+	}
+}
+
+// groupReportSourceRLocked returns the address the reports of n's multicast
+// group memberships for protocol are sent from. As per RFC 2236 section 3,
+// IGMP reports are sent from an IPv4 address of n. As per RFC 2710 section 3
+// and RFC 3590 section 4, MLD reports are sent from a link-local address of n,
+// or from the unspecified address if n has none.
+//
+// n MUST be read locked.
+func (n *NIC) groupReportSourceRLocked(protocol tcpip.NetworkProtocolNumber) tcpip.Address {
+	for _, r := range n.mu.primary[protocol] {
+		if r.getKind() != permanent {
+			continue
+		}
+		if addr := r.ep.ID().LocalAddress; protocol != header.IPv6ProtocolNumber || header.IsV6LinkLocalAddress(addr) {
+			return addr
+		}
+	}
+	if protocol == header.IPv6ProtocolNumber {
+		return header.IPv6Any
+	}
+	return header.IPv4Any
+}
+
 // isInGroup returns true if n has joined the multicast group addr.
 func (n *NIC) isInGroup(addr tcpip.Address) bool {
 	n.mu.RLock()
@@ -1159,6 +2042,12 @@ func handlePacket(protocol tcpip.NetworkProtocolNumber, dst, src tcpip.Address,
 // This rule applies only to the slice itself, not to the items of the slice;
 // the ownership of the items is not retained by the caller.
 func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt PacketBuffer) {
+	n.deliverNetworkPacket(linkEP, remote, local, protocol, pkt, true /* classify */)
+}
+
+// deliverNetworkPacket is like DeliverNetworkPacket, but n's classifier is
+// only evaluated if classify is true.
+func (n *NIC) deliverNetworkPacket(linkEP LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt PacketBuffer, classify bool) {
 	n.mu.RLock()
 	enabled := n.mu.enabled
 	// If the NIC is not yet enabled, don't receive any packets.
@@ -1167,16 +2056,27 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, local tcpip.Link
 
 		n.stats.DisabledRx.Packets.Increment()
 		n.stats.DisabledRx.Bytes.IncrementBy(uint64(pkt.Data.Size()))
+		n.incDrop(&n.drops.stats.Disabled)
 		return
 	}
 
 	n.stats.Rx.Packets.Increment()
 	n.stats.Rx.Bytes.IncrementBy(uint64(pkt.Data.Size()))
 
+	if tap := n.mu.captureTap; tap != nil {
+		n.mu.RUnlock()
+		if local == "" {
+			local = n.linkEP.LinkAddress()
+		}
+		tap(n.id, remote, local, protocol, pkt)
+		return
+	}
+
 	netProto, ok := n.stack.networkProtocols[protocol]
 	if !ok {
 		n.mu.RUnlock()
 		n.stack.stats.UnknownProtocolRcvdPackets.Increment()
+		n.incDrop(&n.drops.stats.UnknownNetworkProtocol)
 		return
 	}
 
@@ -1194,6 +2094,7 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, local tcpip.Link
 	if protocol != header.EthernetProtocolAll {
 		packetEPs = append(packetEPs, n.mu.packetEPs[header.EthernetProtocolAll]...)
 	}
+	classifier := n.mu.classifier
 	n.mu.RUnlock()
 	for _, ep := range packetEPs {
 		ep.HandlePacket(n.id, local, protocol, pkt.Clone())
@@ -1205,17 +2106,50 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, local tcpip.Link
 
 	if len(pkt.Data.First()) < netProto.MinimumPacketSize() {
 		n.stack.stats.MalformedRcvdPackets.Increment()
+		n.incDrop(&n.drops.stats.Malformed)
 		return
 	}
 
 	src, dst := netProto.ParseAddresses(pkt.Data.First())
 
+	if classify && classifier != nil {
+		cp := parseClassifierPacket(n.id, protocol, src, dst, &pkt)
+		res := classifier(&cp)
+		if res.Mark != 0 {
+			pkt.Mark = res.Mark
+		}
+		switch res.Verdict {
+		case ClassifierDrop:
+			n.incDrop(&n.drops.stats.Classifier)
+			return
+		case ClassifierRedirect:
+			n.stack.mu.RLock()
+			target := n.stack.nics[res.RedirectNIC]
+			n.stack.mu.RUnlock()
+			if target == nil {
+				n.incDrop(&n.drops.stats.Classifier)
+				return
+			}
+			target.deliverNetworkPacket(linkEP, remote, local, protocol, pkt, false /* classify */)
+			return
+		}
+	}
+
+	if !n.isLoopback() && !n.stack.allowExternalLoopback && isLoopbackAddress(protocol, dst) {
+		// Packets to the loopback addresses must never appear on the wire, so
+		// this is a martian packet.
+		n.stack.stats.IP.InvalidDestinationAddressesReceived.Increment()
+		n.incDrop(&n.drops.stats.LoopbackDestination)
+		return
+	}
+
 	if n.stack.handleLocal && !n.isLoopback() && n.getRef(protocol, src) != nil {
 		// The source address is one of our own, so we never should have gotten a
 		// packet like this unless handleLocal is false. Loopback also calls this
 		// function even though the packets didn't come from the physical interface
 		// so don't drop those.
 		n.stack.stats.IP.InvalidSourceAddressesReceived.Increment()
+		n.incDrop(&n.drops.stats.InvalidSource)
 		return
 	}
 
@@ -1228,24 +2162,51 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, local tcpip.Link
 		}
 	}
 
+	// Multicast packets are forwarded according to the multicast forwarding
+	// cache, in addition to being delivered locally if n joined the group.
+	mcastForwarded := false
+	if n.stack.Forwarding() && (header.IsV4MulticastAddress(dst) || header.IsV6MulticastAddress(dst)) {
+		mcastForwarded = n.forwardMulticastPacket(protocol, src, dst, pkt)
+	}
+
 	if ref := n.getRef(protocol, dst); ref != nil {
+		n.stats.Delivered.Increment()
 		handlePacket(protocol, dst, src, linkEP.LinkAddress(), remote, ref, pkt)
 		return
 	}
 
+	if ref, unicast := n.directedBroadcastRef(protocol, dst); ref != nil {
+		n.stats.Delivered.Increment()
+		r := makeRoute(protocol, dst, src, linkEP.LinkAddress(), ref, false /* handleLocal */, false /* multicastLoop */)
+		r.RemoteLinkAddress = remote
+		r.directedBroadcastSrc = unicast
+		ref.ep.HandlePacket(&r, pkt)
+		ref.decRef()
+		return
+	}
+
+	if mcastForwarded {
+		return
+	}
+
 	// This NIC doesn't care about the packet. Find a NIC that cares about the
 	// packet and forward it to the NIC.
 	//
 	// TODO: Should we be forwarding the packet even if promiscuous?
 	if n.stack.Forwarding() {
+		ev := ForwardEvent{InNIC: n.id, Src: src, Dst: dst}
 		r, err := n.stack.FindRoute(0, "", dst, protocol, false /* multicastLoop */)
 		if err != nil {
 			n.stack.stats.IP.InvalidDestinationAddressesReceived.Increment()
+			n.incDrop(&n.drops.stats.InvalidDestination)
+			ev.Result = ForwardNoRoute
+			n.stack.recordForward(ev)
 			return
 		}
 
 		// Found a NIC.
 		n := r.ref.nic
+		ev.OutNIC = n.id
 		n.mu.RLock()
 		ref, ok := n.mu.endpoints[NetworkEndpointID{dst}]
 		ok = ok && ref.isValidForOutgoingRLocked() && ref.tryIncRef()
@@ -1258,6 +2219,8 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, local tcpip.Link
 			ref.ep.HandlePacket(&r, pkt)
 			ref.decRef()
 			r.Release()
+			ev.Result = ForwardDeliveredLocally
+			n.stack.recordForward(ev)
 			return
 		}
 
@@ -1266,30 +2229,72 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remote, local tcpip.Link
 		// TODO(b/128629022): move this logic to route.WritePacket.
 		if ch, err := r.Resolve(nil); err != nil {
 			if err == tcpip.ErrWouldBlock {
-				n.stack.forwarder.enqueue(ch, n, &r, protocol, pkt)
+				n.stack.forwarder.enqueue(ch, n, &r, protocol, pkt, ev)
 				// forwarder will release route.
 				return
 			}
 			n.stack.stats.IP.InvalidDestinationAddressesReceived.Increment()
 			r.Release()
+			ev.Result = ForwardLinkResolutionFailed
+			n.stack.recordForward(ev)
 			return
 		}
 
 		// The link-address resolution finished immediately.
-		n.forwardPacket(&r, protocol, pkt)
+		ev.Result = n.forwardPacket(&r, protocol, pkt)
 		r.Release()
+		n.stack.recordForward(ev)
 		return
 	}
 
 	// If a packet socket handled the packet, don't treat it as invalid.
 	if len(packetEPs) == 0 {
 		n.stack.stats.IP.InvalidDestinationAddressesReceived.Increment()
+		n.incDrop(&n.drops.stats.InvalidDestination)
 	}
 }
 
-func (n *NIC) forwardPacket(r *Route, protocol tcpip.NetworkProtocolNumber, pkt PacketBuffer) {
-	// TODO(b/143425874) Decrease the TTL field in forwarded packets.
+// forwardMulticastPacket forwards a copy of pkt, a multicast packet sent to
+// dst and received by n, out of each NIC the stack's multicast forwarding
+// cache holds for n and dst.
+//
+// Returns false if the cache has no route for the packet.
+func (n *NIC) forwardMulticastPacket(protocol tcpip.NetworkProtocolNumber, src, dst tcpip.Address, pkt PacketBuffer) bool {
+	outNICs, ok := n.stack.multicastRoute(n.id, dst)
+	if !ok {
+		return false
+	}
 
+	for _, id := range outNICs {
+		ev := ForwardEvent{InNIC: n.id, OutNIC: id, Src: src, Dst: dst}
+		r, err := n.stack.FindRoute(id, "", dst, protocol, false /* multicastLoop */)
+		if err != nil {
+			ev.Result = ForwardNoRoute
+			n.stack.recordForward(ev)
+			continue
+		}
+
+		// Multicast addresses are resolved statically so this never blocks.
+		if _, err := r.Resolve(nil); err != nil {
+			r.Release()
+			ev.Result = ForwardLinkResolutionFailed
+			n.stack.recordForward(ev)
+			continue
+		}
+
+		// Each outgoing NIC gets its own copy of the packet as forwarding
+		// updates the header in place.
+		ev.Result = r.ref.nic.forwardPacket(&r, protocol, PacketBuffer{
+			Data: buffer.NewViewFromBytes(pkt.Data.ToView()).ToVectorisedView(),
+		})
+		r.Release()
+		n.stack.recordForward(ev)
+	}
+	return true
+}
+
+// forwardPacket sends pkt out of n and returns the outcome.
+func (n *NIC) forwardPacket(r *Route, protocol tcpip.NetworkProtocolNumber, pkt PacketBuffer) ForwardResult {
 	firstData := pkt.Data.First()
 	pkt.Data.RemoveFirst()
 
@@ -1307,13 +2312,186 @@ func (n *NIC) forwardPacket(r *Route, protocol tcpip.NetworkProtocolNumber, pkt
 		}
 	}
 
+	if !n.isPreserveTTL() && !decrementTTL(protocol, pkt.Header.View()) {
+		// TODO(b/143425874): Send an ICMP Time Exceeded message.
+		n.incDrop(&n.drops.stats.TTLExpired)
+		return ForwardTTLExpired
+	}
+
+	// TODO(b/143425874): Fragment the packets which may be fragmented instead
+	// of handing them to the link endpoint as they are.
+	if pkt.Header.UsedLength()+pkt.Data.Size() > int(n.MTU()) && !mayFragment(protocol, pkt.Header.View()) {
+		n.reportPacketTooBig(protocol, pkt)
+		return ForwardPacketTooBig
+	}
+
 	if err := n.linkEP.WritePacket(r, nil /* gso */, protocol, pkt); err != nil {
 		r.Stats().IP.OutgoingPacketErrors.Increment()
-		return
+		return ForwardWriteError
 	}
 
 	n.stats.Tx.Packets.Increment()
 	n.stats.Tx.Bytes.IncrementBy(uint64(pkt.Header.UsedLength() + pkt.Data.Size()))
+	n.recordEgress(r.LocalLinkAddress)
+	return ForwardSent
+}
+
+// mayFragment returns false if the packet of the given protocol whose network
+// header is at the start of hdr must not be fragmented when forwarded: IPv6
+// packets are only fragmented by their source, as per RFC 8200 section 4.5,
+// and IPv4 packets may have the Don't Fragment flag set.
+func mayFragment(protocol tcpip.NetworkProtocolNumber, hdr buffer.View) bool {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		return len(hdr) < header.IPv4MinimumSize || header.IPv4(hdr).Flags()&header.IPv4FlagDontFragment == 0
+	case header.IPv6ProtocolNumber:
+		return false
+	default:
+		return true
+	}
+}
+
+// reportPacketTooBig reports to the source of pkt, a packet that could not be
+// forwarded out of n because it exceeded n's MTU, that the packet was too big,
+// if its network protocol supports it.
+func (n *NIC) reportPacketTooBig(protocol tcpip.NetworkProtocolNumber, pkt PacketBuffer) {
+	netProto, ok := n.stack.networkProtocols[protocol]
+	if !ok {
+		return
+	}
+	reporter, ok := netProto.(PacketTooBigReporter)
+	if !ok {
+		return
+	}
+
+	src, _ := netProto.ParseAddresses(pkt.Header.View())
+	r, err := n.stack.FindRoute(0, "", src, protocol, false /* multicastLoop */)
+	if err != nil {
+		return
+	}
+	defer r.Release()
+	// The source was just heard from, so its link address is very likely
+	// cached. Don't wait for link address resolution otherwise.
+	if _, err := r.Resolve(nil); err != nil {
+		return
+	}
+	reporter.ReportPacketTooBig(&r, n.MTU(), pkt)
+}
+
+// decrementTTL decrements the TTL (or hop limit) field of the IPv4 or IPv6
+// header at the start of hdr, updating the header checksum as needed.
+//
+// Returns false if the packet's TTL has expired and it must not be forwarded.
+// Packets of other network protocols are left untouched.
+func decrementTTL(protocol tcpip.NetworkProtocolNumber, hdr buffer.View) bool {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if len(hdr) < header.IPv4MinimumSize {
+			return true
+		}
+		h := header.IPv4(hdr)
+		ttl := h.TTL()
+		if ttl <= 1 {
+			return false
+		}
+		h.SetTTL(ttl - 1)
+		h.SetChecksum(0)
+		h.SetChecksum(^h.CalculateChecksum())
+	case header.IPv6ProtocolNumber:
+		if len(hdr) < header.IPv6MinimumSize {
+			return true
+		}
+		h := header.IPv6(hdr)
+		hopLimit := h.HopLimit()
+		if hopLimit <= 1 {
+			return false
+		}
+		h.SetHopLimit(hopLimit - 1)
+	}
+	return true
+}
+
+// incDrop increments the drop counter c, which must be a field of
+// n.drops.stats.
+func (n *NIC) incDrop(c *uint64) {
+	n.drops.Lock()
+	*c++
+	n.drops.Unlock()
+	n.stats.Dropped.Increment()
+}
+
+// WriteRawPacket writes vv out of n to the link address remoteLink, bypassing
+// routing and the network protocols. vv must hold a complete network-layer
+// packet of protocol proto; only the link-layer header is added to it. It lets
+// tests and other callers emit crafted packets out of a specific NIC.
+func (n *NIC) WriteRawPacket(proto tcpip.NetworkProtocolNumber, remoteLink tcpip.LinkAddress, vv buffer.VectorisedView) *tcpip.Error {
+	if !n.Enabled() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	r := Route{
+		NetProto:          proto,
+		LocalLinkAddress:  n.linkEP.LinkAddress(),
+		RemoteLinkAddress: remoteLink,
+	}
+	size := vv.Size()
+	pkt := PacketBuffer{
+		Header: buffer.NewPrependable(int(n.linkEP.MaxHeaderLength())),
+		Data:   vv,
+	}
+	if err := n.linkEP.WritePacket(&r, nil /* gso */, proto, pkt); err != nil {
+		n.stack.stats.IP.OutgoingPacketErrors.Increment()
+		return err
+	}
+
+	n.stats.Tx.Packets.Increment()
+	n.stats.Tx.Bytes.IncrementBy(uint64(size))
+	n.recordEgress(r.LocalLinkAddress)
+	return nil
+}
+
+// recordEgress records linkAddr as the local link address used by the most
+// recently written outgoing packet.
+func (n *NIC) recordEgress(linkAddr tcpip.LinkAddress) {
+	// The address rarely changes, so it is only stored when it does to avoid
+	// allocating for every packet.
+	if prev, _ := n.egressLinkAddr.Load().(tcpip.LinkAddress); prev != linkAddr {
+		n.egressLinkAddr.Store(linkAddr)
+	}
+}
+
+// LastEgressLinkAddress returns the local link address of the most recent
+// packet written out or forwarded through n, as chosen by the route it was
+// written with. Returns an empty address if no packet has been written yet.
+func (n *NIC) LastEgressLinkAddress() tcpip.LinkAddress {
+	linkAddr, _ := n.egressLinkAddr.Load().(tcpip.LinkAddress)
+	return linkAddr
+}
+
+// Stats returns the statistics of n.
+func (n *NIC) Stats() NICStats {
+	return n.stats
+}
+
+// DropStats returns a snapshot of the number of packets dropped by n.
+func (n *NIC) DropStats() DropStats {
+	n.drops.Lock()
+	defer n.drops.Unlock()
+
+	return n.drops.stats
+}
+
+// TakeDropStats returns a snapshot of the number of packets dropped by n and
+// resets the drop counters, atomically.
+//
+// This is useful for exporters that periodically report deltas.
+func (n *NIC) TakeDropStats() DropStats {
+	n.drops.Lock()
+	defer n.drops.Unlock()
+
+	s := n.drops.stats
+	n.drops.stats = DropStats{}
+	return s
 }
 
 // DeliverTransportPacket delivers the packets to the appropriate transport
@@ -1348,9 +2526,9 @@ func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolN
 		return
 	}
 
-	// Try to deliver to per-stack default handler.
-	if state.defaultHandler != nil {
-		if state.defaultHandler(r, id, pkt) {
+	// Try to deliver to the per-stack default handlers.
+	for _, h := range state.defaultHandlers {
+		if h(r, id, pkt) {
 			return
 		}
 	}
@@ -1363,8 +2541,13 @@ func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolN
 }
 
 // DeliverTransportControlPacket delivers control packets to the appropriate
-// transport protocol endpoint.
+// transport protocol endpoint. Path MTUs carried by packet too big messages
+// are recorded in the stack's PMTU cache.
 func (n *NIC) DeliverTransportControlPacket(local, remote tcpip.Address, net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ ControlType, extra uint32, pkt PacketBuffer) {
+	if typ == ControlPacketTooBig {
+		n.stack.pmtuCache.update(net, remote, extra)
+	}
+
 	state, ok := n.stack.transportProtocols[trans]
 	if !ok {
 		return
@@ -1397,9 +2580,19 @@ func (n *NIC) ID() tcpip.NICID {
 
 // Name returns the name of n.
 func (n *NIC) Name() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
 	return n.name
 }
 
+// setName sets the name of n.
+func (n *NIC) setName(name string) {
+	n.mu.Lock()
+	n.name = name
+	n.mu.Unlock()
+}
+
 // Stack returns the instance of the Stack that owns this NIC.
 func (n *NIC) Stack() *Stack {
 	return n.stack
@@ -1410,6 +2603,67 @@ func (n *NIC) LinkEndpoint() LinkEndpoint {
 	return n.linkEP
 }
 
+// MTU returns the MTU of n: the MTU of its link endpoint, lowered to the MTU
+// set with SetMTU, if any. It is the MTU used by the network endpoints of n,
+// e.g. to fragment outgoing packets.
+func (n *NIC) MTU() uint32 {
+	mtu := n.linkEP.MTU()
+	if override := atomic.LoadUint32(&n.mtu); override != 0 && override < mtu {
+		mtu = override
+	}
+	return mtu
+}
+
+// SetMTU sets the MTU of n. The MTU of n's link endpoint remains an upper
+// bound; see MTU. A zero mtu removes a previously set MTU.
+//
+// Returns tcpip.ErrInvalidOptionValue if mtu is below the minimum MTU of a
+// network protocol enabled on the stack.
+func (n *NIC) SetMTU(mtu uint32) *tcpip.Error {
+	if mtu != 0 {
+		for proto := range n.stack.networkProtocols {
+			if mtu < minimumMTU(proto) {
+				return tcpip.ErrInvalidOptionValue
+			}
+		}
+	}
+	atomic.StoreUint32(&n.mtu, mtu)
+	return nil
+}
+
+// minimumMTU returns the minimum MTU required by the network protocol proto,
+// or zero if it has none.
+func minimumMTU(proto tcpip.NetworkProtocolNumber) uint32 {
+	switch proto {
+	case header.IPv4ProtocolNumber:
+		return header.IPv4MinimumMTU
+	case header.IPv6ProtocolNumber:
+		return header.IPv6MinimumMTU
+	default:
+		return 0
+	}
+}
+
+// mtuLinkEndpoint is the LinkEndpoint handed to the network endpoints of a
+// NIC. It reports the NIC's MTU rather than the link endpoint's.
+type mtuLinkEndpoint struct {
+	LinkEndpoint
+	nic *NIC
+}
+
+// MTU implements LinkEndpoint.MTU.
+func (e *mtuLinkEndpoint) MTU() uint32 {
+	return e.nic.MTU()
+}
+
+// GSOMaxSize implements GSOEndpoint.GSOMaxSize.
+func (e *mtuLinkEndpoint) GSOMaxSize() uint32 {
+	if gso, ok := e.LinkEndpoint.(GSOEndpoint); ok {
+		return gso.GSOMaxSize()
+	}
+	return 0
+}
+
 // isAddrTentative returns true if addr is tentative on n.
 //
 // Note that if addr is not associated with n, then this function will return
@@ -1434,29 +2688,50 @@ func (n *NIC) isAddrTentative(addr tcpip.Address) bool {
 // the address was generated via SLAAC, an attempt will be made to generate a
 // new address.
 func (n *NIC) dupTentativeAddrDetected(addr tcpip.Address) *tcpip.Error {
+	dadStopped, err := n.removeDupTentativeAddr(addr)
+	n.flushAddressRemovals()
+
+	// Let the integrator know DAD did not resolve now that n is unlocked.
+	if dadStopped {
+		if ndpDisp := n.ndpDispatcher(); ndpDisp != nil {
+			ndpDisp.OnDuplicateAddressDetectionStatus(n.ID(), addr, false, nil)
+		}
+	}
+
+	return err
+}
+
+// removeDupTentativeAddr removes the tentative addr from n. It returns true if
+// DAD was being performed on addr, in which case the caller must inform the
+// integrator that DAD failed.
+func (n *NIC) removeDupTentativeAddr(addr tcpip.Address) (bool, *tcpip.Error) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
 	ref, ok := n.mu.endpoints[NetworkEndpointID{addr}]
 	if !ok {
-		return tcpip.ErrBadAddress
+		return false, tcpip.ErrBadAddress
 	}
 
 	if ref.getKind() != permanentTentative {
-		return tcpip.ErrInvalidEndpointState
+		return false, tcpip.ErrInvalidEndpointState
 	}
 
+	// Stop DAD without informing the integrator as n is locked. This leaves
+	// nothing for removePermanentIPv6EndpointLocked to stop.
+	dadStopped := n.mu.ndp.cancelDuplicateAddressDetection(addr)
+
 	// If the address is a SLAAC address, do not invalidate its SLAAC prefix as a
 	// new address will be generated for it.
 	if err := n.removePermanentIPv6EndpointLocked(ref, false /* allowSLAACPrefixInvalidation */); err != nil {
-		return err
+		return dadStopped, err
 	}
 
 	if ref.configType == slaac {
 		n.mu.ndp.regenerateSLAACAddr(ref.addrWithPrefix().Subnet())
 	}
 
-	return nil
+	return dadStopped, nil
 }
 
 // setNDPConfigs sets the NDP configurations for n.
@@ -1474,9 +2749,11 @@ func (n *NIC) setNDPConfigs(c NDPConfigurations) {
 // handleNDPRA handles an NDP Router Advertisement message that arrived on n.
 func (n *NIC) handleNDPRA(ip tcpip.Address, ra header.NDPRouterAdvert) {
 	n.mu.Lock()
-	defer n.mu.Unlock()
-
 	n.mu.ndp.handleRA(ip, ra)
+	n.mu.Unlock()
+
+	// Invalidated SLAAC prefixes have their addresses removed.
+	n.flushAddressRemovals()
 }
 
 type networkEndpointKind int32
@@ -1514,6 +2791,22 @@ const (
 	temporary
 )
 
+// String implements fmt.Stringer.
+func (k networkEndpointKind) String() string {
+	switch k {
+	case permanentTentative:
+		return "tentative"
+	case permanent:
+		return "permanent"
+	case permanentExpired:
+		return "expired"
+	case temporary:
+		return "temporary"
+	default:
+		return fmt.Sprintf("networkEndpointKind(%d)", int32(k))
+	}
+}
+
 func (n *NIC) registerPacketEndpoint(netProto tcpip.NetworkProtocolNumber, ep PacketEndpoint) *tcpip.Error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
@@ -1544,6 +2837,51 @@ func (n *NIC) unregisterPacketEndpoint(netProto tcpip.NetworkProtocolNumber, ep
 	}
 }
 
+// addressRemoval is an address endpoint removal waiting to be notified.
+type addressRemoval struct {
+	addr tcpip.Address
+	kind networkEndpointKind
+}
+
+// queueAddressRemoval queues the removal of the address endpoint for addr, of
+// the given kind, to be notified by notifyAddressRemovals. n MUST be locked.
+func (n *NIC) queueAddressRemoval(addr tcpip.Address, kind networkEndpointKind) {
+	if n.onAddressRemoved == nil {
+		return
+	}
+	n.addressRemovals.Lock()
+	n.addressRemovals.pending = append(n.addressRemovals.pending, addressRemoval{addr: addr, kind: kind})
+	n.addressRemovals.Unlock()
+}
+
+// takeAddressRemovals dequeues the address endpoint removals queued so far, in
+// the order they were queued.
+func (n *NIC) takeAddressRemovals() []addressRemoval {
+	n.addressRemovals.Lock()
+	defer n.addressRemovals.Unlock()
+	removals := n.addressRemovals.pending
+	n.addressRemovals.pending = nil
+	return removals
+}
+
+// notifyAddressRemovals calls the NIC's OnAddressRemoved callback for each of
+// removals, in order.
+//
+// Neither n nor its stack may be locked, as the callback may call into the
+// stack.
+func (n *NIC) notifyAddressRemovals(removals []addressRemoval) {
+	for _, r := range removals {
+		n.onAddressRemoved(r.addr, r.kind.String())
+	}
+}
+
+// flushAddressRemovals notifies the address endpoint removals queued so far.
+//
+// Neither n nor its stack may be locked.
+func (n *NIC) flushAddressRemovals() {
+	n.notifyAddressRemovals(n.takeAddressRemovals())
+}
+
 type networkEndpointConfigType int32
 
 const (
@@ -1582,6 +2920,10 @@ type referencedNetworkEndpoint struct {
 	// deprecated. That is, when deprecated is true, other endpoints that are not
 	// deprecated should be preferred.
 	deprecated bool
+
+	// expiredFrom is the kind the endpoint had before it was marked expired.
+	// It is protected by the NIC's mu.
+	expiredFrom networkEndpointKind
 }
 
 func (r *referencedNetworkEndpoint) addrWithPrefix() tcpip.AddressWithPrefix {
@@ -1618,9 +2960,22 @@ func (r *referencedNetworkEndpoint) isValidForOutgoingRLocked() bool {
 	return r.nic.mu.enabled && (r.getKind() != permanentExpired || r.nic.mu.spoofing)
 }
 
+// isSpoofed returns true if r's address is not assigned to its NIC, i.e. r is
+// a temporary endpoint or its address has been removed. Packets sent through
+// such an endpoint use a spoofed source address.
+func (r *referencedNetworkEndpoint) isSpoofed() bool {
+	switch r.getKind() {
+	case temporary, permanentExpired:
+		return true
+	default:
+		return false
+	}
+}
+
 // expireLocked decrements the reference count and marks the permanent endpoint
 // as expired.
 func (r *referencedNetworkEndpoint) expireLocked() {
+	r.expiredFrom = r.getKind()
 	r.setKind(permanentExpired)
 	r.decRefLocked()
 }
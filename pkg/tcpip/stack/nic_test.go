@@ -16,10 +16,33 @@ package stack
 
 import (
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 )
 
+// newFwdTestNIC returns a stack with the forwarding test network protocol and
+// opts, and its NIC nicID, created with nicOpts on a forwarding test link
+// endpoint.
+func newFwdTestNIC(t *testing.T, nicID tcpip.NICID, opts Options, nicOpts NICOptions) (*Stack, *NIC) {
+	t.Helper()
+
+	opts.NetworkProtocols = []NetworkProtocol{&fwdTestNetworkProtocol{}}
+	s := New(opts)
+	ep := &fwdTestLinkEndpoint{
+		C:        make(chan fwdTestPacketInfo, 1),
+		mtu:      fwdTestNetDefaultMTU,
+		linkAddr: "a",
+	}
+	if err := s.CreateNICWithOptions(nicID, ep, nicOpts); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, %+v): %s", nicID, nicOpts, err)
+	}
+	return s, s.nics[nicID]
+}
+
 func TestDisabledRxStatsWhenNICDisabled(t *testing.T) {
 	// When the NIC is disabled, the only field that matters is the stats field.
 	// This test is limited to stats counter checks.
@@ -59,3 +82,603 @@ func TestDisabledRxStatsWhenNICDisabled(t *testing.T) {
 		t.Errorf("got Rx.Bytes = %d, want = 0", got)
 	}
 }
+
+func TestTakeDropStats(t *testing.T) {
+	nic := NIC{
+		stats: makeNICStats(),
+	}
+
+	// The NIC is disabled so all delivered packets are dropped.
+	const numPackets = 3
+	for i := 0; i < numPackets; i++ {
+		nic.DeliverNetworkPacket(nil, "", "", 0, PacketBuffer{Data: buffer.View([]byte{1, 2, 3, 4}).ToVectorisedView()})
+	}
+
+	if got, want := nic.TakeDropStats(), (DropStats{Disabled: numPackets}); got != want {
+		t.Errorf("got nic.TakeDropStats() = %+v, want = %+v", got, want)
+	}
+	if got, want := nic.DropStats(), (DropStats{}); got != want {
+		t.Errorf("got nic.DropStats() = %+v after taking stats, want = %+v", got, want)
+	}
+
+	// Counting should continue from zero.
+	nic.DeliverNetworkPacket(nil, "", "", 0, PacketBuffer{Data: buffer.View([]byte{1, 2, 3, 4}).ToVectorisedView()})
+	if got, want := nic.TakeDropStats(), (DropStats{Disabled: 1}); got != want {
+		t.Errorf("got nic.TakeDropStats() = %+v, want = %+v", got, want)
+	}
+}
+
+func TestTempEndpointErrors(t *testing.T) {
+	const (
+		nicID        = 1
+		unknownProto = fwdTestNetNumber - 1
+		addr         = tcpip.Address("\x05")
+	)
+
+	type tempEndpointError struct {
+		nicID    tcpip.NICID
+		protocol tcpip.NetworkProtocolNumber
+		addr     tcpip.Address
+		err      *tcpip.Error
+	}
+	var errs []tempEndpointError
+	s, nic := newFwdTestNIC(t, nicID, Options{
+		TempEndpointErrorHandler: func(nicID tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, err *tcpip.Error) {
+			errs = append(errs, tempEndpointError{nicID, protocol, addr, err})
+		},
+	}, NICOptions{})
+	if err := s.SetPromiscuousMode(nicID, true); err != nil {
+		t.Fatalf("SetPromiscuousMode(%d, true): %s", nicID, err)
+	}
+
+	// Creating a temporary endpoint for a supported protocol succeeds.
+	if ref := nic.getRefOrCreateTemp(fwdTestNetNumber, addr, CanBePrimaryEndpoint, promiscuous); ref == nil {
+		t.Fatalf("got getRefOrCreateTemp(%d, %s, _, promiscuous) = nil, want non-nil", fwdTestNetNumber, addr)
+	} else {
+		ref.decRef()
+	}
+	if got := nic.stats.TempEndpointErrors.Value(); got != 0 {
+		t.Errorf("got TempEndpointErrors = %d, want = 0", got)
+	}
+
+	if ref := nic.getRefOrCreateTemp(unknownProto, addr, CanBePrimaryEndpoint, promiscuous); ref != nil {
+		t.Fatalf("got getRefOrCreateTemp(%d, %s, _, promiscuous) = %+v, want = nil", unknownProto, addr, ref)
+	}
+	if got := nic.stats.TempEndpointErrors.Value(); got != 1 {
+		t.Errorf("got TempEndpointErrors = %d, want = 1", got)
+	}
+	want := []tempEndpointError{{nicID, unknownProto, addr, tcpip.ErrUnknownProtocol}}
+	if len(errs) != len(want) || errs[0] != want[0] {
+		t.Errorf("got temporary endpoint errors = %+v, want = %+v", errs, want)
+	}
+}
+
+func TestDisabledNICDoesNotCreateTempEndpoints(t *testing.T) {
+	const (
+		nicID = 1
+		addr  = tcpip.Address("\x01")
+	)
+
+	s, nic := newFwdTestNIC(t, nicID, Options{}, NICOptions{})
+	if err := s.SetPromiscuousMode(nicID, true); err != nil {
+		t.Fatalf("SetPromiscuousMode(%d, true): %s", nicID, err)
+	}
+
+	if err := nic.Disable(); err != nil {
+		t.Fatalf("nic.Disable(): %s", err)
+	}
+	if ref := nic.getRefOrCreateTemp(fwdTestNetNumber, addr, CanBePrimaryEndpoint, promiscuous); ref != nil {
+		t.Fatalf("got getRefOrCreateTemp(%d, %s, _, promiscuous) = %+v on a disabled NIC, want = nil", fwdTestNetNumber, addr, ref)
+	}
+
+	if err := nic.Enable(); err != nil {
+		t.Fatalf("nic.Enable(): %s", err)
+	}
+	if ref := nic.getRefOrCreateTemp(fwdTestNetNumber, addr, CanBePrimaryEndpoint, promiscuous); ref == nil {
+		t.Fatalf("got getRefOrCreateTemp(%d, %s, _, promiscuous) = nil, want non-nil", fwdTestNetNumber, addr)
+	} else {
+		ref.decRef()
+	}
+}
+
+func TestTempEndpointRateLimit(t *testing.T) {
+	const (
+		nicID     = 1
+		burst     = 3
+		numAddrs  = 10
+		reuseAddr = tcpip.Address("\x01")
+	)
+
+	// The rate is low enough that no token is replenished during the test.
+	s, nic := newFwdTestNIC(t, nicID, Options{}, NICOptions{
+		TempEndpointRateLimit: rate.Every(time.Hour),
+		TempEndpointBurst:     burst,
+	})
+	if err := s.SetPromiscuousMode(nicID, true); err != nil {
+		t.Fatalf("SetPromiscuousMode(%d, true): %s", nicID, err)
+	}
+
+	// Hold a reference to the first endpoint so it is reused below.
+	held := nic.getRefOrCreateTemp(fwdTestNetNumber, reuseAddr, CanBePrimaryEndpoint, promiscuous)
+	if held == nil {
+		t.Fatalf("got getRefOrCreateTemp(%d, %s, _, promiscuous) = nil, want non-nil", fwdTestNetNumber, reuseAddr)
+	}
+	defer held.decRef()
+
+	created := 1
+	for i := 1; i < numAddrs; i++ {
+		addr := tcpip.Address([]byte{byte(i + 1)})
+		if ref := nic.getRefOrCreateTemp(fwdTestNetNumber, addr, CanBePrimaryEndpoint, promiscuous); ref != nil {
+			created++
+			ref.decRef()
+		}
+	}
+	if created != burst {
+		t.Errorf("got %d temporary endpoints created, want = %d", created, burst)
+	}
+	if got := nic.stats.TempEndpointsCreated.Value(); got != burst {
+		t.Errorf("got TempEndpointsCreated = %d, want = %d", got, burst)
+	}
+	if got, want := nic.stats.TempEndpointsThrottled.Value(), uint64(numAddrs-burst); got != want {
+		t.Errorf("got TempEndpointsThrottled = %d, want = %d", got, want)
+	}
+
+	// Existing endpoints are still usable while throttled.
+	if ref := nic.getRefOrCreateTemp(fwdTestNetNumber, reuseAddr, CanBePrimaryEndpoint, promiscuous); ref != held {
+		t.Errorf("got getRefOrCreateTemp(%d, %s, _, promiscuous) = %p, want = %p", fwdTestNetNumber, reuseAddr, ref, held)
+	} else {
+		ref.decRef()
+	}
+	if got, want := nic.stats.TempEndpointsThrottled.Value(), uint64(numAddrs-burst); got != want {
+		t.Errorf("got TempEndpointsThrottled = %d, want = %d", got, want)
+	}
+}
+
+func TestNICForEachAddress(t *testing.T) {
+	const (
+		nicID         = 1
+		addr1         = tcpip.Address("\x01")
+		addr2         = tcpip.Address("\x02")
+		tentativeAddr = tcpip.Address("\x03")
+	)
+
+	_, nic := newFwdTestNIC(t, nicID, Options{}, NICOptions{})
+
+	for _, addr := range []tcpip.Address{addr1, addr2} {
+		if err := nic.AddAddress(tcpip.ProtocolAddress{
+			Protocol: fwdTestNetNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   addr,
+				PrefixLen: fwdTestNetDefaultPrefixLen,
+			},
+		}, CanBePrimaryEndpoint); err != nil {
+			t.Fatalf("nic.AddAddress(_, %s): %s", addr, err)
+		}
+	}
+	nic.mu.Lock()
+	_, err := nic.addAddressLocked(tcpip.ProtocolAddress{
+		Protocol: fwdTestNetNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tentativeAddr,
+			PrefixLen: fwdTestNetDefaultPrefixLen,
+		},
+	}, CanBePrimaryEndpoint, permanentTentative, static, false /* deprecated */)
+	nic.mu.Unlock()
+	if err != nil {
+		t.Fatalf("nic.addAddressLocked(_, %s, permanentTentative): %s", tentativeAddr, err)
+	}
+
+	visited := make(map[tcpip.Address]int)
+	nic.ForEachAddress(func(addr tcpip.ProtocolAddress) bool {
+		visited[addr.AddressWithPrefix.Address]++
+		return true
+	})
+	for _, addr := range []tcpip.Address{addr1, addr2} {
+		if got := visited[addr]; got != 1 {
+			t.Errorf("got %s visited %d times, want = 1", addr, got)
+		}
+	}
+	if got := visited[tentativeAddr]; got != 0 {
+		t.Errorf("got tentative address %s visited %d times, want = 0", tentativeAddr, got)
+	}
+
+	// Iteration stops as soon as the callback returns false.
+	calls := 0
+	nic.ForEachAddress(func(tcpip.ProtocolAddress) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("got %d callback calls, want = 1", calls)
+	}
+
+	// AllAddresses still reports tentative addresses.
+	if got, want := len(nic.AllAddresses()), 3; got != want {
+		t.Errorf("got len(nic.AllAddresses()) = %d, want = %d", got, want)
+	}
+}
+
+func TestNICPromiscuousAndSpoofing(t *testing.T) {
+	const nicID = 1
+
+	s, nic := newFwdTestNIC(t, nicID, Options{}, NICOptions{})
+
+	if nic.Promiscuous() {
+		t.Error("got nic.Promiscuous() = true, want = false")
+	}
+	if nic.Spoofing() {
+		t.Error("got nic.Spoofing() = true, want = false")
+	}
+
+	for _, enable := range []bool{true, false} {
+		if err := s.SetPromiscuousMode(nicID, enable); err != nil {
+			t.Fatalf("SetPromiscuousMode(%d, %t): %s", nicID, enable, err)
+		}
+		if got := nic.Promiscuous(); got != enable {
+			t.Errorf("got nic.Promiscuous() = %t, want = %t", got, enable)
+		}
+
+		if err := s.SetSpoofing(nicID, enable); err != nil {
+			t.Fatalf("SetSpoofing(%d, %t): %s", nicID, enable, err)
+		}
+		if got := nic.Spoofing(); got != enable {
+			t.Errorf("got nic.Spoofing() = %t, want = %t", got, enable)
+		}
+	}
+}
+
+func TestNICAddressKindCounts(t *testing.T) {
+	const (
+		nicID         = 1
+		permAddr      = tcpip.Address("\x01")
+		tentativeAddr = tcpip.Address("\x02")
+		expiredAddr   = tcpip.Address("\x03")
+		tempAddr      = tcpip.Address("\x04")
+	)
+
+	s, nic := newFwdTestNIC(t, nicID, Options{}, NICOptions{})
+	if err := s.SetPromiscuousMode(nicID, true); err != nil {
+		t.Fatalf("SetPromiscuousMode(%d, true): %s", nicID, err)
+	}
+
+	for _, addr := range []tcpip.Address{permAddr, expiredAddr} {
+		if err := nic.AddAddress(tcpip.ProtocolAddress{
+			Protocol: fwdTestNetNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   addr,
+				PrefixLen: fwdTestNetDefaultPrefixLen,
+			},
+		}, CanBePrimaryEndpoint); err != nil {
+			t.Fatalf("nic.AddAddress(_, %s): %s", addr, err)
+		}
+	}
+	nic.mu.Lock()
+	_, err := nic.addAddressLocked(tcpip.ProtocolAddress{
+		Protocol: fwdTestNetNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tentativeAddr,
+			PrefixLen: fwdTestNetDefaultPrefixLen,
+		},
+	}, CanBePrimaryEndpoint, permanentTentative, static, false /* deprecated */)
+	nic.mu.Unlock()
+	if err != nil {
+		t.Fatalf("nic.addAddressLocked(_, %s, permanentTentative): %s", tentativeAddr, err)
+	}
+
+	// An address removed while a reference to it is held expires.
+	expiredRef := nic.getRefOrCreateTemp(fwdTestNetNumber, expiredAddr, CanBePrimaryEndpoint, promiscuous)
+	if expiredRef == nil {
+		t.Fatalf("got getRefOrCreateTemp(%d, %s, _, promiscuous) = nil, want non-nil", fwdTestNetNumber, expiredAddr)
+	}
+	defer expiredRef.decRef()
+	if err := nic.RemoveAddress(expiredAddr); err != nil {
+		t.Fatalf("nic.RemoveAddress(%s): %s", expiredAddr, err)
+	}
+
+	tempRef := nic.getRefOrCreateTemp(fwdTestNetNumber, tempAddr, CanBePrimaryEndpoint, promiscuous)
+	if tempRef == nil {
+		t.Fatalf("got getRefOrCreateTemp(%d, %s, _, promiscuous) = nil, want non-nil", fwdTestNetNumber, tempAddr)
+	}
+	defer tempRef.decRef()
+
+	got := nic.AddressKindCounts()
+	want := map[string]int{
+		"permanent": 1,
+		"tentative": 1,
+		"expired":   1,
+		"temporary": 1,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got nic.AddressKindCounts() = %v, want = %v", got, want)
+	}
+	for kind, n := range want {
+		if got[kind] != n {
+			t.Errorf("got nic.AddressKindCounts()[%q] = %d, want = %d", kind, got[kind], n)
+		}
+	}
+}
+
+func TestNICRemoveLeavesAllGroups(t *testing.T) {
+	const (
+		nicID  = 1
+		group1 = tcpip.Address("\xe0")
+		group2 = tcpip.Address("\xe1")
+	)
+
+	s, nic := newFwdTestNIC(t, nicID, Options{}, NICOptions{})
+
+	for _, group := range []tcpip.Address{group1, group2} {
+		if err := s.JoinGroup(fwdTestNetNumber, nicID, group); err != nil {
+			t.Fatalf("JoinGroup(%d, %d, %s): %s", fwdTestNetNumber, nicID, group, err)
+		}
+	}
+
+	// Leaving a group whose endpoint was already removed is not an error.
+	if err := nic.RemoveAddress(group2); err != nil {
+		t.Fatalf("nic.RemoveAddress(%s): %s", group2, err)
+	}
+
+	if _, err := nic.remove(); err != nil {
+		t.Fatalf("nic.remove(): %s", err)
+	}
+	for _, group := range []tcpip.Address{group1, group2} {
+		if nic.isInGroup(group) {
+			t.Errorf("got nic.isInGroup(%s) = true after removing the NIC, want = false", group)
+		}
+	}
+	if got := len(nic.mu.mcastJoins); got != 0 {
+		t.Errorf("got len(nic.mu.mcastJoins) = %d, want = 0", got)
+	}
+}
+
+func TestNICRemoveAllAddresses(t *testing.T) {
+	const (
+		nicID         = 1
+		addr1         = tcpip.Address("\x01")
+		addr2         = tcpip.Address("\x02")
+		tentativeAddr = tcpip.Address("\x03")
+		group         = tcpip.Address("\xe0")
+	)
+
+	s, nic := newFwdTestNIC(t, nicID, Options{}, NICOptions{})
+
+	for _, addr := range []tcpip.Address{addr1, addr2} {
+		if err := nic.AddAddress(tcpip.ProtocolAddress{
+			Protocol: fwdTestNetNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   addr,
+				PrefixLen: fwdTestNetDefaultPrefixLen,
+			},
+		}, CanBePrimaryEndpoint); err != nil {
+			t.Fatalf("nic.AddAddress(_, %s): %s", addr, err)
+		}
+	}
+	nic.mu.Lock()
+	_, err := nic.addAddressLocked(tcpip.ProtocolAddress{
+		Protocol: fwdTestNetNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tentativeAddr,
+			PrefixLen: fwdTestNetDefaultPrefixLen,
+		},
+	}, CanBePrimaryEndpoint, permanentTentative, static, false /* deprecated */)
+	nic.mu.Unlock()
+	if err != nil {
+		t.Fatalf("nic.addAddressLocked(_, %s, permanentTentative): %s", tentativeAddr, err)
+	}
+	if err := s.JoinGroup(fwdTestNetNumber, nicID, group); err != nil {
+		t.Fatalf("JoinGroup(%d, %d, %s): %s", fwdTestNetNumber, nicID, group, err)
+	}
+
+	// Only the unicast addresses are removed.
+	if err := nic.RemoveAllAddresses(false /* all */); err != nil {
+		t.Fatalf("nic.RemoveAllAddresses(false): %s", err)
+	}
+	addrs := nic.AllAddresses()
+	if len(addrs) != 1 || addrs[0].AddressWithPrefix.Address != group {
+		t.Errorf("got nic.AllAddresses() = %v, want only %s", addrs, group)
+	}
+	if !nic.isInGroup(group) {
+		t.Errorf("got nic.isInGroup(%s) = false, want = true", group)
+	}
+
+	// Multicast group memberships are removed too when requested.
+	if err := nic.RemoveAllAddresses(true /* all */); err != nil {
+		t.Fatalf("nic.RemoveAllAddresses(true): %s", err)
+	}
+	if addrs := nic.AllAddresses(); len(addrs) != 0 {
+		t.Errorf("got nic.AllAddresses() = %v, want = []", addrs)
+	}
+	if nic.isInGroup(group) {
+		t.Errorf("got nic.isInGroup(%s) = true, want = false", group)
+	}
+}
+
+func TestNICPrimaryAddressesFor(t *testing.T) {
+	const (
+		nicID         = 1
+		tentativeAddr = tcpip.Address("\x06")
+	)
+
+	_, nic := newFwdTestNIC(t, nicID, Options{}, NICOptions{})
+
+	if got := nic.PrimaryAddressesFor(fwdTestNetNumber); len(got) != 0 {
+		t.Errorf("got nic.PrimaryAddressesFor(%d) = %v, want = []", fwdTestNetNumber, got)
+	}
+
+	adds := []struct {
+		addr tcpip.Address
+		peb  PrimaryEndpointBehavior
+	}{
+		{addr: "\x01", peb: CanBePrimaryEndpoint},
+		{addr: "\x02", peb: FirstPrimaryEndpoint},
+		{addr: "\x03", peb: NeverPrimaryEndpoint},
+		{addr: "\x04", peb: CanBePrimaryEndpoint},
+		{addr: "\x05", peb: FirstPrimaryEndpoint},
+	}
+	for _, a := range adds {
+		if err := nic.AddAddress(tcpip.ProtocolAddress{
+			Protocol: fwdTestNetNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{
+				Address:   a.addr,
+				PrefixLen: fwdTestNetDefaultPrefixLen,
+			},
+		}, a.peb); err != nil {
+			t.Fatalf("nic.AddAddress(_, %s): %s", a.addr, err)
+		}
+	}
+	nic.mu.Lock()
+	_, err := nic.addAddressLocked(tcpip.ProtocolAddress{
+		Protocol: fwdTestNetNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tentativeAddr,
+			PrefixLen: fwdTestNetDefaultPrefixLen,
+		},
+	}, CanBePrimaryEndpoint, permanentTentative, static, false /* deprecated */)
+	nic.mu.Unlock()
+	if err != nil {
+		t.Fatalf("nic.addAddressLocked(_, %s, permanentTentative): %s", tentativeAddr, err)
+	}
+
+	// FirstPrimaryEndpoint addresses come first, most recent first, then
+	// CanBePrimaryEndpoint addresses in insertion order. The
+	// NeverPrimaryEndpoint and tentative addresses are skipped.
+	want := []tcpip.AddressWithPrefix{
+		{Address: "\x05", PrefixLen: fwdTestNetDefaultPrefixLen},
+		{Address: "\x02", PrefixLen: fwdTestNetDefaultPrefixLen},
+		{Address: "\x01", PrefixLen: fwdTestNetDefaultPrefixLen},
+		{Address: "\x04", PrefixLen: fwdTestNetDefaultPrefixLen},
+	}
+	if diff := cmp.Diff(want, nic.PrimaryAddressesFor(fwdTestNetNumber)); diff != "" {
+		t.Errorf("nic.PrimaryAddressesFor(%d) mismatch (-want +got):\n%s", fwdTestNetNumber, diff)
+	}
+
+	// Other protocols have no primary addresses.
+	if got := nic.PrimaryAddressesFor(fwdTestNetNumber - 1); len(got) != 0 {
+		t.Errorf("got nic.PrimaryAddressesFor(%d) = %v, want = []", fwdTestNetNumber-1, got)
+	}
+}
+
+func TestNICOnAddressRemoved(t *testing.T) {
+	const (
+		nicID    = 1
+		permAddr = tcpip.Address("\x01")
+		heldAddr = tcpip.Address("\x02")
+		tempAddr = tcpip.Address("\x03")
+		permKind = "permanent"
+		tempKind = "temporary"
+	)
+
+	type removal struct {
+		addr tcpip.Address
+		kind string
+	}
+	var removals []removal
+	var s *Stack
+	s, nic := newFwdTestNIC(t, nicID, Options{}, NICOptions{
+		OnAddressRemoved: func(addr tcpip.Address, kind string) {
+			// The NIC must not be locked, so that its addresses can be
+			// queried.
+			for _, a := range s.AllAddresses()[nicID] {
+				if a.AddressWithPrefix.Address == addr {
+					t.Errorf("removed address %s is still assigned", addr)
+				}
+			}
+			removals = append(removals, removal{addr: addr, kind: kind})
+		},
+	})
+	if err := s.SetPromiscuousMode(nicID, true); err != nil {
+		t.Fatalf("SetPromiscuousMode(%d, true): %s", nicID, err)
+	}
+
+	checkRemovals := func(want ...removal) {
+		t.Helper()
+		if len(removals) != len(want) {
+			t.Fatalf("got removals = %v, want = %v", removals, want)
+		}
+		for i := range want {
+			if removals[i] != want[i] {
+				t.Errorf("got removals[%d] = %v, want = %v", i, removals[i], want[i])
+			}
+		}
+		removals = nil
+	}
+
+	for _, addr := range []tcpip.Address{permAddr, heldAddr} {
+		if err := s.AddAddress(nicID, fwdTestNetNumber, addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, fwdTestNetNumber, addr, err)
+		}
+	}
+
+	if err := s.RemoveAddress(nicID, permAddr); err != nil {
+		t.Fatalf("RemoveAddress(%d, %s): %s", nicID, permAddr, err)
+	}
+	checkRemovals(removal{addr: permAddr, kind: permKind})
+
+	// An address removed while a reference to it is held is only removed once
+	// the reference is released.
+	heldRef := nic.getRefOrCreateTemp(fwdTestNetNumber, heldAddr, CanBePrimaryEndpoint, promiscuous)
+	if heldRef == nil {
+		t.Fatalf("got getRefOrCreateTemp(%d, %s, _, promiscuous) = nil, want non-nil", fwdTestNetNumber, heldAddr)
+	}
+	if err := s.RemoveAddress(nicID, heldAddr); err != nil {
+		t.Fatalf("RemoveAddress(%d, %s): %s", nicID, heldAddr, err)
+	}
+	checkRemovals()
+	heldRef.decRef()
+	checkRemovals(removal{addr: heldAddr, kind: permKind})
+
+	tempRef := nic.getRefOrCreateTemp(fwdTestNetNumber, tempAddr, CanBePrimaryEndpoint, promiscuous)
+	if tempRef == nil {
+		t.Fatalf("got getRefOrCreateTemp(%d, %s, _, promiscuous) = nil, want non-nil", fwdTestNetNumber, tempAddr)
+	}
+	checkRemovals()
+	tempRef.decRef()
+	checkRemovals(removal{addr: tempAddr, kind: tempKind})
+}
+
+func TestNICOnAddressRemovedReentersStack(t *testing.T) {
+	const (
+		nicID = 1
+		addr1 = tcpip.Address("\x01")
+		addr2 = tcpip.Address("\x02")
+	)
+
+	removed := make(map[tcpip.Address]int)
+	var s *Stack
+	s, _ = newFwdTestNIC(t, nicID, Options{}, NICOptions{
+		OnAddressRemoved: func(addr tcpip.Address, _ string) {
+			// Neither the NIC nor the stack may be locked while the NIC is
+			// removed, so that the callback may call into the stack.
+			if _, ok := s.NICInfo()[nicID]; ok {
+				t.Errorf("NIC %d still exists after its address %s was removed", nicID, addr)
+			}
+			if err := s.RemoveAddress(nicID, addr); err != tcpip.ErrUnknownNICID {
+				t.Errorf("got RemoveAddress(%d, %s) = %v, want = %s", nicID, addr, err, tcpip.ErrUnknownNICID)
+			}
+			removed[addr]++
+		},
+	})
+	for _, addr := range []tcpip.Address{addr1, addr2} {
+		if err := s.AddAddress(nicID, fwdTestNetNumber, addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, fwdTestNetNumber, addr, err)
+		}
+	}
+
+	done := make(chan *tcpip.Error, 1)
+	go func() {
+		done <- s.RemoveNIC(nicID)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("RemoveNIC(%d): %s", nicID, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for RemoveNIC(%d); the OnAddressRemoved callback deadlocked", nicID)
+	}
+
+	want := map[tcpip.Address]int{addr1: 1, addr2: 1}
+	if diff := cmp.Diff(want, removed); diff != "" {
+		t.Errorf("removed addresses mismatch (-want +got):\n%s", diff)
+	}
+}
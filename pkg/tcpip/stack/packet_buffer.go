@@ -60,6 +60,17 @@ type PacketBuffer struct {
 	// Owner is implemented by task to get the uid and gid.
 	// Only set for locally generated packets.
 	Owner tcpip.PacketOwner
+
+	// RxTimestamp is the time, in nanoseconds since the Unix epoch, at which
+	// an inbound packet was received, as reported by the link endpoint that
+	// delivered it (e.g. from a hardware timestamp). A value of zero
+	// indicates that the link endpoint did not provide one.
+	RxTimestamp int64
+
+	// Mark is the tag set on an inbound packet by the classifier of the NIC
+	// that received it. A value of zero indicates that the packet was not
+	// tagged. See Classifier.
+	Mark uint32
 }
 
 // Clone makes a copy of pk. It clones the Data field, which creates a new
@@ -0,0 +1,188 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/sync"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	// pmtuTimeout is how long a learned path MTU is used for. As per RFC 1191
+	// section 6.3, the path MTU is periodically increased back so that an
+	// increase in the path MTU can be detected, and a path MTU forged by an
+	// off-path host does not stick.
+	pmtuTimeout = 10 * time.Minute
+
+	// maxPMTUEntries is the maximum number of path MTUs held. When it is
+	// reached, the least recently used path MTU is forgotten to make room
+	// for a new one.
+	maxPMTUEntries = 1024
+)
+
+// PMTUEntry is a path MTU learned for a destination.
+type PMTUEntry struct {
+	// Addr is the destination address the path MTU was learned for.
+	Addr tcpip.Address
+
+	// MTU is the largest network-layer payload that can be sent to Addr
+	// without fragmentation, in the same terms as Route.MTU.
+	MTU uint32
+}
+
+// pmtuEntry is a path MTU held by a pmtuCache.
+type pmtuEntry struct {
+	mtu uint32
+
+	// expires is the monotonic time at which the entry stops being used.
+	expires int64
+
+	// lastUsed is the monotonic time at which the entry was last returned by
+	// get. It is accessed atomically.
+	lastUsed int64
+}
+
+// pmtuCache holds the path MTUs learned from ICMP "packet too big" messages,
+// keyed by destination address.
+//
+// The path MTUs are looked up every time a packet is sent, so get doesn't take
+// any lock: the entries are held in a map which is replaced, rather than
+// modified, when they are updated.
+//
+// This struct is safe for concurrent use.
+type pmtuCache struct {
+	clock tcpip.Clock
+
+	// mu serializes the updates of entries.
+	mu sync.Mutex
+
+	// entries holds a map[tcpip.Address]*pmtuEntry, which must not be
+	// modified once stored. It is nil until the first update.
+	entries atomic.Value
+}
+
+// minPMTU returns the smallest path MTU of the network protocol, as a
+// network-layer payload size, or 0 if the protocol is unknown.
+func minPMTU(protocol tcpip.NetworkProtocolNumber) uint32 {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		return header.IPv4MinimumMTU - header.IPv4MinimumSize
+	case header.IPv6ProtocolNumber:
+		return header.IPv6MinimumMTU - header.IPv6MinimumSize
+	default:
+		return 0
+	}
+}
+
+// load returns the current entries, which must not be modified.
+func (c *pmtuCache) load() map[tcpip.Address]*pmtuEntry {
+	entries, _ := c.entries.Load().(map[tcpip.Address]*pmtuEntry)
+	return entries
+}
+
+// update records mtu as the path MTU to addr, a destination of the given
+// network protocol. The path MTU is only ever lowered while it is known, and
+// never below the minimum MTU of the protocol, as ICMP messages carrying it
+// are not authenticated.
+func (c *pmtuCache) update(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, mtu uint32) {
+	if min := minPMTU(protocol); mtu < min {
+		mtu = min
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.NowMonotonic()
+	old := c.load()
+	if cur, ok := old[addr]; ok && cur.expires > now && cur.mtu <= mtu {
+		return
+	}
+
+	// Copy the entries which are still in use, leaving room for the new one.
+	entries := make(map[tcpip.Address]*pmtuEntry, len(old)+1)
+	var lru tcpip.Address
+	var lruTime int64
+	for a, e := range old {
+		if a == addr || e.expires <= now {
+			continue
+		}
+		entries[a] = e
+		if lastUsed := atomic.LoadInt64(&e.lastUsed); lru == "" || lastUsed < lruTime {
+			lru, lruTime = a, lastUsed
+		}
+	}
+	if len(entries) >= maxPMTUEntries {
+		delete(entries, lru)
+	}
+	entries[addr] = &pmtuEntry{
+		mtu:      mtu,
+		expires:  now + pmtuTimeout.Nanoseconds(),
+		lastUsed: now,
+	}
+	c.entries.Store(entries)
+}
+
+// get returns the path MTU to addr, if one is known.
+func (c *pmtuCache) get(addr tcpip.Address) (uint32, bool) {
+	entries := c.load()
+	if len(entries) == 0 {
+		return 0, false
+	}
+	e, ok := entries[addr]
+	if !ok {
+		return 0, false
+	}
+	now := c.clock.NowMonotonic()
+	if e.expires <= now {
+		return 0, false
+	}
+	atomic.StoreInt64(&e.lastUsed, now)
+	return e.mtu, true
+}
+
+// remove forgets the path MTU to addr.
+func (c *pmtuCache) remove(addr tcpip.Address) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old := c.load()
+	if _, ok := old[addr]; !ok {
+		return
+	}
+	entries := make(map[tcpip.Address]*pmtuEntry, len(old))
+	for a, e := range old {
+		if a != addr {
+			entries[a] = e
+		}
+	}
+	c.entries.Store(entries)
+}
+
+// snapshot returns all the known path MTUs.
+func (c *pmtuCache) snapshot() []PMTUEntry {
+	now := c.clock.NowMonotonic()
+	entries := c.load()
+	snapshot := make([]PMTUEntry, 0, len(entries))
+	for addr, e := range entries {
+		if e.expires > now {
+			snapshot = append(snapshot, PMTUEntry{Addr: addr, MTU: e.mtu})
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// fakeClock is a tcpip.Clock whose time only moves when advanced.
+type fakeClock struct {
+	now int64
+}
+
+func (c *fakeClock) NowNanoseconds() int64 {
+	return c.now
+}
+
+func (c *fakeClock) NowMonotonic() int64 {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now += d.Nanoseconds()
+}
+
+func TestPMTUCacheClampsToProtocolMinimum(t *testing.T) {
+	const addr = tcpip.Address("\x0a\x00\x00\x01")
+
+	tests := []struct {
+		protocol tcpip.NetworkProtocolNumber
+		want     uint32
+	}{
+		{header.IPv4ProtocolNumber, header.IPv4MinimumMTU - header.IPv4MinimumSize},
+		{header.IPv6ProtocolNumber, header.IPv6MinimumMTU - header.IPv6MinimumSize},
+	}
+	for _, test := range tests {
+		c := pmtuCache{clock: &fakeClock{}}
+		c.update(test.protocol, addr, 1)
+		if got, ok := c.get(addr); !ok || got != test.want {
+			t.Errorf("got c.get(%s) = (%d, %t) for protocol %d, want = (%d, true)", addr, got, ok, test.protocol, test.want)
+		}
+	}
+}
+
+func TestPMTUCacheExpiry(t *testing.T) {
+	const (
+		addr = tcpip.Address("\x0a\x00\x00\x01")
+		mtu  = 1000
+	)
+
+	clock := &fakeClock{}
+	c := pmtuCache{clock: clock}
+	c.update(header.IPv4ProtocolNumber, addr, mtu)
+
+	clock.advance(pmtuTimeout - time.Nanosecond)
+	if got, ok := c.get(addr); !ok || got != mtu {
+		t.Fatalf("got c.get(%s) = (%d, %t) before the timeout, want = (%d, true)", addr, got, ok, mtu)
+	}
+
+	clock.advance(time.Nanosecond)
+	if got, ok := c.get(addr); ok {
+		t.Fatalf("got c.get(%s) = (%d, true) after the timeout, want = (_, false)", addr, got)
+	}
+	if got := c.snapshot(); len(got) != 0 {
+		t.Errorf("got c.snapshot() = %v after the timeout, want = []", got)
+	}
+
+	// A larger path MTU is learned again once the old one has expired.
+	c.update(header.IPv4ProtocolNumber, addr, mtu+1)
+	if got, ok := c.get(addr); !ok || got != mtu+1 {
+		t.Errorf("got c.get(%s) = (%d, %t) after relearning, want = (%d, true)", addr, got, ok, mtu+1)
+	}
+}
+
+func TestPMTUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	const mtu = 1000
+
+	addrOf := func(i int) tcpip.Address {
+		return tcpip.Address(fmt.Sprintf("\x0a\x00%c%c", byte(i>>8), byte(i)))
+	}
+
+	clock := &fakeClock{}
+	c := pmtuCache{clock: clock}
+	for i := 0; i < maxPMTUEntries; i++ {
+		c.update(header.IPv4ProtocolNumber, addrOf(i), mtu)
+		clock.advance(time.Millisecond)
+	}
+
+	// Use the oldest entry so that the second oldest becomes the least
+	// recently used.
+	if _, ok := c.get(addrOf(0)); !ok {
+		t.Fatalf("got c.get(%s) = (_, false), want = (_, true)", addrOf(0))
+	}
+
+	c.update(header.IPv4ProtocolNumber, addrOf(maxPMTUEntries), mtu)
+	if got := len(c.snapshot()); got != maxPMTUEntries {
+		t.Errorf("got len(c.snapshot()) = %d, want = %d", got, maxPMTUEntries)
+	}
+	if _, ok := c.get(addrOf(1)); ok {
+		t.Errorf("got c.get(%s) = (_, true) for the least recently used entry, want = (_, false)", addrOf(1))
+	}
+	for _, i := range []int{0, 2, maxPMTUEntries} {
+		if _, ok := c.get(addrOf(i)); !ok {
+			t.Errorf("got c.get(%s) = (_, false), want = (_, true)", addrOf(i))
+		}
+	}
+}
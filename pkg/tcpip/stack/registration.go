@@ -185,6 +185,11 @@ type TransportDispatcher interface {
 	// DeliverTransportControlPacket delivers control packets to the
 	// appropriate transport protocol endpoint.
 	//
+	// pkt.Data must start with the transport header of the packet that
+	// caused the control packet to be sent, as the endpoint is found from
+	// the ports in that header. Network protocols must not deliver control
+	// packets about non-first fragments, which carry no transport header.
+	//
 	// pkt.NetworkHeader must be set before calling
 	// DeliverTransportControlPacket.
 	//
@@ -271,6 +276,74 @@ type NetworkEndpoint interface {
 	Close()
 }
 
+// FragmentationStats holds statistics about the reassembly of fragmented
+// packets.
+type FragmentationStats struct {
+	// Reassembled is the number of packets that were successfully
+	// reassembled.
+	Reassembled uint64
+
+	// Malformed is the number of packets discarded because their fragments
+	// could not be reassembled.
+	Malformed uint64
+
+	// TimedOut is the number of incomplete packets discarded because they
+	// were not reassembled within the reassembly timeout.
+	TimedOut uint64
+
+	// TimedOutMissingFirst is the number of the packets counted in TimedOut
+	// whose first fragment was never received, so that no ICMP Time Exceeded
+	// message could be sent for them (RFC 792, RFC 8200 section 4.5).
+	TimedOutMissingFirst uint64
+
+	// Evicted is the number of incomplete packets discarded because the
+	// reassembly memory limits were exceeded.
+	Evicted uint64
+
+	// InconsistentDSCP is the number of packets discarded because their
+	// fragments carried different DSCP values. See
+	// tcpip.FragmentDSCPCheckOption.
+	InconsistentDSCP uint64
+
+	// Pending is the number of packets currently being reassembled.
+	Pending int
+
+	// PendingBytes is the number of bytes of fragments currently held for
+	// packets being reassembled.
+	PendingBytes int
+}
+
+// add adds the statistics in o to s.
+func (s *FragmentationStats) add(o FragmentationStats) {
+	s.Reassembled += o.Reassembled
+	s.Malformed += o.Malformed
+	s.TimedOut += o.TimedOut
+	s.TimedOutMissingFirst += o.TimedOutMissingFirst
+	s.Evicted += o.Evicted
+	s.InconsistentDSCP += o.InconsistentDSCP
+	s.Pending += o.Pending
+	s.PendingBytes += o.PendingBytes
+}
+
+// FragmentationStatsReporter is implemented by network protocols that
+// reassemble fragmented packets.
+type FragmentationStatsReporter interface {
+	// FragmentationStats returns statistics about the packets reassembled by
+	// the protocol.
+	FragmentationStats() FragmentationStats
+}
+
+// NetworkFragmentationStats holds reassembly statistics for all network
+// protocols of a stack.
+type NetworkFragmentationStats struct {
+	// Total holds the statistics aggregated across all network protocols.
+	Total FragmentationStats
+
+	// PerProtocol holds the statistics of each network protocol that
+	// reassembles fragmented packets.
+	PerProtocol map[tcpip.NetworkProtocolNumber]FragmentationStats
+}
+
 // NetworkProtocol is the interface that needs to be implemented by network
 // protocols (e.g., ipv4, ipv6) that want to be part of the networking stack.
 type NetworkProtocol interface {
@@ -457,6 +530,25 @@ type LinkAddressResolver interface {
 	LinkAddressProtocol() tcpip.NetworkProtocolNumber
 }
 
+// A PacketTooBigReporter is an extension to a NetworkProtocol that can report
+// to the source of a packet that it could not be forwarded because it exceeded
+// the MTU of the outgoing link.
+type PacketTooBigReporter interface {
+	// ReportPacketTooBig sends an error message holding mtu to the source of
+	// pkt through r, a route to that source. The network header of pkt is
+	// at the start of pkt.Header.
+	ReportPacketTooBig(r *Route, mtu uint32, pkt PacketBuffer)
+}
+
+// A GroupLeaveReporter is an extension to a NetworkProtocol that can report to
+// the multicast routers of a link that a NIC left a multicast group, e.g. with
+// an IGMP Leave Group or MLD Done message.
+type GroupLeaveReporter interface {
+	// ReportGroupLeave sends a report that group was left through r, a route
+	// from the NIC which left group to the multicast routers of its link.
+	ReportGroupLeave(r *Route, group tcpip.Address)
+}
+
 // A LinkAddressCache caches link addresses.
 type LinkAddressCache interface {
 	// CheckLocalAddress determines if the given local address exists, and if it
@@ -15,6 +15,8 @@
 package stack
 
 import (
+	"sync/atomic"
+
 	"gvisor.dev/gvisor/pkg/sleep"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
@@ -48,6 +50,11 @@ type Route struct {
 
 	// Loop controls where WritePacket should send packets.
 	Loop PacketLooping
+
+	// directedBroadcastSrc is set if the route was made for a packet sent to
+	// a directed broadcast address, which is then LocalAddress. It holds the
+	// unicast address packets sent through the route are sent from.
+	directedBroadcastSrc tcpip.Address
 }
 
 // makeRoute initializes a new route. It takes ownership of the provided
@@ -158,16 +165,82 @@ func (r *Route) WritePacket(gso *GSO, params NetworkHeaderParams, pkt PacketBuff
 		return tcpip.ErrInvalidEndpointState
 	}
 
-	err := r.ref.ep.WritePacket(r, gso, params, pkt)
+	icmpType, isICMP := r.icmpType(params.Protocol, &pkt)
+	err := r.ref.ep.WritePacket(r.withUnicastSource(), gso, params, pkt)
 	if err != nil {
 		r.Stats().IP.OutgoingPacketErrors.Increment()
 	} else {
 		r.ref.nic.stats.Tx.Packets.Increment()
 		r.ref.nic.stats.Tx.Bytes.IncrementBy(uint64(pkt.Header.UsedLength() + pkt.Data.Size()))
+		r.ref.nic.recordEgress(r.LocalLinkAddress)
+		r.recordSpoofedTx(1, pkt.Header.UsedLength()+pkt.Data.Size())
+		if isICMP {
+			icmp := &r.ref.nic.stats.ICMP
+			countICMP(r.NetProto, icmpType, icmp.V4Sent, icmp.V6Sent)
+		}
 	}
 	return err
 }
 
+// withUnicastSource returns r, or a copy of r sending from the unicast address
+// of its NIC if r was made for a packet sent to a directed broadcast address:
+// as per RFC 1122 section 3.2.1.3, a broadcast address must never be used as
+// a source address.
+func (r *Route) withUnicastSource() *Route {
+	if r.directedBroadcastSrc == "" {
+		return r
+	}
+	unicast := *r
+	unicast.LocalAddress = r.directedBroadcastSrc
+	unicast.directedBroadcastSrc = ""
+	return &unicast
+}
+
+// IsDirectedBroadcast returns true if r was made for a packet sent to the
+// broadcast address of one of its NIC's address ranges. Such packets are
+// handled by the NIC's IPv4 broadcast endpoint.
+func (r *Route) IsDirectedBroadcast() bool {
+	return r.directedBroadcastSrc != ""
+}
+
+// icmpType returns the type of the ICMP message pkt holds, if it is an ICMP
+// packet of the route's network protocol, as given by protocol, about to be
+// written through r.
+func (r *Route) icmpType(protocol tcpip.TransportProtocolNumber, pkt *PacketBuffer) (uint8, bool) {
+	switch {
+	case r.NetProto == header.IPv4ProtocolNumber && protocol == header.ICMPv4ProtocolNumber:
+	case r.NetProto == header.IPv6ProtocolNumber && protocol == header.ICMPv6ProtocolNumber:
+	default:
+		return 0, false
+	}
+	// The transport header is at the front of Header, if it holds one.
+	if v := pkt.Header.View(); len(v) > 0 {
+		return v[0], true
+	}
+	if v := pkt.Data.First(); len(v) > 0 {
+		return v[0], true
+	}
+	return 0, false
+}
+
+// CountICMPReceived counts an ICMP message of type typ received through r in
+// the ICMP stats of its NIC. Network protocols call it for every ICMP message
+// they handle.
+func (r *Route) CountICMPReceived(typ uint8) {
+	icmp := &r.ref.nic.stats.ICMP
+	countICMP(r.NetProto, typ, icmp.V4Received, icmp.V6Received)
+}
+
+// recordSpoofedTx records that packets totalling bytes bytes were sent through
+// r, if r's local address is not assigned to its NIC.
+func (r *Route) recordSpoofedTx(packets, bytes int) {
+	if packets == 0 || !r.ref.isSpoofed() {
+		return
+	}
+	r.ref.nic.stats.SpoofedTx.Packets.IncrementBy(uint64(packets))
+	r.ref.nic.stats.SpoofedTx.Bytes.IncrementBy(uint64(bytes))
+}
+
 // WritePackets writes a list of n packets through the given route and returns
 // the number of packets written.
 func (r *Route) WritePackets(gso *GSO, pkts PacketBufferList, params NetworkHeaderParams) (int, *tcpip.Error) {
@@ -175,11 +248,14 @@ func (r *Route) WritePackets(gso *GSO, pkts PacketBufferList, params NetworkHead
 		return 0, tcpip.ErrInvalidEndpointState
 	}
 
-	n, err := r.ref.ep.WritePackets(r, gso, pkts, params)
+	n, err := r.ref.ep.WritePackets(r.withUnicastSource(), gso, pkts, params)
 	if err != nil {
 		r.Stats().IP.OutgoingPacketErrors.IncrementBy(uint64(pkts.Len() - n))
 	}
 	r.ref.nic.stats.Tx.Packets.IncrementBy(uint64(n))
+	if n > 0 {
+		r.ref.nic.recordEgress(r.LocalLinkAddress)
+	}
 
 	writtenBytes := 0
 	for i, pb := 0, pkts.Front(); i < n && pb != nil; i, pb = i+1, pb.Next() {
@@ -188,6 +264,7 @@ func (r *Route) WritePackets(gso *GSO, pkts PacketBufferList, params NetworkHead
 	}
 
 	r.ref.nic.stats.Tx.Bytes.IncrementBy(uint64(writtenBytes))
+	r.recordSpoofedTx(n, writtenBytes)
 	return n, err
 }
 
@@ -204,6 +281,7 @@ func (r *Route) WriteHeaderIncludedPacket(pkt PacketBuffer) *tcpip.Error {
 	}
 	r.ref.nic.stats.Tx.Packets.Increment()
 	r.ref.nic.stats.Tx.Bytes.IncrementBy(uint64(pkt.Data.Size()))
+	r.ref.nic.recordEgress(r.LocalLinkAddress)
 	return nil
 }
 
@@ -212,9 +290,14 @@ func (r *Route) DefaultTTL() uint8 {
 	return r.ref.ep.DefaultTTL()
 }
 
-// MTU returns the MTU of the underlying network endpoint.
+// MTU returns the MTU of the underlying network endpoint, lowered to the path
+// MTU to the remote address if one has been learned.
 func (r *Route) MTU() uint32 {
-	return r.ref.ep.MTU()
+	mtu := r.ref.ep.MTU()
+	if pmtu, ok := r.ref.nic.stack.pmtuCache.get(r.RemoteAddress); ok && pmtu < mtu {
+		mtu = pmtu
+	}
+	return mtu
 }
 
 // Release frees all resources associated with the route.
@@ -251,7 +334,46 @@ func (r *Route) MakeLoopedRoute() Route {
 	return l
 }
 
+// ICMPRepliesSuppressed returns true if ICMP replies and errors must not be
+// sent in response to packets received through the route's NIC, or sent to a
+// directed broadcast address. As per RFC 1122 sections 3.2.2 and 3.2.2.6, no
+// ICMP error is sent about such packets and echo requests sent to them are
+// silently discarded, so that a host cannot be used to amplify traffic.
+func (r *Route) ICMPRepliesSuppressed() bool {
+	return r.ref.nic.suppressICMPReplies || r.IsDirectedBroadcast()
+}
+
+// TCPMSSClamp returns the maximum TCP MSS to advertise on the route, or zero
+// if the MSS is only limited by the MTU. See NICOptions.TCPMSSClamp.
+func (r *Route) TCPMSSClamp() uint16 {
+	return r.ref.nic.tcpMSSClamp
+}
+
+// TCPInitialCwnd returns the initial TCP congestion window, in segments, for
+// connections on the route, or zero to use the TCP default. See
+// NICOptions.TCPInitialCwnd.
+func (r *Route) TCPInitialCwnd() int {
+	return r.ref.nic.tcpInitialCwnd
+}
+
+// ECN returns the ECN codepoint set on the packets of TCP connections on the
+// route which negotiated ECN, or zero if ECN is disabled. See NICOptions.ECN.
+func (r *Route) ECN() uint8 {
+	return r.ref.nic.ecn
+}
+
 // Stack returns the instance of the Stack that owns this route.
 func (r *Route) Stack() *Stack {
 	return r.ref.stack()
 }
+
+// RefInfo returns the address of the endpoint the route is associated with and
+// the number of references currently held on it, including the route's own.
+// It is meant for debugging; the reference count may change as soon as it is
+// returned. A released route returns an empty address and zero references.
+func (r *Route) RefInfo() (addr tcpip.Address, refs int32) {
+	if r.ref == nil {
+		return "", 0
+	}
+	return r.ref.ep.ID().LocalAddress, atomic.LoadInt32(&r.ref.refs)
+}
@@ -23,6 +23,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	mathrand "math/rand"
+	"reflect"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -51,8 +54,11 @@ const (
 )
 
 type transportProtocolState struct {
-	proto          TransportProtocol
-	defaultHandler func(r *Route, id TransportEndpointID, pkt PacketBuffer) bool
+	proto TransportProtocol
+
+	// defaultHandlers are invoked in order for packets that no endpoint
+	// accepted, until one of them returns true.
+	defaultHandlers []func(r *Route, id TransportEndpointID, pkt PacketBuffer) bool
 }
 
 // TCPProbeFunc is the expected function type for a TCP probe function to be
@@ -412,6 +418,16 @@ type Stack struct {
 	// destination.
 	routeTable []tcpip.Route
 
+	// weakHost is 1 if NICs accept packets for addresses assigned to other
+	// NICs. See SetHostModel. It is accessed atomically, as it is checked for
+	// every packet which is not addressed to the NIC it is received on.
+	weakHost uint32
+
+	// multicastRoutes is the multicast forwarding cache. It maps the NIC a
+	// multicast packet was received on and its destination group to the NICs
+	// the packet is forwarded out of.
+	multicastRoutes map[multicastRouteKey][]tcpip.NICID
+
 	*ports.PortManager
 
 	// If not nil, then any new endpoints will have this probe function
@@ -424,6 +440,25 @@ type Stack struct {
 	// handleLocal allows non-loopback interfaces to loop packets.
 	handleLocal bool
 
+	// allowExternalLoopback indicates whether packets destined to a loopback
+	// address are accepted when received by a NIC that is not a loopback NIC.
+	// It is set during Stack creation and is immutable.
+	allowExternalLoopback bool
+
+	// tempEndpointErrorHandler is called when a NIC fails to create a
+	// temporary endpoint. It is set during Stack creation and is immutable.
+	tempEndpointErrorHandler func(tcpip.NICID, tcpip.NetworkProtocolNumber, tcpip.Address, *tcpip.Error)
+
+	// rejectUnknownProtocolFragments indicates whether fragments of packets
+	// for unsupported transport protocols are dropped on receipt. It is set
+	// during Stack creation and is immutable.
+	rejectUnknownProtocolFragments bool
+
+	// strictSourceAddressCheck indicates whether routes may only be found for
+	// a local address assigned to the NIC. It is set during Stack creation and
+	// is immutable.
+	strictSourceAddressCheck bool
+
 	// tablesMu protects iptables.
 	tablesMu sync.RWMutex
 
@@ -471,6 +506,13 @@ type Stack struct {
 	// randomGenerator is an injectable pseudo random generator that can be
 	// used when a random number is required.
 	randomGenerator *mathrand.Rand
+
+	// forwardingLog holds the most recent forwarding decisions. It is nil if
+	// forwarding decisions are not logged.
+	forwardingLog *forwardingLog
+
+	// pmtuCache holds the path MTUs learned from ICMP messages.
+	pmtuCache pmtuCache
 }
 
 // UniqueID is an abstract generator of unique identifiers.
@@ -541,6 +583,39 @@ type Options struct {
 	//
 	// RandSource must be thread-safe.
 	RandSource mathrand.Source
+
+	// ForwardingLogSize is the number of most recent forwarding decisions
+	// kept in the log returned by Stack.ForwardingLog. If zero, forwarding
+	// decisions are not logged.
+	ForwardingLogSize int
+
+	// RejectUnknownProtocolFragments indicates whether IP fragments of packets
+	// carrying a transport protocol the stack does not support are dropped as
+	// soon as they are received, instead of being buffered for reassembly. Such
+	// packets are dropped once reassembled either way; rejecting their
+	// fragments early saves the memory used to hold them.
+	RejectUnknownProtocolFragments bool
+
+	// AllowExternalLoopbackTraffic indicates whether packets destined to a
+	// loopback address (127.0.0.0/8 or ::1) are accepted when they are
+	// received by a NIC that is not a loopback NIC. By default, such packets
+	// are dropped as martians.
+	AllowExternalLoopbackTraffic bool
+
+	// TempEndpointErrorHandler, if not nil, is called with the NIC, protocol,
+	// address and error whenever a NIC fails to create a temporary endpoint,
+	// e.g. to receive a packet in promiscuous mode. Such failures are also
+	// counted in NICStats.TempEndpointErrors.
+	TempEndpointErrorHandler func(nicID tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, err *tcpip.Error)
+
+	// StrictSourceAddressCheck indicates whether a route may only be found for
+	// a local address that is permanently assigned to the egress NIC, unless
+	// the NIC allows spoofing. When enabled, FindRoute returns
+	// tcpip.ErrBadLocalAddress instead of using a temporary endpoint for an
+	// unassigned local address, e.g. one created in promiscuous mode or for an
+	// address range, so that endpoints cannot accidentally send packets with a
+	// spoofed source address.
+	StrictSourceAddressCheck bool
 }
 
 // TransportEndpointInfo holds useful information about a transport endpoint
@@ -655,6 +730,7 @@ func New(opts Options) *Stack {
 		linkAddrCache:        newLinkAddrCache(ageLimit, resolutionTimeout, resolutionAttempts),
 		PortManager:          ports.NewPortManager(),
 		clock:                clock,
+		pmtuCache:            pmtuCache{clock: clock},
 		stats:                opts.Stats.FillIn(),
 		handleLocal:          opts.HandleLocal,
 		icmpRateLimiter:      NewICMPRateLimiter(),
@@ -666,6 +742,12 @@ func New(opts Options) *Stack {
 		opaqueIIDOpts:        opts.OpaqueIIDOpts,
 		forwarder:            newForwardQueue(),
 		randomGenerator:      mathrand.New(randSrc),
+		forwardingLog:        newForwardingLog(opts.ForwardingLogSize),
+
+		rejectUnknownProtocolFragments: opts.RejectUnknownProtocolFragments,
+		allowExternalLoopback:          opts.AllowExternalLoopbackTraffic,
+		tempEndpointErrorHandler:       opts.TempEndpointErrorHandler,
+		strictSourceAddressCheck:       opts.StrictSourceAddressCheck,
 	}
 
 	// Add specified network protocols.
@@ -754,14 +836,32 @@ func (s *Stack) TransportProtocolOption(transport tcpip.TransportProtocolNumber,
 }
 
 // SetTransportProtocolHandler sets the per-stack default handler for the given
-// protocol.
+// protocol, replacing any handlers added previously. A nil h removes all the
+// default handlers.
 //
 // It must be called only during initialization of the stack. Changing it as the
 // stack is operating is not supported.
 func (s *Stack) SetTransportProtocolHandler(p tcpip.TransportProtocolNumber, h func(*Route, TransportEndpointID, PacketBuffer) bool) {
+	state := s.transportProtocols[p]
+	if state == nil {
+		return
+	}
+	state.defaultHandlers = nil
+	if h != nil {
+		state.defaultHandlers = append(state.defaultHandlers, h)
+	}
+}
+
+// AddTransportProtocolHandler adds a per-stack default handler for the given
+// protocol. Default handlers are invoked in the order they were added for
+// packets that no endpoint accepted, until one of them returns true.
+//
+// It must be called only during initialization of the stack. Changing it as the
+// stack is operating is not supported.
+func (s *Stack) AddTransportProtocolHandler(p tcpip.TransportProtocolNumber, h func(*Route, TransportEndpointID, PacketBuffer) bool) {
 	state := s.transportProtocols[p]
 	if state != nil {
-		state.defaultHandler = h
+		state.defaultHandlers = append(state.defaultHandlers, h)
 	}
 }
 
@@ -770,6 +870,16 @@ func (s *Stack) NowNanoseconds() int64 {
 	return s.clock.NowNanoseconds()
 }
 
+// ReceiveTime returns the time at which pkt was received, in nanoseconds since
+// the Unix epoch. It is the timestamp attached to pkt by the link endpoint if
+// there is one, and the current time otherwise.
+func (s *Stack) ReceiveTime(pkt *PacketBuffer) int64 {
+	if pkt.RxTimestamp != 0 {
+		return pkt.RxTimestamp
+	}
+	return s.NowNanoseconds()
+}
+
 // Stats returns a mutable copy of the current stats.
 //
 // This is not generally exported via the public interface, but is available
@@ -786,6 +896,15 @@ func (s *Stack) Stats() tcpip.Stats {
 // Solicitations will be stopped.
 func (s *Stack) SetForwarding(enable bool) {
 	// TODO(igudger, bgeffon): Expose via /proc/sys/net/ipv4/ip_forward.
+	// The NICs which became IPv6 routers are notified of the removals of their
+	// auto-generated addresses once s is unlocked.
+	var routers []*NIC
+	defer func() {
+		for _, nic := range routers {
+			nic.flushAddressRemovals()
+		}
+	}()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -804,6 +923,7 @@ func (s *Stack) SetForwarding(enable bool) {
 	if enable {
 		for _, nic := range s.nics {
 			nic.becomeIPv6Router()
+			routers = append(routers, nic)
 		}
 	} else {
 		for _, nic := range s.nics {
@@ -812,6 +932,51 @@ func (s *Stack) SetForwarding(enable bool) {
 	}
 }
 
+// SetHostModel sets whether the stack follows the weak host model, in which a
+// NIC accepts unicast packets for addresses assigned to any of the stack's
+// NICs, or the strong host model, in which a NIC only accepts packets for its
+// own addresses. The strong host model is used by default.
+//
+// Under the weak host model, loopback addresses are still only accepted by
+// the NIC they are assigned to. Packets for the addresses of other NICs are
+// handled by the NIC they are received on, so that replies to them are sent
+// through that NIC.
+func (s *Stack) SetHostModel(weak bool) {
+	var v uint32
+	if weak {
+		v = 1
+	}
+	atomic.StoreUint32(&s.weakHost, v)
+}
+
+// isWeakHostAddress returns true if the stack follows the weak host model and
+// addr is a unicast address assigned to a NIC other than in.
+func (s *Stack) isWeakHostAddress(in *NIC, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	if atomic.LoadUint32(&s.weakHost) == 0 {
+		return false
+	}
+	if isLoopbackAddress(protocol, addr) || addr == header.IPv4Broadcast || header.IsV4MulticastAddress(addr) || header.IsV6MulticastAddress(addr) {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, nic := range s.nics {
+		if nic == in {
+			continue
+		}
+		nic.mu.RLock()
+		ref, ok := nic.mu.endpoints[NetworkEndpointID{addr}]
+		assigned := ok && nic.mu.enabled && ref.protocol == protocol && ref.getKind() == permanent
+		nic.mu.RUnlock()
+		if assigned {
+			return true
+		}
+	}
+	return false
+}
+
 // Forwarding returns if the packet forwarding between NICs is enabled.
 func (s *Stack) Forwarding() bool {
 	// TODO(igudger, bgeffon): Expose via /proc/sys/net/ipv4/ip_forward.
@@ -820,6 +985,60 @@ func (s *Stack) Forwarding() bool {
 	return s.forwarding
 }
 
+// ForwardingLog returns the most recent forwarding decisions, oldest first.
+//
+// Returns nil if the stack was not configured to log forwarding decisions.
+func (s *Stack) ForwardingLog() []ForwardEvent {
+	if s.forwardingLog == nil {
+		return nil
+	}
+	return s.forwardingLog.snapshot()
+}
+
+// PMTUEntries returns the path MTUs the stack has learned from ICMP "packet
+// too big" messages, in no particular order.
+func (s *Stack) PMTUEntries() []PMTUEntry {
+	return s.pmtuCache.snapshot()
+}
+
+// ClearPMTU forgets the path MTU learned for dst, so that routes to dst use
+// their link's MTU again.
+func (s *Stack) ClearPMTU(dst tcpip.Address) {
+	s.pmtuCache.remove(dst)
+}
+
+// recordForward records the forwarding decision e in the statistics of the
+// NICs involved and in the forwarding log, if forwarding decisions are logged.
+func (s *Stack) recordForward(e ForwardEvent) {
+	s.mu.RLock()
+	inNIC := s.nics[e.InNIC]
+	outNIC := s.nics[e.OutNIC]
+	s.mu.RUnlock()
+
+	switch e.Result {
+	case ForwardSent:
+		if inNIC != nil {
+			inNIC.stats.Forwarded.Increment()
+		}
+	case ForwardDeliveredLocally:
+		if inNIC != nil {
+			inNIC.stats.Delivered.Increment()
+		}
+	case ForwardLinkResolutionFailed, ForwardWriteError:
+		// Other failures are recorded as drops by the NIC that dropped the
+		// packet.
+		if outNIC != nil {
+			outNIC.stats.Dropped.Increment()
+		}
+	}
+
+	if s.forwardingLog == nil {
+		return
+	}
+	e.Timestamp = s.clock.NowNanoseconds()
+	s.forwardingLog.record(e)
+}
+
 // SetRouteTable assigns the route table to be used by this stack. It
 // specifies which NIC to use for given destination address ranges.
 //
@@ -845,6 +1064,129 @@ func (s *Stack) AddRoute(route tcpip.Route) {
 	s.routeTable = append(s.routeTable, route)
 }
 
+// ReplaceRoute adds a route to the front of the route table, so that it takes
+// precedence over all other routes, and removes any other route to the same
+// destination through the same NIC.
+func (s *Stack) ReplaceRoute(route tcpip.Route) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table := []tcpip.Route{route}
+	for _, r := range s.routeTable {
+		if r.Destination != route.Destination || r.NIC != route.NIC {
+			table = append(table, r)
+		}
+	}
+	s.routeTable = table
+}
+
+// RemoveRoute removes every route equal to route from the route table. It
+// returns true if a route was removed.
+func (s *Stack) RemoveRoute(route tcpip.Route) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table := s.routeTable[:0]
+	for _, r := range s.routeTable {
+		if r != route {
+			table = append(table, r)
+		}
+	}
+	removed := len(table) != len(s.routeTable)
+	s.routeTable = table
+	return removed
+}
+
+// MulticastRoute is an entry in the stack's multicast forwarding cache.
+type MulticastRoute struct {
+	// InNIC is the NIC multicast packets must be received on to be
+	// forwarded.
+	InNIC tcpip.NICID
+
+	// Group is the multicast group address the packets are sent to.
+	Group tcpip.Address
+
+	// OutNICs are the NICs the packets are forwarded out of. Each NIC must
+	// have an address of the packet's network protocol for packets to be
+	// forwarded out of it.
+	OutNICs []tcpip.NICID
+}
+
+// multicastRouteKey is the key of an entry in the multicast forwarding cache.
+type multicastRouteKey struct {
+	inNIC tcpip.NICID
+	group tcpip.Address
+}
+
+// AddMulticastRoute adds route to the stack's multicast forwarding cache,
+// replacing any route with the same incoming NIC and group. When forwarding
+// is enabled, multicast packets received on route.InNIC and sent to
+// route.Group are forwarded out of route.OutNICs, in addition to being
+// delivered locally if the incoming NIC joined the group.
+//
+// Link-local multicast groups are never forwarded.
+func (s *Stack) AddMulticastRoute(route MulticastRoute) *tcpip.Error {
+	isV4 := header.IsV4MulticastAddress(route.Group)
+	if !isV4 && !header.IsV6MulticastAddress(route.Group) {
+		return tcpip.ErrBadAddress
+	}
+	// Packets sent to the IPv4 Local Network Control Block (224.0.0.0/24) or
+	// link-local IPv6 multicast addresses must not be forwarded.
+	if (isV4 && route.Group[:3] == "\xe0\x00\x00") || header.IsV6LinkLocalMulticastAddress(route.Group) {
+		return tcpip.ErrBadAddress
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nics[route.InNIC]; !ok {
+		return tcpip.ErrUnknownNICID
+	}
+	outNICs := make([]tcpip.NICID, 0, len(route.OutNICs))
+	for _, id := range route.OutNICs {
+		if _, ok := s.nics[id]; !ok {
+			return tcpip.ErrUnknownNICID
+		}
+		// Packets are never forwarded back out of the NIC they were received
+		// on.
+		if id != route.InNIC {
+			outNICs = append(outNICs, id)
+		}
+	}
+
+	if s.multicastRoutes == nil {
+		s.multicastRoutes = make(map[multicastRouteKey][]tcpip.NICID)
+	}
+	s.multicastRoutes[multicastRouteKey{inNIC: route.InNIC, group: route.Group}] = outNICs
+	return nil
+}
+
+// RemoveMulticastRoute removes the route for packets received on inNIC and
+// sent to group from the stack's multicast forwarding cache. Returns false if
+// there was no such route.
+func (s *Stack) RemoveMulticastRoute(inNIC tcpip.NICID, group tcpip.Address) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := multicastRouteKey{inNIC: inNIC, group: group}
+	if _, ok := s.multicastRoutes[key]; !ok {
+		return false
+	}
+	delete(s.multicastRoutes, key)
+	return true
+}
+
+// multicastRoute returns the NICs that multicast packets received on inNIC
+// and sent to group are forwarded out of. Returns false if there is no route
+// for such packets. The returned slice must not be modified.
+func (s *Stack) multicastRoute(inNIC tcpip.NICID, group tcpip.Address) ([]tcpip.NICID, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	outNICs, ok := s.multicastRoutes[multicastRouteKey{inNIC: inNIC, group: group}]
+	return outNICs, ok
+}
+
 // NewEndpoint creates a new transport layer endpoint of the given protocol.
 func (s *Stack) NewEndpoint(transport tcpip.TransportProtocolNumber, network tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
 	t, ok := s.transportProtocols[transport]
@@ -903,6 +1245,64 @@ type NICOptions struct {
 	// should be tracked alongside a NIC, to avoid having to keep a
 	// map[tcpip.NICID]metadata mirroring stack.Stack's nic map.
 	Context NICContext
+
+	// MaxAddresses specifies the maximum number of permanent addresses the
+	// NIC may hold, to bound memory usage. Multicast group memberships are not
+	// counted. Zero means no limit.
+	MaxAddresses int
+
+	// SuppressICMPReplies specifies whether the stack should refrain from
+	// sending any ICMP replies or errors (e.g. Echo Replies or Destination
+	// Unreachable messages) in response to packets received by the NIC.
+	// Neighbor Discovery messages are not affected.
+	SuppressICMPReplies bool
+
+	// OnModeChanged, if not nil, is called with the new state of both modes
+	// whenever promiscuous or spoofing mode is enabled or disabled on the
+	// NIC. It is not called if a mode is set to its current state.
+	OnModeChanged func(promiscuous, spoofing bool)
+
+	// TCPMSSClamp is the maximum TCP MSS advertised in SYN and SYN-ACK
+	// segments sent out of the NIC, as done by gateways for tunnels whose
+	// MTU is lower than the NIC's. Zero means the MSS is only limited by
+	// the NIC's MTU.
+	TCPMSSClamp uint16
+
+	// TCPInitialCwnd is the initial congestion window, in segments, of TCP
+	// connections through the NIC. Zero means the TCP default.
+	TCPInitialCwnd int
+
+	// ECN is the ECN codepoint set on the data packets of TCP connections
+	// through the NIC which negotiated ECN with their peer, as per RFC 3168.
+	// Zero (Not-ECT) disables ECN negotiation; otherwise it must be
+	// header.ECNECT0 or header.ECNECT1.
+	ECN uint8
+
+	// TempEndpointRateLimit is the maximum rate, in endpoints per second, at
+	// which the NIC creates temporary endpoints, e.g. for the destinations
+	// of packets received in promiscuous mode. Packets that would need a
+	// temporary endpoint beyond this rate are dropped and counted in
+	// NICStats.TempEndpointsThrottled. Zero means no limit.
+	TempEndpointRateLimit rate.Limit
+
+	// TempEndpointBurst is the number of temporary endpoints that may be
+	// created in a burst when TempEndpointRateLimit is set. Values below 1
+	// are treated as 1.
+	TempEndpointBurst int
+
+	// NDPDisp, if set, is the NDP event dispatcher that receives the NDP
+	// related events of the NIC, instead of Options.NDPDisp. It lets the
+	// events of different NICs be handled separately.
+	NDPDisp NDPDispatcher
+
+	// OnAddressRemoved, if not nil, is called whenever an address endpoint
+	// is removed from the NIC, once it is closed, with the kind the endpoint
+	// had before it was removed: "permanent" or "tentative" for addresses
+	// which were removed from the NIC, once their endpoint is no longer
+	// referenced, or "temporary" for temporary endpoints. It is called once
+	// neither the NIC nor the stack is locked, so it may call into the stack
+	// to query or modify the addresses of the NIC.
+	OnAddressRemoved func(addr tcpip.Address, kind string)
 }
 
 // CreateNICWithOptions creates a NIC with the provided id, LinkEndpoint, and
@@ -928,10 +1328,16 @@ func (s *Stack) CreateNICWithOptions(id tcpip.NICID, ep LinkEndpoint, opts NICOp
 		}
 	}
 
-	n := newNIC(s, id, opts.Name, ep, opts.Context)
+	switch opts.ECN {
+	case 0, header.ECNECT0, header.ECNECT1:
+	default:
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	n := newNIC(s, id, ep, opts)
 	s.nics[id] = n
 	if !opts.Disabled {
-		return n.enable()
+		return n.Enable()
 	}
 
 	return nil
@@ -943,6 +1349,37 @@ func (s *Stack) CreateNIC(id tcpip.NICID, ep LinkEndpoint) *tcpip.Error {
 	return s.CreateNICWithOptions(id, ep, NICOptions{})
 }
 
+// RenameNIC changes the name of the NIC with the given ID to name, which must
+// not be empty nor contain NUL bytes. Returns tcpip.ErrDuplicateNICID if
+// another NIC already has that name.
+func (s *Stack) RenameNIC(id tcpip.NICID, name string) *tcpip.Error {
+	if name == "" || strings.IndexByte(name, 0) != -1 {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nic, ok := s.nics[id]
+	if !ok {
+		return tcpip.ErrUnknownNICID
+	}
+	for otherID, other := range s.nics {
+		if otherID != id && other.Name() == name {
+			return tcpip.ErrDuplicateNICID
+		}
+	}
+
+	nic.setName(name)
+	return nil
+}
+
+// FindNICByName returns the NIC with the given name. It is the same as
+// GetNICByName.
+func (s *Stack) FindNICByName(name string) (*NIC, bool) {
+	return s.GetNICByName(name)
+}
+
 // GetNICByName gets the NIC specified by name.
 func (s *Stack) GetNICByName(name string) (*NIC, bool) {
 	s.mu.RLock()
@@ -966,20 +1403,20 @@ func (s *Stack) EnableNIC(id tcpip.NICID) *tcpip.Error {
 		return tcpip.ErrUnknownNICID
 	}
 
-	return nic.enable()
+	return nic.Enable()
 }
 
 // DisableNIC disables the given NIC.
 func (s *Stack) DisableNIC(id tcpip.NICID) *tcpip.Error {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-
 	nic, ok := s.nics[id]
+	s.mu.RUnlock()
+
 	if !ok {
 		return tcpip.ErrUnknownNICID
 	}
 
-	return nic.disable()
+	return nic.Disable()
 }
 
 // CheckNIC checks if a NIC is usable.
@@ -992,16 +1429,16 @@ func (s *Stack) CheckNIC(id tcpip.NICID) bool {
 		return false
 	}
 
-	return nic.enabled()
+	return nic.Enabled()
 }
 
 // RemoveNIC removes NIC and all related routes from the network stack.
 func (s *Stack) RemoveNIC(id tcpip.NICID) *tcpip.Error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	nic, ok := s.nics[id]
 	if !ok {
+		s.mu.Unlock()
 		return tcpip.ErrUnknownNICID
 	}
 	delete(s.nics, id)
@@ -1019,7 +1456,29 @@ func (s *Stack) RemoveNIC(id tcpip.NICID) *tcpip.Error {
 	}
 	s.routeTable = s.routeTable[:n]
 
-	return nic.remove()
+	s.linkAddrCache.removeNIC(id)
+
+	// Remove multicast routes through the NIC.
+	for key, outNICs := range s.multicastRoutes {
+		if key.inNIC == id {
+			delete(s.multicastRoutes, key)
+			continue
+		}
+		for i, outNIC := range outNICs {
+			if outNIC == id {
+				// The slice may be in use by readers, so replace it instead of
+				// modifying it in place.
+				s.multicastRoutes[key] = append(append([]tcpip.NICID(nil), outNICs[:i]...), outNICs[i+1:]...)
+				break
+			}
+		}
+	}
+
+	removals, err := nic.remove()
+	s.mu.Unlock()
+
+	nic.notifyAddressRemovals(removals)
+	return err
 }
 
 // NICAddressRanges returns a map of NICIDs to their associated subnets.
@@ -1071,16 +1530,16 @@ func (s *Stack) NICInfo() map[tcpip.NICID]NICInfo {
 	for id, nic := range s.nics {
 		flags := NICStateFlags{
 			Up:          true, // Netstack interfaces are always up.
-			Running:     nic.enabled(),
-			Promiscuous: nic.isPromiscuousMode(),
+			Running:     nic.Enabled(),
+			Promiscuous: nic.Promiscuous(),
 			Loopback:    nic.isLoopback(),
 		}
 		nics[id] = NICInfo{
-			Name:              nic.name,
+			Name:              nic.Name(),
 			LinkAddress:       nic.linkEP.LinkAddress(),
 			ProtocolAddresses: nic.PrimaryAddresses(),
 			Flags:             flags,
-			MTU:               nic.linkEP.MTU(),
+			MTU:               nic.MTU(),
 			Stats:             nic.stats,
 			Context:           nic.context,
 		}
@@ -1144,6 +1603,22 @@ func (s *Stack) AddProtocolAddressWithOptions(id tcpip.NICID, protocolAddress tc
 	return nic.AddAddress(protocolAddress, peb)
 }
 
+// AddDeprecatedProtocolAddress is the same as AddProtocolAddressWithOptions,
+// but the address is added in the deprecated state: it accepts inbound
+// packets but is not preferred as the source address for new outbound
+// traffic. This is useful when renumbering.
+func (s *Stack) AddDeprecatedProtocolAddress(id tcpip.NICID, protocolAddress tcpip.ProtocolAddress, peb PrimaryEndpointBehavior) *tcpip.Error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.AddDeprecatedAddress(protocolAddress, peb)
+}
+
 // AddAddressRange adds a range of addresses to the specified NIC. The range is
 // given by a subnet address, and all addresses contained in the subnet are
 // used except for the subnet address itself and the subnet's broadcast
@@ -1177,9 +1652,10 @@ func (s *Stack) RemoveAddressRange(id tcpip.NICID, subnet tcpip.Subnet) *tcpip.E
 // NIC.
 func (s *Stack) RemoveAddress(id tcpip.NICID, addr tcpip.Address) *tcpip.Error {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	nic, ok := s.nics[id]
+	s.mu.RUnlock()
 
-	if nic, ok := s.nics[id]; ok {
+	if ok {
 		return nic.RemoveAddress(addr)
 	}
 
@@ -1216,35 +1692,75 @@ func (s *Stack) GetMainNICAddress(id tcpip.NICID, protocol tcpip.NetworkProtocol
 	return nic.primaryAddress(protocol), nil
 }
 
-func (s *Stack) getRefEP(nic *NIC, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) (ref *referencedNetworkEndpoint) {
+// getRefEP returns a reference to the endpoint of nic to use for a route from
+// localAddr to remoteAddr.
+//
+// If localAddr is rejected, the reference taken to its endpoint is returned as
+// rejected, for the caller to release once s is unlocked.
+func (s *Stack) getRefEP(nic *NIC, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) (ref, rejected *referencedNetworkEndpoint, err *tcpip.Error) {
 	if len(localAddr) == 0 {
-		return nic.primaryEndpoint(netProto, remoteAddr)
+		return nic.primaryEndpoint(netProto, remoteAddr), nil, nil
 	}
-	return nic.findEndpoint(netProto, localAddr, CanBePrimaryEndpoint)
+	ref = nic.findEndpoint(netProto, localAddr, CanBePrimaryEndpoint)
+	if ref != nil && s.strictSourceAddressCheck && ref.getKind() != permanent && !nic.Spoofing() {
+		// localAddr is not assigned to nic.
+		return nil, ref, tcpip.ErrBadLocalAddress
+	}
+	return ref, nil, nil
 }
 
 // FindRoute creates a route to the given destination address, leaving through
 // the given nic and local address (if provided).
 func (s *Stack) FindRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber, multicastLoop bool) (Route, *tcpip.Error) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	r, rejected, err := s.findRouteRLocked(id, localAddr, remoteAddr, netProto, multicastLoop)
+	s.mu.RUnlock()
+
+	// Release the references to the rejected local endpoints once s is
+	// unlocked, as it may remove the endpoints.
+	for _, ref := range rejected {
+		ref.decRef()
+	}
+
+	return r, err
+}
+
+// findRouteRLocked is FindRoute with s read locked. It also returns the
+// references taken to the endpoints of rejected local addresses.
+func (s *Stack) findRouteRLocked(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber, multicastLoop bool) (Route, []*referencedNetworkEndpoint, *tcpip.Error) {
+	var rejected []*referencedNetworkEndpoint
 
 	isBroadcast := remoteAddr == header.IPv4Broadcast
 	isMulticast := header.IsV4MulticastAddress(remoteAddr) || header.IsV6MulticastAddress(remoteAddr)
 	needRoute := !(isBroadcast || isMulticast || header.IsV6LinkLocalAddress(remoteAddr))
+
+	// refErr is returned if no route is found because localAddr was rejected.
+	var refErr *tcpip.Error
 	if id != 0 && !needRoute {
-		if nic, ok := s.nics[id]; ok && nic.enabled() {
-			if ref := s.getRefEP(nic, localAddr, remoteAddr, netProto); ref != nil {
-				return makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, nic.linkEP.LinkAddress(), ref, s.handleLocal && !nic.isLoopback(), multicastLoop && !nic.isLoopback()), nil
+		if nic, ok := s.nics[id]; ok && nic.Enabled() {
+			ref, rejectedRef, err := s.getRefEP(nic, localAddr, remoteAddr, netProto)
+			if ref != nil {
+				return makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, nic.linkEP.LinkAddress(), ref, s.handleLocal && !nic.isLoopback(), multicastLoop && !nic.isLoopback()), nil, nil
 			}
+			if rejectedRef != nil {
+				rejected = append(rejected, rejectedRef)
+			}
+			refErr = err
 		}
 	} else {
 		for _, route := range s.routeTable {
 			if (id != 0 && id != route.NIC) || (len(remoteAddr) != 0 && !route.Destination.Contains(remoteAddr)) {
 				continue
 			}
-			if nic, ok := s.nics[route.NIC]; ok && nic.enabled() {
-				if ref := s.getRefEP(nic, localAddr, remoteAddr, netProto); ref != nil {
+			if nic, ok := s.nics[route.NIC]; ok && nic.Enabled() {
+				ref, rejectedRef, err := s.getRefEP(nic, localAddr, remoteAddr, netProto)
+				if rejectedRef != nil {
+					rejected = append(rejected, rejectedRef)
+				}
+				if err != nil && refErr == nil {
+					refErr = err
+				}
+				if ref != nil {
 					if len(remoteAddr) == 0 {
 						// If no remote address was provided, then the route
 						// provided will refer to the link local address.
@@ -1255,17 +1771,21 @@ func (s *Stack) FindRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, n
 					if needRoute {
 						r.NextHop = route.Gateway
 					}
-					return r, nil
+					return r, rejected, nil
 				}
 			}
 		}
 	}
 
+	if refErr != nil {
+		return Route{}, rejected, refErr
+	}
+
 	if !needRoute {
-		return Route{}, tcpip.ErrNetworkUnreachable
+		return Route{}, rejected, tcpip.ErrNetworkUnreachable
 	}
 
-	return Route{}, tcpip.ErrNoRoute
+	return Route{}, rejected, tcpip.ErrNoRoute
 }
 
 // CheckNetworkProtocol checks if a given network protocol is enabled in the
@@ -1275,10 +1795,40 @@ func (s *Stack) CheckNetworkProtocol(protocol tcpip.NetworkProtocolNumber) bool
 	return ok
 }
 
+// RejectUnknownProtocolFragments returns true if fragments of packets for
+// transport protocols that are not enabled in the stack should be dropped
+// instead of being reassembled.
+//
+// See Options.RejectUnknownProtocolFragments.
+func (s *Stack) RejectUnknownProtocolFragments() bool {
+	return s.rejectUnknownProtocolFragments
+}
+
+// CheckTransportProtocol checks if a given transport protocol is enabled in the
+// stack.
+func (s *Stack) CheckTransportProtocol(protocol tcpip.TransportProtocolNumber) bool {
+	_, ok := s.transportProtocols[protocol]
+	return ok
+}
+
 // CheckLocalAddress determines if the given local address exists, and if it
 // does, returns the id of the NIC it's bound to. Returns 0 if the address
 // does not exist.
 func (s *Stack) CheckLocalAddress(nicID tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) tcpip.NICID {
+	ref := s.findLocalEndpoint(nicID, protocol, addr)
+	if ref == nil {
+		return 0
+	}
+
+	// Release the reference once s is unlocked, as it may remove the endpoint.
+	ref.decRef()
+
+	return ref.nic.id
+}
+
+// findLocalEndpoint returns a reference to the endpoint for addr on the NIC
+// with ID nicID, or on any NIC if nicID is 0.
+func (s *Stack) findLocalEndpoint(nicID tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *referencedNetworkEndpoint {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -1286,29 +1836,53 @@ func (s *Stack) CheckLocalAddress(nicID tcpip.NICID, protocol tcpip.NetworkProto
 	if nicID != 0 {
 		nic := s.nics[nicID]
 		if nic == nil {
-			return 0
+			return nil
 		}
 
-		ref := nic.findEndpoint(protocol, addr, CanBePrimaryEndpoint)
-		if ref == nil {
-			return 0
-		}
-
-		ref.decRef()
-
-		return nic.id
+		return nic.findEndpoint(protocol, addr, CanBePrimaryEndpoint)
 	}
 
 	// Go through all the NICs.
 	for _, nic := range s.nics {
-		ref := nic.findEndpoint(protocol, addr, CanBePrimaryEndpoint)
-		if ref != nil {
-			ref.decRef()
-			return nic.id
+		if ref := nic.findEndpoint(protocol, addr, CanBePrimaryEndpoint); ref != nil {
+			return ref
 		}
 	}
 
-	return 0
+	return nil
+}
+
+// SetARPPrimaryOnly sets whether the given NIC only answers ARP requests for
+// its primary IPv4 address, rather than for all of its IPv4 addresses. This is
+// useful when secondary addresses are shared with other hosts, e.g. virtual
+// addresses in high availability setups, and must only be claimed by their
+// current owner.
+func (s *Stack) SetARPPrimaryOnly(nicID tcpip.NICID, enable bool) *tcpip.Error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setARPPrimaryOnly(enable)
+
+	return nil
+}
+
+// AnswersARP returns true if the given NIC should answer ARP requests for
+// addr, one of its IPv4 addresses. See SetARPPrimaryOnly.
+func (s *Stack) AnswersARP(nicID tcpip.NICID, addr tcpip.Address) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return false
+	}
+
+	return nic.answersARP(addr)
 }
 
 // SetPromiscuousMode enables or disables promiscuous mode in the given NIC.
@@ -1326,6 +1900,44 @@ func (s *Stack) SetPromiscuousMode(nicID tcpip.NICID, enable bool) *tcpip.Error
 	return nil
 }
 
+// SetCaptureMode puts the given NIC in capture mode, for monitoring: every
+// packet it receives is handed to tap, and none is processed any further. No
+// network endpoints are created and nothing is delivered to packet or
+// transport endpoints. Unlike promiscuous mode, capture mode does not depend
+// on the packets' destination addresses. A nil tap takes the NIC out of
+// capture mode.
+func (s *Stack) SetCaptureMode(nicID tcpip.NICID, tap CaptureTap) *tcpip.Error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setCaptureTap(tap)
+
+	return nil
+}
+
+// SetClassifier attaches c to the input of the given NIC. Every packet the NIC
+// receives is then evaluated by c before being delivered, and may be tagged,
+// dropped or redirected to another NIC. A nil c detaches the NIC's
+// classifier.
+func (s *Stack) SetClassifier(nicID tcpip.NICID, c Classifier) *tcpip.Error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setClassifier(c)
+
+	return nil
+}
+
 // SetSpoofing enables or disables address spoofing in the given NIC, allowing
 // endpoints to bind to any address in the NIC.
 func (s *Stack) SetSpoofing(nicID tcpip.NICID, enable bool) *tcpip.Error {
@@ -1342,6 +1954,47 @@ func (s *Stack) SetSpoofing(nicID tcpip.NICID, enable bool) *tcpip.Error {
 	return nil
 }
 
+// SetPreserveTTL enables or disables preserving the TTL (or hop limit) of
+// packets forwarded out of the given NIC.
+//
+// By default, the TTL of forwarded packets is decremented. Transparent bridging
+// setups may preserve it instead.
+func (s *Stack) SetPreserveTTL(nicID tcpip.NICID, enable bool) *tcpip.Error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setPreserveTTL(enable)
+
+	return nil
+}
+
+// SetAcceptDirectedBroadcast enables or disables the local delivery of IPv4
+// packets sent to the broadcast address of one of the given NIC's address
+// ranges (see AddAddressRange). Such packets are delivered to all matching
+// UDP endpoints, as packets sent to the limited broadcast address are.
+//
+// Directed broadcast packets are not accepted by default. Echo requests sent to
+// a directed broadcast address are never answered, see
+// Route.ICMPRepliesSuppressed.
+func (s *Stack) SetAcceptDirectedBroadcast(nicID tcpip.NICID, enable bool) *tcpip.Error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setAcceptDirectedBroadcast(enable)
+
+	return nil
+}
+
 // AddLinkAddress adds a link address to the stack link cache.
 func (s *Stack) AddLinkAddress(nicID tcpip.NICID, addr tcpip.Address, linkAddr tcpip.LinkAddress) {
 	fullAddr := tcpip.FullAddress{NIC: nicID, Addr: addr}
@@ -1376,6 +2029,97 @@ func (s *Stack) RemoveWaker(nicID tcpip.NICID, addr tcpip.Address, waker *sleep.
 	}
 }
 
+// LinkAddressCacheStats returns statistics about the stack's link address
+// cache, which is shared by all NICs.
+func (s *Stack) LinkAddressCacheStats() LinkCacheStats {
+	return s.linkAddrCache.stats()
+}
+
+// FragmentationStats returns statistics about the reassembly of fragmented
+// packets by the network protocols of the stack, both aggregated and broken
+// down by network protocol.
+func (s *Stack) FragmentationStats() NetworkFragmentationStats {
+	stats := NetworkFragmentationStats{
+		PerProtocol: make(map[tcpip.NetworkProtocolNumber]FragmentationStats),
+	}
+
+	for number, netProto := range s.networkProtocols {
+		r, ok := netProto.(FragmentationStatsReporter)
+		if !ok {
+			continue
+		}
+		protoStats := r.FragmentationStats()
+		stats.Total.add(protoStats)
+		stats.PerProtocol[number] = protoStats
+	}
+	return stats
+}
+
+// StatsSnapshot holds the statistics of a stack at a point in time, for
+// export to metric systems. Unlike the statistics returned by Stats and
+// NICInfo, its StatCounters are copies which don't change as the stack keeps
+// running.
+type StatsSnapshot struct {
+	// Stack holds the stack-wide statistics, including the IP statistics.
+	Stack tcpip.Stats
+
+	// NICs holds the statistics of each NIC.
+	NICs map[tcpip.NICID]NICStatsSnapshot
+
+	// Fragmentation holds statistics about the reassembly of fragmented
+	// packets.
+	Fragmentation NetworkFragmentationStats
+
+	// LinkAddressCache holds statistics about the link address cache.
+	LinkAddressCache LinkCacheStats
+
+	// Demux holds statistics about the registered transport endpoints, per
+	// pair of network and transport protocols.
+	Demux []DemuxStats
+}
+
+// NICStatsSnapshot holds the statistics of a NIC at a point in time.
+type NICStatsSnapshot struct {
+	// Name is the name of the NIC.
+	Name string
+
+	// Stats holds the packet counters of the NIC.
+	Stats NICStats
+
+	// Drops holds the number of packets dropped by the NIC, by reason.
+	Drops DropStats
+}
+
+// Snapshot returns the statistics of all the subsystems of the stack, so that
+// callers exporting metrics don't need to read each of them separately.
+//
+// The set of NICs cannot change while the snapshot is taken, but packets may
+// still be processed, so counters which are incremented together may be off
+// by the number of packets in flight.
+func (s *Stack) Snapshot() StatsSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := StatsSnapshot{
+		Stack:            s.stats,
+		NICs:             make(map[tcpip.NICID]NICStatsSnapshot, len(s.nics)),
+		Fragmentation:    s.FragmentationStats(),
+		LinkAddressCache: s.LinkAddressCacheStats(),
+		Demux:            s.demux.stats(),
+	}
+	tcpip.SnapshotStatCounters(reflect.ValueOf(&snapshot.Stack).Elem())
+	for id, nic := range s.nics {
+		nicSnapshot := NICStatsSnapshot{
+			Name:  nic.Name(),
+			Stats: nic.stats,
+			Drops: nic.DropStats(),
+		}
+		tcpip.SnapshotStatCounters(reflect.ValueOf(&nicSnapshot.Stats).Elem())
+		snapshot.NICs[id] = nicSnapshot
+	}
+	return snapshot
+}
+
 // RegisterTransportEndpoint registers the given endpoint with the stack
 // transport dispatcher. Received packets that match the provided id will be
 // delivered to the given endpoint; specifying a nic is optional, but
@@ -1648,6 +2392,28 @@ func (s *Stack) TransportProtocolInstance(num tcpip.TransportProtocolNumber) Tra
 	return nil
 }
 
+// NetworkProtocols returns the numbers of the network protocols handled by the
+// stack, in increasing order.
+func (s *Stack) NetworkProtocols() []tcpip.NetworkProtocolNumber {
+	protos := make([]tcpip.NetworkProtocolNumber, 0, len(s.networkProtocols))
+	for num := range s.networkProtocols {
+		protos = append(protos, num)
+	}
+	sort.Slice(protos, func(i, j int) bool { return protos[i] < protos[j] })
+	return protos
+}
+
+// TransportProtocols returns the numbers of the transport protocols handled by
+// the stack, in increasing order.
+func (s *Stack) TransportProtocols() []tcpip.TransportProtocolNumber {
+	protos := make([]tcpip.TransportProtocolNumber, 0, len(s.transportProtocols))
+	for num := range s.transportProtocols {
+		protos = append(protos, num)
+	}
+	sort.Slice(protos, func(i, j int) bool { return protos[i] < protos[j] })
+	return protos
+}
+
 // AddTCPProbe installs a probe function that will be invoked on every segment
 // received by a given TCP endpoint. The probe function is passed a copy of the
 // TCP endpoint state before and after processing of the segment.
@@ -1700,9 +2466,10 @@ func (s *Stack) JoinGroup(protocol tcpip.NetworkProtocolNumber, nicID tcpip.NICI
 // LeaveGroup leaves the given multicast group on the given NIC.
 func (s *Stack) LeaveGroup(protocol tcpip.NetworkProtocolNumber, nicID tcpip.NICID, multicastAddr tcpip.Address) *tcpip.Error {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	nic, ok := s.nics[nicID]
+	s.mu.RUnlock()
 
-	if nic, ok := s.nics[nicID]; ok {
+	if ok {
 		return nic.leaveGroup(multicastAddr)
 	}
 	return tcpip.ErrUnknownNICID
@@ -1785,10 +2552,10 @@ func (s *Stack) IsAddrTentative(id tcpip.NICID, addr tcpip.Address) (bool, *tcpi
 // DupTentativeAddrDetected attempts to inform the NIC with ID id that a
 // tentative addr on it is a duplicate on a link.
 func (s *Stack) DupTentativeAddrDetected(id tcpip.NICID, addr tcpip.Address) *tcpip.Error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+	s.mu.RLock()
 	nic, ok := s.nics[id]
+	s.mu.RUnlock()
+
 	if !ok {
 		return tcpip.ErrUnknownNICID
 	}
@@ -1818,10 +2585,10 @@ func (s *Stack) SetNDPConfigurations(id tcpip.NICID, c NDPConfigurations) *tcpip
 // HandleNDPRA provides a NIC with ID id a validated NDP Router Advertisement
 // message that it needs to handle.
 func (s *Stack) HandleNDPRA(id tcpip.NICID, ip tcpip.Address, ra header.NDPRouterAdvert) *tcpip.Error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+	s.mu.RLock()
 	nic, ok := s.nics[id]
+	s.mu.RUnlock()
+
 	if !ok {
 		return tcpip.ErrUnknownNICID
 	}
@@ -30,13 +30,16 @@ import (
 	"gvisor.dev/gvisor/pkg/rand"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/checker"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/link/loopback"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
 )
 
 const (
@@ -422,6 +425,243 @@ func testRecvInternal(t *testing.T, fakeNet *fakeNetworkProtocol, localAddrByte
 	}
 }
 
+func TestWeakHostModel(t *testing.T) {
+	// Create a stack with the fake network protocol and three NICs: NIC 1 with
+	// address 1, NIC 2 with address 2 and NIC 3 with addresses 2 and 3.
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	ep1 := channel.New(10, defaultMTU, "")
+	nicAddrs := map[tcpip.NICID][]tcpip.Address{
+		1: {"\x01"},
+		2: {"\x02"},
+		3: {"\x02", "\x03"},
+	}
+	for nicID, addrs := range nicAddrs {
+		ep := ep1
+		if nicID != 1 {
+			ep = channel.New(10, defaultMTU, "")
+		}
+		if err := s.CreateNIC(nicID, ep); err != nil {
+			t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+		}
+		for _, addr := range addrs {
+			if err := s.AddAddress(nicID, fakeNetNumber, addr); err != nil {
+				t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, fakeNetNumber, addr, err)
+			}
+		}
+	}
+
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+	buf := buffer.NewView(30)
+
+	// Under the strong host model, NIC 1 only accepts packets for its own
+	// address.
+	for _, dst := range []byte{2, 3, 4} {
+		buf[0] = dst
+		testFailingRecv(t, fakeNet, dst, ep1, buf)
+	}
+	buf[0] = 1
+	testRecv(t, fakeNet, 1, ep1, buf)
+
+	// Under the weak host model, NIC 1 also accepts packets for the addresses
+	// of the other NICs, including those assigned to several of them.
+	s.SetHostModel(true /* weak */)
+	for _, dst := range []byte{1, 2, 3} {
+		buf[0] = dst
+		testRecv(t, fakeNet, dst, ep1, buf)
+	}
+	buf[0] = 4
+	testFailingRecv(t, fakeNet, 4, ep1, buf)
+
+	s.SetHostModel(false /* weak */)
+	buf[0] = 2
+	testFailingRecv(t, fakeNet, 2, ep1, buf)
+}
+
+func TestWeakHostModelReplyEgress(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+
+		nic1Addr   = tcpip.Address("\x0a\x00\x00\x01")
+		nic2Addr   = tcpip.Address("\x0a\x00\x01\x01")
+		remoteAddr = tcpip.Address("\x0a\x00\x00\x02")
+
+		nic1LinkAddr   = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+		nic2LinkAddr   = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+		remoteLinkAddr = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x03")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+	})
+	ep1 := channel.New(10, defaultMTU, nic1LinkAddr)
+	ep2 := channel.New(10, defaultMTU, nic2LinkAddr)
+	for _, nic := range []struct {
+		id   tcpip.NICID
+		ep   *channel.Endpoint
+		addr tcpip.Address
+	}{
+		{nicID1, ep1, nic1Addr},
+		{nicID2, ep2, nic2Addr},
+	} {
+		if err := s.CreateNIC(nic.id, nic.ep); err != nil {
+			t.Fatalf("CreateNIC(%d, _): %s", nic.id, err)
+		}
+		if err := s.AddAddress(nic.id, ipv4.ProtocolNumber, nic.addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s): %s", nic.id, ipv4.ProtocolNumber, nic.addr, err)
+		}
+	}
+	s.SetHostModel(true /* weak */)
+
+	// Send an echo request for NIC 2's address through NIC 1.
+	buf := buffer.NewView(header.IPv4MinimumSize + header.ICMPv4MinimumSize)
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     remoteAddr,
+		DstAddr:     nic2Addr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(buf[header.IPv4MinimumSize:])
+	icmp.SetType(header.ICMPv4Echo)
+	icmp.SetChecksum(^header.Checksum(icmp, 0))
+	ep1.InjectLinkAddr(ipv4.ProtocolNumber, remoteLinkAddr, stack.PacketBuffer{
+		Data: buf.ToVectorisedView(),
+	})
+
+	// The reply is sent from NIC 2's address, back through NIC 1 to the link
+	// address the request came from.
+	p, ok := ep1.Read()
+	if !ok {
+		t.Fatal("expected an echo reply through NIC 1")
+	}
+	if p.Route.RemoteLinkAddress != remoteLinkAddr {
+		t.Errorf("got p.Route.RemoteLinkAddress = %s, want = %s", p.Route.RemoteLinkAddress, remoteLinkAddr)
+	}
+	b := append(buffer.View(nil), p.Pkt.Header.View()...)
+	checker.IPv4(t, append(b, p.Pkt.Data.ToView()...),
+		checker.SrcAddr(nic2Addr),
+		checker.DstAddr(remoteAddr),
+		checker.ICMPv4(checker.ICMPv4Type(header.ICMPv4EchoReply)))
+	if p, ok := ep2.Read(); ok {
+		t.Errorf("got unexpected packet through NIC 2 = %#v", p)
+	}
+}
+
+func TestNICClassifier(t *testing.T) {
+	const (
+		nicID   = 1
+		nicName = "nic1"
+		srcAddr = tcpip.Address("\x0a\x00\x00\x02")
+		dstAddr = tcpip.Address("\x0a\x00\x00\x01")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+	})
+	ep := channel.New(10, defaultMTU, "")
+	if err := s.CreateNICWithOptions(nicID, ep, stack.NICOptions{Name: nicName}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, header.IPv4ProtocolNumber, dstAddr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, header.IPv4ProtocolNumber, dstAddr, err)
+	}
+	nic, ok := s.GetNICByName(nicName)
+	if !ok {
+		t.Fatalf("GetNICByName(%q) = (_, false), want = (_, true)", nicName)
+	}
+
+	var classified []stack.ClassifierPacket
+	if err := s.SetClassifier(nicID, func(pkt *stack.ClassifierPacket) stack.ClassifierResult {
+		classified = append(classified, *pkt)
+		if pkt.TransportProtocol == header.UDPProtocolNumber {
+			return stack.ClassifierResult{Verdict: stack.ClassifierDrop}
+		}
+		return stack.ClassifierResult{Verdict: stack.ClassifierAccept}
+	}); err != nil {
+		t.Fatalf("SetClassifier(%d, _): %s", nicID, err)
+	}
+
+	ipv4Packet := func(proto tcpip.TransportProtocolNumber, transportSize int) buffer.View {
+		buf := buffer.NewView(header.IPv4MinimumSize + transportSize)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(buf)),
+			TTL:         64,
+			Protocol:    uint8(proto),
+			SrcAddr:     srcAddr,
+			DstAddr:     dstAddr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		return buf
+	}
+
+	tests := []struct {
+		name          string
+		proto         tcpip.TransportProtocolNumber
+		transportSize int
+		wantDelivered uint64
+		wantDropped   uint64
+	}{
+		{
+			name:          "UDP",
+			proto:         header.UDPProtocolNumber,
+			transportSize: header.UDPMinimumSize,
+			wantDelivered: 0,
+			wantDropped:   1,
+		},
+		{
+			name:          "TCP",
+			proto:         header.TCPProtocolNumber,
+			transportSize: header.TCPMinimumSize,
+			wantDelivered: 1,
+			wantDropped:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delivered := s.Stats().IP.PacketsDelivered.Value()
+			classified = nil
+			buf := ipv4Packet(test.proto, test.transportSize)
+			// The ports are at the same offsets in the TCP and UDP headers.
+			header.UDP(buf[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+				SrcPort: 1000,
+				DstPort: 80,
+			})
+			ep.InjectInbound(header.IPv4ProtocolNumber, stack.PacketBuffer{
+				Data: buf.ToVectorisedView(),
+			})
+
+			want := []stack.ClassifierPacket{{
+				NICID:             nicID,
+				NetworkProtocol:   header.IPv4ProtocolNumber,
+				Src:               srcAddr,
+				Dst:               dstAddr,
+				TransportProtocol: test.proto,
+				SrcPort:           1000,
+				DstPort:           80,
+				Size:              len(buf),
+			}}
+			if diff := cmp.Diff(want, classified); diff != "" {
+				t.Errorf("classified packets mismatch (-want +got):\n%s", diff)
+			}
+			if got := s.Stats().IP.PacketsDelivered.Value() - delivered; got != test.wantDelivered {
+				t.Errorf("got PacketsDelivered = %d, want = %d", got, test.wantDelivered)
+			}
+			if got := nic.DropStats().Classifier; got != test.wantDropped {
+				t.Errorf("got Classifier drops = %d, want = %d", got, test.wantDropped)
+			}
+		})
+	}
+}
+
 func TestNetworkSend(t *testing.T) {
 	// Create a stack with the fake network protocol, one nic, and one
 	// address: 1. The route table sends all packets through the only
@@ -631,6 +871,108 @@ func TestDisabledNICsNICInfoAndCheckNIC(t *testing.T) {
 	checkNIC(false)
 }
 
+func TestDisabledNICDropsInboundPackets(t *testing.T) {
+	const nicID = 1
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	e := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 0x01): %s", nicID, fakeNetNumber, err)
+	}
+	if err := s.DisableNIC(nicID); err != nil {
+		t.Fatalf("DisableNIC(%d): %s", nicID, err)
+	}
+
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	e.InjectInbound(fakeNetNumber, stack.PacketBuffer{
+		Data: buf.ToVectorisedView(),
+	})
+
+	nic, ok := s.NICInfo()[nicID]
+	if !ok {
+		t.Fatalf("NICInfo() has no entry for NIC %d", nicID)
+	}
+	if got := nic.Stats.DisabledRx.Packets.Value(); got != 1 {
+		t.Errorf("got DisabledRx.Packets = %d, want = 1", got)
+	}
+	if got, want := nic.Stats.DisabledRx.Bytes.Value(), uint64(len(buf)); got != want {
+		t.Errorf("got DisabledRx.Bytes = %d, want = %d", got, want)
+	}
+	if got := nic.Stats.Rx.Packets.Value(); got != 0 {
+		t.Errorf("got Rx.Packets = %d, want = 0", got)
+	}
+	if got := nic.Stats.Dropped.Value(); got != 1 {
+		t.Errorf("got Dropped = %d, want = 1", got)
+	}
+}
+
+func TestNICDisableAndEnable(t *testing.T) {
+	const (
+		nicID    = 1
+		nicName  = "nic1"
+		tempAddr = "\x02"
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	e := channel.New(10, defaultMTU, "")
+	if err := s.CreateNICWithOptions(nicID, e, stack.NICOptions{Name: nicName}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 0x01): %s", nicID, fakeNetNumber, err)
+	}
+	// Promiscuous mode has the NIC create a temporary endpoint for tempAddr.
+	if err := s.SetPromiscuousMode(nicID, true); err != nil {
+		t.Fatalf("SetPromiscuousMode(%d, true): %s", nicID, err)
+	}
+	nic, ok := s.GetNICByName(nicName)
+	if !ok {
+		t.Fatalf("GetNICByName(%q) = (_, false), want = (_, true)", nicName)
+	}
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+
+	buf := buffer.NewView(30)
+	tempBuf := buffer.NewView(30)
+	tempBuf[0] = tempAddr[0]
+
+	buf[0] = 1
+	testRecv(t, fakeNet, 1, e, buf)
+	testRecv(t, fakeNet, tempAddr[0], e, tempBuf)
+
+	if err := nic.Disable(); err != nil {
+		t.Fatalf("nic.Disable(): %s", err)
+	}
+	if nic.Enabled() {
+		t.Fatal("got nic.Enabled() = true after nic.Disable(), want = false")
+	}
+	if s.CheckNIC(nicID) {
+		t.Errorf("got s.CheckNIC(%d) = true after nic.Disable(), want = false", nicID)
+	}
+	// Disabling a disabled NIC is a no-op.
+	if err := nic.Disable(); err != nil {
+		t.Fatalf("second nic.Disable(): %s", err)
+	}
+	testFailingRecv(t, fakeNet, 1, e, buf)
+	testFailingRecv(t, fakeNet, tempAddr[0], e, tempBuf)
+
+	if err := nic.Enable(); err != nil {
+		t.Fatalf("nic.Enable(): %s", err)
+	}
+	if !nic.Enabled() {
+		t.Fatal("got nic.Enabled() = false after nic.Enable(), want = true")
+	}
+	testRecv(t, fakeNet, 1, e, buf)
+	testRecv(t, fakeNet, tempAddr[0], e, tempBuf)
+}
+
 func TestRemoveUnknownNIC(t *testing.T) {
 	s := stack.New(stack.Options{
 		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
@@ -1294,6 +1636,67 @@ func TestPromiscuousMode(t *testing.T) {
 	testFailingRecv(t, fakeNet, localAddrByte, ep, buf)
 }
 
+func TestCaptureMode(t *testing.T) {
+	const nicID = 1
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+
+	ep := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 1): %s", nicID, fakeNetNumber, err)
+	}
+
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+
+	var captured []buffer.View
+	if err := s.SetCaptureMode(nicID, func(id tcpip.NICID, _, _ tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBuffer) {
+		if id != nicID {
+			t.Errorf("got captured packet NIC = %d, want = %d", id, nicID)
+		}
+		if protocol != fakeNetNumber {
+			t.Errorf("got captured packet protocol = %d, want = %d", protocol, fakeNetNumber)
+		}
+		captured = append(captured, pkt.Data.ToView())
+	}); err != nil {
+		t.Fatalf("SetCaptureMode(%d, _): %s", nicID, err)
+	}
+
+	// Neither a packet to the NIC's address nor one to another address is
+	// processed, but both are captured.
+	for _, dst := range []byte{0x01, 0x02} {
+		buf := buffer.NewView(30)
+		buf[0] = dst
+		testFailingRecv(t, fakeNet, dst, ep, buf)
+	}
+	if got, want := len(captured), 2; got != want {
+		t.Fatalf("got %d captured packets, want = %d", got, want)
+	}
+	for i, dst := range []byte{0x01, 0x02} {
+		if got := captured[i][0]; got != dst {
+			t.Errorf("got captured packet %d destination = %d, want = %d", i, got, dst)
+		}
+	}
+	if got := s.NICInfo()[nicID].Stats.Delivered.Value(); got != 0 {
+		t.Errorf("got Delivered = %d, want = 0", got)
+	}
+
+	// Once out of capture mode, packets are processed again.
+	if err := s.SetCaptureMode(nicID, nil); err != nil {
+		t.Fatalf("SetCaptureMode(%d, nil): %s", nicID, err)
+	}
+	buf := buffer.NewView(30)
+	buf[0] = 0x01
+	testRecv(t, fakeNet, 0x01, ep, buf)
+	if got, want := len(captured), 2; got != want {
+		t.Errorf("got %d captured packets after leaving capture mode, want = %d", got, want)
+	}
+}
+
 func TestSpoofingWithAddress(t *testing.T) {
 	localAddr := tcpip.Address("\x01")
 	nonExistentLocalAddr := tcpip.Address("\x02")
@@ -1411,63 +1814,298 @@ func TestSpoofingNoAddress(t *testing.T) {
 	// testSendTo(t, s, remoteAddr, ep, nil)
 }
 
-func verifyRoute(gotRoute, wantRoute stack.Route) error {
-	if gotRoute.LocalAddress != wantRoute.LocalAddress {
-		return fmt.Errorf("bad local address: got %s, want = %s", gotRoute.LocalAddress, wantRoute.LocalAddress)
-	}
-	if gotRoute.RemoteAddress != wantRoute.RemoteAddress {
-		return fmt.Errorf("bad remote address: got %s, want = %s", gotRoute.RemoteAddress, wantRoute.RemoteAddress)
-	}
-	if gotRoute.RemoteLinkAddress != wantRoute.RemoteLinkAddress {
-		return fmt.Errorf("bad remote link address: got %s, want = %s", gotRoute.RemoteLinkAddress, wantRoute.RemoteLinkAddress)
-	}
-	if gotRoute.NextHop != wantRoute.NextHop {
-		return fmt.Errorf("bad next-hop address: got %s, want = %s", gotRoute.NextHop, wantRoute.NextHop)
+func TestStrictSourceAddressCheck(t *testing.T) {
+	const nicID = 1
+	localAddr := tcpip.Address("\x01")
+	rangeAddr := tcpip.Address("\x82")
+	dstAddr := tcpip.Address("\x03")
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("StrictSourceAddressCheck=%t", strict), func(t *testing.T) {
+			s := stack.New(stack.Options{
+				NetworkProtocols:         []stack.NetworkProtocol{fakeNetFactory()},
+				StrictSourceAddressCheck: strict,
+			})
+
+			ep := channel.New(10, defaultMTU, "")
+			if err := s.CreateNIC(nicID, ep); err != nil {
+				t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+			}
+			if err := s.AddAddress(nicID, fakeNetNumber, localAddr); err != nil {
+				t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, fakeNetNumber, localAddr, err)
+			}
+			{
+				rangeSubnet, err := tcpip.NewSubnet("\x80", "\x80")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.AddAddressRange(nicID, fakeNetNumber, rangeSubnet); err != nil {
+					t.Fatalf("AddAddressRange(%d, %d, %s): %s", nicID, fakeNetNumber, rangeSubnet, err)
+				}
+			}
+			{
+				subnet, err := tcpip.NewSubnet("\x00", "\x00")
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.SetRouteTable([]tcpip.Route{{Destination: subnet, Gateway: "\x00", NIC: nicID}})
+			}
+
+			// An assigned address may always be used as the source.
+			r, err := s.FindRoute(0, localAddr, dstAddr, fakeNetNumber, false /* multicastLoop */)
+			if err != nil {
+				t.Fatalf("FindRoute(0, %s, %s, %d, false): %s", localAddr, dstAddr, fakeNetNumber, err)
+			}
+			r.Release()
+
+			// An address which is only in one of the NIC's address ranges is
+			// rejected when checking strictly.
+			r, err = s.FindRoute(0, rangeAddr, dstAddr, fakeNetNumber, false /* multicastLoop */)
+			if strict {
+				if err != tcpip.ErrBadLocalAddress {
+					t.Fatalf("got FindRoute(0, %s, %s, %d, false) = (%+v, %v), want = (_, %s)", rangeAddr, dstAddr, fakeNetNumber, r, err, tcpip.ErrBadLocalAddress)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("FindRoute(0, %s, %s, %d, false): %s", rangeAddr, dstAddr, fakeNetNumber, err)
+				}
+				r.Release()
+			}
+
+			// Spoofing permits any address to be used as the source.
+			if err := s.SetSpoofing(nicID, true); err != nil {
+				t.Fatalf("SetSpoofing(%d, true): %s", nicID, err)
+			}
+			r, err = s.FindRoute(0, rangeAddr, dstAddr, fakeNetNumber, false /* multicastLoop */)
+			if err != nil {
+				t.Fatalf("FindRoute(0, %s, %s, %d, false) with spoofing: %s", rangeAddr, dstAddr, fakeNetNumber, err)
+			}
+			r.Release()
+		})
 	}
-	return nil
 }
 
-func TestOutgoingBroadcastWithEmptyRouteTable(t *testing.T) {
+func TestSpoofedTxStats(t *testing.T) {
+	const (
+		nicID     = 1
+		nicName   = "nic1"
+		localAddr = tcpip.Address("\x01")
+		spoofAddr = tcpip.Address("\x05")
+		dstAddr   = tcpip.Address("\x02")
+	)
+
 	s := stack.New(stack.Options{
 		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
 	})
-
 	ep := channel.New(10, defaultMTU, "")
-	if err := s.CreateNIC(1, ep); err != nil {
-		t.Fatal("CreateNIC failed:", err)
+	if err := s.CreateNICWithOptions(nicID, ep, stack.NICOptions{Name: nicName}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
 	}
-	s.SetRouteTable([]tcpip.Route{})
-
-	// If there is no endpoint, it won't work.
-	if _, err := s.FindRoute(1, header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, false /* multicastLoop */); err != tcpip.ErrNetworkUnreachable {
-		t.Fatalf("got FindRoute(1, %s, %s, %d) = %s, want = %s", header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, err, tcpip.ErrNetworkUnreachable)
+	if err := s.AddAddress(nicID, fakeNetNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, fakeNetNumber, localAddr, err)
 	}
-
-	protoAddr := tcpip.ProtocolAddress{Protocol: fakeNetNumber, AddressWithPrefix: tcpip.AddressWithPrefix{header.IPv4Any, 0}}
-	if err := s.AddProtocolAddress(1, protoAddr); err != nil {
-		t.Fatalf("AddProtocolAddress(1, %v) failed: %v", protoAddr, err)
+	if err := s.SetSpoofing(nicID, true); err != nil {
+		t.Fatalf("SetSpoofing(%d, true): %s", nicID, err)
 	}
-	r, err := s.FindRoute(1, header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, false /* multicastLoop */)
-	if err != nil {
-		t.Fatalf("FindRoute(1, %v, %v, %d) failed: %v", header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, err)
+	{
+		subnet, err := tcpip.NewSubnet("\x00", "\x00")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetRouteTable([]tcpip.Route{{Destination: subnet, Gateway: "\x00", NIC: nicID}})
 	}
-	if err := verifyRoute(r, stack.Route{LocalAddress: header.IPv4Any, RemoteAddress: header.IPv4Broadcast}); err != nil {
-		t.Errorf("FindRoute(1, %v, %v, %d) returned unexpected Route: %v", header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, err)
+	nic, ok := s.GetNICByName(nicName)
+	if !ok {
+		t.Fatalf("GetNICByName(%q) = (_, false), want = (_, true)", nicName)
 	}
 
-	// If the NIC doesn't exist, it won't work.
-	if _, err := s.FindRoute(2, header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, false /* multicastLoop */); err != tcpip.ErrNetworkUnreachable {
-		t.Fatalf("got FindRoute(2, %v, %v, %d) = %v want = %v", header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, err, tcpip.ErrNetworkUnreachable)
+	payload := buffer.NewView(10)
+	for _, test := range []struct {
+		src         tcpip.Address
+		wantSpoofed uint64
+	}{
+		// Sending from an assigned address is not spoofing.
+		{src: localAddr, wantSpoofed: 0},
+		// Sending from an unassigned address is.
+		{src: spoofAddr, wantSpoofed: 1},
+	} {
+		r, err := s.FindRoute(nicID, test.src, dstAddr, fakeNetNumber, false /* multicastLoop */)
+		if err != nil {
+			t.Fatalf("FindRoute(%d, %s, %s, %d, false): %s", nicID, test.src, dstAddr, fakeNetNumber, err)
+		}
+		testSend(t, r, ep, payload)
+		r.Release()
+
+		if got := nic.Stats().SpoofedTx.Packets.Value(); got != test.wantSpoofed {
+			t.Errorf("got SpoofedTx.Packets.Value() = %d after sending from %s, want = %d", got, test.src, test.wantSpoofed)
+		}
+	}
+	if got, want := nic.Stats().Tx.Packets.Value(), uint64(2); got != want {
+		t.Errorf("got Tx.Packets.Value() = %d, want = %d", got, want)
 	}
 }
 
-func TestOutgoingBroadcastWithRouteTable(t *testing.T) {
-	defaultAddr := tcpip.AddressWithPrefix{header.IPv4Any, 0}
-	// Local subnet on NIC1: 192.168.1.58/24, gateway 192.168.1.1.
-	nic1Addr := tcpip.AddressWithPrefix{"\xc0\xa8\x01\x3a", 24}
-	nic1Gateway := tcpip.Address("\xc0\xa8\x01\x01")
-	// Local subnet on NIC2: 10.10.10.5/24, gateway 10.10.10.1.
-	nic2Addr := tcpip.AddressWithPrefix{"\x0a\x0a\x0a\x05", 24}
+func TestRouteRefInfo(t *testing.T) {
+	const (
+		nicID     = 1
+		localAddr = tcpip.Address("\x01")
+		dstAddr   = tcpip.Address("\x02")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	if err := s.CreateNIC(nicID, channel.New(10, defaultMTU, "")); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, fakeNetNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, fakeNetNumber, localAddr, err)
+	}
+	{
+		subnet, err := tcpip.NewSubnet("\x00", "\x00")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetRouteTable([]tcpip.Route{{Destination: subnet, Gateway: "\x00", NIC: nicID}})
+	}
+
+	checkRefInfo := func(r *stack.Route, wantAddr tcpip.Address, wantRefs int32) {
+		t.Helper()
+		if addr, refs := r.RefInfo(); addr != wantAddr || refs != wantRefs {
+			t.Errorf("got r.RefInfo() = (%s, %d), want = (%s, %d)", addr, refs, wantAddr, wantRefs)
+		}
+	}
+
+	// The permanent address holds a reference of its own on the endpoint.
+	r1, err := s.FindRoute(nicID, localAddr, dstAddr, fakeNetNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute(%d, %s, %s, %d, false): %s", nicID, localAddr, dstAddr, fakeNetNumber, err)
+	}
+	checkRefInfo(&r1, localAddr, 2)
+
+	r2, err := s.FindRoute(nicID, localAddr, dstAddr, fakeNetNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute(%d, %s, %s, %d, false): %s", nicID, localAddr, dstAddr, fakeNetNumber, err)
+	}
+	checkRefInfo(&r1, localAddr, 3)
+	checkRefInfo(&r2, localAddr, 3)
+
+	r3 := r2.Clone()
+	checkRefInfo(&r3, localAddr, 4)
+
+	r2.Release()
+	checkRefInfo(&r2, "", 0)
+	checkRefInfo(&r1, localAddr, 3)
+
+	r3.Release()
+	r1.Release()
+	checkRefInfo(&r1, "", 0)
+}
+
+func TestOnModeChanged(t *testing.T) {
+	const nicID = 1
+
+	type modes struct {
+		promiscuous, spoofing bool
+	}
+	var got []modes
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	if err := s.CreateNICWithOptions(nicID, channel.New(10, defaultMTU, ""), stack.NICOptions{
+		OnModeChanged: func(promiscuous, spoofing bool) {
+			got = append(got, modes{promiscuous, spoofing})
+		},
+	}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+	}
+
+	steps := []struct {
+		name string
+		set  func(tcpip.NICID, bool) *tcpip.Error
+		v    bool
+	}{
+		{name: "SetPromiscuousMode", set: s.SetPromiscuousMode, v: true},
+		{name: "SetSpoofing", set: s.SetSpoofing, v: true},
+		// Setting a mode to its current state is not a change.
+		{name: "SetSpoofing", set: s.SetSpoofing, v: true},
+		{name: "SetPromiscuousMode", set: s.SetPromiscuousMode, v: false},
+		{name: "SetSpoofing", set: s.SetSpoofing, v: false},
+	}
+	for _, step := range steps {
+		if err := step.set(nicID, step.v); err != nil {
+			t.Fatalf("%s(%d, %t): %s", step.name, nicID, step.v, err)
+		}
+	}
+
+	want := []modes{
+		{promiscuous: true, spoofing: false},
+		{promiscuous: true, spoofing: true},
+		{promiscuous: false, spoofing: true},
+		{promiscuous: false, spoofing: false},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(modes{})); diff != "" {
+		t.Errorf("mode changes mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func verifyRoute(gotRoute, wantRoute stack.Route) error {
+	if gotRoute.LocalAddress != wantRoute.LocalAddress {
+		return fmt.Errorf("bad local address: got %s, want = %s", gotRoute.LocalAddress, wantRoute.LocalAddress)
+	}
+	if gotRoute.RemoteAddress != wantRoute.RemoteAddress {
+		return fmt.Errorf("bad remote address: got %s, want = %s", gotRoute.RemoteAddress, wantRoute.RemoteAddress)
+	}
+	if gotRoute.RemoteLinkAddress != wantRoute.RemoteLinkAddress {
+		return fmt.Errorf("bad remote link address: got %s, want = %s", gotRoute.RemoteLinkAddress, wantRoute.RemoteLinkAddress)
+	}
+	if gotRoute.NextHop != wantRoute.NextHop {
+		return fmt.Errorf("bad next-hop address: got %s, want = %s", gotRoute.NextHop, wantRoute.NextHop)
+	}
+	return nil
+}
+
+func TestOutgoingBroadcastWithEmptyRouteTable(t *testing.T) {
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+
+	ep := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, ep); err != nil {
+		t.Fatal("CreateNIC failed:", err)
+	}
+	s.SetRouteTable([]tcpip.Route{})
+
+	// If there is no endpoint, it won't work.
+	if _, err := s.FindRoute(1, header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, false /* multicastLoop */); err != tcpip.ErrNetworkUnreachable {
+		t.Fatalf("got FindRoute(1, %s, %s, %d) = %s, want = %s", header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, err, tcpip.ErrNetworkUnreachable)
+	}
+
+	protoAddr := tcpip.ProtocolAddress{Protocol: fakeNetNumber, AddressWithPrefix: tcpip.AddressWithPrefix{header.IPv4Any, 0}}
+	if err := s.AddProtocolAddress(1, protoAddr); err != nil {
+		t.Fatalf("AddProtocolAddress(1, %v) failed: %v", protoAddr, err)
+	}
+	r, err := s.FindRoute(1, header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute(1, %v, %v, %d) failed: %v", header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, err)
+	}
+	if err := verifyRoute(r, stack.Route{LocalAddress: header.IPv4Any, RemoteAddress: header.IPv4Broadcast}); err != nil {
+		t.Errorf("FindRoute(1, %v, %v, %d) returned unexpected Route: %v", header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, err)
+	}
+
+	// If the NIC doesn't exist, it won't work.
+	if _, err := s.FindRoute(2, header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, false /* multicastLoop */); err != tcpip.ErrNetworkUnreachable {
+		t.Fatalf("got FindRoute(2, %v, %v, %d) = %v want = %v", header.IPv4Any, header.IPv4Broadcast, fakeNetNumber, err, tcpip.ErrNetworkUnreachable)
+	}
+}
+
+func TestOutgoingBroadcastWithRouteTable(t *testing.T) {
+	defaultAddr := tcpip.AddressWithPrefix{header.IPv4Any, 0}
+	// Local subnet on NIC1: 192.168.1.58/24, gateway 192.168.1.1.
+	nic1Addr := tcpip.AddressWithPrefix{"\xc0\xa8\x01\x3a", 24}
+	nic1Gateway := tcpip.Address("\xc0\xa8\x01\x01")
+	// Local subnet on NIC2: 10.10.10.5/24, gateway 10.10.10.1.
+	nic2Addr := tcpip.AddressWithPrefix{"\x0a\x0a\x0a\x05", 24}
 	nic2Gateway := tcpip.Address("\x0a\x0a\x0a\x01")
 
 	// Create a new stack with two NICs.
@@ -1864,6 +2502,173 @@ func TestAddresRangeAddRemove(t *testing.T) {
 	}
 }
 
+func TestNICHasAddressRange(t *testing.T) {
+	const (
+		nicID   = 1
+		nicName = "nic1"
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	if err := s.CreateNICWithOptions(nicID, channel.New(10, defaultMTU, ""), stack.NICOptions{Name: nicName}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+	}
+	nic, ok := s.GetNICByName(nicName)
+	if !ok {
+		t.Fatalf("GetNICByName(%q) = (_, false), want = (_, true)", nicName)
+	}
+
+	addrRange, err := tcpip.NewSubnet("\x0a\x00\x00\x00", "\xff\x00\x00\x00")
+	if err != nil {
+		t.Fatal("NewSubnet failed:", err)
+	}
+	otherRange, err := tcpip.NewSubnet("\x0a\x00\x00\x00", "\xff\xff\x00\x00")
+	if err != nil {
+		t.Fatal("NewSubnet failed:", err)
+	}
+
+	if nic.HasAddressRange(addrRange) {
+		t.Fatalf("got nic.HasAddressRange(%v) = true before adding it, want = false", addrRange)
+	}
+
+	if err := s.AddAddressRange(nicID, fakeNetNumber, addrRange); err != nil {
+		t.Fatal("AddAddressRange failed:", err)
+	}
+	if !nic.HasAddressRange(addrRange) {
+		t.Fatalf("got nic.HasAddressRange(%v) = false, want = true", addrRange)
+	}
+	// Only exact matches are reported, even if a range is contained within a
+	// configured one.
+	if nic.HasAddressRange(otherRange) {
+		t.Fatalf("got nic.HasAddressRange(%v) = true, want = false", otherRange)
+	}
+
+	if err := s.RemoveAddressRange(nicID, addrRange); err != nil {
+		t.Fatal("RemoveAddressRange failed:", err)
+	}
+	if nic.HasAddressRange(addrRange) {
+		t.Fatalf("got nic.HasAddressRange(%v) = true after removing it, want = false", addrRange)
+	}
+}
+
+func TestNICPrimaryAddress(t *testing.T) {
+	const (
+		nicID   = 1
+		nicName = "nic1"
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	if err := s.CreateNICWithOptions(nicID, channel.New(10, defaultMTU, ""), stack.NICOptions{Name: nicName}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+	}
+	nic, ok := s.GetNICByName(nicName)
+	if !ok {
+		t.Fatalf("GetNICByName(%q) = (_, false), want = (_, true)", nicName)
+	}
+
+	if _, err := nic.PrimaryAddress(ipv4.ProtocolNumber); err != tcpip.ErrUnknownProtocol {
+		t.Errorf("got nic.PrimaryAddress(%d) = (_, %v), want = (_, %s)", ipv4.ProtocolNumber, err, tcpip.ErrUnknownProtocol)
+	}
+	if _, err := nic.PrimaryAddress(fakeNetNumber); err != tcpip.ErrBadLocalAddress {
+		t.Errorf("got nic.PrimaryAddress(%d) = (_, %v) without addresses, want = (_, %s)", fakeNetNumber, err, tcpip.ErrBadLocalAddress)
+	}
+
+	checkPrimary := func(want tcpip.Address) {
+		t.Helper()
+		got, err := nic.PrimaryAddress(fakeNetNumber)
+		if err != nil {
+			t.Fatalf("nic.PrimaryAddress(%d): %s", fakeNetNumber, err)
+		}
+		if got.Address != want {
+			t.Errorf("got nic.PrimaryAddress(%d) = (%s, nil), want = (%s, nil)", fakeNetNumber, got, want)
+		}
+	}
+
+	for _, a := range []struct {
+		addr tcpip.Address
+		peb  stack.PrimaryEndpointBehavior
+	}{
+		{addr: "\x01", peb: stack.CanBePrimaryEndpoint},
+		{addr: "\x02", peb: stack.CanBePrimaryEndpoint},
+		{addr: "\x03", peb: stack.NeverPrimaryEndpoint},
+	} {
+		if err := s.AddAddressWithOptions(nicID, fakeNetNumber, a.addr, a.peb); err != nil {
+			t.Fatalf("AddAddressWithOptions(%d, %d, %s, %d): %s", nicID, fakeNetNumber, a.addr, a.peb, err)
+		}
+	}
+	// The first address that can be primary is selected.
+	checkPrimary("\x01")
+
+	if err := s.AddAddressWithOptions(nicID, fakeNetNumber, "\x04", stack.FirstPrimaryEndpoint); err != nil {
+		t.Fatalf("AddAddressWithOptions(%d, %d, 4, %d): %s", nicID, fakeNetNumber, stack.FirstPrimaryEndpoint, err)
+	}
+	checkPrimary("\x04")
+
+	if err := s.RemoveAddress(nicID, "\x04"); err != nil {
+		t.Fatalf("RemoveAddress(%d, 4): %s", nicID, err)
+	}
+	checkPrimary("\x01")
+
+	// Querying the primary address must not hold a reference to it, so it can
+	// still be removed.
+	if err := s.RemoveAddress(nicID, "\x01"); err != nil {
+		t.Fatalf("RemoveAddress(%d, 1): %s", nicID, err)
+	}
+	checkPrimary("\x02")
+}
+
+func TestAddDeprecatedAddress(t *testing.T) {
+	const nicID = 1
+
+	ep := channel.New(10, defaultMTU, "")
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	subnet, err := tcpip.NewSubnet("\x00", "\x00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: subnet, Gateway: "\x00", NIC: nicID}})
+
+	// Add the deprecated address first so that it would be selected as the
+	// source address if it was not deprecated.
+	deprecatedAddr := tcpip.ProtocolAddress{
+		Protocol: fakeNetNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   "\x01",
+			PrefixLen: fakeDefaultPrefixLen,
+		},
+	}
+	if err := s.AddDeprecatedProtocolAddress(nicID, deprecatedAddr, stack.CanBePrimaryEndpoint); err != nil {
+		t.Fatalf("AddDeprecatedProtocolAddress(%d, %+v, %d): %s", nicID, deprecatedAddr, stack.CanBePrimaryEndpoint, err)
+	}
+	if err := s.AddAddress(nicID, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 2): %s", nicID, fakeNetNumber, err)
+	}
+
+	// The deprecated address still accepts inbound packets.
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	testRecv(t, fakeNet, 1, ep, buf)
+
+	// The preferred address is used as the source address for outbound
+	// traffic.
+	testRoute(t, s, nicID, "", "\x03", "\x02")
+
+	// The deprecated address is used when no preferred address is available.
+	if err := s.RemoveAddress(nicID, "\x02"); err != nil {
+		t.Fatalf("RemoveAddress(%d, 2): %s", nicID, err)
+	}
+	testRoute(t, s, nicID, "", "\x03", "\x01")
+}
+
 func TestGetMainNICAddressAddPrimaryNonPrimary(t *testing.T) {
 	for _, addrLen := range []int{4, 16} {
 		t.Run(fmt.Sprintf("addrLen=%d", addrLen), func(t *testing.T) {
@@ -2235,62 +3040,324 @@ func TestCreateNICWithOptions(t *testing.T) {
 	}
 }
 
-func TestNICStats(t *testing.T) {
-	s := stack.New(stack.Options{
-		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
-	})
-	ep1 := channel.New(10, defaultMTU, "")
-	if err := s.CreateNIC(1, ep1); err != nil {
-		t.Fatal("CreateNIC failed: ", err)
-	}
-	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
-		t.Fatal("AddAddress failed:", err)
-	}
-	// Route all packets for address \x01 to NIC 1.
-	{
-		subnet, err := tcpip.NewSubnet("\x01", "\xff")
-		if err != nil {
-			t.Fatal(err)
+func TestRenameNIC(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	s := stack.New(stack.Options{})
+	for _, c := range []struct {
+		nicID tcpip.NICID
+		name  string
+	}{
+		{nicID1, "eth0"},
+		{nicID2, "eth1"},
+	} {
+		if err := s.CreateNICWithOptions(c.nicID, channel.New(0, defaultMTU, ""), stack.NICOptions{Name: c.name}); err != nil {
+			t.Fatalf("CreateNICWithOptions(%d, _, {Name: %q}): %s", c.nicID, c.name, err)
 		}
-		s.SetRouteTable([]tcpip.Route{{Destination: subnet, Gateway: "\x00", NIC: 1}})
 	}
 
-	// Send a packet to address 1.
-	buf := buffer.NewView(30)
-	ep1.InjectInbound(fakeNetNumber, stack.PacketBuffer{
-		Data: buf.ToVectorisedView(),
-	})
-	if got, want := s.NICInfo()[1].Stats.Rx.Packets.Value(), uint64(1); got != want {
-		t.Errorf("got Rx.Packets.Value() = %d, want = %d", got, want)
+	if err := s.RenameNIC(nicID1, "wan0"); err != nil {
+		t.Fatalf("RenameNIC(%d, wan0): %s", nicID1, err)
 	}
-
-	if got, want := s.NICInfo()[1].Stats.Rx.Bytes.Value(), uint64(len(buf)); got != want {
-		t.Errorf("got Rx.Bytes.Value() = %d, want = %d", got, want)
+	nic, ok := s.FindNICByName("wan0")
+	if !ok {
+		t.Fatal("got FindNICByName(wan0) = (_, false), want = (_, true)")
 	}
-
-	payload := buffer.NewView(10)
-	// Write a packet out via the address for NIC 1
-	if err := sendTo(s, "\x01", payload); err != nil {
-		t.Fatal("sendTo failed: ", err)
+	if got := nic.ID(); got != nicID1 {
+		t.Errorf("got FindNICByName(wan0).ID() = %d, want = %d", got, nicID1)
 	}
-	want := uint64(ep1.Drain())
-	if got := s.NICInfo()[1].Stats.Tx.Packets.Value(); got != want {
-		t.Errorf("got Tx.Packets.Value() = %d, ep1.Drain() = %d", got, want)
+	if got := nic.Name(); got != "wan0" {
+		t.Errorf("got nic.Name() = %q, want = wan0", got)
+	}
+	if _, ok := s.FindNICByName("eth0"); ok {
+		t.Error("got FindNICByName(eth0) = (_, true) after rename, want = (_, false)")
+	}
+	if got := s.NICInfo()[nicID1].Name; got != "wan0" {
+		t.Errorf("got NICInfo()[%d].Name = %q, want = wan0", nicID1, got)
 	}
 
-	if got, want := s.NICInfo()[1].Stats.Tx.Bytes.Value(), uint64(len(payload)); got != want {
-		t.Errorf("got Tx.Bytes.Value() = %d, want = %d", got, want)
+	// Renaming a NIC to its own name is allowed.
+	if err := s.RenameNIC(nicID1, "wan0"); err != nil {
+		t.Errorf("RenameNIC(%d, wan0): %s", nicID1, err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		nicID   tcpip.NICID
+		newName string
+		want    *tcpip.Error
+	}{
+		{"Duplicate", nicID2, "wan0", tcpip.ErrDuplicateNICID},
+		{"Empty", nicID2, "", tcpip.ErrInvalidOptionValue},
+		{"NUL", nicID2, "eth\x001", tcpip.ErrInvalidOptionValue},
+		{"UnknownNIC", 3, "eth3", tcpip.ErrUnknownNICID},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := s.RenameNIC(test.nicID, test.newName); got != test.want {
+				t.Errorf("got RenameNIC(%d, %q) = %v, want = %s", test.nicID, test.newName, got, test.want)
+			}
+		})
+	}
+	if _, ok := s.FindNICByName("eth1"); !ok {
+		t.Error("got FindNICByName(eth1) = (_, false) after failed renames, want = (_, true)")
 	}
 }
 
-func TestNICForwarding(t *testing.T) {
-	const nicID1 = 1
-	const nicID2 = 2
-	const dstAddr = tcpip.Address("\x03")
+func TestNICMaxAddresses(t *testing.T) {
+	const (
+		nicID        = 1
+		maxAddresses = 2
+		addr1        = tcpip.Address("\x0a\x00\x00\x01")
+		addr2        = tcpip.Address("\x0a\x00\x00\x02")
+		addr3        = tcpip.Address("\x0a\x00\x00\x03")
+		mcastAddr    = tcpip.Address("\xe0\x00\x00\x01")
+	)
 
-	tests := []struct {
-		name      string
-		headerLen uint16
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+	})
+	if err := s.CreateNICWithOptions(nicID, channel.New(0, defaultMTU, ""), stack.NICOptions{MaxAddresses: maxAddresses}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+	}
+
+	// The limit should not count the IPv4 broadcast address added when the NIC
+	// was enabled.
+	for _, addr := range []tcpip.Address{addr1, addr2} {
+		if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, addr, err)
+		}
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr3); err != tcpip.ErrNoBufferSpace {
+		t.Fatalf("got AddAddress(%d, %d, %s) = %v, want = %s", nicID, ipv4.ProtocolNumber, addr3, err, tcpip.ErrNoBufferSpace)
+	}
+
+	// Adding a duplicate address should still be reported as such.
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr1); err != tcpip.ErrDuplicateAddress {
+		t.Fatalf("got AddAddress(%d, %d, %s) = %v, want = %s", nicID, ipv4.ProtocolNumber, addr1, err, tcpip.ErrDuplicateAddress)
+	}
+
+	// Multicast group memberships are exempt from the limit.
+	if err := s.JoinGroup(ipv4.ProtocolNumber, nicID, mcastAddr); err != nil {
+		t.Fatalf("JoinGroup(%d, %d, %s): %s", ipv4.ProtocolNumber, nicID, mcastAddr, err)
+	}
+
+	// Removing an address should make room for another.
+	if err := s.RemoveAddress(nicID, addr1); err != nil {
+		t.Fatalf("RemoveAddress(%d, %s): %s", nicID, addr1, err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr3); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, addr3, err)
+	}
+}
+
+func TestNICMaxProtocolAddresses(t *testing.T) {
+	const (
+		nicID     = 1
+		maxV4     = 2
+		v4Addr1   = tcpip.Address("\x0a\x00\x00\x01")
+		v4Addr2   = tcpip.Address("\x0a\x00\x00\x02")
+		v4Addr3   = tcpip.Address("\x0a\x00\x00\x03")
+		mcastAddr = tcpip.Address("\xe0\x00\x00\x01")
+		v6Addr1   = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+		v6Addr2   = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+		v6Addr3   = tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x03")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol(), ipv6.NewProtocol()},
+	})
+	if err := s.CreateNICWithOptions(nicID, channel.New(0, defaultMTU, ""), stack.NICOptions{Name: "nic1"}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+	}
+	nic, ok := s.GetNICByName("nic1")
+	if !ok {
+		t.Fatal("got GetNICByName(nic1) = (_, false), want = (_, true)")
+	}
+	nic.SetMaxAddresses(ipv4.ProtocolNumber, maxV4)
+
+	for _, addr := range []tcpip.Address{v4Addr1, v4Addr2} {
+		if err := s.AddAddress(nicID, ipv4.ProtocolNumber, addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, addr, err)
+		}
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, v4Addr3); err != tcpip.ErrNoBufferSpace {
+		t.Fatalf("got AddAddress(%d, %d, %s) = %v, want = %s", nicID, ipv4.ProtocolNumber, v4Addr3, err, tcpip.ErrNoBufferSpace)
+	}
+
+	// Multicast group memberships are exempt from the limit.
+	if err := s.JoinGroup(ipv4.ProtocolNumber, nicID, mcastAddr); err != nil {
+		t.Fatalf("JoinGroup(%d, %d, %s): %s", ipv4.ProtocolNumber, nicID, mcastAddr, err)
+	}
+
+	// The limit only applies to IPv4 addresses.
+	for _, addr := range []tcpip.Address{v6Addr1, v6Addr2, v6Addr3} {
+		if err := s.AddAddress(nicID, ipv6.ProtocolNumber, addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv6.ProtocolNumber, addr, err)
+		}
+	}
+
+	// Removing an address should make room for another.
+	if err := s.RemoveAddress(nicID, v4Addr1); err != nil {
+		t.Fatalf("RemoveAddress(%d, %s): %s", nicID, v4Addr1, err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, v4Addr3); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, v4Addr3, err)
+	}
+
+	// Removing the limit allows more addresses.
+	nic.SetMaxAddresses(ipv4.ProtocolNumber, 0)
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, v4Addr1); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s) after removing the limit: %s", nicID, ipv4.ProtocolNumber, v4Addr1, err)
+	}
+}
+
+func TestNICStats(t *testing.T) {
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	ep1 := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, ep1); err != nil {
+		t.Fatal("CreateNIC failed: ", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatal("AddAddress failed:", err)
+	}
+	// Route all packets for address \x01 to NIC 1.
+	{
+		subnet, err := tcpip.NewSubnet("\x01", "\xff")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetRouteTable([]tcpip.Route{{Destination: subnet, Gateway: "\x00", NIC: 1}})
+	}
+
+	// Send a packet to address 1.
+	buf := buffer.NewView(30)
+	ep1.InjectInbound(fakeNetNumber, stack.PacketBuffer{
+		Data: buf.ToVectorisedView(),
+	})
+	if got, want := s.NICInfo()[1].Stats.Rx.Packets.Value(), uint64(1); got != want {
+		t.Errorf("got Rx.Packets.Value() = %d, want = %d", got, want)
+	}
+
+	if got, want := s.NICInfo()[1].Stats.Rx.Bytes.Value(), uint64(len(buf)); got != want {
+		t.Errorf("got Rx.Bytes.Value() = %d, want = %d", got, want)
+	}
+
+	payload := buffer.NewView(10)
+	// Write a packet out via the address for NIC 1
+	if err := sendTo(s, "\x01", payload); err != nil {
+		t.Fatal("sendTo failed: ", err)
+	}
+	want := uint64(ep1.Drain())
+	if got := s.NICInfo()[1].Stats.Tx.Packets.Value(); got != want {
+		t.Errorf("got Tx.Packets.Value() = %d, ep1.Drain() = %d", got, want)
+	}
+
+	if got, want := s.NICInfo()[1].Stats.Tx.Bytes.Value(), uint64(len(payload)); got != want {
+		t.Errorf("got Tx.Bytes.Value() = %d, want = %d", got, want)
+	}
+}
+
+func TestNICForwardingStats(t *testing.T) {
+	const (
+		nicID1     = 1
+		nicID2     = 2
+		nicName1   = "nic1"
+		srcAddr    = tcpip.Address("\x05")
+		dstAddr    = tcpip.Address("\x03")
+		noRouteDst = tcpip.Address("\x04")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	s.SetForwarding(true)
+
+	ep1 := channel.New(10, defaultMTU, "")
+	if err := s.CreateNICWithOptions(nicID1, ep1, stack.NICOptions{Name: nicName1}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID1, err)
+	}
+	if err := s.AddAddress(nicID1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 0x01): %s", nicID1, fakeNetNumber, err)
+	}
+
+	ep2 := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(nicID2, ep2); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID2, err)
+	}
+	if err := s.AddAddress(nicID2, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 0x02): %s", nicID2, fakeNetNumber, err)
+	}
+
+	// Route all packets to dstAddr and NIC 2's address to NIC 2.
+	{
+		subnet, err := tcpip.NewSubnet(dstAddr, "\xff")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nic2Subnet, err := tcpip.NewSubnet("\x02", "\xff")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetRouteTable([]tcpip.Route{
+			{Destination: subnet, Gateway: "\x00", NIC: nicID2},
+			{Destination: nic2Subnet, Gateway: "\x00", NIC: nicID2},
+		})
+	}
+
+	// Send packets to NIC 1's address, NIC 2's address, a forwarded
+	// destination and a destination without a route.
+	for _, dst := range []tcpip.Address{"\x01", "\x02", dstAddr, dstAddr, noRouteDst} {
+		buf := buffer.NewView(30)
+		buf[0] = dst[0]
+		buf[1] = srcAddr[0]
+		ep1.InjectInbound(fakeNetNumber, stack.PacketBuffer{
+			Data: buf.ToVectorisedView(),
+		})
+	}
+	if got, want := ep2.Drain(), 2; got != want {
+		t.Errorf("got %d packets forwarded out of NIC %d, want = %d", got, nicID2, want)
+	}
+
+	nic, ok := s.GetNICByName(nicName1)
+	if !ok {
+		t.Fatalf("GetNICByName(%q) = (_, false), want = (_, true)", nicName1)
+	}
+	stats := nic.Stats()
+	for _, c := range []struct {
+		name    string
+		counter *tcpip.StatCounter
+		want    uint64
+	}{
+		{name: "Rx.Packets", counter: stats.Rx.Packets, want: 5},
+		{name: "Delivered", counter: stats.Delivered, want: 2},
+		{name: "Forwarded", counter: stats.Forwarded, want: 2},
+		{name: "Dropped", counter: stats.Dropped, want: 1},
+	} {
+		if got := c.counter.Value(); got != c.want {
+			t.Errorf("got nic.Stats().%s.Value() = %d, want = %d", c.name, got, c.want)
+		}
+	}
+
+	// Forwarded traffic is not counted as received by the outgoing NIC.
+	nic2Stats := s.NICInfo()[nicID2].Stats
+	if got := nic2Stats.Delivered.Value() + nic2Stats.Forwarded.Value() + nic2Stats.Dropped.Value(); got != 0 {
+		t.Errorf("got %d packets delivered, forwarded or dropped by NIC %d, want = 0", got, nicID2)
+	}
+}
+
+func TestNICForwarding(t *testing.T) {
+	const nicID1 = 1
+	const nicID2 = 2
+	const dstAddr = tcpip.Address("\x03")
+
+	tests := []struct {
+		name      string
+		headerLen uint16
 	}{
 		{
 			name: "Zero header length",
@@ -2353,15 +3420,608 @@ func TestNICForwarding(t *testing.T) {
 				t.Errorf("got Header.AvailableLength() = %d, want = %d", capacity, want)
 			}
 
-			// Test that forwarding increments Tx stats correctly.
-			if got, want := s.NICInfo()[nicID2].Stats.Tx.Packets.Value(), uint64(1); got != want {
-				t.Errorf("got Tx.Packets.Value() = %d, want = %d", got, want)
-			}
+			// Test that forwarding increments Tx stats correctly.
+			if got, want := s.NICInfo()[nicID2].Stats.Tx.Packets.Value(), uint64(1); got != want {
+				t.Errorf("got Tx.Packets.Value() = %d, want = %d", got, want)
+			}
+
+			if got, want := s.NICInfo()[nicID2].Stats.Tx.Bytes.Value(), uint64(len(buf)); got != want {
+				t.Errorf("got Tx.Bytes.Value() = %d, want = %d", got, want)
+			}
+		})
+	}
+}
+
+func TestForwardingLog(t *testing.T) {
+	const (
+		nicID1     = 1
+		nicID2     = 2
+		srcAddr    = tcpip.Address("\x05")
+		dstAddr    = tcpip.Address("\x03")
+		noRouteDst = tcpip.Address("\x04")
+		logSize    = 3
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:  []stack.NetworkProtocol{fakeNetFactory()},
+		ForwardingLogSize: logSize,
+	})
+	s.SetForwarding(true)
+
+	ep1 := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(nicID1, ep1); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID1, err)
+	}
+	if err := s.AddAddress(nicID1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 0x01): %s", nicID1, fakeNetNumber, err)
+	}
+
+	ep2 := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(nicID2, ep2); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID2, err)
+	}
+	if err := s.AddAddress(nicID2, fakeNetNumber, "\x02"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 0x02): %s", nicID2, fakeNetNumber, err)
+	}
+
+	// Route all packets to dstAddr to NIC 2.
+	{
+		subnet, err := tcpip.NewSubnet(dstAddr, "\xff")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetRouteTable([]tcpip.Route{{Destination: subnet, Gateway: "\x00", NIC: nicID2}})
+	}
+
+	if got := s.ForwardingLog(); len(got) != 0 {
+		t.Fatalf("got s.ForwardingLog() = %+v, want = []", got)
+	}
+
+	// Forward more packets than the log can hold. Only the most recent logSize
+	// decisions should be kept.
+	for _, dst := range []tcpip.Address{dstAddr, noRouteDst, dstAddr, dstAddr} {
+		buf := buffer.NewView(30)
+		buf[0] = dst[0]
+		buf[1] = srcAddr[0]
+		ep1.InjectInbound(fakeNetNumber, stack.PacketBuffer{
+			Data: buf.ToVectorisedView(),
+		})
+	}
+
+	got := s.ForwardingLog()
+	for i := range got {
+		if got[i].Timestamp == 0 {
+			t.Errorf("got s.ForwardingLog()[%d].Timestamp = 0, want non-zero", i)
+		}
+		got[i].Timestamp = 0
+	}
+	want := []stack.ForwardEvent{
+		{InNIC: nicID1, Src: srcAddr, Dst: noRouteDst, Result: stack.ForwardNoRoute},
+		{InNIC: nicID1, OutNIC: nicID2, Src: srcAddr, Dst: dstAddr, Result: stack.ForwardSent},
+		{InNIC: nicID1, OutNIC: nicID2, Src: srcAddr, Dst: dstAddr, Result: stack.ForwardSent},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("forwarding log mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestNICForwardingTTL tests that the TTL of forwarded IPv4 packets is
+// decremented unless the outgoing NIC is configured to preserve it.
+func TestNICForwardingTTL(t *testing.T) {
+	const (
+		nicID1  = 1
+		nicID2  = 2
+		srcAddr = tcpip.Address("\x0a\x00\x00\x02")
+		dstAddr = tcpip.Address("\x0a\x00\x01\x02")
+	)
+
+	tests := []struct {
+		name        string
+		preserveTTL bool
+		ttl         uint8
+		wantTTL     uint8
+		wantFwd     bool
+	}{
+		{
+			name:    "Decrement",
+			ttl:     64,
+			wantTTL: 63,
+			wantFwd: true,
+		},
+		{
+			name:    "Decrement expired",
+			ttl:     1,
+			wantFwd: false,
+		},
+		{
+			name:        "Preserve",
+			preserveTTL: true,
+			ttl:         64,
+			wantTTL:     64,
+			wantFwd:     true,
+		},
+		{
+			name:        "Preserve with TTL of 1",
+			preserveTTL: true,
+			ttl:         1,
+			wantTTL:     1,
+			wantFwd:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := stack.New(stack.Options{
+				NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+			})
+			s.SetForwarding(true)
+
+			ep1 := channel.New(10, defaultMTU, "")
+			if err := s.CreateNIC(nicID1, ep1); err != nil {
+				t.Fatalf("CreateNIC(%d, _): %s", nicID1, err)
+			}
+			if err := s.AddAddress(nicID1, ipv4.ProtocolNumber, "\x0a\x00\x00\x01"); err != nil {
+				t.Fatalf("AddAddress(%d, %d, 10.0.0.1): %s", nicID1, ipv4.ProtocolNumber, err)
+			}
+
+			ep2 := channel.New(10, defaultMTU, "")
+			if err := s.CreateNIC(nicID2, ep2); err != nil {
+				t.Fatalf("CreateNIC(%d, _): %s", nicID2, err)
+			}
+			if err := s.AddAddress(nicID2, ipv4.ProtocolNumber, "\x0a\x00\x01\x01"); err != nil {
+				t.Fatalf("AddAddress(%d, %d, 10.0.1.1): %s", nicID2, ipv4.ProtocolNumber, err)
+			}
+			if err := s.SetPreserveTTL(nicID2, test.preserveTTL); err != nil {
+				t.Fatalf("SetPreserveTTL(%d, %t): %s", nicID2, test.preserveTTL, err)
+			}
+
+			// Route all packets to dstAddr to NIC 2.
+			{
+				subnet, err := tcpip.NewSubnet("\x0a\x00\x01\x00", "\xff\xff\xff\x00")
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.SetRouteTable([]tcpip.Route{{Destination: subnet, NIC: nicID2}})
+			}
+
+			// Send a packet to dstAddr.
+			buf := buffer.NewView(header.IPv4MinimumSize + 10)
+			ip := header.IPv4(buf)
+			ip.Encode(&header.IPv4Fields{
+				IHL:         header.IPv4MinimumSize,
+				TotalLength: uint16(len(buf)),
+				TTL:         test.ttl,
+				Protocol:    uint8(header.UDPProtocolNumber),
+				SrcAddr:     srcAddr,
+				DstAddr:     dstAddr,
+			})
+			ip.SetChecksum(^ip.CalculateChecksum())
+			ep1.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+				Data: buf.ToVectorisedView(),
+			})
+
+			pkt, ok := ep2.Read()
+			if ok != test.wantFwd {
+				t.Fatalf("got ep2.Read() = (_, %t), want = (_, %t)", ok, test.wantFwd)
+			}
+			if !ok {
+				return
+			}
+			checker.IPv4(t, pkt.Pkt.Header.View(),
+				checker.SrcAddr(srcAddr),
+				checker.DstAddr(dstAddr),
+				checker.TTL(test.wantTTL),
+			)
+		})
+	}
+}
+
+func TestNICForwardingPacketTooBig(t *testing.T) {
+	const (
+		nicID1      = 1
+		nicID2      = 2
+		outMTU      = header.IPv6MinimumMTU
+		payloadSize = outMTU
+		v4Addr1     = tcpip.Address("\x0a\x00\x00\x01")
+		v4Addr2     = tcpip.Address("\x0a\x00\x01\x01")
+		v4SrcAddr   = tcpip.Address("\x0a\x00\x00\x02")
+		v4DstAddr   = tcpip.Address("\x0a\x00\x01\x02")
+		v6Addr1     = tcpip.Address("\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+		v6Addr2     = tcpip.Address("\x0a\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+		v6SrcAddr   = tcpip.Address("\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+		v6DstAddr   = tcpip.Address("\x0a\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+	)
+
+	ipv4Packet := func(flags uint8) buffer.View {
+		buf := buffer.NewView(header.IPv4MinimumSize + payloadSize)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(buf)),
+			Flags:       flags,
+			TTL:         64,
+			Protocol:    uint8(header.UDPProtocolNumber),
+			SrcAddr:     v4SrcAddr,
+			DstAddr:     v4DstAddr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		return buf
+	}
+
+	ipv6Packet := func() buffer.View {
+		buf := buffer.NewView(header.IPv6MinimumSize + payloadSize)
+		header.IPv6(buf).Encode(&header.IPv6Fields{
+			PayloadLength: payloadSize,
+			NextHeader:    uint8(header.UDPProtocolNumber),
+			HopLimit:      64,
+			SrcAddr:       v6SrcAddr,
+			DstAddr:       v6DstAddr,
+		})
+		return buf
+	}
+
+	tests := []struct {
+		name          string
+		proto         tcpip.NetworkProtocolNumber
+		pkt           buffer.View
+		suppress      bool
+		icmpSent      func(stack.NICICMPStats) *tcpip.StatCounter
+		wantICMPSent  uint64
+		wantForwarded bool
+		checkResponse func(*testing.T, buffer.View)
+	}{
+		{
+			name:  "IPv4 with DF",
+			proto: ipv4.ProtocolNumber,
+			pkt:   ipv4Packet(header.IPv4FlagDontFragment),
+			icmpSent: func(stats stack.NICICMPStats) *tcpip.StatCounter {
+				return stats.V4Sent.DstUnreachable
+			},
+			wantICMPSent: 1,
+			checkResponse: func(t *testing.T, b buffer.View) {
+				checker.IPv4(t, b,
+					checker.SrcAddr(v4Addr1),
+					checker.DstAddr(v4SrcAddr),
+					checker.ICMPv4(
+						checker.ICMPv4Type(header.ICMPv4DstUnreachable),
+						checker.ICMPv4Code(header.ICMPv4FragmentationNeeded),
+					),
+				)
+				if got := header.ICMPv4(header.IPv4(b).Payload()).MTU(); got != outMTU {
+					t.Errorf("got ICMP MTU = %d, want = %d", got, outMTU)
+				}
+			},
+		},
+		{
+			name:     "IPv4 with DF and ICMP replies suppressed",
+			proto:    ipv4.ProtocolNumber,
+			pkt:      ipv4Packet(header.IPv4FlagDontFragment),
+			suppress: true,
+			icmpSent: func(stats stack.NICICMPStats) *tcpip.StatCounter {
+				return stats.V4Sent.DstUnreachable
+			},
+			wantICMPSent: 0,
+		},
+		{
+			// TODO(b/143425874): Expect the packet to be fragmented.
+			name:  "IPv4 without DF",
+			proto: ipv4.ProtocolNumber,
+			pkt:   ipv4Packet(0),
+			icmpSent: func(stats stack.NICICMPStats) *tcpip.StatCounter {
+				return stats.V4Sent.DstUnreachable
+			},
+			wantICMPSent:  0,
+			wantForwarded: true,
+		},
+		{
+			name:  "IPv6",
+			proto: ipv6.ProtocolNumber,
+			pkt:   ipv6Packet(),
+			icmpSent: func(stats stack.NICICMPStats) *tcpip.StatCounter {
+				return stats.V6Sent.PacketTooBig
+			},
+			wantICMPSent: 1,
+			checkResponse: func(t *testing.T, b buffer.View) {
+				checker.IPv6(t, b,
+					checker.SrcAddr(v6Addr1),
+					checker.DstAddr(v6SrcAddr),
+					checker.ICMPv6(
+						checker.ICMPv6Type(header.ICMPv6PacketTooBig),
+						checker.ICMPv6Code(0),
+					),
+				)
+				if got := header.ICMPv6(header.IPv6(b).Payload()).MTU(); got != outMTU {
+					t.Errorf("got ICMP MTU = %d, want = %d", got, outMTU)
+				}
+			},
+		},
+		{
+			name:     "IPv6 with ICMP replies suppressed",
+			proto:    ipv6.ProtocolNumber,
+			pkt:      ipv6Packet(),
+			suppress: true,
+			icmpSent: func(stats stack.NICICMPStats) *tcpip.StatCounter {
+				return stats.V6Sent.PacketTooBig
+			},
+			wantICMPSent: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := stack.New(stack.Options{
+				NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol(), ipv6.NewProtocol()},
+			})
+			s.SetForwarding(true)
+
+			ep1 := channel.New(10, defaultMTU, "")
+			if err := s.CreateNICWithOptions(nicID1, ep1, stack.NICOptions{SuppressICMPReplies: test.suppress}); err != nil {
+				t.Fatalf("CreateNICWithOptions(%d, _, {SuppressICMPReplies: %t}): %s", nicID1, test.suppress, err)
+			}
+			ep2 := channel.New(10, outMTU, "")
+			if err := s.CreateNIC(nicID2, ep2); err != nil {
+				t.Fatalf("CreateNIC(%d, _): %s", nicID2, err)
+			}
+			for _, a := range []struct {
+				nicID tcpip.NICID
+				proto tcpip.NetworkProtocolNumber
+				addr  tcpip.Address
+			}{
+				{nicID1, ipv4.ProtocolNumber, v4Addr1},
+				{nicID2, ipv4.ProtocolNumber, v4Addr2},
+				{nicID1, ipv6.ProtocolNumber, v6Addr1},
+				{nicID2, ipv6.ProtocolNumber, v6Addr2},
+			} {
+				if err := s.AddAddress(a.nicID, a.proto, a.addr); err != nil {
+					t.Fatalf("AddAddress(%d, %d, %s): %s", a.nicID, a.proto, a.addr, err)
+				}
+			}
+			var routes []tcpip.Route
+			for _, r := range []struct {
+				addr, mask tcpip.Address
+				nicID      tcpip.NICID
+			}{
+				{"\x0a\x00\x00\x00", "\xff\xff\xff\x00", nicID1},
+				{"\x0a\x00\x01\x00", "\xff\xff\xff\x00", nicID2},
+				{v6Addr1[:8] + "\x00\x00\x00\x00\x00\x00\x00\x00", "\xff\xff\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00\x00\x00\x00\x00", nicID1},
+				{v6Addr2[:8] + "\x00\x00\x00\x00\x00\x00\x00\x00", "\xff\xff\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00\x00\x00\x00\x00", nicID2},
+			} {
+				subnet, err := tcpip.NewSubnet(r.addr, tcpip.AddressMask(r.mask))
+				if err != nil {
+					t.Fatal(err)
+				}
+				routes = append(routes, tcpip.Route{Destination: subnet, NIC: r.nicID})
+			}
+			s.SetRouteTable(routes)
+
+			ep1.InjectInbound(test.proto, stack.PacketBuffer{
+				Data: test.pkt.ToVectorisedView(),
+			})
+
+			if p, ok := ep2.Read(); ok != test.wantForwarded {
+				t.Errorf("got a packet forwarded out of NIC 2 = %t, want = %t", ok, test.wantForwarded)
+			} else if ok {
+				b := append(buffer.View(nil), p.Pkt.Header.View()...)
+				checker.IPv4(t, append(b, p.Pkt.Data.ToView()...),
+					checker.SrcAddr(v4SrcAddr),
+					checker.DstAddr(v4DstAddr),
+					checker.TTL(63),
+				)
+			}
+			if got := s.Stats().IP.OutgoingPacketErrors.Value(); got != 0 {
+				t.Errorf("got OutgoingPacketErrors = %d, want = 0", got)
+			}
+			if got := test.icmpSent(s.NICInfo()[nicID1].Stats.ICMP).Value(); got != test.wantICMPSent {
+				t.Errorf("got ICMP messages sent out of NIC 1 = %d, want = %d", got, test.wantICMPSent)
+			}
+			tooBigSent := s.Stats().ICMP.V4PacketsSent.PacketTooBig
+			if test.proto == ipv6.ProtocolNumber {
+				tooBigSent = s.Stats().ICMP.V6PacketsSent.PacketTooBig
+			}
+			if got := tooBigSent.Value(); got != test.wantICMPSent {
+				t.Errorf("got PacketTooBig sent = %d, want = %d", got, test.wantICMPSent)
+			}
+
+			p, ok := ep1.Read()
+			if test.checkResponse == nil {
+				if ok {
+					t.Error("got a packet sent out of NIC 1, want none")
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("expected an ICMP error sent out of NIC 1")
+			}
+			b := append(buffer.View(nil), p.Pkt.Header.View()...)
+			test.checkResponse(t, append(b, p.Pkt.Data.ToView()...))
+		})
+	}
+}
+
+func TestMulticastForwarding(t *testing.T) {
+	const (
+		nicID1       = 1
+		nicID2       = 2
+		nicID3       = 3
+		srcAddr      = tcpip.Address("\x0a\x00\x00\x02")
+		groupAddr    = tcpip.Address("\xef\x01\x02\x03")
+		noRouteGroup = tcpip.Address("\xef\x01\x02\x04")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+	})
+	s.SetForwarding(true)
+
+	eps := make(map[tcpip.NICID]*channel.Endpoint)
+	for _, nic := range []struct {
+		id   tcpip.NICID
+		addr tcpip.Address
+	}{
+		{id: nicID1, addr: "\x0a\x00\x00\x01"},
+		{id: nicID2, addr: "\x0a\x00\x01\x01"},
+		{id: nicID3, addr: "\x0a\x00\x02\x01"},
+	} {
+		ep := channel.New(10, defaultMTU, "")
+		if err := s.CreateNIC(nic.id, ep); err != nil {
+			t.Fatalf("CreateNIC(%d, _): %s", nic.id, err)
+		}
+		if err := s.AddAddress(nic.id, ipv4.ProtocolNumber, nic.addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s): %s", nic.id, ipv4.ProtocolNumber, nic.addr, err)
+		}
+		eps[nic.id] = ep
+	}
+
+	for _, test := range []struct {
+		name    string
+		route   stack.MulticastRoute
+		wantErr *tcpip.Error
+	}{
+		{
+			name:    "Unicast group",
+			route:   stack.MulticastRoute{InNIC: nicID1, Group: srcAddr, OutNICs: []tcpip.NICID{nicID2}},
+			wantErr: tcpip.ErrBadAddress,
+		},
+		{
+			name:    "Link-local group",
+			route:   stack.MulticastRoute{InNIC: nicID1, Group: "\xe0\x00\x00\x05", OutNICs: []tcpip.NICID{nicID2}},
+			wantErr: tcpip.ErrBadAddress,
+		},
+		{
+			name:    "Unknown outgoing NIC",
+			route:   stack.MulticastRoute{InNIC: nicID1, Group: groupAddr, OutNICs: []tcpip.NICID{4}},
+			wantErr: tcpip.ErrUnknownNICID,
+		},
+	} {
+		if err := s.AddMulticastRoute(test.route); err != test.wantErr {
+			t.Errorf("%s: got s.AddMulticastRoute(%+v) = %v, want = %s", test.name, test.route, err, test.wantErr)
+		}
+	}
+
+	// Listing the incoming NIC as an outgoing NIC must not loop packets back.
+	route := stack.MulticastRoute{InNIC: nicID1, Group: groupAddr, OutNICs: []tcpip.NICID{nicID1, nicID2, nicID3}}
+	if err := s.AddMulticastRoute(route); err != nil {
+		t.Fatalf("s.AddMulticastRoute(%+v): %s", route, err)
+	}
+
+	send := func(dst tcpip.Address) {
+		buf := buffer.NewView(header.IPv4MinimumSize + 10)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(buf)),
+			TTL:         64,
+			Protocol:    uint8(header.UDPProtocolNumber),
+			SrcAddr:     srcAddr,
+			DstAddr:     dst,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		eps[nicID1].InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+			Data: buf.ToVectorisedView(),
+		})
+	}
+
+	send(groupAddr)
+	if got := eps[nicID1].Drain(); got != 0 {
+		t.Errorf("got %d packets sent out of the incoming NIC, want = 0", got)
+	}
+	for _, id := range []tcpip.NICID{nicID2, nicID3} {
+		pkt, ok := eps[id].Read()
+		if !ok {
+			t.Fatalf("expected packet to be forwarded out of NIC %d", id)
+		}
+		checker.IPv4(t, pkt.Pkt.Header.View(),
+			checker.SrcAddr(srcAddr),
+			checker.DstAddr(groupAddr),
+			checker.TTL(63),
+		)
+	}
+
+	// Packets sent to a group without a route are not forwarded.
+	send(noRouteGroup)
+	for id, ep := range eps {
+		if got := ep.Drain(); got != 0 {
+			t.Errorf("got %d packets sent out of NIC %d for a group without a route, want = 0", got, id)
+		}
+	}
+
+	// Packets are no longer forwarded once the route is removed.
+	if !s.RemoveMulticastRoute(nicID1, groupAddr) {
+		t.Fatalf("got s.RemoveMulticastRoute(%d, %s) = false, want = true", nicID1, groupAddr)
+	}
+	send(groupAddr)
+	for id, ep := range eps {
+		if got := ep.Drain(); got != 0 {
+			t.Errorf("got %d packets sent out of NIC %d after removing the route, want = 0", got, id)
+		}
+	}
+}
+
+func TestSetPreserveTTLUnknownNIC(t *testing.T) {
+	s := stack.New(stack.Options{})
+	if err := s.SetPreserveTTL(1, true); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("got s.SetPreserveTTL(1, true) = %v, want = %s", err, tcpip.ErrUnknownNICID)
+	}
+}
+
+// TestEgressLinkAddress tests that the local link address of a route is
+// observable on outgoing frames and through NIC.LastEgressLinkAddress, including
+// when the route's link address is overridden.
+func TestEgressLinkAddress(t *testing.T) {
+	const (
+		nicID        = 1
+		nicName      = "nic1"
+		nicLinkAddr  = tcpip.LinkAddress("\x02\x02\x03\x04\x05\x06")
+		overrideAddr = tcpip.LinkAddress("\x02\x0a\x0b\x0c\x0d\x0e")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	ep := channel.New(10, defaultMTU, nicLinkAddr)
+	if err := s.CreateNICWithOptions(nicID, ep, stack.NICOptions{Name: nicName}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress(%d, %d, 1): %s", nicID, fakeNetNumber, err)
+	}
+	{
+		subnet, err := tcpip.NewSubnet("\x00", "\x00")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetRouteTable([]tcpip.Route{{Destination: subnet, Gateway: "\x00", NIC: nicID}})
+	}
+
+	nic, ok := s.GetNICByName(nicName)
+	if !ok {
+		t.Fatalf("GetNICByName(%q) = (_, false), want = (_, true)", nicName)
+	}
+	if got := nic.LastEgressLinkAddress(); got != "" {
+		t.Fatalf("got nic.LastEgressLinkAddress() = %s before sending, want = \"\"", got)
+	}
+
+	r, err := s.FindRoute(nicID, "", "\x02", fakeNetNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute(%d, '', 2, %d, false): %s", nicID, fakeNetNumber, err)
+	}
+	defer r.Release()
 
-			if got, want := s.NICInfo()[nicID2].Stats.Tx.Bytes.Value(), uint64(len(buf)); got != want {
-				t.Errorf("got Tx.Bytes.Value() = %d, want = %d", got, want)
-			}
-		})
+	for _, linkAddr := range []tcpip.LinkAddress{nicLinkAddr, overrideAddr} {
+		r.LocalLinkAddress = linkAddr
+		if err := send(r, buffer.NewView(1)); err != nil {
+			t.Fatalf("send(_, _) with local link address %s: %s", linkAddr, err)
+		}
+		p, ok := ep.Read()
+		if !ok {
+			t.Fatalf("expected a packet to be written with local link address %s", linkAddr)
+		}
+		if got := p.Route.LocalLinkAddress; got != linkAddr {
+			t.Errorf("got p.Route.LocalLinkAddress = %s, want = %s", got, linkAddr)
+		}
+		if got := nic.LastEgressLinkAddress(); got != linkAddr {
+			t.Errorf("got nic.LastEgressLinkAddress() = %s, want = %s", got, linkAddr)
+		}
 	}
 }
 
@@ -3173,6 +4833,125 @@ func TestJoinLeaveAllNodesMulticastOnNICEnableDisable(t *testing.T) {
 	}
 }
 
+// TestGroupLeaveReportsOnNICDisableAndRemove tests that IGMP Leave Group and
+// MLD Done messages are sent for the multicast groups joined by a NIC when it
+// is disabled or removed.
+func TestGroupLeaveReportsOnNICDisableAndRemove(t *testing.T) {
+	const (
+		nicID    = 1
+		v4Addr   = tcpip.Address("\x0a\x00\x00\x01")
+		v4Group  = tcpip.Address("\xe0\x00\x00\x05")
+		v6LLAddr = tcpip.Address("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+		v6Addr   = tcpip.Address("\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+		v6Group  = tcpip.Address("\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol(), ipv6.NewProtocol()},
+	})
+	e := channel.New(10, defaultMTU, linkAddr1)
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	for _, a := range []struct {
+		proto tcpip.NetworkProtocolNumber
+		addr  tcpip.Address
+	}{
+		{ipv4.ProtocolNumber, v4Addr},
+		{ipv6.ProtocolNumber, v6Addr},
+		{ipv6.ProtocolNumber, v6LLAddr},
+	} {
+		if err := s.AddAddress(nicID, a.proto, a.addr); err != nil {
+			t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, a.proto, a.addr, err)
+		}
+	}
+	if err := s.JoinGroup(ipv4.ProtocolNumber, nicID, v4Group); err != nil {
+		t.Fatalf("JoinGroup(%d, %d, %s): %s", ipv4.ProtocolNumber, nicID, v4Group, err)
+	}
+	if err := s.JoinGroup(ipv6.ProtocolNumber, nicID, v6Group); err != nil {
+		t.Fatalf("JoinGroup(%d, %d, %s): %s", ipv6.ProtocolNumber, nicID, v6Group, err)
+	}
+
+	// checkReports checks that a single report was sent for each group the NIC
+	// joined, including the solicited-node multicast group of its IPv6
+	// addresses, and none for the IPv6 all-nodes multicast group.
+	checkReports := func(t *testing.T) {
+		t.Helper()
+
+		var groups []tcpip.Address
+		for {
+			p, ok := e.Read()
+			if !ok {
+				break
+			}
+			b := append(buffer.View(nil), p.Pkt.Header.View()...)
+			b = append(b, p.Pkt.Data.ToView()...)
+
+			switch p.Proto {
+			case ipv4.ProtocolNumber:
+				checker.IPv4(t, b,
+					checker.SrcAddr(v4Addr),
+					checker.DstAddr(header.IPv4AllRoutersGroup),
+					checker.TTL(header.IGMPTTL),
+				)
+				if want := header.EthernetAddressFromMulticastIPv4Address(header.IPv4AllRoutersGroup); p.Route.RemoteLinkAddress != want {
+					t.Errorf("got IGMP report RemoteLinkAddress = %s, want = %s", p.Route.RemoteLinkAddress, want)
+				}
+				ip := header.IPv4(b)
+				if got := ip.TransportProtocol(); got != header.IGMPProtocolNumber {
+					t.Fatalf("got IGMP report TransportProtocol() = %d, want = %d", got, header.IGMPProtocolNumber)
+				}
+				igmp := header.IGMP(ip.Payload())
+				if got := igmp.Type(); got != header.IGMPLeaveGroup {
+					t.Errorf("got IGMP report Type() = %#x, want = %#x", got, header.IGMPLeaveGroup)
+				}
+				if got := header.Checksum(igmp, 0); got != 0xffff {
+					t.Errorf("got IGMP report checksum = %#x, want = 0xffff", got)
+				}
+				groups = append(groups, igmp.GroupAddress())
+			case ipv6.ProtocolNumber:
+				checker.IPv6(t, b,
+					checker.SrcAddr(v6LLAddr),
+					checker.DstAddr(header.IPv6AllRoutersMulticastAddress),
+					checker.TTL(header.MLDHopLimit),
+					checker.ICMPv6(checker.ICMPv6Type(header.ICMPv6MulticastListenerDone)),
+				)
+				if want := header.EthernetAddressFromMulticastIPv6Address(header.IPv6AllRoutersMulticastAddress); p.Route.RemoteLinkAddress != want {
+					t.Errorf("got MLD report RemoteLinkAddress = %s, want = %s", p.Route.RemoteLinkAddress, want)
+				}
+				groups = append(groups, header.MLD(header.ICMPv6(header.IPv6(b).Payload()).NDPPayload()).MulticastAddress())
+			default:
+				t.Fatalf("got a packet of unexpected network protocol %d", p.Proto)
+			}
+		}
+
+		want := []tcpip.Address{v4Group, v6Group, header.SolicitedNodeAddr(v6Addr)}
+		sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+		sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+		if diff := cmp.Diff(want, groups); diff != "" {
+			t.Errorf("reported groups mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	t.Run("Disable", func(t *testing.T) {
+		if err := s.DisableNIC(nicID); err != nil {
+			t.Fatalf("DisableNIC(%d): %s", nicID, err)
+		}
+		checkReports(t)
+	})
+
+	if err := s.EnableNIC(nicID); err != nil {
+		t.Fatalf("EnableNIC(%d): %s", nicID, err)
+	}
+
+	t.Run("Remove", func(t *testing.T) {
+		if err := s.RemoveNIC(nicID); err != nil {
+			t.Fatalf("RemoveNIC(%d): %s", nicID, err)
+		}
+		checkReports(t)
+	})
+}
+
 // TestDoDADWhenNICEnabled tests that IPv6 endpoints that were added while a NIC
 // was disabled have DAD performed on them when the NIC is enabled.
 func TestDoDADWhenNICEnabled(t *testing.T) {
@@ -3276,3 +5055,571 @@ func TestDoDADWhenNICEnabled(t *testing.T) {
 		t.Fatalf("got stack.GetMainNICAddress(%d, %d) = (%s, nil), want = (%s, nil)", nicID, header.IPv6ProtocolNumber, got, addr.AddressWithPrefix)
 	}
 }
+
+// TestFragmentationStats tests that the stack reports reassembly statistics
+// aggregated across network protocols and broken down per protocol.
+func TestFragmentationStats(t *testing.T) {
+	const (
+		nicID = 1
+
+		// fragmentProto is an unassigned transport protocol number so that
+		// reassembled packets are not handled by any transport protocol.
+		fragmentProto = 253
+
+		ipv4Addr       = tcpip.Address("\x0a\x00\x00\x01")
+		ipv4RemoteAddr = tcpip.Address("\x0a\x00\x00\x02")
+		ipv6Addr       = tcpip.Address("\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+		ipv6RemoteAddr = tcpip.Address("\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+	)
+
+	ipv4Fragment := func(id, offset uint16, more bool, payload []byte) buffer.View {
+		var flags uint8
+		if more {
+			flags = header.IPv4FlagMoreFragments
+		}
+		buf := buffer.NewView(header.IPv4MinimumSize + len(payload))
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:            header.IPv4MinimumSize,
+			TotalLength:    uint16(len(buf)),
+			ID:             id,
+			Flags:          flags,
+			FragmentOffset: offset,
+			TTL:            64,
+			Protocol:       fragmentProto,
+			SrcAddr:        ipv4RemoteAddr,
+			DstAddr:        ipv4Addr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		copy(buf[header.IPv4MinimumSize:], payload)
+		return buf
+	}
+
+	ipv6Fragment := func(id uint32, offset uint16, more bool, payload []byte) buffer.View {
+		buf := buffer.NewView(header.IPv6MinimumSize + header.IPv6FragmentExtHdrLength + len(payload))
+		ip := header.IPv6(buf)
+		ip.Encode(&header.IPv6Fields{
+			PayloadLength: uint16(header.IPv6FragmentExtHdrLength + len(payload)),
+			NextHeader:    header.IPv6FragmentHeader,
+			HopLimit:      64,
+			SrcAddr:       ipv6RemoteAddr,
+			DstAddr:       ipv6Addr,
+		})
+		fragOffsetAndFlags := offset
+		if more {
+			fragOffsetAndFlags |= 1
+		}
+		copy(buf[header.IPv6MinimumSize:], []byte{
+			// Fragment extension header.
+			fragmentProto, 0,
+			byte(fragOffsetAndFlags >> 8), byte(fragOffsetAndFlags),
+			byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id),
+		})
+		copy(buf[header.IPv6MinimumSize+header.IPv6FragmentExtHdrLength:], payload)
+		return buf
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol(), ipv6.NewProtocol()},
+	})
+	e := channel.New(10, 1280, "")
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, ipv4Addr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, ipv4Addr, err)
+	}
+	if err := s.AddAddress(nicID, ipv6.ProtocolNumber, ipv6Addr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv6.ProtocolNumber, ipv6Addr, err)
+	}
+
+	data := []byte("0123456789abcdef")
+	for _, pkt := range []struct {
+		proto tcpip.NetworkProtocolNumber
+		buf   buffer.View
+	}{
+		// A complete IPv4 packet followed by the first half of another.
+		{proto: ipv4.ProtocolNumber, buf: ipv4Fragment(1, 0, true, data[:8])},
+		{proto: ipv4.ProtocolNumber, buf: ipv4Fragment(1, 8, false, data[8:])},
+		{proto: ipv4.ProtocolNumber, buf: ipv4Fragment(2, 0, true, data[:8])},
+		// A complete IPv6 packet.
+		{proto: ipv6.ProtocolNumber, buf: ipv6Fragment(1, 0, true, data[:8])},
+		{proto: ipv6.ProtocolNumber, buf: ipv6Fragment(1, 8, false, data[8:])},
+	} {
+		e.InjectInbound(pkt.proto, stack.PacketBuffer{
+			Data: pkt.buf.ToVectorisedView(),
+		})
+	}
+
+	want := stack.NetworkFragmentationStats{
+		Total: stack.FragmentationStats{
+			Reassembled:  2,
+			Pending:      1,
+			PendingBytes: 8,
+		},
+		PerProtocol: map[tcpip.NetworkProtocolNumber]stack.FragmentationStats{
+			ipv4.ProtocolNumber: {
+				Reassembled:  1,
+				Pending:      1,
+				PendingBytes: 8,
+			},
+			ipv6.ProtocolNumber: {
+				Reassembled: 1,
+			},
+		},
+	}
+	if diff := cmp.Diff(want, s.FragmentationStats()); diff != "" {
+		t.Errorf("fragmentation stats mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStatsSnapshot(t *testing.T) {
+	const (
+		nicID      = 1
+		localAddr  = tcpip.Address("\x0a\x00\x00\x01")
+		remoteAddr = tcpip.Address("\x0a\x00\x00\x02")
+		localPort  = 80
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocol{ipv4.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{udp.NewProtocol()},
+	})
+	e := channel.New(10, 1280, "")
+	if err := s.CreateNICWithOptions(nicID, e, stack.NICOptions{Name: "nic1"}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, localAddr, err)
+	}
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint(%d, %d, _): %s", udp.ProtocolNumber, ipv4.ProtocolNumber, err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: localPort}); err != nil {
+		t.Fatalf("ep.Bind(_): %s", err)
+	}
+
+	udpPacket := func(fragmentOffset uint16, more bool, payload []byte) buffer.View {
+		buf := buffer.NewView(header.IPv4MinimumSize + len(payload))
+		var flags uint8
+		if more {
+			flags = header.IPv4FlagMoreFragments
+		}
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:            header.IPv4MinimumSize,
+			TotalLength:    uint16(len(buf)),
+			ID:             1,
+			Flags:          flags,
+			FragmentOffset: fragmentOffset,
+			TTL:            64,
+			Protocol:       uint8(udp.ProtocolNumber),
+			SrcAddr:        remoteAddr,
+			DstAddr:        localAddr,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		copy(buf[header.IPv4MinimumSize:], payload)
+		return buf
+	}
+	// A UDP datagram with no checksum, split in two fragments.
+	datagram := make([]byte, header.UDPMinimumSize+8)
+	header.UDP(datagram).Encode(&header.UDPFields{
+		SrcPort: 1234,
+		DstPort: localPort,
+		Length:  uint16(len(datagram)),
+	})
+	for _, buf := range []buffer.View{
+		udpPacket(0, true, datagram[:8]),
+		udpPacket(8, false, datagram[8:]),
+		// A packet too short to hold an IPv4 header.
+		buffer.NewView(header.IPv4MinimumSize - 1),
+	} {
+		e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+			Data: buf.ToVectorisedView(),
+		})
+	}
+
+	snapshot := s.Snapshot()
+	if got, want := snapshot.Stack.IP.PacketsReceived.Value(), uint64(3); got != want {
+		t.Errorf("got Stack.IP.PacketsReceived = %d, want = %d", got, want)
+	}
+	if got, want := snapshot.Stack.UDP.PacketsReceived.Value(), uint64(1); got != want {
+		t.Errorf("got Stack.UDP.PacketsReceived = %d, want = %d", got, want)
+	}
+	nicSnapshot, ok := snapshot.NICs[nicID]
+	if !ok {
+		t.Fatalf("got NICs = %v, want an entry for NIC %d", snapshot.NICs, nicID)
+	}
+	if got, want := nicSnapshot.Name, "nic1"; got != want {
+		t.Errorf("got NICs[%d].Name = %q, want = %q", nicID, got, want)
+	}
+	if got, want := nicSnapshot.Stats.Rx.Packets.Value(), uint64(3); got != want {
+		t.Errorf("got NICs[%d].Stats.Rx.Packets = %d, want = %d", nicID, got, want)
+	}
+	if got, want := nicSnapshot.Drops, (stack.DropStats{Malformed: 1}); got != want {
+		t.Errorf("got NICs[%d].Drops = %+v, want = %+v", nicID, got, want)
+	}
+	if got, want := snapshot.Fragmentation.Total.Reassembled, uint64(1); got != want {
+		t.Errorf("got Fragmentation.Total.Reassembled = %d, want = %d", got, want)
+	}
+	wantDemux := []stack.DemuxStats{{
+		NetworkProtocol:   ipv4.ProtocolNumber,
+		TransportProtocol: udp.ProtocolNumber,
+		Endpoints:         1,
+	}}
+	if diff := cmp.Diff(wantDemux, snapshot.Demux); diff != "" {
+		t.Errorf("Demux mismatch (-want +got):\n%s", diff)
+	}
+
+	// The snapshot must not change as the stack keeps counting.
+	e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+		Data: buffer.NewView(header.IPv4MinimumSize - 1).ToVectorisedView(),
+	})
+	if got, want := snapshot.Stack.IP.PacketsReceived.Value(), uint64(3); got != want {
+		t.Errorf("got Stack.IP.PacketsReceived = %d after another packet, want = %d", got, want)
+	}
+	if got, want := nicSnapshot.Stats.Rx.Packets.Value(), uint64(3); got != want {
+		t.Errorf("got NICs[%d].Stats.Rx.Packets = %d after another packet, want = %d", nicID, got, want)
+	}
+	if got, want := s.Snapshot().NICs[nicID].Stats.Rx.Packets.Value(), uint64(4); got != want {
+		t.Errorf("got NICs[%d].Stats.Rx.Packets = %d in a new snapshot, want = %d", nicID, got, want)
+	}
+}
+
+func TestPMTUCache(t *testing.T) {
+	const (
+		nicID   = 1
+		linkMTU = 1500
+		pathMTU = 1280
+
+		localAddr  = tcpip.Address("\x0a\x00\x00\x01")
+		routerAddr = tcpip.Address("\x0a\x00\x00\xfe")
+		remoteAddr = tcpip.Address("\x0b\x00\x00\x01")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocol{ipv4.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{udp.NewProtocol()},
+	})
+	e := channel.New(10, linkMTU, "")
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("CreateNIC(%d, _): %s", nicID, err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, localAddr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	routeMTU := func() uint32 {
+		t.Helper()
+		r, err := s.FindRoute(nicID, localAddr, remoteAddr, ipv4.ProtocolNumber, false /* multicastLoop */)
+		if err != nil {
+			t.Fatalf("FindRoute(%d, %s, %s, %d, false): %s", nicID, localAddr, remoteAddr, ipv4.ProtocolNumber, err)
+		}
+		defer r.Release()
+		return r.MTU()
+	}
+
+	const wantLinkMTU = linkMTU - header.IPv4MinimumSize
+	if got := routeMTU(); got != wantLinkMTU {
+		t.Fatalf("got r.MTU() = %d before ICMP, want = %d", got, wantLinkMTU)
+	}
+
+	// Have the router report that the path to remoteAddr only fits packets of
+	// pathMTU bytes.
+	const icmpOffset = header.IPv4MinimumSize
+	const innerOffset = icmpOffset + header.ICMPv4MinimumSize
+	buf := buffer.NewView(innerOffset + header.IPv4MinimumSize + header.UDPMinimumSize)
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     routerAddr,
+		DstAddr:     localAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(buf[icmpOffset:])
+	icmp.SetType(header.ICMPv4DstUnreachable)
+	icmp.SetCode(header.ICMPv4FragmentationNeeded)
+	icmp.SetMTU(pathMTU)
+	inner := header.IPv4(buf[innerOffset:])
+	inner.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: linkMTU,
+		TTL:         64,
+		Protocol:    uint8(udp.ProtocolNumber),
+		SrcAddr:     localAddr,
+		DstAddr:     remoteAddr,
+	})
+	e.InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+		Data: buf.ToVectorisedView(),
+	})
+
+	const wantPathMTU = pathMTU - header.IPv4MinimumSize
+	want := []stack.PMTUEntry{{Addr: remoteAddr, MTU: wantPathMTU}}
+	if diff := cmp.Diff(want, s.PMTUEntries()); diff != "" {
+		t.Errorf("PMTUEntries() mismatch (-want +got):\n%s", diff)
+	}
+	if got := routeMTU(); got != wantPathMTU {
+		t.Errorf("got r.MTU() = %d after ICMP, want = %d", got, wantPathMTU)
+	}
+
+	s.ClearPMTU(remoteAddr)
+	if got := s.PMTUEntries(); len(got) != 0 {
+		t.Errorf("got PMTUEntries() = %v after ClearPMTU, want = []", got)
+	}
+	if got := routeMTU(); got != wantLinkMTU {
+		t.Errorf("got r.MTU() = %d after ClearPMTU, want = %d", got, wantLinkMTU)
+	}
+}
+
+func TestNICECN(t *testing.T) {
+	const (
+		nicID      = 1
+		localAddr  = tcpip.Address("\x0a\x00\x00\x01")
+		remoteAddr = tcpip.Address("\x0a\x00\x00\x02")
+	)
+
+	tests := []struct {
+		name string
+		ecn  uint8
+		tos  uint8
+	}{
+		{name: "Disabled", ecn: 0, tos: 0x10},
+		{name: "ECT(0)", ecn: header.ECNECT0, tos: 0x10},
+		{name: "ECT(1)", ecn: header.ECNECT1, tos: 0x10},
+		{name: "Transport codepoint kept", ecn: header.ECNECT0, tos: 0x10 | header.ECNECT1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := stack.New(stack.Options{
+				NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol()},
+			})
+			e := channel.New(1, defaultMTU, "")
+			if err := s.CreateNICWithOptions(nicID, e, stack.NICOptions{ECN: test.ecn}); err != nil {
+				t.Fatalf("CreateNICWithOptions(%d, _, {ECN: %d}): %s", nicID, test.ecn, err)
+			}
+			if err := s.AddAddress(nicID, ipv4.ProtocolNumber, localAddr); err != nil {
+				t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, localAddr, err)
+			}
+			s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+			r, err := s.FindRoute(nicID, localAddr, remoteAddr, ipv4.ProtocolNumber, false /* multicastLoop */)
+			if err != nil {
+				t.Fatalf("FindRoute(%d, %s, %s, %d, false): %s", nicID, localAddr, remoteAddr, ipv4.ProtocolNumber, err)
+			}
+			defer r.Release()
+
+			if got := r.ECN(); got != test.ecn {
+				t.Errorf("got r.ECN() = %d, want = %d", got, test.ecn)
+			}
+
+			// The ECN codepoint is only set by transport protocols which
+			// negotiated ECN, so packets written through the route keep
+			// their TOS.
+			hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+			if err := r.WritePacket(nil /* gso */, stack.NetworkHeaderParams{Protocol: udp.ProtocolNumber, TTL: 64, TOS: test.tos}, stack.PacketBuffer{
+				Header: hdr,
+				Data:   buffer.View([]byte{1, 2, 3, 4}).ToVectorisedView(),
+			}); err != nil {
+				t.Fatalf("WritePacket(...): %s", err)
+			}
+
+			p, ok := e.Read()
+			if !ok {
+				t.Fatal("expected a packet to be written")
+			}
+			b := append(buffer.View(nil), p.Pkt.Header.View()...)
+			b = append(b, p.Pkt.Data.ToView()...)
+			checker.IPv4(t, b, checker.TOS(test.tos, 0))
+		})
+	}
+}
+
+func TestNICECNInvalid(t *testing.T) {
+	s := stack.New(stack.Options{})
+	e := channel.New(1, defaultMTU, "")
+	opts := stack.NICOptions{ECN: header.ECNCE}
+	if err := s.CreateNICWithOptions(1, e, opts); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("got CreateNICWithOptions(1, _, %+v) = %v, want = %s", opts, err, tcpip.ErrInvalidOptionValue)
+	}
+}
+
+func TestNICWriteRawPacket(t *testing.T) {
+	const (
+		nicID      = 1
+		nicName    = "nic1"
+		linkAddr   = tcpip.LinkAddress("\x02\x02\x03\x04\x05\x06")
+		remoteLink = tcpip.LinkAddress("\x02\x02\x03\x04\x05\x07")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{fakeNetFactory()},
+	})
+	e := channel.New(1, defaultMTU, linkAddr)
+	if err := s.CreateNICWithOptions(nicID, e, stack.NICOptions{Name: nicName}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, {Name: %s}): %s", nicID, nicName, err)
+	}
+	nic, ok := s.GetNICByName(nicName)
+	if !ok {
+		t.Fatalf("GetNICByName(%s) = (_, false), want = (_, true)", nicName)
+	}
+
+	payload := buffer.View("crafted packet")
+	if err := nic.WriteRawPacket(fakeNetNumber, remoteLink, payload.ToVectorisedView()); err != nil {
+		t.Fatalf("WriteRawPacket(%d, %s, _): %s", fakeNetNumber, remoteLink, err)
+	}
+
+	p, ok := e.Read()
+	if !ok {
+		t.Fatal("expected a packet to be written")
+	}
+	if p.Proto != fakeNetNumber {
+		t.Errorf("got p.Proto = %d, want = %d", p.Proto, fakeNetNumber)
+	}
+	if p.Route.LocalLinkAddress != linkAddr {
+		t.Errorf("got p.Route.LocalLinkAddress = %s, want = %s", p.Route.LocalLinkAddress, linkAddr)
+	}
+	if p.Route.RemoteLinkAddress != remoteLink {
+		t.Errorf("got p.Route.RemoteLinkAddress = %s, want = %s", p.Route.RemoteLinkAddress, remoteLink)
+	}
+	if got := p.Pkt.Data.ToView(); !bytes.Equal(got, payload) {
+		t.Errorf("got p.Pkt.Data = %x, want = %x", got, payload)
+	}
+
+	stats := nic.Stats()
+	if got := stats.Tx.Packets.Value(); got != 1 {
+		t.Errorf("got Tx.Packets = %d, want = 1", got)
+	}
+	if got, want := stats.Tx.Bytes.Value(), uint64(len(payload)); got != want {
+		t.Errorf("got Tx.Bytes = %d, want = %d", got, want)
+	}
+
+	if err := s.DisableNIC(nicID); err != nil {
+		t.Fatalf("DisableNIC(%d): %s", nicID, err)
+	}
+	if err := nic.WriteRawPacket(fakeNetNumber, remoteLink, payload.ToVectorisedView()); err != tcpip.ErrInvalidEndpointState {
+		t.Errorf("got WriteRawPacket(%d, %s, _) on a disabled NIC = %v, want = %s", fakeNetNumber, remoteLink, err, tcpip.ErrInvalidEndpointState)
+	}
+}
+
+func TestNICSetMTU(t *testing.T) {
+	const (
+		nicID      = 1
+		nicName    = "nic1"
+		linkMTU    = 9000
+		mtu        = 1400
+		localAddr  = tcpip.Address("\x0a\x00\x00\x01")
+		remoteAddr = tcpip.Address("\x0a\x00\x00\x02")
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{ipv4.NewProtocol(), ipv6.NewProtocol()},
+	})
+	e := channel.New(10, linkMTU, "")
+	if err := s.CreateNICWithOptions(nicID, e, stack.NICOptions{Name: nicName}); err != nil {
+		t.Fatalf("CreateNICWithOptions(%d, _, {Name: %s}): %s", nicID, nicName, err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, localAddr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+	nic, ok := s.GetNICByName(nicName)
+	if !ok {
+		t.Fatalf("GetNICByName(%s) = (_, false), want = (_, true)", nicName)
+	}
+
+	// IPv6 is enabled so the MTU may not go below the IPv6 minimum MTU.
+	if err := nic.SetMTU(header.IPv6MinimumMTU - 1); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("got nic.SetMTU(%d) = %v, want = %s", header.IPv6MinimumMTU-1, err, tcpip.ErrInvalidOptionValue)
+	}
+
+	// The link endpoint's MTU is an upper bound.
+	if err := nic.SetMTU(2 * linkMTU); err != nil {
+		t.Fatalf("nic.SetMTU(%d): %s", 2*linkMTU, err)
+	}
+	if got := nic.MTU(); got != linkMTU {
+		t.Errorf("got nic.MTU() = %d, want = %d", got, linkMTU)
+	}
+
+	if err := nic.SetMTU(mtu); err != nil {
+		t.Fatalf("nic.SetMTU(%d): %s", mtu, err)
+	}
+	if got := nic.MTU(); got != mtu {
+		t.Errorf("got nic.MTU() = %d, want = %d", got, mtu)
+	}
+	if got := s.NICInfo()[nicID].MTU; got != mtu {
+		t.Errorf("got NICInfo()[%d].MTU = %d, want = %d", nicID, got, mtu)
+	}
+
+	r, err := s.FindRoute(nicID, localAddr, remoteAddr, ipv4.ProtocolNumber, false /* multicastLoop */)
+	if err != nil {
+		t.Fatalf("FindRoute(%d, %s, %s, %d, false): %s", nicID, localAddr, remoteAddr, ipv4.ProtocolNumber, err)
+	}
+	defer r.Release()
+	if got, want := r.MTU(), uint32(mtu-header.IPv4MinimumSize); got != want {
+		t.Errorf("got r.MTU() = %d, want = %d", got, want)
+	}
+
+	// A packet which fits the link endpoint's MTU but not the NIC's must be
+	// fragmented.
+	const payloadSize = 3000
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+	if err := r.WritePacket(nil /* gso */, stack.NetworkHeaderParams{Protocol: udp.ProtocolNumber, TTL: 64, TOS: stack.DefaultTOS}, stack.PacketBuffer{
+		Header: hdr,
+		Data:   buffer.NewView(payloadSize).ToVectorisedView(),
+	}); err != nil {
+		t.Fatalf("WritePacket(...): %s", err)
+	}
+
+	fragments, total := 0, 0
+	for {
+		p, ok := e.Read()
+		if !ok {
+			break
+		}
+		fragments++
+		size := p.Pkt.Header.UsedLength() + p.Pkt.Data.Size()
+		if size > mtu {
+			t.Errorf("got fragment of %d bytes, want at most %d bytes", size, mtu)
+		}
+		total += size - header.IPv4MinimumSize
+	}
+	if want := (payloadSize + mtu - header.IPv4MinimumSize - 1) / (mtu - header.IPv4MinimumSize); fragments < want {
+		t.Errorf("got %d fragments, want at least %d", fragments, want)
+	}
+	if total != payloadSize {
+		t.Errorf("got %d payload bytes in fragments, want = %d", total, payloadSize)
+	}
+}
+
+func TestRegisteredProtocols(t *testing.T) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocol{ipv6.NewProtocol(), ipv4.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{udp.NewProtocol(), tcp.NewProtocol()},
+	})
+
+	wantNet := []tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber, ipv6.ProtocolNumber}
+	if diff := cmp.Diff(wantNet, s.NetworkProtocols()); diff != "" {
+		t.Errorf("NetworkProtocols() mismatch (-want +got):\n%s", diff)
+	}
+	wantTrans := []tcpip.TransportProtocolNumber{tcp.ProtocolNumber, udp.ProtocolNumber}
+	if diff := cmp.Diff(wantTrans, s.TransportProtocols()); diff != "" {
+		t.Errorf("TransportProtocols() mismatch (-want +got):\n%s", diff)
+	}
+
+	s = stack.New(stack.Options{})
+	if got := s.NetworkProtocols(); len(got) != 0 {
+		t.Errorf("got NetworkProtocols() = %v on an empty stack, want = []", got)
+	}
+	if got := s.TransportProtocols(); len(got) != 0 {
+		t.Errorf("got TransportProtocols() = %v on an empty stack, want = []", got)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"container/heap"
 	"fmt"
 	"math/rand"
+	"sort"
 
 	"gvisor.dev/gvisor/pkg/sync"
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -122,6 +123,8 @@ func (eps *transportEndpoints) findAllEndpointsLocked(id TransportEndpointID) []
 }
 
 // findEndpointLocked returns the endpoint that most closely matches the given id.
+// A fully specified (e.g. connected) endpoint is always preferred over one
+// bound to the same port with a wildcard address, such as a listener.
 //
 // Preconditions: eps.mu must be locked.
 func (eps *transportEndpoints) findEndpointLocked(id TransportEndpointID) *endpointsByNIC {
@@ -165,7 +168,7 @@ func (epsByNIC *endpointsByNIC) handlePacket(r *Route, id TransportEndpointID, p
 
 	// If this is a broadcast or multicast datagram, deliver the datagram to all
 	// endpoints bound to the right device.
-	if isMulticastOrBroadcast(id.LocalAddress) {
+	if isMulticastOrBroadcast(id.LocalAddress) || r.IsDirectedBroadcast() {
 		mpep.handlePacketAll(r, id, pkt)
 		epsByNIC.mu.RUnlock() // Don't use defer for performance reasons.
 		return
@@ -290,6 +293,47 @@ func (d *transportDemuxer) registerEndpoint(netProtos []tcpip.NetworkProtocolNum
 	return nil
 }
 
+// DemuxStats holds statistics about the transport endpoints registered with
+// the stack for a pair of network and transport protocols.
+type DemuxStats struct {
+	// NetworkProtocol and TransportProtocol are the protocols the endpoints
+	// are registered for.
+	NetworkProtocol   tcpip.NetworkProtocolNumber
+	TransportProtocol tcpip.TransportProtocolNumber
+
+	// Endpoints is the number of transport endpoints registered. Endpoints
+	// registered for several NICs or sharing a port are counted once per
+	// registration.
+	Endpoints int
+
+	// RawEndpoints is the number of raw endpoints registered.
+	RawEndpoints int
+}
+
+// stats returns statistics about the endpoints registered with d, sorted by
+// network then transport protocol.
+func (d *transportDemuxer) stats() []DemuxStats {
+	stats := make([]DemuxStats, 0, len(d.protocol))
+	for ids, eps := range d.protocol {
+		eps.mu.RLock()
+		rawEndpoints := len(eps.rawEndpoints)
+		eps.mu.RUnlock()
+		stats = append(stats, DemuxStats{
+			NetworkProtocol:   ids.network,
+			TransportProtocol: ids.transport,
+			Endpoints:         len(eps.transportEndpoints()),
+			RawEndpoints:      rawEndpoints,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].NetworkProtocol != stats[j].NetworkProtocol {
+			return stats[i].NetworkProtocol < stats[j].NetworkProtocol
+		}
+		return stats[i].TransportProtocol < stats[j].TransportProtocol
+	})
+	return stats
+}
+
 type transportEndpointHeap []TransportEndpoint
 
 var _ heap.Interface = (*transportEndpointHeap)(nil)
@@ -478,7 +522,7 @@ func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProto
 
 	// If the packet is a UDP broadcast or multicast, then find all matching
 	// transport endpoints.
-	if protocol == header.UDPProtocolNumber && isMulticastOrBroadcast(id.LocalAddress) {
+	if protocol == header.UDPProtocolNumber && (isMulticastOrBroadcast(id.LocalAddress) || r.IsDirectedBroadcast()) {
 		eps.mu.RLock()
 		destEPs := eps.findAllEndpointsLocked(id)
 		eps.mu.RUnlock()
@@ -498,7 +542,7 @@ func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProto
 
 	// If the packet is a TCP packet with a non-unicast source or destination
 	// address, then do nothing further and instruct the caller to do the same.
-	if protocol == header.TCPProtocolNumber && (!isUnicast(r.LocalAddress) || !isUnicast(r.RemoteAddress)) {
+	if protocol == header.TCPProtocolNumber && (!isUnicast(r.LocalAddress) || !isUnicast(r.RemoteAddress) || r.IsDirectedBroadcast()) {
 		// TCP can only be used to communicate between a single source and a
 		// single destination; the addresses must be unicast.
 		r.Stats().TCP.InvalidSegmentsReceived.Increment()
@@ -387,3 +387,250 @@ func TestBindToDeviceDistribution(t *testing.T) {
 		}
 	}
 }
+
+// TestConnectedEndpointPreferredOverListener tests that packets are delivered to
+// a connected endpoint rather than to a wildcard endpoint listening on the same
+// port when both match the packet.
+func TestConnectedEndpointPreferredOverListener(t *testing.T) {
+	const nicID = 1
+
+	for _, test := range []struct {
+		name       string
+		netProto   tcpip.NetworkProtocolNumber
+		srcAddr    tcpip.Address
+		dstAddr    tcpip.Address
+		sendPacket func(*testContext, []byte, *headers, tcpip.NICID)
+	}{
+		{
+			name:       "IPv4",
+			netProto:   ipv4.ProtocolNumber,
+			srcAddr:    testSrcAddrV4,
+			dstAddr:    testDstAddrV4,
+			sendPacket: (*testContext).sendV4Packet,
+		},
+		{
+			name:       "IPv6",
+			netProto:   ipv6.ProtocolNumber,
+			srcAddr:    testSrcAddrV6,
+			dstAddr:    testDstAddrV6,
+			sendPacket: (*testContext).sendV6Packet,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContextMultiNIC(t, defaultMTU, []tcpip.NICID{nicID})
+
+			newEP := func(name string) tcpip.Endpoint {
+				t.Helper()
+				var wq waiter.Queue
+				ep, err := c.s.NewEndpoint(udp.ProtocolNumber, test.netProto, &wq)
+				if err != nil {
+					t.Fatalf("NewEndpoint for %s endpoint failed: %s", name, err)
+				}
+				if err := ep.SetSockOptBool(tcpip.ReusePortOption, true); err != nil {
+					t.Fatalf("SetSockOptBool(ReusePortOption, true) on %s endpoint failed: %s", name, err)
+				}
+				if err := ep.Bind(tcpip.FullAddress{Port: testDstPort}); err != nil {
+					t.Fatalf("Bind on %s endpoint failed: %s", name, err)
+				}
+				return ep
+			}
+
+			// Create the listener first so the connected endpoint cannot win just
+			// by being registered first.
+			listener := newEP("listening")
+			defer listener.Close()
+			connected := newEP("connected")
+			defer connected.Close()
+			if err := connected.Connect(tcpip.FullAddress{Addr: test.srcAddr, Port: testSrcPort}); err != nil {
+				t.Fatalf("Connect on connected endpoint failed: %s", err)
+			}
+
+			// A packet from the connected endpoint's peer should only be received by
+			// the connected endpoint.
+			test.sendPacket(c, newPayload(), &headers{srcPort: testSrcPort, dstPort: testDstPort}, nicID)
+			if _, _, err := connected.Read(nil); err != nil {
+				t.Errorf("Read on connected endpoint failed: %s", err)
+			}
+			if _, _, err := listener.Read(nil); err != tcpip.ErrWouldBlock {
+				t.Errorf("got Read on listening endpoint = %v, want = %s", err, tcpip.ErrWouldBlock)
+			}
+
+			// A packet from any other peer should be received by the listener.
+			test.sendPacket(c, newPayload(), &headers{srcPort: testSrcPort + 1, dstPort: testDstPort}, nicID)
+			if _, _, err := listener.Read(nil); err != nil {
+				t.Errorf("Read on listening endpoint failed: %s", err)
+			}
+			if _, _, err := connected.Read(nil); err != tcpip.ErrWouldBlock {
+				t.Errorf("got Read on connected endpoint = %v, want = %s", err, tcpip.ErrWouldBlock)
+			}
+		})
+	}
+}
+
+func TestDirectedBroadcastDelivery(t *testing.T) {
+	const (
+		nicID = 1
+		bcast = tcpip.Address("\xc0\xa8\x01\xff")
+	)
+	subnet, err := tcpip.NewSubnet("\xc0\xa8\x01\x00", "\xff\xff\xff\x00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendPacket := func(c *testContext, payload []byte) {
+		buf := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize + len(payload))
+		copy(buf[len(buf)-len(payload):], payload)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(buf)),
+			TTL:         65,
+			Protocol:    uint8(udp.ProtocolNumber),
+			SrcAddr:     testSrcAddrV4,
+			DstAddr:     bcast,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		u := header.UDP(buf[header.IPv4MinimumSize:])
+		u.Encode(&header.UDPFields{
+			SrcPort: testSrcPort,
+			DstPort: testDstPort,
+			Length:  uint16(header.UDPMinimumSize + len(payload)),
+		})
+		xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, testSrcAddrV4, bcast, uint16(len(u)))
+		xsum = header.Checksum(payload, xsum)
+		u.SetChecksum(^u.CalculateChecksum(xsum))
+		c.linkEps[nicID].InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+			Data: buf.ToVectorisedView(),
+		})
+	}
+
+	for _, test := range []struct {
+		name        string
+		setAccept   bool
+		accept      bool
+		wantReceive bool
+	}{
+		{name: "default", setAccept: false, wantReceive: false},
+		{name: "accepted", setAccept: true, accept: true, wantReceive: true},
+		{name: "rejected", setAccept: true, accept: false, wantReceive: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContextMultiNIC(t, defaultMTU, []tcpip.NICID{nicID})
+			if err := c.s.AddAddressRange(nicID, ipv4.ProtocolNumber, subnet); err != nil {
+				t.Fatalf("AddAddressRange(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, subnet, err)
+			}
+			if test.setAccept {
+				if err := c.s.SetAcceptDirectedBroadcast(nicID, test.accept); err != nil {
+					t.Fatalf("SetAcceptDirectedBroadcast(%d, %t): %s", nicID, test.accept, err)
+				}
+			}
+
+			var eps []tcpip.Endpoint
+			for i := 0; i < 2; i++ {
+				var wq waiter.Queue
+				ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+				if err != nil {
+					t.Fatalf("NewEndpoint failed: %s", err)
+				}
+				defer ep.Close()
+				if err := ep.SetSockOptBool(tcpip.ReusePortOption, true); err != nil {
+					t.Fatalf("SetSockOptBool(ReusePortOption, true) failed: %s", err)
+				}
+				if err := ep.Bind(tcpip.FullAddress{Port: testDstPort}); err != nil {
+					t.Fatalf("Bind failed: %s", err)
+				}
+				eps = append(eps, ep)
+			}
+
+			sendPacket(c, newPayload())
+
+			// Every endpoint bound to the port receives its own copy of a
+			// broadcast packet.
+			for i, ep := range eps {
+				_, _, err := ep.Read(nil)
+				if test.wantReceive && err != nil {
+					t.Errorf("Read on endpoint %d failed: %s", i, err)
+				}
+				if !test.wantReceive && err != tcpip.ErrWouldBlock {
+					t.Errorf("got Read on endpoint %d = %v, want = %s", i, err, tcpip.ErrWouldBlock)
+				}
+			}
+		})
+	}
+}
+
+func TestDirectedBroadcastNoReplies(t *testing.T) {
+	const (
+		nicID = 1
+		bcast = tcpip.Address("\xc0\xa8\x01\xff")
+	)
+	subnet, err := tcpip.NewSubnet("\xc0\xa8\x01\x00", "\xff\xff\xff\x00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		protocol  tcpip.TransportProtocolNumber
+		transport func(buffer.View)
+	}{
+		{
+			name:     "echo request",
+			protocol: header.ICMPv4ProtocolNumber,
+			transport: func(v buffer.View) {
+				icmp := header.ICMPv4(v)
+				icmp.SetType(header.ICMPv4Echo)
+				icmp.SetChecksum(^header.Checksum(icmp, 0))
+			},
+		},
+		{
+			name:     "UDP to closed port",
+			protocol: udp.ProtocolNumber,
+			transport: func(v buffer.View) {
+				u := header.UDP(v)
+				u.Encode(&header.UDPFields{
+					SrcPort: testSrcPort,
+					DstPort: testDstPort,
+					Length:  header.UDPMinimumSize,
+				})
+				xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, testSrcAddrV4, bcast, header.UDPMinimumSize)
+				u.SetChecksum(^u.CalculateChecksum(xsum))
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContextMultiNIC(t, defaultMTU, []tcpip.NICID{nicID})
+			if err := c.s.AddAddressRange(nicID, ipv4.ProtocolNumber, subnet); err != nil {
+				t.Fatalf("AddAddressRange(%d, %d, %s): %s", nicID, ipv4.ProtocolNumber, subnet, err)
+			}
+			if err := c.s.SetAcceptDirectedBroadcast(nicID, true); err != nil {
+				t.Fatalf("SetAcceptDirectedBroadcast(%d, true): %s", nicID, err)
+			}
+			c.linkEps[nicID].Drain()
+
+			// Both an ICMPv4 echo request and a UDP header fit in 8 bytes.
+			buf := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize)
+			ip := header.IPv4(buf)
+			ip.Encode(&header.IPv4Fields{
+				IHL:         header.IPv4MinimumSize,
+				TotalLength: uint16(len(buf)),
+				TTL:         65,
+				Protocol:    uint8(test.protocol),
+				SrcAddr:     testSrcAddrV4,
+				DstAddr:     bcast,
+			})
+			ip.SetChecksum(^ip.CalculateChecksum())
+			test.transport(buf[header.IPv4MinimumSize:])
+			c.linkEps[nicID].InjectInbound(ipv4.ProtocolNumber, stack.PacketBuffer{
+				Data: buf.ToVectorisedView(),
+			})
+
+			// As per RFC 1122 sections 3.2.2 and 3.2.2.6, packets sent to a
+			// directed broadcast address are neither answered nor reported.
+			if p, ok := c.linkEps[nicID].Read(); ok {
+				t.Errorf("got unexpected packet = %#v", p)
+			}
+		})
+	}
+}
@@ -17,6 +17,7 @@ package stack_test
 import (
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
@@ -399,6 +400,72 @@ func TestTransportReceive(t *testing.T) {
 	}
 }
 
+func TestTransportDefaultHandlerChain(t *testing.T) {
+	linkEP := channel.New(10, defaultMTU, "")
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocol{fakeNetFactory()},
+		TransportProtocols: []stack.TransportProtocol{fakeTransFactory()},
+	})
+	if err := s.CreateNIC(1, linkEP); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	// The first handler declines packets until accept is set; the second
+	// handler accepts everything but must not be reached once the first one
+	// accepts.
+	var calls []int
+	accept := false
+	s.AddTransportProtocolHandler(fakeTransNumber, func(*stack.Route, stack.TransportEndpointID, stack.PacketBuffer) bool {
+		calls = append(calls, 1)
+		return accept
+	})
+	s.AddTransportProtocolHandler(fakeTransNumber, func(*stack.Route, stack.TransportEndpointID, stack.PacketBuffer) bool {
+		calls = append(calls, 2)
+		return true
+	})
+
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	buf[1] = 2
+	buf[2] = byte(fakeTransNumber)
+	deliver := func() {
+		linkEP.InjectInbound(fakeNetNumber, stack.PacketBuffer{
+			Data: buf.ToVectorisedView(),
+		})
+	}
+
+	deliver()
+	if diff := cmp.Diff([]int{1, 2}, calls); diff != "" {
+		t.Fatalf("calls after first packet mismatch (-want +got):\n%s", diff)
+	}
+
+	calls = nil
+	accept = true
+	deliver()
+	if diff := cmp.Diff([]int{1}, calls); diff != "" {
+		t.Fatalf("calls after second packet mismatch (-want +got):\n%s", diff)
+	}
+
+	// Setting a handler replaces the chain.
+	calls = nil
+	s.SetTransportProtocolHandler(fakeTransNumber, func(*stack.Route, stack.TransportEndpointID, stack.PacketBuffer) bool {
+		calls = append(calls, 3)
+		return true
+	})
+	deliver()
+	if diff := cmp.Diff([]int{3}, calls); diff != "" {
+		t.Fatalf("calls after replacing handlers mismatch (-want +got):\n%s", diff)
+	}
+
+	fakeTrans := s.TransportProtocolInstance(fakeTransNumber).(*fakeTransportProtocol)
+	if fakeTrans.packetCount != 0 {
+		t.Errorf("packetCount = %d, want %d", fakeTrans.packetCount, 0)
+	}
+}
+
 func TestTransportControlReceive(t *testing.T) {
 	linkEP := channel.New(10, defaultMTU, "")
 	s := stack.New(stack.Options{
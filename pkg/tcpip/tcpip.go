@@ -723,6 +723,11 @@ type OutOfBandInlineOption int
 // a default TTL.
 type DefaultTTLOption uint8
 
+// FragmentDSCPCheckOption is used by stack.(*Stack).NetworkProtocolOption to
+// specify whether IP packets whose fragments carry different DSCP values are
+// discarded instead of reassembled. The check is disabled by default.
+type FragmentDSCPCheckOption bool
+
 // IPPacketInfo is the message struture for IP_PKTINFO.
 //
 // +stateify savable
@@ -890,6 +895,11 @@ type ICMPv6PacketStats struct {
 type ICMPv4SentPacketStats struct {
 	ICMPv4PacketStats
 
+	// PacketTooBig is the total number of ICMPv4 destination unreachable
+	// packets with the fragmentation needed code sent. They are also
+	// counted in DstUnreachable.
+	PacketTooBig *StatCounter
+
 	// Dropped is the total number of ICMPv4 packets dropped due to link
 	// layer errors.
 	Dropped *StatCounter
@@ -1237,6 +1247,24 @@ func InitStatCounters(v reflect.Value) {
 	}
 }
 
+// SnapshotStatCounters sets v's non-nil StatCounter fields to new StatCounters
+// holding the current values of the StatCounters they point to, so that v no
+// longer changes as the original StatCounters are incremented.
+func SnapshotStatCounters(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		v := v.Field(i)
+		if s, ok := v.Addr().Interface().(**StatCounter); ok {
+			if *s != nil {
+				c := new(StatCounter)
+				c.IncrementBy((*s).Value())
+				*s = c
+			}
+		} else {
+			SnapshotStatCounters(v)
+		}
+	}
+}
+
 // FillIn returns a copy of s with nil fields initialized to new StatCounters.
 func (s Stats) FillIn() Stats {
 	InitStatCounters(reflect.ValueOf(&s).Elem())
@@ -794,7 +794,7 @@ func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, pk
 	e.rcvList.PushBack(packet)
 	e.rcvBufSize += packet.data.Size()
 
-	packet.timestamp = e.stack.NowNanoseconds()
+	packet.timestamp = e.stack.ReceiveTime(&pkt)
 
 	e.rcvMu.Unlock()
 	e.stats.PacketsReceived.Increment()
@@ -636,7 +636,7 @@ func (e *endpoint) HandlePacket(route *stack.Route, pkt stack.PacketBuffer) {
 	combinedVV := networkHeader.ToVectorisedView()
 	combinedVV.Append(pkt.Data)
 	packet.data = combinedVV
-	packet.timestampNS = e.stack.NowNanoseconds()
+	packet.timestampNS = e.stack.ReceiveTime(&pkt)
 
 	e.rcvList.PushBack(packet)
 	e.rcvBufSize += packet.data.Size()
@@ -294,6 +294,14 @@ func (l *listenContext) createEndpointAndPerformHandshake(s *segment, opts *head
 
 	// Perform the 3-way handshake.
 	h := newPassiveHandshake(ep, ep.rcv.rcvWnd, isn, irs, opts, deferAccept)
+
+	// Accept ECN if the peer sent an ECN-setup SYN, by replying with an
+	// ECN-setup SYN-ACK as per RFC 3168 section 6.1.1.
+	if s.flagsAreSet(ecnSetupFlags) && ep.route.ECN() != 0 {
+		h.flags |= header.TCPFlagEce
+		ep.ecn = ep.route.ECN()
+	}
+
 	if err := h.execute(); err != nil {
 		ep.mu.Unlock()
 		ep.Close()
@@ -449,7 +457,7 @@ func (e *endpoint) handleListenSegment(ctx *listenContext, s *segment) {
 	// for accepted sockets.
 
 	switch {
-	case s.flags == header.TCPFlagSyn:
+	case s.flags&^ecnSetupFlags == header.TCPFlagSyn:
 		opts := parseSynSegmentOptions(s)
 		if ctx.synRcvdCount.inc() {
 			// Only handle the syn if the following conditions hold
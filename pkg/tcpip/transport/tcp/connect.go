@@ -58,6 +58,10 @@ const (
 const (
 	// Maximum space available for options.
 	maxOptionSize = 40
+
+	// ecnSetupFlags are the flags set on an ECN-setup SYN, as defined in
+	// RFC 3168 section 6.1.1.
+	ecnSetupFlags = header.TCPFlagEce | header.TCPFlagCwr
 )
 
 // handshake holds the state used during a TCP 3-way handshake.
@@ -148,6 +152,10 @@ func (h *handshake) resetState() {
 
 	h.state = handshakeSynSent
 	h.flags = header.TCPFlagSyn
+	if h.ep.route.ECN() != 0 {
+		// Request ECN from the peer with an ECN-setup SYN.
+		h.flags |= ecnSetupFlags
+	}
 	h.ackNum = 0
 	h.mss = 0
 	h.iss = generateSecureISN(h.ep.ID, h.ep.stack.Seed())
@@ -256,6 +264,12 @@ func (h *handshake) synSentState(s *segment) *tcpip.Error {
 	// Remember if the SACKPermitted option was negotiated.
 	h.ep.maybeEnableSACKPermitted(&rcvSynOpts)
 
+	// Our SYN was an ECN-setup SYN if it carried both ECE and CWR. ECN is
+	// only used if the peer answered with an ECN-setup SYN-ACK, which
+	// carries ECE but not CWR, as per RFC 3168 section 6.1.1.
+	ecnSetup := h.flags&ecnSetupFlags == ecnSetupFlags
+	h.flags &^= ecnSetupFlags
+
 	// Remember the sequence we'll ack from now on.
 	h.ackNum = s.sequenceNumber + 1
 	h.flags |= header.TCPFlagAck
@@ -265,6 +279,10 @@ func (h *handshake) synSentState(s *segment) *tcpip.Error {
 	// If this is a SYN ACK response, we only need to acknowledge the SYN
 	// and the handshake is completed.
 	if s.flagIsSet(header.TCPFlagAck) {
+		if ecnSetup && s.flags&ecnSetupFlags == header.TCPFlagEce {
+			h.ep.ecn = h.ep.route.ECN()
+		}
+
 		h.state = handshakeCompleted
 
 		h.ep.transitionToStateEstablishedLocked(h)
@@ -898,10 +916,11 @@ func (e *endpoint) sendRaw(data buffer.VectorisedView, flags byte, seq, ack seqn
 		sackBlocks = e.sack.Blocks[:e.sack.NumBlocks]
 	}
 	options := e.makeOptions(sackBlocks)
+	flags, tos := e.ecnParams(data.Size(), flags, seq)
 	err := e.sendTCP(&e.route, tcpFields{
 		id:     e.ID,
 		ttl:    e.ttl,
-		tos:    e.sendTOS,
+		tos:    tos,
 		flags:  flags,
 		seq:    seq,
 		ack:    ack,
@@ -912,6 +931,29 @@ func (e *endpoint) sendRaw(data buffer.VectorisedView, flags byte, seq, ack seqn
 	return err
 }
 
+// ecnParams returns the flags and the TOS of a segment of dataLen bytes
+// starting at seq, with the ECN signals of RFC 3168 section 6.1 applied if ECN
+// was negotiated with the peer.
+func (e *endpoint) ecnParams(dataLen int, flags byte, seq seqnum.Value) (byte, uint8) {
+	tos := e.sendTOS
+	if e.ecn == 0 || flags&header.TCPFlagRst != 0 {
+		return flags, tos
+	}
+	if e.ecnEcho && flags&header.TCPFlagAck != 0 {
+		flags |= header.TCPFlagEce
+	}
+	// Only new data segments are ECN-capable. Pure ACKs and retransmissions
+	// must not be, as per RFC 3168 sections 6.1.4 and 6.1.5.
+	if dataLen != 0 && !seq.LessThan(e.snd.sndNxt) {
+		tos = tos&^header.ECNMask | e.ecn
+		if e.snd.ecnCWR {
+			flags |= header.TCPFlagCwr
+			e.snd.ecnCWR = false
+		}
+	}
+	return flags, tos
+}
+
 func (e *endpoint) handleWrite() *tcpip.Error {
 	// Move packets from send queue to send list. The queue is accessible
 	// from other goroutines and protected by the send mutex, while the send
@@ -1198,6 +1240,18 @@ func (e *endpoint) handleSegment(s *segment) (cont bool, err *tcpip.Error) {
 		// send window scale.
 		s.window <<= e.snd.sndWndScale
 
+		// Echo the congestion indications received from the network
+		// until the peer reduces its congestion window, as per RFC 3168
+		// section 6.1.3.
+		if e.ecn != 0 {
+			if s.flagIsSet(header.TCPFlagCwr) {
+				e.ecnEcho = false
+			}
+			if s.ce {
+				e.ecnEcho = true
+			}
+		}
+
 		// RFC 793, page 41 states that "once in the ESTABLISHED
 		// state all segments must carry current acknowledgment
 		// information."
@@ -424,6 +424,16 @@ type endpoint struct {
 	// option in the SYN/SYN-ACK.
 	sackPermitted bool
 
+	// ecn is the ECN codepoint set on the data segments sent by the
+	// endpoint once ECN was negotiated with the peer in the SYN/SYN-ACK, as
+	// per RFC 3168 section 6.1.1. It is zero if ECN is not in use.
+	ecn uint8
+
+	// ecnEcho is true if the ECE flag must be set on the ACKs sent by the
+	// endpoint, because a segment marked CE was received and the peer has
+	// not yet reduced its congestion window in response.
+	ecnEcho bool
+
 	// sack holds TCP SACK related information for this endpoint.
 	sack SACKInfo
 
@@ -2770,5 +2780,9 @@ func (e *endpoint) Wait() {
 
 func mssForRoute(r *stack.Route) uint16 {
 	// TODO(b/143359391): Respect TCP Min and Max size.
-	return uint16(r.MTU() - header.TCPMinimumSize)
+	mss := uint16(r.MTU() - header.TCPMinimumSize)
+	if clamp := r.TCPMSSClamp(); clamp != 0 && clamp < mss {
+		mss = clamp
+	}
+	return mss
 }
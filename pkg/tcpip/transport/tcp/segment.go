@@ -49,6 +49,9 @@ type segment struct {
 	csum uint16
 	// csumValid is true if the csum in the received segment is valid.
 	csumValid bool
+	// ce is true if the received segment was marked CE (Congestion
+	// Experienced) in its IP header.
+	ce bool
 
 	// parsedOptions stores the parsed values from the options in the segment.
 	parsedOptions  header.TCPOptions
@@ -67,10 +70,30 @@ func newSegment(r *stack.Route, id stack.TransportEndpointID, pkt stack.PacketBu
 		route:  r.Clone(),
 	}
 	s.data = pkt.Data.Clone(s.views[:])
+	s.ce = ecnCodepoint(pkt.NetworkHeader) == header.ECNCE
 	s.rcvdTime = time.Now()
 	return s
 }
 
+// ecnCodepoint returns the ECN codepoint of the IP header h, or zero if h is
+// not a valid IPv4 or IPv6 header.
+func ecnCodepoint(h buffer.View) uint8 {
+	var tos uint8
+	switch header.IPVersion(h) {
+	case header.IPv4Version:
+		if len(h) < header.IPv4MinimumSize {
+			return 0
+		}
+		tos, _ = header.IPv4(h).TOS()
+	case header.IPv6Version:
+		if len(h) < header.IPv6MinimumSize {
+			return 0
+		}
+		tos, _ = header.IPv6(h).TOS()
+	}
+	return tos & header.ECNMask
+}
+
 func newSegmentFromView(r *stack.Route, id stack.TransportEndpointID, v buffer.View) *segment {
 	s := &segment{
 		refCnt: 1,
@@ -93,6 +116,7 @@ func (s *segment) clone() *segment {
 		ackNumber:      s.ackNumber,
 		flags:          s.flags,
 		window:         s.window,
+		ce:             s.ce,
 		route:          s.route.Clone(),
 		viewToDeliver:  s.viewToDeliver,
 		rcvdTime:       s.rcvdTime,
@@ -102,6 +102,10 @@ type sender struct {
 	// fr holds state related to fast recovery.
 	fr fastRecovery
 
+	// initialCwnd is the initial congestion window, in packets. It is
+	// taken from the route when the sender is created.
+	initialCwnd int
+
 	// sndCwnd is the congestion window, in packets.
 	sndCwnd int
 
@@ -172,6 +176,17 @@ type sender struct {
 
 	// cc is the congestion control algorithm in use for this sender.
 	cc congestionControl
+
+	// ecnRecover is the highest sequence number sent when the congestion
+	// window was last reduced in response to an ECE. The window is not
+	// reduced again until ecnRecover is acknowledged, as per RFC 3168
+	// section 6.1.2.
+	ecnRecover seqnum.Value
+
+	// ecnCWR is true if the CWR flag must be set on the next new data
+	// segment sent, to notify the peer that the congestion window was
+	// reduced.
+	ecnCWR bool
 }
 
 // rtt is a synchronization wrapper used to appease stateify. See the comment
@@ -240,7 +255,13 @@ func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint
 			highRxt:   iss,
 			rescueRxt: iss,
 		},
-		gso: ep.gso != nil,
+		gso:         ep.gso != nil,
+		initialCwnd: InitialCwnd,
+		ecnRecover:  iss,
+	}
+
+	if iw := ep.route.TCPInitialCwnd(); iw > 0 {
+		s.initialCwnd = iw
 	}
 
 	if s.gso {
@@ -278,7 +299,7 @@ func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint
 // returns a handle to it. It also initializes the sndCwnd and sndSsThresh to
 // their initial values.
 func (s *sender) initCongestionControl(congestionControlName tcpip.CongestionControlOption) congestionControl {
-	s.sndCwnd = InitialCwnd
+	s.sndCwnd = s.initialCwnd
 	s.sndSsthresh = math.MaxInt64
 
 	switch congestionControlName {
@@ -841,8 +862,8 @@ func (s *sender) sendData() {
 	// transmission if the TCP has not sent data in the interval exceeding
 	// the retrasmission timeout."
 	if !s.fr.active && time.Now().Sub(s.lastSendTime) > s.rto {
-		if s.sndCwnd > InitialCwnd {
-			s.sndCwnd = InitialCwnd
+		if s.sndCwnd > s.initialCwnd {
+			s.sndCwnd = s.initialCwnd
 		}
 	}
 
@@ -905,6 +926,16 @@ func (s *sender) enterFastRecovery() {
 	s.ep.stack.Stats().TCP.FastRecovery.Increment()
 }
 
+// handleECE reduces the congestion window in response to an ACK carrying the
+// ECE flag, as per RFC 3168 section 6.1.2, and sets the CWR flag on the next
+// new data segment sent.
+func (s *sender) handleECE() {
+	s.cc.HandleNDupAcks()
+	s.sndCwnd = s.sndSsthresh
+	s.ecnRecover = s.sndNxt - 1
+	s.ecnCWR = true
+}
+
 func (s *sender) leaveFastRecovery() {
 	s.fr.active = false
 	s.fr.maxCwnd = 0
@@ -1215,6 +1246,12 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 			s.resendTimer.disable()
 		}
 	}
+	// Reduce the congestion window if the peer echoed a congestion
+	// indication, at most once per window of data.
+	if s.ep.ecn != 0 && seg.flagIsSet(header.TCPFlagEce) && !s.fr.active && s.ecnRecover.LessThan(ack) {
+		s.handleECE()
+	}
+
 	// Now that we've popped all acknowledged data from the retransmit
 	// queue, retransmit if needed.
 	if rtx {
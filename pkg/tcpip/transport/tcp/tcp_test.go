@@ -2874,6 +2874,272 @@ func TestSynOptionsOnActiveConnect(t *testing.T) {
 	}
 }
 
+func TestSynOptionsMSSClampedByNIC(t *testing.T) {
+	const mtu = 1400
+	const mssClamp = 536
+	c := context.NewWithNICOptions(t, mtu, stack.NICOptions{TCPMSSClamp: mssClamp})
+	defer c.Cleanup()
+
+	var err *tcpip.Error
+	c.EP, err = c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.WQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	if err := c.EP.Connect(tcpip.FullAddress{Addr: context.TestAddr, Port: context.TestPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("got c.EP.Connect(...) = %v, want = %v", err, tcpip.ErrConnectStarted)
+	}
+
+	// The SYN must advertise the clamped MSS rather than the one derived
+	// from the NIC's MTU.
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.TCPFlags(header.TCPFlagSyn),
+			checker.TCPSynOptions(header.TCPSynOptions{MSS: mssClamp, WS: int(c.WindowScale)}),
+		),
+	)
+}
+
+// sendCE sends a TCP segment with the given payload and headers in an IPv4
+// packet marked CE.
+func sendCE(c *context.Context, payload []byte, h *context.Headers) {
+	vv := c.BuildSegment(payload, h)
+	v := vv.ToView()
+	ip := header.IPv4(v)
+	ip.SetTOS(header.ECNCE, 0)
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	c.SendSegment(v.ToVectorisedView())
+}
+
+func TestECNActiveOpen(t *testing.T) {
+	const iss = seqnum.Value(789)
+
+	tests := []struct {
+		name        string
+		nicECN      uint8
+		synFlags    uint8
+		synAckFlags int
+		negotiated  bool
+	}{
+		{
+			name:        "Disabled",
+			synFlags:    header.TCPFlagSyn,
+			synAckFlags: header.TCPFlagSyn | header.TCPFlagAck | header.TCPFlagEce,
+		},
+		{
+			name:        "Refused by peer",
+			nicECN:      header.ECNECT0,
+			synFlags:    header.TCPFlagSyn | header.TCPFlagEce | header.TCPFlagCwr,
+			synAckFlags: header.TCPFlagSyn | header.TCPFlagAck,
+		},
+		{
+			name:        "Negotiated ECT(0)",
+			nicECN:      header.ECNECT0,
+			synFlags:    header.TCPFlagSyn | header.TCPFlagEce | header.TCPFlagCwr,
+			synAckFlags: header.TCPFlagSyn | header.TCPFlagAck | header.TCPFlagEce,
+			negotiated:  true,
+		},
+		{
+			name:        "Negotiated ECT(1)",
+			nicECN:      header.ECNECT1,
+			synFlags:    header.TCPFlagSyn | header.TCPFlagEce | header.TCPFlagCwr,
+			synAckFlags: header.TCPFlagSyn | header.TCPFlagAck | header.TCPFlagEce,
+			negotiated:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := context.NewWithNICOptions(t, defaultMTU, stack.NICOptions{ECN: test.nicECN})
+			defer c.Cleanup()
+
+			var err *tcpip.Error
+			c.EP, err = c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.WQ)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+
+			we, ch := waiter.NewChannelEntry(nil)
+			c.WQ.EventRegister(&we, waiter.EventOut)
+			defer c.WQ.EventUnregister(&we)
+
+			if err := c.EP.Connect(tcpip.FullAddress{Addr: context.TestAddr, Port: context.TestPort}); err != tcpip.ErrConnectStarted {
+				t.Fatalf("got c.EP.Connect(...) = %v, want = %v", err, tcpip.ErrConnectStarted)
+			}
+
+			// The SYN requests ECN if it is enabled on the NIC, and is not
+			// ECN-capable itself.
+			b := c.GetPacket()
+			checker.IPv4(t, b,
+				checker.TOS(0, 0),
+				checker.TCP(
+					checker.DstPort(context.TestPort),
+					checker.TCPFlags(test.synFlags),
+				),
+			)
+			tcpHdr := header.TCP(header.IPv4(b).Payload())
+			c.IRS = seqnum.Value(tcpHdr.SequenceNumber())
+			c.Port = tcpHdr.SourcePort()
+
+			c.SendPacket(nil, &context.Headers{
+				SrcPort: context.TestPort,
+				DstPort: c.Port,
+				Flags:   test.synAckFlags,
+				SeqNum:  iss,
+				AckNum:  c.IRS.Add(1),
+				RcvWnd:  30000,
+			})
+			checker.IPv4(t, c.GetPacket(),
+				checker.TOS(0, 0),
+				checker.TCP(
+					checker.DstPort(context.TestPort),
+					checker.TCPFlags(header.TCPFlagAck),
+					checker.SeqNum(uint32(c.IRS)+1),
+					checker.AckNum(uint32(iss)+1),
+				),
+			)
+
+			select {
+			case <-ch:
+			case <-time.After(1 * time.Second):
+				t.Fatal("timed out waiting for connection")
+			}
+
+			var dataECN, ece, cwr uint8
+			if test.negotiated {
+				dataECN = test.nicECN
+				ece = header.TCPFlagEce
+				cwr = header.TCPFlagCwr
+			}
+
+			// Only data segments of connections which negotiated ECN are
+			// ECN-capable.
+			data := []byte{1, 2, 3}
+			if _, _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			checker.IPv4(t, c.GetPacket(),
+				checker.TOS(dataECN, 0),
+				checker.PayloadLen(len(data)+header.TCPMinimumSize),
+				checker.TCP(
+					checker.DstPort(context.TestPort),
+					checker.TCPFlags(header.TCPFlagAck|header.TCPFlagPsh),
+					checker.SeqNum(uint32(c.IRS)+1),
+				),
+			)
+
+			// A segment marked CE is echoed with ECE in the ACK of
+			// connections which negotiated ECN.
+			sendCE(c, data, &context.Headers{
+				SrcPort: context.TestPort,
+				DstPort: c.Port,
+				Flags:   header.TCPFlagAck,
+				SeqNum:  iss + 1,
+				AckNum:  c.IRS.Add(1 + seqnum.Size(len(data))),
+				RcvWnd:  30000,
+			})
+			checker.IPv4(t, c.GetPacket(),
+				checker.TOS(0, 0),
+				checker.TCP(
+					checker.DstPort(context.TestPort),
+					checker.TCPFlags(header.TCPFlagAck|ece),
+					checker.AckNum(uint32(iss)+1+uint32(len(data))),
+				),
+			)
+
+			// An ECE from the peer reduces the congestion window, which is
+			// signaled with CWR on the next data segment only. ECE is still
+			// echoed as the peer has not sent CWR yet.
+			c.SendPacket(nil, &context.Headers{
+				SrcPort: context.TestPort,
+				DstPort: c.Port,
+				Flags:   header.TCPFlagAck | header.TCPFlagEce,
+				SeqNum:  iss.Add(1 + seqnum.Size(len(data))),
+				AckNum:  c.IRS.Add(1 + seqnum.Size(len(data))),
+				RcvWnd:  30000,
+			})
+			for i, wantCWR := range []uint8{cwr, 0} {
+				if _, _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+				checker.IPv4(t, c.GetPacket(),
+					checker.TOS(dataECN, 0),
+					checker.TCP(
+						checker.DstPort(context.TestPort),
+						checker.TCPFlags(header.TCPFlagAck|header.TCPFlagPsh|ece|wantCWR),
+						checker.SeqNum(uint32(c.IRS)+1+uint32((i+1)*len(data))),
+					),
+				)
+			}
+		})
+	}
+}
+
+func TestECNPassiveOpen(t *testing.T) {
+	tests := []struct {
+		name            string
+		nicECN          uint8
+		synFlags        int
+		wantSynAckFlags uint8
+	}{
+		{
+			name:            "Disabled",
+			synFlags:        header.TCPFlagSyn | header.TCPFlagEce | header.TCPFlagCwr,
+			wantSynAckFlags: header.TCPFlagSyn | header.TCPFlagAck,
+		},
+		{
+			name:            "Not requested",
+			nicECN:          header.ECNECT0,
+			synFlags:        header.TCPFlagSyn,
+			wantSynAckFlags: header.TCPFlagSyn | header.TCPFlagAck,
+		},
+		{
+			name:            "Negotiated",
+			nicECN:          header.ECNECT0,
+			synFlags:        header.TCPFlagSyn | header.TCPFlagEce | header.TCPFlagCwr,
+			wantSynAckFlags: header.TCPFlagSyn | header.TCPFlagAck | header.TCPFlagEce,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := context.NewWithNICOptions(t, defaultMTU, stack.NICOptions{ECN: test.nicECN})
+			defer c.Cleanup()
+
+			var err *tcpip.Error
+			c.EP, err = c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.WQ)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			if err := c.EP.Bind(tcpip.FullAddress{Port: context.StackPort}); err != nil {
+				t.Fatalf("Bind failed: %v", err)
+			}
+			if err := c.EP.Listen(10); err != nil {
+				t.Fatalf("Listen failed: %v", err)
+			}
+
+			c.SendPacket(nil, &context.Headers{
+				SrcPort: context.TestPort,
+				DstPort: context.StackPort,
+				Flags:   test.synFlags,
+				SeqNum:  seqnum.Value(789),
+				RcvWnd:  30000,
+			})
+			checker.IPv4(t, c.GetPacket(),
+				checker.TOS(0, 0),
+				checker.TCP(
+					checker.SrcPort(context.StackPort),
+					checker.DstPort(context.TestPort),
+					checker.TCPFlags(test.wantSynAckFlags),
+					checker.AckNum(790),
+				),
+			)
+		})
+	}
+}
+
 func TestCloseListener(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -4311,6 +4577,45 @@ func TestPathMTUDiscovery(t *testing.T) {
 	receivePackets(c, sizes, -1, uint32(c.IRS)+1)
 }
 
+func TestPathMTUDiscoveryIgnoresNonFirstFragment(t *testing.T) {
+	// This test verifies that ICMP errors about a non-first fragment are not
+	// matched against the connection: such fragments carry no transport
+	// header, so the bytes where the ports would be are payload.
+	c := context.New(t, 1500)
+	defer c.Cleanup()
+
+	const maxPayload = 1500 - header.TCPMinimumSize - header.IPv4MinimumSize
+	c.CreateConnectedWithRawOptions(789, 30000, -1 /* epRcvBuf */, []byte{
+		header.TCPOptionMSS, 4, byte(maxPayload / 256), byte(maxPayload % 256),
+	})
+
+	data := buffer.NewView(maxPayload)
+	if _, _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	first := c.GetPacket()
+	checker.IPv4(t, first, checker.PayloadLen(maxPayload+header.TCPMinimumSize))
+
+	// Mark the quoted packet as a non-first fragment. Its leading bytes still
+	// match the connection's ports.
+	quoted := append([]byte(nil), first...)
+	ip := header.IPv4(quoted)
+	ip.SetFlagsFragmentOffset(0, 1480)
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	const newMTU = 1200
+	mtu := []byte{0, 0, newMTU / 256, newMTU % 256}
+	c.SendICMPPacket(header.ICMPv4DstUnreachable, header.ICMPv4FragmentationNeeded, mtu, quoted, newMTU)
+
+	// The segment must not be retransmitted with a smaller MSS, and the path
+	// MTU must not be recorded.
+	c.CheckNoPacket("got retransmission after ICMP error for a non-first fragment")
+	if got := c.Stack().PMTUEntries(); len(got) != 0 {
+		t.Errorf("got PMTUEntries() = %v, want = []", got)
+	}
+}
+
 func TestTCPEndpointProbe(t *testing.T) {
 	c := context.New(t, 1500)
 	defer c.Cleanup()
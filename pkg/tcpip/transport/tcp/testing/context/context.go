@@ -138,9 +138,18 @@ type Context struct {
 // New allocates and initializes a test context containing a new
 // stack and a link-layer endpoint.
 func New(t *testing.T, mtu uint32) *Context {
+	return NewWithNICOptions(t, mtu, stack.NICOptions{})
+}
+
+// NewWithNICOptions is like New, but creates the test NIC with the given
+// options. The NIC's name is always "nic1".
+func NewWithNICOptions(t *testing.T, mtu uint32, opts stack.NICOptions) *Context {
 	s := stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocol{ipv4.NewProtocol(), ipv6.NewProtocol()},
 		TransportProtocols: []stack.TransportProtocol{tcp.NewProtocol()},
+		// StackV6Addr is the IPv6 loopback address, but it is assigned to a
+		// channel NIC.
+		AllowExternalLoopbackTraffic: true,
 	})
 
 	// Allow minimum send/receive buffer sizes to be 1 during tests.
@@ -166,7 +175,7 @@ func New(t *testing.T, mtu uint32) *Context {
 	if testing.Verbose() {
 		wep = sniffer.New(ep)
 	}
-	opts := stack.NICOptions{Name: "nic1"}
+	opts.Name = "nic1"
 	if err := s.CreateNICWithOptions(1, wep, opts); err != nil {
 		t.Fatalf("CreateNICWithOptions(_, _, %+v) failed: %v", opts, err)
 	}
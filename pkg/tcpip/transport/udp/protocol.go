@@ -76,6 +76,12 @@ func (p *protocol) HandleUnknownDestinationPacket(r *stack.Route, id stack.Trans
 	}
 	// TODO(b/129426613): only send an ICMP message if UDP checksum is valid.
 
+	// Don't send ICMP errors if the NIC the packet arrived on is configured not
+	// to.
+	if r.ICMPRepliesSuppressed() {
+		return true
+	}
+
 	// Only send ICMP error if the address is not a multicast/broadcast
 	// v4/v6 address or the source is not the unspecified address.
 	//
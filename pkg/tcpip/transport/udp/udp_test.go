@@ -271,6 +271,10 @@ type testContext struct {
 
 	ep tcpip.Endpoint
 	wq waiter.Queue
+
+	// rxTimestamp is the receive timestamp attached to injected packets, as
+	// if by the link endpoint.
+	rxTimestamp int64
 }
 
 func newDualTestContext(t *testing.T, mtu uint32) *testContext {
@@ -284,6 +288,9 @@ func newDualTestContext(t *testing.T, mtu uint32) *testContext {
 func newDualTestContextWithOptions(t *testing.T, mtu uint32, options stack.Options) *testContext {
 	t.Helper()
 
+	// stackV6Addr is the IPv6 loopback address, but it is assigned to a
+	// channel NIC.
+	options.AllowExternalLoopbackTraffic = true
 	s := stack.New(options)
 	ep := channel.New(256, mtu, "")
 	wep := stack.LinkEndpoint(ep)
@@ -444,6 +451,7 @@ func (c *testContext) injectV6Packet(payload []byte, h *header4Tuple, valid bool
 		Data:            buf.ToVectorisedView(),
 		NetworkHeader:   buffer.View(ip),
 		TransportHeader: buffer.View(u),
+		RxTimestamp:     c.rxTimestamp,
 	})
 }
 
@@ -491,6 +499,7 @@ func (c *testContext) injectV4Packet(payload []byte, h *header4Tuple, valid bool
 		Data:            buf.ToVectorisedView(),
 		NetworkHeader:   buffer.View(ip),
 		TransportHeader: buffer.View(u),
+		RxTimestamp:     c.rxTimestamp,
 	})
 }
 
@@ -828,6 +837,26 @@ func TestV4ReadOnV4(t *testing.T) {
 	testRead(c, unicastV4)
 }
 
+// TestReadRxTimestamp checks that the receive timestamp attached to a packet by
+// the link endpoint is handed through as ancillary data.
+func TestReadRxTimestamp(t *testing.T) {
+	const rxTimestamp = 1234567890
+	for _, flow := range []testFlow{unicastV4, unicastV6} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createEndpointForFlow(flow)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}); err != nil {
+				c.t.Fatalf("Bind failed: %s", err)
+			}
+
+			c.rxTimestamp = rxTimestamp
+			testRead(c, flow, checker.ReceiveTimestamp(rxTimestamp))
+		})
+	}
+}
+
 // TestReadOnBoundToMulticast checks that an endpoint can bind to a multicast
 // address and receive data sent to that address.
 func TestReadOnBoundToMulticast(t *testing.T) {
@@ -17,10 +17,13 @@
 package testbench
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"math/rand"
 	"net"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -35,6 +38,8 @@ import (
 
 var localIPv4 = flag.String("local_ipv4", "", "local IPv4 address for test packets")
 var remoteIPv4 = flag.String("remote_ipv4", "", "remote IPv4 address for test packets")
+var localIPv6 = flag.String("local_ipv6", "", "local IPv6 address for test packets")
+var remoteIPv6 = flag.String("remote_ipv6", "", "remote IPv6 address for test packets")
 var localMAC = flag.String("local_mac", "", "local mac address for test packets")
 var remoteMAC = flag.String("remote_mac", "", "remote mac address for test packets")
 
@@ -184,13 +189,61 @@ func (*ipv4State) close() error {
 	return nil
 }
 
+// ipv6State maintains state about an IPv6 connection.
+type ipv6State struct {
+	out, in IPv6
+}
+
+var _ layerState = (*ipv6State)(nil)
+
+// newIPv6State creates a new ipv6State.
+func newIPv6State(out, in IPv6) (*ipv6State, error) {
+	lIP := tcpip.Address(net.ParseIP(*localIPv6).To16())
+	rIP := tcpip.Address(net.ParseIP(*remoteIPv6).To16())
+	s := ipv6State{
+		out: IPv6{SrcAddr: &lIP, DstAddr: &rIP},
+		in:  IPv6{SrcAddr: &rIP, DstAddr: &lIP},
+	}
+	if err := s.out.merge(&out); err != nil {
+		return nil, err
+	}
+	if err := s.in.merge(&in); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *ipv6State) outgoing() Layer {
+	return &s.out
+}
+
+func (s *ipv6State) incoming(Layer) Layer {
+	return deepcopy.Copy(&s.in).(Layer)
+}
+
+func (*ipv6State) sent(Layer) error {
+	return nil
+}
+
+func (*ipv6State) received(Layer) error {
+	return nil
+}
+
+func (*ipv6State) close() error {
+	return nil
+}
+
 // tcpState maintains state about a TCP connection.
 type tcpState struct {
 	out, in                   TCP
 	localSeqNum, remoteSeqNum *seqnum.Value
-	synAck                    *TCP
-	portPickerFD              int
-	finSent                   bool
+	// localISN is the initial sequence number of the testbench.
+	localISN     seqnum.Value
+	synAck       *TCP
+	portPickerFD int
+	finSent      bool
+	// trackSeqNums is set by SetSeqNumTracking.
+	trackSeqNums bool
 }
 
 var _ layerState = (*tcpState)(nil)
@@ -207,10 +260,12 @@ func newTCPState(out, in TCP) (*tcpState, error) {
 	if err != nil {
 		return nil, err
 	}
+	isn := seqnum.Value(rand.Uint32())
 	s := tcpState{
 		out:          TCP{SrcPort: &localPort},
 		in:           TCP{DstPort: &localPort},
-		localSeqNum:  SeqNumValue(seqnum.Value(rand.Uint32())),
+		localSeqNum:  SeqNumValue(isn),
+		localISN:     isn,
 		portPickerFD: portPickerFD,
 		finSent:      false,
 	}
@@ -257,6 +312,12 @@ func (s *tcpState) sent(sent Layer) error {
 	if !ok {
 		return fmt.Errorf("can't update tcpState with %T Layer", sent)
 	}
+	if s.trackSeqNums && seqnum.Value(*tcp.SeqNum) != *s.localSeqNum {
+		// The test chose the sequence number of the segment, e.g. to
+		// retransmit or to probe outside of the window, so it doesn't take up
+		// any new sequence space.
+		return nil
+	}
 	if !s.finSent {
 		// update localSeqNum by the payload only when FIN is not yet sent by us
 		for current := tcp.next(); current != nil; current = current.next() {
@@ -277,13 +338,18 @@ func (s *tcpState) received(l Layer) error {
 	if !ok {
 		return fmt.Errorf("can't update tcpState with %T Layer", l)
 	}
-	s.remoteSeqNum = SeqNumValue(seqnum.Value(*tcp.SeqNum))
+	next := seqnum.Value(*tcp.SeqNum)
 	if *tcp.Flags&(header.TCPFlagSyn|header.TCPFlagFin) != 0 {
-		s.remoteSeqNum.UpdateForward(1)
+		next.UpdateForward(1)
 	}
 	for current := tcp.next(); current != nil; current = current.next() {
-		s.remoteSeqNum.UpdateForward(seqnum.Size(current.length()))
+		next.UpdateForward(seqnum.Size(current.length()))
 	}
+	if s.trackSeqNums && s.remoteSeqNum != nil && next.LessThan(*s.remoteSeqNum) {
+		// A retransmission of data already received.
+		return nil
+	}
+	s.remoteSeqNum = SeqNumValue(next)
 	return nil
 }
 
@@ -356,6 +422,16 @@ type Connection struct {
 	injector    Injector
 	sniffer     Sniffer
 	t           *testing.T
+
+	// sendDelay and sendJitter hold the delay added before sending frames.
+	// See SetSendDelay.
+	sendDelay  time.Duration
+	sendJitter time.Duration
+
+	// lossPercent and lossRand decide which frames are dropped in either
+	// direction. See SetPacketLoss.
+	lossPercent float64
+	lossRand    *rand.Rand
 }
 
 // match tries to match each Layer in received against the incoming filter. If
@@ -427,11 +503,20 @@ func (conn *Connection) CreateFrame(layer Layer, additionalLayers ...Layer) Laye
 
 // SendFrame sends a frame on the wire and updates the state of all layers.
 func (conn *Connection) SendFrame(frame Layers) {
-	outBytes, err := frame.toBytes()
+	outBytes := conn.prepareFrame(frame)
+	conn.waitSendDelay()
+	if !conn.lose() {
+		conn.injector.Send(outBytes)
+	}
+}
+
+// prepareFrame returns the bytes of frame and updates the state of all layers
+// as if it was sent.
+func (conn *Connection) prepareFrame(frame Layers) []byte {
+	outBytes, err := frame.ToBytes()
 	if err != nil {
 		conn.t.Fatalf("can't build outgoing TCP packet: %s", err)
 	}
-	conn.injector.Send(outBytes)
 
 	// frame might have nil values where the caller wanted to use default values.
 	// sentFrame will have no nil values in it because it comes from parsing the
@@ -443,6 +528,47 @@ func (conn *Connection) SendFrame(frame Layers) {
 			conn.t.Fatalf("Unable to update the state of %+v with %s: %s", s, sentFrame[i], err)
 		}
 	}
+	return outBytes
+}
+
+// SetSendDelay makes SendFrame wait for delay, plus a random duration of up to
+// jitter, before sending each frame, so that the DUT sees a link with a high
+// and variable latency. Frames are still sent in order. A zero delay and
+// jitter disable the wait.
+func (conn *Connection) SetSendDelay(delay, jitter time.Duration) {
+	conn.sendDelay = delay
+	conn.sendJitter = jitter
+}
+
+// waitSendDelay waits for the delay configured with SetSendDelay.
+func (conn *Connection) waitSendDelay() {
+	d := conn.sendDelay
+	if conn.sendJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(conn.sendJitter)))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// SetPacketLoss makes the link between the testbench and the DUT drop percent
+// percent of the frames, chosen at random, in both directions. A dropped
+// outgoing frame still updates the state of the connection, as if it was lost
+// after being sent, and a dropped incoming frame is never seen by Expect. The
+// random choices are made from seed so that a test is reproducible. A percent
+// of zero disables the losses.
+func (conn *Connection) SetPacketLoss(percent float64, seed int64) {
+	conn.lossPercent = percent
+	conn.lossRand = rand.New(rand.NewSource(seed))
+}
+
+// lose returns whether the next frame should be dropped, as configured with
+// SetPacketLoss.
+func (conn *Connection) lose() bool {
+	if conn.lossPercent <= 0 || conn.lossRand == nil {
+		return false
+	}
+	return conn.lossRand.Float64()*100 < conn.lossPercent
 }
 
 // Send a packet with reasonable defaults. Potentially override the final layer
@@ -451,18 +577,80 @@ func (conn *Connection) Send(layer Layer, additionalLayers ...Layer) {
 	conn.SendFrame(conn.CreateFrame(layer, additionalLayers...))
 }
 
+// Sendv sends a frame for each of segments, back to back. Each segment holds a
+// layer overriding the defaults of the final layer followed by additional
+// layers, like the arguments of Send. The frame of a segment is built once the
+// state of the connection was updated for the previous ones, so that the
+// defaults of a TCP layer follow the previous segments. The delay configured
+// with SetSendDelay is only waited before the first frame.
+func (conn *Connection) Sendv(segments ...Layers) {
+	var outBytes [][]byte
+	for _, segment := range segments {
+		if len(segment) == 0 {
+			conn.t.Fatalf("can't send an empty segment")
+		}
+		outBytes = append(outBytes, conn.prepareFrame(conn.CreateFrame(segment[0], segment[1:]...)))
+	}
+	conn.waitSendDelay()
+	for _, b := range outBytes {
+		if !conn.lose() {
+			conn.injector.Send(b)
+		}
+	}
+}
+
+// ReplayPCAP sends the frames captured in the pcap file at path to the DUT,
+// waiting between frames for as long as passed between them when they were
+// captured.
+//
+// Frames are sent exactly as they were captured; the state of the connection
+// is not updated to account for them.
+func (conn *Connection) ReplayPCAP(path string) {
+	conn.ReplayPCAPWithSpeedup(path, 1)
+}
+
+// ReplayPCAPWithSpeedup is like ReplayPCAP but the time waited between frames
+// is divided by speedup. If speedup is not positive, frames are sent back to
+// back.
+func (conn *Connection) ReplayPCAPWithSpeedup(path string, speedup float64) {
+	f, err := os.Open(path)
+	if err != nil {
+		conn.t.Fatalf("can't open pcap file: %s", err)
+	}
+	defer f.Close()
+	records, err := ReadPCAP(f)
+	if err != nil {
+		conn.t.Fatalf("can't read pcap file %s: %s", path, err)
+	}
+
+	for i, r := range records {
+		if i > 0 && speedup > 0 {
+			if gap := r.Timestamp.Sub(records[i-1].Timestamp); gap > 0 {
+				time.Sleep(time.Duration(float64(gap) / speedup))
+			}
+		}
+		conn.injector.Send(r.Data)
+	}
+}
+
 // recvFrame gets the next successfully parsed frame (of type Layers) within the
 // timeout provided. If no parsable frame arrives before the timeout, it returns
 // nil.
 func (conn *Connection) recvFrame(timeout time.Duration) Layers {
-	if timeout <= 0 {
-		return nil
-	}
-	b := conn.sniffer.Recv(timeout)
-	if b == nil {
-		return nil
+	deadline := time.Now().Add(timeout)
+	for {
+		if timeout <= 0 {
+			return nil
+		}
+		b := conn.sniffer.Recv(timeout)
+		if b == nil {
+			return nil
+		}
+		if !conn.lose() {
+			return parse(parseEther, b)
+		}
+		timeout = time.Until(deadline)
 	}
-	return parse(parseEther, b)
 }
 
 // Expect a frame with the final layerStates layer matching the provided Layer
@@ -486,15 +674,24 @@ func (conn *Connection) Expect(layer Layer, timeout time.Duration) (Layer, error
 // ExpectFrame expects a frame that matches the provided Layers within the
 // timeout specified. If it doesn't arrive in time, it returns nil.
 func (conn *Connection) ExpectFrame(layers Layers, timeout time.Duration) (Layers, error) {
+	gotLayers, _, err := conn.expectFrame(layers, timeout)
+	return gotLayers, err
+}
+
+// expectFrame is ExpectFrame, which also returns, if no matching frame arrives
+// in time, the last frame of the connection received, or nil if there was
+// none. See isConnFrame.
+func (conn *Connection) expectFrame(layers Layers, timeout time.Duration) (Layers, Layers, error) {
 	deadline := time.Now().Add(timeout)
 	var allLayers []string
+	var lastConnFrame Layers
 	for {
 		var gotLayers Layers
 		if timeout = time.Until(deadline); timeout > 0 {
 			gotLayers = conn.recvFrame(timeout)
 		}
 		if gotLayers == nil {
-			return nil, fmt.Errorf("got %d packets:\n%s", len(allLayers), strings.Join(allLayers, "\n"))
+			return nil, lastConnFrame, fmt.Errorf("got %d packets:\n%s", len(allLayers), strings.Join(allLayers, "\n"))
 		}
 		if conn.match(layers, gotLayers) {
 			for i, s := range conn.layerStates {
@@ -502,12 +699,136 @@ func (conn *Connection) ExpectFrame(layers Layers, timeout time.Duration) (Layer
 					conn.t.Fatal(err)
 				}
 			}
-			return gotLayers, nil
+			return gotLayers, nil, nil
+		}
+		if conn.isConnFrame(gotLayers) {
+			lastConnFrame = gotLayers
 		}
 		allLayers = append(allLayers, fmt.Sprintf("%s", gotLayers))
 	}
 }
 
+// isConnFrame returns true if frame was sent to the connection: all of its
+// layers but the innermost one match the connection's, and the innermost one
+// is a TCP or UDP layer with the connection's ports.
+func (conn *Connection) isConnFrame(frame Layers) bool {
+	last := len(conn.layerStates) - 1
+	if len(frame) <= last {
+		return false
+	}
+	for i, s := range conn.layerStates[:last] {
+		if want := s.incoming(frame[i]); want == nil || !want.match(frame[i]) {
+			return false
+		}
+	}
+	var ports Layer
+	switch want := conn.layerStates[last].incoming(frame[last]).(type) {
+	case *TCP:
+		ports = &TCP{SrcPort: want.SrcPort, DstPort: want.DstPort}
+	case *UDP:
+		ports = &UDP{SrcPort: want.SrcPort, DstPort: want.DstPort}
+	default:
+		return false
+	}
+	return ports.match(frame[last])
+}
+
+// ErrNoFrame is wrapped by an ExpectError when no frame of the connection was
+// received at all.
+var ErrNoFrame = errors.New("no frame of the connection received")
+
+// ExpectError is the error returned by the Expect methods of TCP connections
+// when no segment matching the expected TCP layer arrives in time. It holds the
+// last segment of the connection received instead, if any, so that tests can
+// tell which fields did not match.
+type ExpectError struct {
+	// Want is the expected TCP layer. If Got is set, it includes the fields
+	// the connection expects by default, such as its ports and sequence
+	// numbers.
+	Want *TCP
+
+	// Got is the TCP layer of the last segment of the connection received,
+	// which didn't match Want, or nil if none was received.
+	Got *TCP
+
+	// err describes all the frames received.
+	err error
+}
+
+// Error implements error.Error.
+func (e *ExpectError) Error() string {
+	if e.Got == nil {
+		return fmt.Sprintf("%s, want %s: %s", ErrNoFrame, e.Want, e.err)
+	}
+	return fmt.Sprintf("got %s, want %s, mismatched fields: %s: %s", e.Got, e.Want, e.Diff(), e.err)
+}
+
+// Unwrap returns ErrNoFrame if no segment of the connection was received.
+func (e *ExpectError) Unwrap() error {
+	if e.Got == nil {
+		return ErrNoFrame
+	}
+	return nil
+}
+
+// Diff describes the fields of Got which differ from Want, e.g.
+// "Flags: got 4, want 16". It is empty if Got is nil.
+func (e *ExpectError) Diff() string {
+	if e.Got == nil {
+		return ""
+	}
+	return strings.Join(diffLayer(e.Want, e.Got), ", ")
+}
+
+// expectTCP expects a frame of the connection, which must have a final TCP
+// layer, with the TCP layer matching tcp within the timeout specified. If it
+// doesn't arrive in time, it returns an ExpectError.
+func (conn *Connection) expectTCP(tcp *TCP, timeout time.Duration) (*TCP, error) {
+	last := len(conn.layerStates) - 1
+	layers := make(Layers, len(conn.layerStates))
+	layers[last] = tcp
+	gotLayers, lastConnFrame, err := conn.expectFrame(layers, timeout)
+	if err != nil {
+		expectErr := &ExpectError{Want: tcp, err: err}
+		if lastConnFrame != nil {
+			if gotTCP, ok := lastConnFrame[last].(*TCP); ok {
+				want := conn.layerStates[last].incoming(gotTCP)
+				if err := want.merge(tcp); err != nil {
+					conn.t.Fatalf("failed to merge: %s", err)
+				}
+				expectErr.Want = want.(*TCP)
+				expectErr.Got = gotTCP
+			}
+		}
+		return nil, expectErr
+	}
+	gotTCP, ok := gotLayers[last].(*TCP)
+	if !ok {
+		conn.t.Fatalf("expected %s to be TCP", gotLayers[last])
+	}
+	return gotTCP, nil
+}
+
+// ExpectNone expects no frame with the final layerStates layer matching the
+// provided Layer to arrive within the timeout specified. It returns nil once the
+// timeout expires, or an error holding the matching frame as soon as one
+// arrives. Frames that don't match are ignored.
+func (conn *Connection) ExpectNone(layer Layer, timeout time.Duration) error {
+	layers := make([]Layer, len(conn.layerStates))
+	layers[len(layers)-1] = layer
+
+	deadline := time.Now().Add(timeout)
+	for {
+		gotLayers := conn.recvFrame(time.Until(deadline))
+		if gotLayers == nil {
+			return nil
+		}
+		if conn.match(layers, gotLayers) {
+			return fmt.Errorf("got unexpected frame %s", gotLayers)
+		}
+	}
+}
+
 // Drain drains the sniffer's receive buffer by receiving packets until there's
 // nothing else to receive.
 func (conn *Connection) Drain() {
@@ -565,6 +886,69 @@ func (conn *TCPIPv4) Handshake() {
 	conn.Send(TCP{Flags: Uint8(header.TCPFlagAck)})
 }
 
+// synFloodFirstPort is the first source port used by SendSYNFlood.
+const synFloodFirstPort = 1024
+
+// SendSYNFlood sends count SYNs to the DUT without completing any of the
+// handshakes, as in a SYN flood. Each SYN is sent from a different source port
+// other than conn's and with a random initial sequence number. The state of
+// conn is not updated, so conn can still be used to connect to the DUT
+// afterwards.
+func (conn *TCPIPv4) SendSYNFlood(count int) {
+	localPort := *conn.state().out.SrcPort
+	port := uint16(synFloodFirstPort)
+	for i := 0; i < count; i++ {
+		if port == localPort {
+			port++
+		}
+		frame := conn.CreateFrame(TCP{
+			SrcPort: Uint16(port),
+			SeqNum:  Uint32(rand.Uint32()),
+			Flags:   Uint8(header.TCPFlagSyn),
+		})
+		outBytes, err := frame.ToBytes()
+		if err != nil {
+			conn.t.Fatalf("can't build SYN flood packet: %s", err)
+		}
+		conn.injector.Send(outBytes)
+		port++
+	}
+}
+
+// MeasureRTT estimates the round-trip time to the DUT. It sends a keepalive
+// probe, an ACK with a sequence number one below the next one to send, which
+// the DUT must acknowledge right away, and returns the time until that ACK is
+// received. The connection must be established.
+func (conn *TCPIPv4) MeasureRTT(timeout time.Duration) (time.Duration, error) {
+	probe := conn.CreateFrame(TCP{
+		SeqNum: Uint32(uint32(*conn.LocalSeqNum() - 1)),
+		Flags:  Uint8(header.TCPFlagAck),
+	})
+	start := time.Now()
+	(*Connection)(conn).SendFrame(probe)
+	if _, err := conn.Expect(TCP{Flags: Uint8(header.TCPFlagAck)}, timeout); err != nil {
+		return 0, fmt.Errorf("didn't get an ACK of the keepalive probe: %s", err)
+	}
+	return time.Since(start), nil
+}
+
+// MeasureAckDelay sends each of payloads to the DUT in its own segment, back
+// to back, and returns the time from sending the last segment until the DUT
+// acknowledges all of them. The connection must be established.
+func (conn *TCPIPv4) MeasureAckDelay(timeout time.Duration, payloads ...[]byte) (time.Duration, error) {
+	var start time.Time
+	for _, payload := range payloads {
+		frame := conn.CreateFrame(TCP{Flags: Uint8(header.TCPFlagAck | header.TCPFlagPsh)}, &Payload{Bytes: payload})
+		start = time.Now()
+		(*Connection)(conn).SendFrame(frame)
+	}
+	ackNum := Uint32(uint32(*conn.LocalSeqNum()))
+	if _, err := conn.Expect(TCP{Flags: Uint8(header.TCPFlagAck), AckNum: ackNum}, timeout); err != nil {
+		return 0, fmt.Errorf("didn't get an ACK of the %d sent segments: %s", len(payloads), err)
+	}
+	return time.Since(start), nil
+}
+
 // ExpectData is a convenient method that expects a Layer and the Layer after
 // it. If it doens't arrive in time, it returns nil.
 func (conn *TCPIPv4) ExpectData(tcp *TCP, payload *Payload, timeout time.Duration) (Layers, error) {
@@ -576,29 +960,333 @@ func (conn *TCPIPv4) ExpectData(tcp *TCP, payload *Payload, timeout time.Duratio
 	return (*Connection)(conn).ExpectFrame(expected, timeout)
 }
 
+// Segment is a data segment received from the DUT, captured with
+// CaptureSegment so that its retransmission can be checked with
+// ExpectRetransmission.
+type Segment struct {
+	// SeqNum is the sequence number of the segment.
+	SeqNum uint32
+
+	// Payload holds a copy of the data carried by the segment.
+	Payload []byte
+}
+
+// CaptureSegment returns the sequence number and a copy of the payload of the
+// TCP segment in frame, a frame received from the DUT as returned by
+// ExpectData.
+func (conn *TCPIPv4) CaptureSegment(frame Layers) *Segment {
+	tcpIndex := len(conn.layerStates) - 1
+	if len(frame) <= tcpIndex {
+		conn.t.Fatalf("frame %s is too short to hold a TCP layer", frame)
+	}
+	tcp, ok := frame[tcpIndex].(*TCP)
+	if !ok {
+		conn.t.Fatalf("expected %s to be TCP", frame[tcpIndex])
+	}
+	seg := Segment{SeqNum: *tcp.SeqNum}
+	if len(frame) > tcpIndex+1 {
+		payload, ok := frame[tcpIndex+1].(*Payload)
+		if !ok {
+			conn.t.Fatalf("expected %s to be Payload", frame[tcpIndex+1])
+		}
+		seg.Payload = append([]byte(nil), payload.Bytes...)
+	}
+	return &seg
+}
+
+// ExpectRetransmission expects the DUT to retransmit seg within the timeout
+// specified: a segment with the same sequence number carrying exactly the same
+// payload bytes. It returns an error if no segment with that sequence number
+// arrives in time, or if its payload differs from seg's.
+func (conn *TCPIPv4) ExpectRetransmission(seg *Segment, timeout time.Duration) (Layers, error) {
+	frame, err := conn.ExpectData(&TCP{SeqNum: Uint32(seg.SeqNum)}, nil, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("didn't get a retransmission of the segment with sequence number %d: %s", seg.SeqNum, err)
+	}
+	var got []byte
+	if tcpIndex := len(conn.layerStates) - 1; len(frame) > tcpIndex+1 {
+		if payload, ok := frame[tcpIndex+1].(*Payload); ok {
+			got = payload.Bytes
+		}
+	}
+	if !bytes.Equal(got, seg.Payload) {
+		return frame, fmt.Errorf("got retransmitted payload = %x, want = %x", got, seg.Payload)
+	}
+	return frame, nil
+}
+
+// AdvertiseWindow sends an ACK advertising a receive window of size bytes to
+// the DUT. Advertising a zero window makes the DUT probe the window with
+// ExpectZeroWindowProbes until a nonzero one is advertised.
+func (conn *TCPIPv4) AdvertiseWindow(size uint16) {
+	conn.Send(TCP{Flags: Uint8(header.TCPFlagAck), WindowSize: Uint16(size)})
+}
+
+// ExpectZeroWindowProbes expects the DUT, to which a zero window was
+// advertised, to send count zero-window probes, each within timeout of the
+// previous one. A probe either carries no data and the sequence number of the
+// last byte acknowledged, as sent by Linux, or carries only the next byte of
+// data. Other segments are ignored.
+//
+// It returns the time between each probe and the previous one, the first one
+// being measured from the call. The sequence number expected from the DUT is
+// left unchanged, as the window is never opened to the probes.
+func (conn *TCPIPv4) ExpectZeroWindowProbes(count int, timeout time.Duration) ([]time.Duration, error) {
+	next := *conn.RemoteSeqNum()
+	tcpIndex := len(conn.layerStates) - 1
+	isProbe := func(frame Layers) bool {
+		payloadLen := 0
+		if len(frame) > tcpIndex+1 {
+			payloadLen = frame[tcpIndex+1].length()
+		}
+		for _, probe := range []struct {
+			seqNum     seqnum.Value
+			payloadLen int
+		}{
+			{seqNum: next - 1, payloadLen: 0},
+			{seqNum: next, payloadLen: 1},
+		} {
+			layers := make(Layers, len(conn.layerStates))
+			layers[tcpIndex] = &TCP{SeqNum: Uint32(uint32(probe.seqNum))}
+			if payloadLen == probe.payloadLen && (*Connection)(conn).match(layers, frame) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var intervals []time.Duration
+	last := time.Now()
+	for len(intervals) < count {
+		frame := (*Connection)(conn).recvFrame(time.Until(last.Add(timeout)))
+		if frame == nil {
+			return intervals, fmt.Errorf("got %d zero-window probes, want = %d", len(intervals), count)
+		}
+		if !isProbe(frame) {
+			continue
+		}
+		now := time.Now()
+		intervals = append(intervals, now.Sub(last))
+		last = now
+	}
+	return intervals, nil
+}
+
+// recvDataSegment receives the next segment of the connection carrying data
+// within the timeout specified, whatever its sequence number. Other frames are
+// ignored. It returns nil if no data segment arrives in time.
+func (conn *TCPIPv4) recvDataSegment(timeout time.Duration) *Segment {
+	tcpIndex := len(conn.layerStates) - 1
+	deadline := time.Now().Add(timeout)
+	for {
+		frame := (*Connection)(conn).recvFrame(time.Until(deadline))
+		if frame == nil {
+			return nil
+		}
+		if len(frame) <= tcpIndex+1 {
+			continue
+		}
+		tcp, ok := frame[tcpIndex].(*TCP)
+		if !ok || tcp.SeqNum == nil {
+			continue
+		}
+		layers := make(Layers, len(conn.layerStates))
+		layers[tcpIndex] = &TCP{SeqNum: Uint32(*tcp.SeqNum)}
+		if !(*Connection)(conn).match(layers, frame) {
+			continue
+		}
+		if seg := conn.CaptureSegment(frame); len(seg.Payload) > 0 {
+			return seg
+		}
+	}
+}
+
+// segmentEnd returns the sequence number following the last byte of seg.
+func segmentEnd(seg *Segment) seqnum.Value {
+	return seqnum.Value(seg.SeqNum).Add(seqnum.Size(len(seg.Payload)))
+}
+
+// ExpectFlight expects a flight of data segments sent back to back by the DUT:
+// the first segment must arrive within timeout, and the flight ends once no
+// segment has arrived for quiet. quiet must be shorter than the DUT's
+// retransmission timeout but long enough for the whole flight to arrive.
+//
+// The segments are not acknowledged, see AckFlight.
+func (conn *TCPIPv4) ExpectFlight(quiet, timeout time.Duration) ([]*Segment, error) {
+	seg := conn.recvDataSegment(timeout)
+	if seg == nil {
+		return nil, fmt.Errorf("didn't get a data segment within %s", timeout)
+	}
+	flight := []*Segment{seg}
+	for {
+		seg := conn.recvDataSegment(quiet)
+		if seg == nil {
+			return flight, nil
+		}
+		flight = append(flight, seg)
+	}
+}
+
+// AckFlight acknowledges each segment of flight, as returned by ExpectFlight,
+// with an ACK of its own, as a receiver which doesn't delay ACKs would. The
+// sequence number expected from the DUT is advanced past the flight.
+func (conn *TCPIPv4) AckFlight(flight []*Segment) {
+	for _, seg := range flight {
+		if end := segmentEnd(seg); conn.RemoteSeqNum().LessThan(end) {
+			*conn.RemoteSeqNum() = end
+		}
+		conn.Send(TCP{Flags: Uint8(header.TCPFlagAck)})
+	}
+}
+
+// MeasureFlights infers the congestion window of the DUT from its ACK clock.
+// For each of rounds round trips, it expects a flight with ExpectFlight and
+// acknowledges it with AckFlight, and returns the number of bytes sent in each
+// flight.
+//
+// The DUT must have enough data queued to fill its congestion window, and
+// neither the window advertised to it nor its send buffer must limit it, so
+// that each flight is as large as its congestion window for that round trip.
+func (conn *TCPIPv4) MeasureFlights(rounds int, quiet, timeout time.Duration) ([]int, error) {
+	var sizes []int
+	for len(sizes) < rounds {
+		flight, err := conn.ExpectFlight(quiet, timeout)
+		if err != nil {
+			return sizes, fmt.Errorf("got %d flights, want = %d: %s", len(sizes), rounds, err)
+		}
+		size := 0
+		for _, seg := range flight {
+			size += len(seg.Payload)
+		}
+		sizes = append(sizes, size)
+		conn.AckFlight(flight)
+	}
+	return sizes, nil
+}
+
+// SimulateLoss makes the DUT believe that the first segment of flight, as
+// returned by ExpectFlight, was lost: it sends a duplicate ACK for each of the
+// other segments, expects the DUT to fast retransmit the first one within
+// timeout, and then acknowledges every segment received, ending fast recovery.
+// flight must hold at least 4 segments so that the 3 duplicate ACKs triggering
+// fast retransmit are sent.
+//
+// Once fast recovery ends, the DUT's congestion window is halved and it is in
+// congestion avoidance.
+func (conn *TCPIPv4) SimulateLoss(flight []*Segment, timeout time.Duration) error {
+	if len(flight) < 4 {
+		return fmt.Errorf("got a flight of %d segments, want at least 4", len(flight))
+	}
+	lost := flight[0]
+	high := segmentEnd(lost)
+	for _, seg := range flight[1:] {
+		if end := segmentEnd(seg); high.LessThan(end) {
+			high = end
+		}
+	}
+	*conn.RemoteSeqNum() = seqnum.Value(lost.SeqNum)
+	for range flight[1:] {
+		conn.Send(TCP{Flags: Uint8(header.TCPFlagAck)})
+	}
+
+	// The DUT may send new data while in fast recovery, before or after
+	// retransmitting the lost segment.
+	deadline := time.Now().Add(timeout)
+	for {
+		seg := conn.recvDataSegment(time.Until(deadline))
+		if seg == nil {
+			return fmt.Errorf("didn't get a fast retransmission of the segment with sequence number %d", lost.SeqNum)
+		}
+		if seg.SeqNum == lost.SeqNum {
+			if !bytes.Equal(seg.Payload, lost.Payload) {
+				return fmt.Errorf("got retransmitted payload = %x, want = %x", seg.Payload, lost.Payload)
+			}
+			break
+		}
+		if end := segmentEnd(seg); high.LessThan(end) {
+			high = end
+		}
+	}
+	*conn.RemoteSeqNum() = high
+	conn.Send(TCP{Flags: Uint8(header.TCPFlagAck)})
+	return nil
+}
+
+// CreateFrame builds a frame for the connection with tcp overriding defaults
+// and additionalLayers added after the TCP layer.
+func (conn *TCPIPv4) CreateFrame(tcp TCP, additionalLayers ...Layer) Layers {
+	return (*Connection)(conn).CreateFrame(&tcp, additionalLayers...)
+}
+
 // Send a packet with reasonable defaults. Potentially override the TCP layer in
 // the connection with the provided layer and add additionLayers.
 func (conn *TCPIPv4) Send(tcp TCP, additionalLayers ...Layer) {
 	(*Connection)(conn).Send(&tcp, additionalLayers...)
 }
 
+// OutgoingSegment is a segment to send with Sendv.
+type OutgoingSegment struct {
+	// TCP overrides the defaults of the TCP layer. If its SeqNum is nil, the
+	// segment follows the previous one.
+	TCP TCP
+
+	// Payload is the data carried by the segment, if any.
+	Payload []byte
+}
+
+// outgoingFrames returns the arguments of Connection.Sendv for segments.
+func outgoingFrames(segments []OutgoingSegment) []Layers {
+	frames := make([]Layers, 0, len(segments))
+	for i := range segments {
+		frame := Layers{&segments[i].TCP}
+		if len(segments[i].Payload) > 0 {
+			frame = append(frame, &Payload{Bytes: segments[i].Payload})
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// Sendv sends segments back to back, updating the sequence number of the
+// connection after each one. See Connection.Sendv for details.
+func (conn *TCPIPv4) Sendv(segments ...OutgoingSegment) {
+	(*Connection)(conn).Sendv(outgoingFrames(segments)...)
+}
+
+// ReplayPCAP sends the frames captured in the pcap file at path to the DUT. See
+// Connection.ReplayPCAP for details.
+func (conn *TCPIPv4) ReplayPCAP(path string) {
+	(*Connection)(conn).ReplayPCAP(path)
+}
+
+// SetSendDelay delays frames sent to the DUT. See Connection.SetSendDelay for
+// details.
+func (conn *TCPIPv4) SetSendDelay(delay, jitter time.Duration) {
+	(*Connection)(conn).SetSendDelay(delay, jitter)
+}
+
+// SetPacketLoss drops frames sent to and received from the DUT. See
+// Connection.SetPacketLoss for details.
+func (conn *TCPIPv4) SetPacketLoss(percent float64, seed int64) {
+	(*Connection)(conn).SetPacketLoss(percent, seed)
+}
+
 // Close frees associated resources held by the TCPIPv4 connection.
 func (conn *TCPIPv4) Close() {
 	(*Connection)(conn).Close()
 }
 
 // Expect a frame with the TCP layer matching the provided TCP within the
-// timeout specified. If it doesn't arrive in time, it returns nil.
+// timeout specified. If it doesn't arrive in time, it returns nil and an
+// ExpectError.
 func (conn *TCPIPv4) Expect(tcp TCP, timeout time.Duration) (*TCP, error) {
-	layer, err := (*Connection)(conn).Expect(&tcp, timeout)
-	if layer == nil {
-		return nil, err
-	}
-	gotTCP, ok := layer.(*TCP)
-	if !ok {
-		conn.t.Fatalf("expected %s to be TCP", layer)
-	}
-	return gotTCP, err
+	return (*Connection)(conn).expectTCP(&tcp, timeout)
+}
+
+// ExpectNone expects no frame with the TCP layer matching the provided TCP to
+// arrive within the timeout specified. See Connection.ExpectNone for details.
+func (conn *TCPIPv4) ExpectNone(tcp TCP, timeout time.Duration) error {
+	return (*Connection)(conn).ExpectNone(&tcp, timeout)
 }
 
 func (conn *TCPIPv4) state() *tcpState {
@@ -624,6 +1312,37 @@ func (conn *TCPIPv4) SynAck() *TCP {
 	return conn.state().synAck
 }
 
+// SetSeqNumTracking sets whether LocalSeqNum and RemoteSeqNum only account for
+// new data. When it is enabled, a segment sent with a SeqNum other than
+// LocalSeqNum, such as a retransmission, leaves LocalSeqNum unchanged, and a
+// segment received from the DUT only moves RemoteSeqNum forward. Segments sent
+// without a SeqNum or an AckNum then carry the next sequence number of the
+// testbench and acknowledge all the data received, without tests computing
+// them. It is disabled by default.
+func (conn *TCPIPv4) SetSeqNumTracking(enabled bool) {
+	conn.state().trackSeqNums = enabled
+}
+
+// RelSeqNum returns the DUT's sequence number offset bytes after its initial
+// sequence number, for use as the SeqNum of an expected TCP layer. The SYN
+// takes up offset 0, so the first byte of data sent by the DUT is at offset 1.
+// It must be called after the handshake.
+func (conn *TCPIPv4) RelSeqNum(offset seqnum.Size) *uint32 {
+	synAck := conn.state().synAck
+	if synAck == nil {
+		conn.t.Fatal("can't get the DUT's initial sequence number before the handshake")
+	}
+	return Uint32(uint32(seqnum.Value(*synAck.SeqNum).Add(offset)))
+}
+
+// RelAckNum returns the testbench's sequence number offset bytes after its
+// initial sequence number, for use as the AckNum of an expected TCP layer. The
+// SYN takes up offset 0, so the DUT acknowledges n bytes of data sent by the
+// testbench with RelAckNum(1+n).
+func (conn *TCPIPv4) RelAckNum(offset seqnum.Size) *uint32 {
+	return Uint32(uint32(conn.state().localISN.Add(offset)))
+}
+
 // Drain drains the sniffer's receive buffer by receiving packets until there's
 // nothing else to receive.
 func (conn *TCPIPv4) Drain() {
@@ -685,3 +1404,142 @@ func (conn *UDPIPv4) Close() {
 func (conn *UDPIPv4) Drain() {
 	conn.sniffer.Drain()
 }
+
+// TCPIPv6 maintains the state for all the layers in a TCP/IPv6 connection.
+type TCPIPv6 Connection
+
+// NewTCPIPv6 creates a new TCPIPv6 connection with reasonable defaults. The
+// DUT is reached at its IPv6 address.
+func NewTCPIPv6(t *testing.T, outgoingTCP, incomingTCP TCP) TCPIPv6 {
+	etherState, err := newEtherState(Ether{}, Ether{})
+	if err != nil {
+		t.Fatalf("can't make etherState: %s", err)
+	}
+	ipv6State, err := newIPv6State(IPv6{}, IPv6{})
+	if err != nil {
+		t.Fatalf("can't make ipv6State: %s", err)
+	}
+	tcpState, err := newTCPState(outgoingTCP, incomingTCP)
+	if err != nil {
+		t.Fatalf("can't make tcpState: %s", err)
+	}
+	injector, err := NewInjector(t)
+	if err != nil {
+		t.Fatalf("can't make injector: %s", err)
+	}
+	sniffer, err := NewSniffer(t)
+	if err != nil {
+		t.Fatalf("can't make sniffer: %s", err)
+	}
+
+	return TCPIPv6{
+		layerStates: []layerState{etherState, ipv6State, tcpState},
+		injector:    injector,
+		sniffer:     sniffer,
+		t:           t,
+	}
+}
+
+// Handshake performs a TCP 3-way handshake. The input Connection should have a
+// final TCP Layer.
+func (conn *TCPIPv6) Handshake() {
+	// Send the SYN.
+	conn.Send(TCP{Flags: Uint8(header.TCPFlagSyn)})
+
+	// Wait for the SYN-ACK.
+	synAck, err := conn.Expect(TCP{Flags: Uint8(header.TCPFlagSyn | header.TCPFlagAck)}, time.Second)
+	if synAck == nil {
+		conn.t.Fatalf("didn't get synack during handshake: %s", err)
+	}
+	conn.layerStates[len(conn.layerStates)-1].(*tcpState).synAck = synAck
+
+	// Send an ACK.
+	conn.Send(TCP{Flags: Uint8(header.TCPFlagAck)})
+}
+
+// ExpectData is a convenient method that expects a Layer and the Layer after
+// it. If it doens't arrive in time, it returns nil.
+func (conn *TCPIPv6) ExpectData(tcp *TCP, payload *Payload, timeout time.Duration) (Layers, error) {
+	expected := make([]Layer, len(conn.layerStates))
+	expected[len(expected)-1] = tcp
+	if payload != nil {
+		expected = append(expected, payload)
+	}
+	return (*Connection)(conn).ExpectFrame(expected, timeout)
+}
+
+// CreateFrame builds a frame for the connection with tcp overriding defaults
+// and additionalLayers added after the TCP layer.
+func (conn *TCPIPv6) CreateFrame(tcp TCP, additionalLayers ...Layer) Layers {
+	return (*Connection)(conn).CreateFrame(&tcp, additionalLayers...)
+}
+
+// Send a packet with reasonable defaults. Potentially override the TCP layer in
+// the connection with the provided layer and add additionLayers.
+func (conn *TCPIPv6) Send(tcp TCP, additionalLayers ...Layer) {
+	(*Connection)(conn).Send(&tcp, additionalLayers...)
+}
+
+// Sendv sends segments back to back, updating the sequence number of the
+// connection after each one. See Connection.Sendv for details.
+func (conn *TCPIPv6) Sendv(segments ...OutgoingSegment) {
+	(*Connection)(conn).Sendv(outgoingFrames(segments)...)
+}
+
+// Close frees associated resources held by the TCPIPv6 connection.
+func (conn *TCPIPv6) Close() {
+	(*Connection)(conn).Close()
+}
+
+// Expect a frame with the TCP layer matching the provided TCP within the
+// timeout specified. If it doesn't arrive in time, it returns nil and an
+// ExpectError.
+func (conn *TCPIPv6) Expect(tcp TCP, timeout time.Duration) (*TCP, error) {
+	return (*Connection)(conn).expectTCP(&tcp, timeout)
+}
+
+// ExpectNone expects no frame with the TCP layer matching the provided TCP to
+// arrive within the timeout specified. See Connection.ExpectNone for details.
+func (conn *TCPIPv6) ExpectNone(tcp TCP, timeout time.Duration) error {
+	return (*Connection)(conn).ExpectNone(&tcp, timeout)
+}
+
+func (conn *TCPIPv6) state() *tcpState {
+	state, ok := conn.layerStates[len(conn.layerStates)-1].(*tcpState)
+	if !ok {
+		conn.t.Fatalf("expected final state of %v to be tcpState", conn.layerStates)
+	}
+	return state
+}
+
+// RemoteSeqNum returns the next expected sequence number from the DUT.
+func (conn *TCPIPv6) RemoteSeqNum() *seqnum.Value {
+	return conn.state().remoteSeqNum
+}
+
+// LocalSeqNum returns the next sequence number to send from the testbench.
+func (conn *TCPIPv6) LocalSeqNum() *seqnum.Value {
+	return conn.state().localSeqNum
+}
+
+// SynAck returns the SynAck that was part of the handshake.
+func (conn *TCPIPv6) SynAck() *TCP {
+	return conn.state().synAck
+}
+
+// SetSeqNumTracking sets whether LocalSeqNum and RemoteSeqNum only account for
+// new data. When it is enabled, a segment sent with a SeqNum other than
+// LocalSeqNum, such as a retransmission, leaves LocalSeqNum unchanged, and a
+// segment received from the DUT only moves RemoteSeqNum forward. Segments sent
+// without a SeqNum or an AckNum then carry the next sequence number of the
+// testbench and acknowledge all the data received, without tests computing
+// them. It is disabled by default.
+func (conn *TCPIPv6) SetSeqNumTracking(enabled bool) {
+	conn.state().trackSeqNums = enabled
+}
+
+// Drain drains the sniffer's receive buffer by receiving packets until there's
+// nothing else to receive.
+func (conn *TCPIPv6) Drain() {
+	conn.sniffer.Drain()
+}
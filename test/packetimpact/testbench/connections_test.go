@@ -0,0 +1,97 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testbench
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/seqnum"
+)
+
+func TestTCPStateSeqNumTracking(t *testing.T) {
+	const (
+		localISN  = 1000
+		remoteISN = 5000
+	)
+	dataSegment := func(seqNum uint32, size int) *TCP {
+		return &TCP{
+			SeqNum:    Uint32(seqNum),
+			Flags:     Uint8(header.TCPFlagAck),
+			LayerBase: LayerBase{nextLayer: &Payload{Bytes: make([]byte, size)}},
+		}
+	}
+	for _, tt := range []struct {
+		description      string
+		trackSeqNums     bool
+		wantLocalSeqNum  seqnum.Value
+		wantRemoteSeqNum seqnum.Value
+	}{
+		{
+			description:      "disabled",
+			trackSeqNums:     false,
+			wantLocalSeqNum:  localISN + 30,
+			wantRemoteSeqNum: remoteISN + 10,
+		},
+		{
+			description:      "enabled",
+			trackSeqNums:     true,
+			wantLocalSeqNum:  localISN + 20,
+			wantRemoteSeqNum: remoteISN + 20,
+		},
+	} {
+		t.Run(tt.description, func(t *testing.T) {
+			s, err := newTCPState(TCP{}, TCP{})
+			if err != nil {
+				t.Fatalf("newTCPState(_, _): %s", err)
+			}
+			defer s.close()
+			s.localSeqNum = SeqNumValue(localISN)
+			s.trackSeqNums = tt.trackSeqNums
+
+			// Two data segments, then a retransmission of the first one.
+			for _, seg := range []*TCP{
+				dataSegment(localISN, 10),
+				dataSegment(localISN+10, 10),
+				dataSegment(localISN, 10),
+			} {
+				if err := s.sent(seg); err != nil {
+					t.Fatalf("s.sent(%s): %s", seg, err)
+				}
+			}
+			for _, seg := range []*TCP{
+				dataSegment(remoteISN, 10),
+				dataSegment(remoteISN+10, 10),
+				dataSegment(remoteISN, 10),
+			} {
+				if err := s.received(seg); err != nil {
+					t.Fatalf("s.received(%s): %s", seg, err)
+				}
+			}
+
+			if got := *s.localSeqNum; got != tt.wantLocalSeqNum {
+				t.Errorf("got localSeqNum = %d, want = %d", got, tt.wantLocalSeqNum)
+			}
+			if got := *s.remoteSeqNum; got != tt.wantRemoteSeqNum {
+				t.Errorf("got remoteSeqNum = %d, want = %d", got, tt.wantRemoteSeqNum)
+			}
+			// Segments acknowledge all the data received by default.
+			out := s.outgoing().(*TCP)
+			if got, want := seqnum.Value(*out.AckNum), tt.wantRemoteSeqNum; got != want {
+				t.Errorf("got outgoing AckNum = %d, want = %d", got, want)
+			}
+		})
+	}
+}
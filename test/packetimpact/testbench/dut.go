@@ -110,6 +110,7 @@ func (dut *DUT) protoToSockaddr(sa *pb.Sockaddr) unix.Sockaddr {
 			ZoneId: s.In6.GetScopeId(),
 		}
 		copy(ret.Addr[:], s.In6.GetAddr())
+		return &ret
 	}
 	dut.t.Fatalf("can't parse Sockaddr: %+v", sa)
 	return nil
@@ -154,6 +155,40 @@ func (dut *DUT) CreateListener(typ, proto, backlog int32) (int32, uint16) {
 	return fd, remotePort
 }
 
+// CreateListenerIPv6 makes a new TCP connection listening on all the IPv6
+// addresses of the DUT, as binding to its link-local address would require a
+// scope ID. If it fails, the test ends.
+func (dut *DUT) CreateListenerIPv6(typ, proto, backlog int32) (int32, uint16) {
+	fd, remotePort := dut.CreateBoundSocket(typ, proto, net.IPv6unspecified)
+	dut.Listen(fd, backlog)
+	return fd, remotePort
+}
+
+// CreateMulticastListener makes a new UDP socket on the DUT bound to the IPv4
+// multicast group and joins the group on the DUT's test interface. Returns the
+// new file descriptor and the port that was selected on the DUT.
+func (dut *DUT) CreateMulticastListener(group net.IP) (int32, uint16) {
+	dut.t.Helper()
+	fd, remotePort := dut.CreateBoundSocket(unix.SOCK_DGRAM, unix.IPPROTO_UDP, group)
+	dut.JoinMulticastGroup(fd, group)
+	return fd, remotePort
+}
+
+// JoinMulticastGroup makes the socket sockfd on the DUT join the IPv4
+// multicast group on the DUT's test interface. If it fails, the test ends.
+func (dut *DUT) JoinMulticastGroup(sockfd int32, group net.IP) {
+	dut.t.Helper()
+	if group.To4() == nil || !group.IsMulticast() {
+		dut.t.Fatalf("%s is not an IPv4 multicast address", group)
+	}
+	// struct ip_mreq is the multicast group address followed by the address of
+	// the local interface, both in network byte order.
+	var mreq [2 * net.IPv4len]byte
+	copy(mreq[:], group.To4())
+	copy(mreq[net.IPv4len:], net.ParseIP(*remoteIPv4).To4())
+	dut.SetSockOpt(sockfd, unix.IPPROTO_IP, unix.IP_ADD_MEMBERSHIP, mreq[:])
+}
+
 // All the functions that make gRPC calls to the Posix service are below, sorted
 // alphabetically.
 
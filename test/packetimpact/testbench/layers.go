@@ -111,6 +111,33 @@ func equalLayer(x, y Layer) bool {
 	return cmp.Equal(x, y, opt, cmpopts.IgnoreTypes(LayerBase{}))
 }
 
+// diffLayer describes the fields of got which differ from the non-nil fields of
+// want, both of the same Layer type, one field per string.
+func diffLayer(want, got Layer) []string {
+	wantV, gotV := reflect.ValueOf(want).Elem(), reflect.ValueOf(got).Elem()
+	t := wantV.Type()
+	var diffs []string
+	for i := 0; i < wantV.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			// Ignore the LayerBase in the Layer struct.
+			continue
+		}
+		w, g := wantV.Field(i), gotV.Field(i)
+		if w.IsNil() {
+			continue
+		}
+		if g.IsNil() {
+			diffs = append(diffs, fmt.Sprintf("%s: got nil, want %v", f.Name, reflect.Indirect(w)))
+			continue
+		}
+		if w, g := reflect.Indirect(w).Interface(), reflect.Indirect(g).Interface(); !reflect.DeepEqual(w, g) {
+			diffs = append(diffs, fmt.Sprintf("%s: got %v, want %v", f.Name, g, w))
+		}
+	}
+	return diffs
+}
+
 // mergeLayer merges other in layer. Any non-nil value in other overrides the
 // corresponding value in layer. If other is nil, no action is performed.
 func mergeLayer(layer, other Layer) error {
@@ -172,8 +199,10 @@ func (l *Ether) toBytes() ([]byte, error) {
 		switch n := l.next().(type) {
 		case *IPv4:
 			fields.Type = header.IPv4ProtocolNumber
+		case *IPv6:
+			fields.Type = header.IPv6ProtocolNumber
 		default:
-			// TODO(b/150301488): Support more protocols, like IPv6.
+			// TODO(b/150301488): Support more protocols as needed.
 			return nil, fmt.Errorf("ethernet header's next layer is unrecognized: %#v", n)
 		}
 	}
@@ -228,6 +257,8 @@ func parseEther(b []byte) (Layer, layerParser) {
 	switch h.Type() {
 	case header.IPv4ProtocolNumber:
 		nextParser = parseIPv4
+	case header.IPv6ProtocolNumber:
+		nextParser = parseIPv6
 	default:
 		// Assume that the rest is a payload.
 		nextParser = parsePayload
@@ -263,6 +294,10 @@ type IPv4 struct {
 	Checksum       *uint16
 	SrcAddr        *tcpip.Address
 	DstAddr        *tcpip.Address
+
+	// CorruptChecksum, if true, causes an incorrect checksum to be emitted.
+	// It has no effect if Checksum is set.
+	CorruptChecksum *bool
 }
 
 func (l *IPv4) String() string {
@@ -335,6 +370,9 @@ func (l *IPv4) toBytes() ([]byte, error) {
 	h.Encode(fields)
 	if l.Checksum == nil {
 		h.SetChecksum(^h.CalculateChecksum())
+		if l.CorruptChecksum != nil && *l.CorruptChecksum {
+			h.SetChecksum(h.Checksum() + 1)
+		}
 	}
 	return h, nil
 }
@@ -351,6 +389,12 @@ func Uint8(v uint8) *uint8 {
 	return &v
 }
 
+// Bool is a helper routine that allocates a new
+// bool value to store v and returns a pointer to it.
+func Bool(v bool) *bool {
+	return &v
+}
+
 // Address is a helper routine that allocates a new tcpip.Address value to store
 // v and returns a pointer to it.
 func Address(v tcpip.Address) *tcpip.Address {
@@ -405,6 +449,108 @@ func (l *IPv4) merge(other Layer) error {
 	return mergeLayer(l, other)
 }
 
+// IPv6 can construct and match an IPv6 encapsulation.
+type IPv6 struct {
+	LayerBase
+	TrafficClass  *uint8
+	FlowLabel     *uint32
+	PayloadLength *uint16
+	NextHeader    *uint8
+	HopLimit      *uint8
+	SrcAddr       *tcpip.Address
+	DstAddr       *tcpip.Address
+}
+
+func (l *IPv6) String() string {
+	return stringLayer(l)
+}
+
+func (l *IPv6) toBytes() ([]byte, error) {
+	b := make([]byte, header.IPv6MinimumSize)
+	h := header.IPv6(b)
+	fields := &header.IPv6Fields{
+		HopLimit: 64,
+	}
+	if l.TrafficClass != nil {
+		fields.TrafficClass = *l.TrafficClass
+	}
+	if l.FlowLabel != nil {
+		fields.FlowLabel = *l.FlowLabel
+	}
+	if l.PayloadLength != nil {
+		fields.PayloadLength = *l.PayloadLength
+	} else {
+		for current := l.next(); current != nil; current = current.next() {
+			fields.PayloadLength += uint16(current.length())
+		}
+	}
+	if l.NextHeader != nil {
+		fields.NextHeader = *l.NextHeader
+	} else {
+		switch n := l.next().(type) {
+		case *TCP:
+			fields.NextHeader = uint8(header.TCPProtocolNumber)
+		case *UDP:
+			fields.NextHeader = uint8(header.UDPProtocolNumber)
+		default:
+			// TODO(b/150301488): Support more protocols as needed.
+			return nil, fmt.Errorf("ipv6 header's next layer is unrecognized: %#v", n)
+		}
+	}
+	if l.HopLimit != nil {
+		fields.HopLimit = *l.HopLimit
+	}
+	if l.SrcAddr != nil {
+		fields.SrcAddr = *l.SrcAddr
+	}
+	if l.DstAddr != nil {
+		fields.DstAddr = *l.DstAddr
+	}
+	h.Encode(fields)
+	return h, nil
+}
+
+// parseIPv6 parses the bytes assuming that they start with an ipv6 header and
+// continues parsing further encapsulations.
+func parseIPv6(b []byte) (Layer, layerParser) {
+	h := header.IPv6(b)
+	tc, flowLabel := h.TOS()
+	ipv6 := IPv6{
+		TrafficClass:  &tc,
+		FlowLabel:     &flowLabel,
+		PayloadLength: Uint16(h.PayloadLength()),
+		NextHeader:    Uint8(h.NextHeader()),
+		HopLimit:      Uint8(h.HopLimit()),
+		SrcAddr:       Address(h.SourceAddress()),
+		DstAddr:       Address(h.DestinationAddress()),
+	}
+	var nextParser layerParser
+	switch h.TransportProtocol() {
+	case header.TCPProtocolNumber:
+		nextParser = parseTCP
+	case header.UDPProtocolNumber:
+		nextParser = parseUDP
+	default:
+		// Assume that the rest is a payload.
+		nextParser = parsePayload
+	}
+	return &ipv6, nextParser
+}
+
+func (l *IPv6) match(other Layer) bool {
+	return equalLayer(l, other)
+}
+
+func (l *IPv6) length() int {
+	return header.IPv6MinimumSize
+}
+
+// merge overrides the values in l with the values from other but only in fields
+// where the value is not nil.
+func (l *IPv6) merge(other Layer) error {
+	return mergeLayer(l, other)
+}
+
 // TCP can construct and match a TCP encapsulation.
 type TCP struct {
 	LayerBase
@@ -417,6 +563,10 @@ type TCP struct {
 	WindowSize    *uint16
 	Checksum      *uint16
 	UrgentPointer *uint16
+
+	// CorruptChecksum, if true, causes an incorrect checksum to be emitted.
+	// It has no effect if Checksum is set.
+	CorruptChecksum *bool
 }
 
 func (l *TCP) String() string {
@@ -461,6 +611,9 @@ func (l *TCP) toBytes() ([]byte, error) {
 	if err := setTCPChecksum(&h, l); err != nil {
 		return nil, err
 	}
+	if l.CorruptChecksum != nil && *l.CorruptChecksum {
+		h.SetChecksum(h.Checksum() + 1)
+	}
 	return h, nil
 }
 
@@ -482,8 +635,10 @@ func layerChecksum(l Layer, protoNumber tcpip.TransportProtocolNumber) (uint16,
 	switch s := l.prev().(type) {
 	case *IPv4:
 		xsum = header.PseudoHeaderChecksum(protoNumber, *s.SrcAddr, *s.DstAddr, totalLength)
+	case *IPv6:
+		xsum = header.PseudoHeaderChecksum(protoNumber, *s.SrcAddr, *s.DstAddr, totalLength)
 	default:
-		// TODO(b/150301488): Support more protocols, like IPv6.
+		// TODO(b/150301488): Support more protocols as needed.
 		return 0, fmt.Errorf("can't get src and dst addr from previous layer: %#v", s)
 	}
 	var payloadBytes buffer.VectorisedView
@@ -684,7 +839,9 @@ func (ls *Layers) linkLayers() {
 	}
 }
 
-func (ls *Layers) toBytes() ([]byte, error) {
+// ToBytes serializes ls into the bytes of a frame, as it would be sent on the
+// wire.
+func (ls *Layers) ToBytes() ([]byte, error) {
 	ls.linkLayers()
 	outBytes := []byte{}
 	for _, l := range *ls {
@@ -17,7 +17,9 @@ package testbench
 import (
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 )
 
 func TestLayerMatch(t *testing.T) {
@@ -27,6 +29,9 @@ func TestLayerMatch(t *testing.T) {
 	fullPayload := &Payload{Bytes: []byte{1, 2, 3}}
 	emptyTCP := &TCP{SrcPort: Uint16(1234), LayerBase: LayerBase{nextLayer: emptyPayload}}
 	fullTCP := &TCP{SrcPort: Uint16(1234), LayerBase: LayerBase{nextLayer: fullPayload}}
+	urgTCP := &TCP{Flags: Uint8(header.TCPFlagUrg), UrgentPointer: Uint16(1)}
+	otherUrgTCP := &TCP{Flags: Uint8(header.TCPFlagUrg), UrgentPointer: Uint16(2)}
+	noUrgTCP := &TCP{Flags: Uint8(0), UrgentPointer: Uint16(1)}
 	for _, tt := range []struct {
 		a, b Layer
 		want bool
@@ -42,6 +47,10 @@ func TestLayerMatch(t *testing.T) {
 		{emptyPayload, fullPayload, false},
 		{fullPayload, fullPayload, true},
 		{emptyTCP, fullTCP, true},
+		{urgTCP, urgTCP, true},
+		{urgTCP, otherUrgTCP, false},
+		{urgTCP, noUrgTCP, false},
+		{urgTCP, &TCP{}, true},
 	} {
 		if got := tt.a.match(tt.b); got != tt.want {
 			t.Errorf("%s.match(%s) = %t, want %t", tt.a, tt.b, got, tt.want)
@@ -52,6 +61,80 @@ func TestLayerMatch(t *testing.T) {
 	}
 }
 
+func TestTCPUrgentPointer(t *testing.T) {
+	want := &TCP{
+		Flags:         Uint8(header.TCPFlagAck | header.TCPFlagUrg),
+		UrgentPointer: Uint16(5),
+		// Setting the checksum avoids needing an IPv4 layer to compute it.
+		Checksum: Uint16(0),
+	}
+	b, err := want.toBytes()
+	if err != nil {
+		t.Fatalf("%s.toBytes() = (_, %s), want = (_, nil)", want, err)
+	}
+	got, _ := parseTCP(b)
+	if !want.match(got) {
+		t.Errorf("parseTCP(%s.toBytes()) = %s, want a match", want, got)
+	}
+}
+
+func TestIPv6TrafficClassAndFlowLabel(t *testing.T) {
+	srcAddr := tcpip.Address("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	dstAddr := tcpip.Address("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+	sent := Layers{
+		&Ether{},
+		&IPv6{
+			TrafficClass: Uint8(0xb8),
+			FlowLabel:    Uint32(0xabcde),
+			SrcAddr:      &srcAddr,
+			DstAddr:      &dstAddr,
+		},
+		&UDP{SrcPort: Uint16(1234), DstPort: Uint16(5678)},
+		&Payload{Bytes: []byte("hello")},
+	}
+	b, err := sent.ToBytes()
+	if err != nil {
+		t.Fatalf("%s.ToBytes() = (_, %s), want = (_, nil)", &sent, err)
+	}
+	received := parse(parseEther, b)
+
+	for _, tt := range []struct {
+		description string
+		want        *IPv6
+		wantMatch   bool
+	}{
+		{
+			description: "matching traffic class and flow label",
+			want:        &IPv6{TrafficClass: Uint8(0xb8), FlowLabel: Uint32(0xabcde)},
+			wantMatch:   true,
+		},
+		{
+			description: "matching flow label only",
+			want:        &IPv6{FlowLabel: Uint32(0xabcde)},
+			wantMatch:   true,
+		},
+		{
+			description: "traffic class mismatch",
+			want:        &IPv6{TrafficClass: Uint8(0)},
+			wantMatch:   false,
+		},
+		{
+			description: "flow label mismatch",
+			want:        &IPv6{FlowLabel: Uint32(0x12345)},
+			wantMatch:   false,
+		},
+	} {
+		t.Run(tt.description, func(t *testing.T) {
+			if len(received) < 2 {
+				t.Fatalf("parsed %s into %d layers, want at least 2", &sent, len(received))
+			}
+			if gotMatch := tt.want.match(received[1]); gotMatch != tt.wantMatch {
+				t.Errorf("%s.match(%s) = %t, want %t", tt.want, received[1], gotMatch, tt.wantMatch)
+			}
+		})
+	}
+}
+
 func TestLayerStringFormat(t *testing.T) {
 	for _, tt := range []struct {
 		name string
@@ -204,3 +287,37 @@ func TestConnectionMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestDiffLayer(t *testing.T) {
+	for _, tt := range []struct {
+		description string
+		want, got   Layer
+		wantDiffs   []string
+	}{
+		{
+			description: "match",
+			want:        &TCP{SrcPort: Uint16(1234), Flags: Uint8(header.TCPFlagAck)},
+			got:         &TCP{SrcPort: Uint16(1234), DstPort: Uint16(80), Flags: Uint8(header.TCPFlagAck)},
+			wantDiffs:   nil,
+		},
+		{
+			description: "mismatched fields",
+			want:        &TCP{SeqNum: Uint32(1), Flags: Uint8(header.TCPFlagAck)},
+			got:         &TCP{SeqNum: Uint32(2), Flags: Uint8(header.TCPFlagRst)},
+			wantDiffs:   []string{"SeqNum: got 2, want 1", "Flags: got 4, want 16"},
+		},
+		{
+			description: "missing field",
+			want:        &TCP{WindowSize: Uint16(10)},
+			got:         &TCP{},
+			wantDiffs:   []string{"WindowSize: got nil, want 10"},
+		},
+	} {
+		t.Run(tt.description, func(t *testing.T) {
+			gotDiffs := diffLayer(tt.want, tt.got)
+			if !cmp.Equal(gotDiffs, tt.wantDiffs) {
+				t.Fatalf("diffLayer(%s, %s) = %q, want %q", tt.want, tt.got, gotDiffs, tt.wantDiffs)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testbench
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// pcapMagic is the magic number of pcap files with microsecond resolution
+	// timestamps.
+	pcapMagic = 0xa1b2c3d4
+
+	// pcapMagicNanoseconds is the magic number of pcap files with nanosecond
+	// resolution timestamps.
+	pcapMagicNanoseconds = 0xa1b23c4d
+
+	// pcapLinkTypeEthernet is the link type of captures of Ethernet frames.
+	pcapLinkTypeEthernet = 1
+
+	pcapFileHeaderSize   = 24
+	pcapRecordHeaderSize = 16
+	pcapVersionMajor     = 2
+	pcapVersionMinor     = 4
+	pcapSnapLen          = 65536
+)
+
+// PCAPRecord is a frame held in a pcap capture.
+type PCAPRecord struct {
+	// Timestamp is the time at which the frame was captured.
+	Timestamp time.Time
+
+	// Data holds the bytes of the captured frame, starting with the Ethernet
+	// header.
+	Data []byte
+}
+
+// ReadPCAP reads all the records from a pcap capture of Ethernet frames.
+func ReadPCAP(r io.Reader) ([]PCAPRecord, error) {
+	var hdr [pcapFileHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("can't read pcap file header: %w", err)
+	}
+
+	order, unit, ok := pcapFormat(hdr[0:4])
+	if !ok {
+		return nil, fmt.Errorf("bad pcap magic number %#x", binary.LittleEndian.Uint32(hdr[0:]))
+	}
+	if linkType := order.Uint32(hdr[20:]); linkType != pcapLinkTypeEthernet {
+		return nil, fmt.Errorf("unsupported pcap link type %d, want %d", linkType, pcapLinkTypeEthernet)
+	}
+
+	var records []PCAPRecord
+	for {
+		var recHdr [pcapRecordHeaderSize]byte
+		if _, err := io.ReadFull(r, recHdr[:]); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return nil, fmt.Errorf("can't read header of pcap record %d: %w", len(records), err)
+		}
+		sec := order.Uint32(recHdr[0:])
+		frac := order.Uint32(recHdr[4:])
+		data := make([]byte, order.Uint32(recHdr[8:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("can't read data of pcap record %d: %w", len(records), err)
+		}
+		records = append(records, PCAPRecord{
+			Timestamp: time.Unix(int64(sec), int64(frac)*int64(unit)),
+			Data:      data,
+		})
+	}
+}
+
+// pcapFormat returns the byte order and timestamp resolution of a pcap file
+// that starts with magic.
+func pcapFormat(magic []byte) (binary.ByteOrder, time.Duration, bool) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(magic) {
+		case pcapMagic:
+			return order, time.Microsecond, true
+		case pcapMagicNanoseconds:
+			return order, time.Nanosecond, true
+		}
+	}
+	return nil, 0, false
+}
+
+// WritePCAP writes records as a pcap capture of Ethernet frames, with
+// microsecond resolution timestamps.
+func WritePCAP(w io.Writer, records []PCAPRecord) error {
+	var hdr [pcapFileHeaderSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:], pcapVersionMinor)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeEthernet)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return fmt.Errorf("can't write pcap file header: %w", err)
+	}
+
+	for i, r := range records {
+		var recHdr [pcapRecordHeaderSize]byte
+		binary.LittleEndian.PutUint32(recHdr[0:], uint32(r.Timestamp.Unix()))
+		binary.LittleEndian.PutUint32(recHdr[4:], uint32(r.Timestamp.Nanosecond()/int(time.Microsecond)))
+		binary.LittleEndian.PutUint32(recHdr[8:], uint32(len(r.Data)))
+		binary.LittleEndian.PutUint32(recHdr[12:], uint32(len(r.Data)))
+		if _, err := w.Write(recHdr[:]); err != nil {
+			return fmt.Errorf("can't write header of pcap record %d: %w", i, err)
+		}
+		if _, err := w.Write(r.Data); err != nil {
+			return fmt.Errorf("can't write data of pcap record %d: %w", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testbench
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPCAPRoundTrip(t *testing.T) {
+	start := time.Unix(1500000000, 123456000)
+	records := []PCAPRecord{
+		{Timestamp: start, Data: []byte{1, 2, 3, 4}},
+		{Timestamp: start.Add(1500 * time.Microsecond), Data: []byte{5, 6}},
+		{Timestamp: start.Add(2 * time.Second), Data: []byte{}},
+	}
+
+	var buf bytes.Buffer
+	if err := WritePCAP(&buf, records); err != nil {
+		t.Fatalf("WritePCAP(_, %+v): %s", records, err)
+	}
+	got, err := ReadPCAP(&buf)
+	if err != nil {
+		t.Fatalf("ReadPCAP(_): %s", err)
+	}
+	if diff := cmp.Diff(records, got); diff != "" {
+		t.Errorf("ReadPCAP(_) mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadPCAPBigEndianNanoseconds(t *testing.T) {
+	var b []byte
+	b = append(b, 0xa1, 0xb2, 0x3c, 0x4d, 0, 2, 0, 4)
+	b = append(b, make([]byte, 8)...)
+	b = append(b, 0, 1, 0, 0, 0, 0, 0, 1)
+	// A single record with a 2 byte frame.
+	b = append(b, 0, 0, 0, 10, 0, 0, 0, 20, 0, 0, 0, 2, 0, 0, 0, 2, 0xab, 0xcd)
+
+	got, err := ReadPCAP(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("ReadPCAP(_): %s", err)
+	}
+	want := []PCAPRecord{{Timestamp: time.Unix(10, 20), Data: []byte{0xab, 0xcd}}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadPCAP(_) mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadPCAPErrors(t *testing.T) {
+	header := func(magic, linkType uint32) []byte {
+		b := make([]byte, pcapFileHeaderSize)
+		binary.LittleEndian.PutUint32(b[0:], magic)
+		binary.LittleEndian.PutUint32(b[20:], linkType)
+		return b
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{
+			name: "Short file header",
+			b:    header(pcapMagic, pcapLinkTypeEthernet)[:10],
+		},
+		{
+			name: "Bad magic",
+			b:    header(0x12345678, pcapLinkTypeEthernet),
+		},
+		{
+			name: "Unsupported link type",
+			b:    header(pcapMagic, 101),
+		},
+		{
+			name: "Truncated record",
+			b:    append(header(pcapMagic, pcapLinkTypeEthernet), 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 4, 0, 0, 0, 1, 2),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := ReadPCAP(bytes.NewReader(test.b)); err == nil {
+				t.Fatalf("got ReadPCAP(_) = (%+v, nil), want = (_, non-nil)", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_bad_checksum_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// TestTCPBadChecksum tests that the DUT silently drops a data segment with an
+// incorrect TCP checksum instead of acknowledging it.
+func TestTCPBadChecksum(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFD, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFD)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.Handshake()
+	acceptFD, _ := dut.Accept(listenFD)
+	defer dut.Close(acceptFD)
+
+	conn.Drain()
+	sampleData := []byte("Sample Data")
+	conn.Send(tb.TCP{
+		Flags:           tb.Uint8(header.TCPFlagAck | header.TCPFlagPsh),
+		CorruptChecksum: tb.Bool(true),
+	}, &tb.Payload{Bytes: sampleData})
+
+	// An ACK of the corrupt segment would acknowledge the next sequence number
+	// after sampleData.
+	timeout := time.Second
+	if gotACK, err := conn.Expect(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck), AckNum: tb.Uint32(uint32(*conn.LocalSeqNum()))}, timeout); err == nil {
+		t.Fatalf("expected no ACK for a segment with a bad checksum within %s but got one: %s", timeout, gotACK)
+	}
+}
@@ -58,12 +58,12 @@ func TestCloseWaitAck(t *testing.T) {
 
 			// Send a segment with OTW Seq / unacc ACK and expect an ACK back
 			conn.Send(tt.makeTestingTCP(&conn, tt.seqNumOffset), &tb.Payload{Bytes: []byte("Sample Data")})
-			gotAck, err := conn.Expect(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)}, time.Second)
-			if tt.expectAck && err != nil {
-				t.Fatalf("expected an ack but got none: %s", err)
-			}
-			if !tt.expectAck && gotAck != nil {
-				t.Fatalf("expected no ack but got one: %s", gotAck)
+			if tt.expectAck {
+				if _, err := conn.Expect(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)}, time.Second); err != nil {
+					t.Fatalf("expected an ack but got none: %s", err)
+				}
+			} else if err := conn.ExpectNone(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)}, time.Second); err != nil {
+				t.Fatalf("expected no ack: %s", err)
 			}
 
 			// Now let's verify DUT is indeed in CLOSE_WAIT
@@ -0,0 +1,104 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_cwnd_growth_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// TestCwndGrowth tests that the congestion window of the DUT doubles every
+// round trip in slow start and, once a loss halved it, grows by about one
+// segment every round trip in congestion avoidance.
+func TestCwndGrowth(t *testing.T) {
+	const (
+		slowStartRounds           = 3
+		congestionAvoidanceRounds = 4
+		// quiet is the time without data after which a flight is over.
+		quiet = 100 * time.Millisecond
+		// defaultMSS is the MSS the DUT uses, as the SYN of the testbench
+		// carries no MSS option.
+		defaultMSS = 536
+		dataSize   = 512 << 10
+	)
+
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFd, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFd)
+	// Advertise the largest window possible without window scaling so that
+	// it doesn't limit the flights.
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort, WindowSize: tb.Uint16(math.MaxUint16)}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.Handshake()
+	acceptFd, _ := dut.Accept(listenFd)
+	defer dut.Close(acceptFd)
+
+	// Reno grows the window by one segment per round trip in congestion
+	// avoidance, which makes it measurable.
+	dut.SetSockOpt(acceptFd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, []byte("reno"))
+	dut.SetSockOptInt(acceptFd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+	dut.SetSockOptInt(acceptFd, unix.SOL_SOCKET, unix.SO_SNDBUF, 2*dataSize)
+	if got := dut.Send(acceptFd, make([]byte, dataSize), unix.MSG_DONTWAIT); got != dataSize {
+		t.Fatalf("got dut.Send(...) = %d, want = %d", got, dataSize)
+	}
+
+	sizes, err := conn.MeasureFlights(slowStartRounds, quiet, time.Second)
+	if err != nil {
+		t.Fatalf("failed to measure the flights in slow start: %s", err)
+	}
+	for i := 1; i < len(sizes); i++ {
+		// Every segment acknowledged grows the window by one segment, so it
+		// doubles. Allow for some slack.
+		if sizes[i] < 3*sizes[i-1]/2 {
+			t.Fatalf("got flight sizes = %v in slow start, want each one about twice the previous one", sizes)
+		}
+	}
+
+	flight, err := conn.ExpectFlight(quiet, time.Second)
+	if err != nil {
+		t.Fatalf("expected a flight before the loss: %s", err)
+	}
+	lossSize := 0
+	for _, seg := range flight {
+		lossSize += len(seg.Payload)
+	}
+	if err := conn.SimulateLoss(flight, time.Second); err != nil {
+		t.Fatalf("failed to simulate the loss of a segment: %s", err)
+	}
+
+	sizes, err = conn.MeasureFlights(congestionAvoidanceRounds, quiet, time.Second)
+	if err != nil {
+		t.Fatalf("failed to measure the flights in congestion avoidance: %s", err)
+	}
+	// The loss halves the window. Allow for segments sent in fast recovery
+	// being counted in the first flight.
+	if sizes[0] > 3*lossSize/4 {
+		t.Errorf("got first flight size = %d after the loss of a segment of a %d bytes flight, want about half of it", sizes[0], lossSize)
+	}
+	for i := 1; i < len(sizes); i++ {
+		if sizes[i]-sizes[i-1] > 2*defaultMSS {
+			t.Fatalf("got flight sizes = %v in congestion avoidance, want each one about one segment larger than the previous one", sizes)
+		}
+	}
+	if last := sizes[len(sizes)-1]; last <= sizes[0] {
+		t.Errorf("got flight sizes = %v in congestion avoidance, want them to grow", sizes)
+	}
+}
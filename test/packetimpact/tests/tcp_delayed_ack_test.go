@@ -0,0 +1,73 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_delayed_ack_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+const (
+	// ackThreshold separates an immediate ACK from a delayed one. It is well
+	// below the 40ms minimum delayed-ACK timeout used by Linux.
+	ackThreshold = 20 * time.Millisecond
+
+	// maxAckDelay is the longest an ACK may be delayed, as per RFC 1122
+	// section 4.2.3.2.
+	maxAckDelay = 500 * time.Millisecond
+)
+
+// TestDelayedAck tests that the DUT delays the ACK of a single segment but
+// acknowledges two full-sized segments right away.
+func TestDelayedAck(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFd, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFd)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.Handshake()
+	acceptFd, _ := dut.Accept(listenFd)
+	defer dut.Close(acceptFd)
+
+	// The testbench's SYN carries no MSS option so the DUT assumes the default
+	// MSS, which makes a segment of that size a full-sized one.
+	fullSegment := make([]byte, header.TCPDefaultMSS)
+
+	// Leave quickack mode, which a new connection starts in, before each
+	// measurement so that the DUT is allowed to delay its ACKs.
+	dut.SetSockOptInt(acceptFd, unix.IPPROTO_TCP, unix.TCP_QUICKACK, 0)
+	delay, err := conn.MeasureAckDelay(time.Second, []byte("Sample Data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delay < ackThreshold || delay > maxAckDelay {
+		t.Errorf("got the ACK of a single segment after %s, want between %s and %s", delay, ackThreshold, maxAckDelay)
+	}
+
+	dut.SetSockOptInt(acceptFd, unix.IPPROTO_TCP, unix.TCP_QUICKACK, 0)
+	delay, err = conn.MeasureAckDelay(time.Second, fullSegment, fullSegment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delay >= ackThreshold {
+		t.Errorf("got the ACK of two full-sized segments after %s, want less than %s", delay, ackThreshold)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_lossy_link_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// TestBulkTransferOverLossyLink tests that a bulk transfer from the DUT
+// completes when the link drops 5% of the frames in both directions.
+func TestBulkTransferOverLossyLink(t *testing.T) {
+	const (
+		lossPercent = 5
+		seed        = 1
+		dataSize    = 64 << 10
+	)
+
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFd, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFd)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.Handshake()
+	acceptFd, _ := dut.Accept(listenFd)
+	defer dut.Close(acceptFd)
+
+	conn.SetPacketLoss(lossPercent, seed)
+
+	sampleData := bytes.Repeat([]byte("x"), dataSize)
+	dut.Send(acceptFd, sampleData, 0)
+
+	// Only the next in-order segment matches, so segments following a lost one
+	// are ignored until the DUT retransmits. When nothing arrives in time, our
+	// last ACK may have been lost, so send it again.
+	deadline := time.Now().Add(time.Minute)
+	received := 0
+	for received < dataSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d bytes before the deadline, want = %d", received, dataSize)
+		}
+		frame, err := conn.ExpectData(&tb.TCP{}, nil, time.Second)
+		if err == nil {
+			if payload, ok := frame[len(frame)-1].(*tb.Payload); ok {
+				received += len(payload.Bytes)
+			}
+		}
+		conn.Send(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)})
+	}
+}
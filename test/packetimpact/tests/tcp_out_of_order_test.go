@@ -0,0 +1,77 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_out_of_order_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/seqnum"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// TestOutOfOrderCumulativeAck sends segments with gaps between them back to
+// back and checks that the DUT only acknowledges the data received in order,
+// until the gaps are filled.
+func TestOutOfOrderCumulativeAck(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFD, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFD)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+	conn.Handshake()
+	acceptFD, _ := dut.Accept(listenFD)
+	defer dut.Close(acceptFD)
+
+	const segmentSize = 10
+	base := *conn.LocalSeqNum()
+	segment := func(i int) tb.OutgoingSegment {
+		return tb.OutgoingSegment{
+			TCP: tb.TCP{
+				Flags:  tb.Uint8(header.TCPFlagAck),
+				SeqNum: tb.Uint32(uint32(base.Add(seqnum.Size(i * segmentSize)))),
+			},
+			Payload: make([]byte, segmentSize),
+		}
+	}
+
+	// Send the first, third and fifth segments, leaving gaps for the second
+	// and fourth ones.
+	conn.Sendv(segment(0), segment(2), segment(4))
+	wantAck := base.Add(segmentSize)
+	if _, err := conn.Expect(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck), AckNum: tb.Uint32(uint32(wantAck))}, time.Second); err != nil {
+		t.Fatalf("expected an ACK of the first segment only: %s", err)
+	}
+	conn.Drain()
+
+	// Filling the gaps must have the DUT acknowledge all the segments.
+	conn.Sendv(segment(1), segment(3))
+	wantAck = base.Add(5 * segmentSize)
+	if _, err := conn.Expect(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck), AckNum: tb.Uint32(uint32(wantAck))}, time.Second); err != nil {
+		t.Fatalf("expected an ACK of all the segments: %s", err)
+	}
+	if got := *conn.LocalSeqNum(); got != wantAck {
+		t.Errorf("got LocalSeqNum() = %d after sending all the segments, want = %d", got, wantAck)
+	}
+
+	// The DUT must have received all the data in order.
+	const dataSize = 5 * segmentSize
+	if got := dut.Recv(acceptFD, dataSize, 0); len(got) != dataSize {
+		t.Errorf("got %d bytes from the DUT, want = %d", len(got), dataSize)
+	}
+}
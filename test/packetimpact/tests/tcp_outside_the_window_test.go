@@ -15,6 +15,7 @@
 package tcp_outside_the_window_test
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -78,6 +79,10 @@ func TestTCPOutsideTheWindow(t *testing.T) {
 			timeout := 3 * time.Second
 			gotACK, err := conn.Expect(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck), AckNum: localSeqNum}, timeout)
 			if tt.expectACK && err != nil {
+				var expectErr *tb.ExpectError
+				if errors.As(err, &expectErr) && expectErr.Got != nil {
+					t.Fatalf("expected an ACK packet within %s but got a segment with mismatched fields: %s", timeout, expectErr.Diff())
+				}
 				t.Fatalf("expected an ACK packet within %s but got none: %s", timeout, err)
 			}
 			if !tt.expectACK && gotACK != nil {
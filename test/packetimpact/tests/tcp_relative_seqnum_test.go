@@ -0,0 +1,66 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_relative_seqnum_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/seqnum"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// TestRelativeSeqNum tests the sequence and acknowledgement numbers of a data
+// exchange with the DUT relative to the initial sequence numbers of both ends.
+func TestRelativeSeqNum(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFd, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFd)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.Handshake()
+	acceptFd, _ := dut.Accept(listenFd)
+	defer dut.Close(acceptFd)
+
+	sampleData := []byte("Sample Data")
+	dataLen := seqnum.Size(len(sampleData))
+
+	// The DUT acknowledges the data sent by the testbench.
+	conn.Send(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck | header.TCPFlagPsh)}, &tb.Payload{Bytes: sampleData})
+	if _, err := conn.Expect(tb.TCP{
+		SeqNum: conn.RelSeqNum(1),
+		AckNum: conn.RelAckNum(1 + dataLen),
+		Flags:  tb.Uint8(header.TCPFlagAck),
+	}, time.Second); err != nil {
+		t.Fatalf("expected an ACK of the data: %s", err)
+	}
+
+	// The testbench acknowledges two segments of data sent by the DUT.
+	for i := seqnum.Size(0); i < 2; i++ {
+		dut.Send(acceptFd, sampleData, 0)
+		if _, err := conn.ExpectData(&tb.TCP{
+			SeqNum: conn.RelSeqNum(1 + i*dataLen),
+			AckNum: conn.RelAckNum(1 + dataLen),
+			Flags:  tb.Uint8(header.TCPFlagAck | header.TCPFlagPsh),
+		}, &tb.Payload{Bytes: sampleData}, time.Second); err != nil {
+			t.Fatalf("expected segment %d of data: %s", i, err)
+		}
+		conn.Send(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)})
+	}
+}
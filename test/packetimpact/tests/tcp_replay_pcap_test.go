@@ -0,0 +1,71 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_replay_pcap_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// TestTCPReplayPCAP tests that a handshake started by replaying a captured SYN
+// can be completed with the DUT.
+func TestTCPReplayPCAP(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFD, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFD)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	// Capture the SYN that would open the connection. The capture has to be
+	// made for this connection as the DUT's addresses and the listening port
+	// are only known at run time.
+	syn := conn.CreateFrame(tb.TCP{Flags: tb.Uint8(header.TCPFlagSyn)})
+	b, err := syn.ToBytes()
+	if err != nil {
+		t.Fatalf("can't serialize SYN: %s", err)
+	}
+	f, err := ioutil.TempFile("", "tcp_replay_pcap_*.pcap")
+	if err != nil {
+		t.Fatalf("can't create pcap file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if err := tb.WritePCAP(f, []tb.PCAPRecord{{Timestamp: time.Now(), Data: b}}); err != nil {
+		t.Fatalf("can't write pcap file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("can't close pcap file: %s", err)
+	}
+
+	conn.ReplayPCAP(f.Name())
+	// Replaying doesn't update the connection's state so account for the
+	// sequence number consumed by the SYN.
+	conn.LocalSeqNum().UpdateForward(1)
+
+	timeout := time.Second
+	if _, err := conn.Expect(tb.TCP{Flags: tb.Uint8(header.TCPFlagSyn | header.TCPFlagAck)}, timeout); err != nil {
+		t.Fatalf("expected a SYN-ACK for the replayed SYN within %s but got none: %s", timeout, err)
+	}
+	conn.Send(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)})
+
+	acceptFD, _ := dut.Accept(listenFD)
+	dut.Close(acceptFD)
+}
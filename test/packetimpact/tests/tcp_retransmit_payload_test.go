@@ -0,0 +1,55 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_retransmit_payload_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// TestRetransmitIdenticalPayload tests that when the ACK of a data segment is
+// lost, the DUT retransmits exactly the same bytes.
+func TestRetransmitIdenticalPayload(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFd, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFd)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.Handshake()
+	acceptFd, _ := dut.Accept(listenFd)
+	defer dut.Close(acceptFd)
+
+	dut.SetSockOptInt(acceptFd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+
+	sampleData := []byte("Sample Data")
+	dut.Send(acceptFd, sampleData, 0)
+	frame, err := conn.ExpectData(&tb.TCP{}, &tb.Payload{Bytes: sampleData}, time.Second)
+	if err != nil {
+		t.Fatalf("expected a packet with payload %q: %s", sampleData, err)
+	}
+	seg := conn.CaptureSegment(frame)
+
+	// Don't acknowledge the segment, as if the ACK was lost.
+	if _, err := conn.ExpectRetransmission(seg, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	conn.Send(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)})
+}
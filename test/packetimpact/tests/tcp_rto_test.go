@@ -0,0 +1,100 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_rto_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+const (
+	// delay and jitter are the latency added to the frames sent to the DUT.
+	delay  = 300 * time.Millisecond
+	jitter = 100 * time.Millisecond
+
+	// samples is the number of round trips made over the slow link for the
+	// DUT to update its RTT estimate.
+	samples = 5
+)
+
+// TestRTOAdaptsToDelay tests that the DUT's retransmission timeout grows when
+// the round-trip time to its peer increases.
+func TestRTOAdaptsToDelay(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFd, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFd)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.Handshake()
+	acceptFd, _ := dut.Accept(listenFd)
+	defer dut.Close(acceptFd)
+
+	dut.SetSockOptInt(acceptFd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+
+	sampleData := []byte("Sample Data")
+	samplePayload := &tb.Payload{Bytes: sampleData}
+
+	// exchange has the DUT send data and acknowledges it.
+	exchange := func() {
+		t.Helper()
+		dut.Send(acceptFd, sampleData, 0)
+		if _, err := conn.ExpectData(&tb.TCP{}, samplePayload, time.Second); err != nil {
+			t.Fatalf("expected a packet with payload %v: %s", samplePayload, err)
+		}
+		conn.Send(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)})
+	}
+
+	// measureRTO has the DUT send data, withholds the acknowledgement and
+	// returns the time until the data is retransmitted.
+	measureRTO := func() time.Duration {
+		t.Helper()
+		seqNum := tb.Uint32(uint32(*conn.RemoteSeqNum()))
+		dut.Send(acceptFd, sampleData, 0)
+		if _, err := conn.ExpectData(&tb.TCP{SeqNum: seqNum}, samplePayload, time.Second); err != nil {
+			t.Fatalf("expected a packet with payload %v: %s", samplePayload, err)
+		}
+		start := time.Now()
+		if _, err := conn.ExpectData(&tb.TCP{SeqNum: seqNum}, samplePayload, 5*time.Second); err != nil {
+			t.Fatalf("expected a retransmission of the packet with payload %v: %s", samplePayload, err)
+		}
+		rto := time.Since(start)
+		conn.Send(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)})
+		return rto
+	}
+
+	for i := 0; i < samples; i++ {
+		exchange()
+	}
+	fastRTO := measureRTO()
+
+	conn.SetSendDelay(delay, jitter)
+	for i := 0; i < samples; i++ {
+		exchange()
+	}
+	slowRTO := measureRTO()
+
+	if slowRTO <= fastRTO {
+		t.Errorf("got RTO = %s with a %s (+%s jitter) delay, want more than the %s RTO without delay", slowRTO, delay, jitter, fastRTO)
+	}
+	if slowRTO < delay {
+		t.Errorf("got RTO = %s, want at least the %s delay", slowRTO, delay)
+	}
+}
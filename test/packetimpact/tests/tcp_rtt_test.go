@@ -0,0 +1,52 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_rtt_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// maxRTT is a generous bound on the round-trip time between the testbench and
+// the DUT, which are connected by a local link.
+const maxRTT = 500 * time.Millisecond
+
+// TestRTT tests that the DUT promptly acknowledges keepalive probes, so that
+// the round-trip time to it can be measured.
+func TestRTT(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFd, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFd)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.Handshake()
+	acceptFd, _ := dut.Accept(listenFd)
+	defer dut.Close(acceptFd)
+
+	for i := 0; i < 3; i++ {
+		rtt, err := conn.MeasureRTT(time.Second)
+		if err != nil {
+			t.Fatalf("conn.MeasureRTT(%s): %s", time.Second, err)
+		}
+		if rtt <= 0 || rtt > maxRTT {
+			t.Errorf("got RTT = %s, want within (0, %s]", rtt, maxRTT)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_seqnum_tracking_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/seqnum"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// TestSeqNumTracking checks that the sequence numbers maintained by the
+// testbench, with sequence number tracking enabled, match the ones the DUT
+// acknowledges.
+func TestSeqNumTracking(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFD, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFD)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+	conn.Handshake()
+	acceptFD, _ := dut.Accept(listenFD)
+	defer dut.Close(acceptFD)
+	conn.SetSeqNumTracking(true)
+
+	payload := []byte("sample data")
+	// Send two data segments without choosing their sequence numbers.
+	for i := 0; i < 2; i++ {
+		conn.Send(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck | header.TCPFlagPsh)}, &tb.Payload{Bytes: payload})
+		wantAck := conn.RelAckNum(seqnum.Size(1 + (i+1)*len(payload)))
+		if got := uint32(*conn.LocalSeqNum()); got != *wantAck {
+			t.Fatalf("got LocalSeqNum() = %d after data segment #%d, want = %d", got, i, *wantAck)
+		}
+		if _, err := conn.Expect(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck), AckNum: wantAck}, time.Second); err != nil {
+			t.Fatalf("expected an ACK of data segment #%d: %s", i, err)
+		}
+	}
+
+	// Retransmitting the first segment must not move LocalSeqNum, which the
+	// DUT acknowledges again.
+	localSeqNum := *conn.LocalSeqNum()
+	conn.Send(tb.TCP{SeqNum: conn.RelAckNum(1), Flags: tb.Uint8(header.TCPFlagAck | header.TCPFlagPsh)}, &tb.Payload{Bytes: payload})
+	if got := *conn.LocalSeqNum(); got != localSeqNum {
+		t.Fatalf("got LocalSeqNum() = %d after a retransmission, want = %d", got, localSeqNum)
+	}
+	if _, err := conn.Expect(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)}, time.Second); err != nil {
+		t.Fatalf("expected an ACK of the retransmission: %s", err)
+	}
+
+	// Data sent by the DUT must move RemoteSeqNum past it.
+	dut.Send(acceptFD, payload, 0)
+	if _, err := conn.ExpectData(&tb.TCP{Flags: tb.Uint8(header.TCPFlagAck | header.TCPFlagPsh)}, &tb.Payload{Bytes: payload}, time.Second); err != nil {
+		t.Fatalf("expected data from the DUT: %s", err)
+	}
+	if got, want := uint32(*conn.RemoteSeqNum()), *conn.RelSeqNum(seqnum.Size(1 + len(payload))); got != want {
+		t.Fatalf("got RemoteSeqNum() = %d after data from the DUT, want = %d", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_syn_cookies_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// synFloodSize is the number of SYNs sent to overflow the listener's SYN
+// queue so that the DUT has to fall back to SYN cookies.
+const synFloodSize = 200
+
+// TestSYNCookies tests that a listener under a SYN flood keeps accepting new
+// connections and that the initial sequence number of the SYN-ACK it sends is
+// validated when the handshake is completed.
+func TestSYNCookies(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFd, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFd)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.SendSYNFlood(synFloodSize)
+
+	// Complete a handshake with the DUT. The SYN-ACK's sequence number is the
+	// DUT's cookie; the DUT must accept our ACK of it.
+	conn.Handshake()
+	synAck := conn.SynAck()
+	if got, want := *synAck.AckNum, uint32(*conn.LocalSeqNum()); got != want {
+		t.Fatalf("got SYN-ACK with AckNum = %d, want = %d", got, want)
+	}
+	acceptFd, _ := dut.Accept(listenFd)
+	defer dut.Close(acceptFd)
+
+	// Data sent with the sequence numbers derived from the cookie must be
+	// received by the DUT.
+	sampleData := []byte("Sample Data")
+	conn.Send(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck | header.TCPFlagPsh)}, &tb.Payload{Bytes: sampleData})
+	if _, err := conn.Expect(tb.TCP{Flags: tb.Uint8(header.TCPFlagAck)}, time.Second); err != nil {
+		t.Fatalf("expected an ACK of the data: %s", err)
+	}
+	if got := dut.Recv(acceptFd, int32(len(sampleData)), 0); !bytes.Equal(got, sampleData) {
+		t.Fatalf("got dut.Recv(...) = %q, want = %q", got, sampleData)
+	}
+}
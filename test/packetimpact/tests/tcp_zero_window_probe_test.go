@@ -0,0 +1,108 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_zero_window_probe_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// TestZeroWindowProbe tests that the DUT probes a zero window with increasing
+// intervals, and resumes sending data once the window opens.
+func TestZeroWindowProbe(t *testing.T) {
+	const numProbes = 3
+
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFd, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFd)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.Handshake()
+	acceptFd, _ := dut.Accept(listenFd)
+	defer dut.Close(acceptFd)
+
+	dut.SetSockOptInt(acceptFd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+
+	sampleData := []byte("Sample Data")
+	samplePayload := &tb.Payload{Bytes: sampleData}
+
+	// Close the window while acknowledging the first segment, so that the
+	// DUT has to probe it to send the second one.
+	dut.Send(acceptFd, sampleData, 0)
+	if _, err := conn.ExpectData(&tb.TCP{}, samplePayload, time.Second); err != nil {
+		t.Fatalf("expected a packet with payload %v: %s", samplePayload, err)
+	}
+	conn.AdvertiseWindow(0)
+	dut.Send(acceptFd, sampleData, 0)
+
+	intervals, err := conn.ExpectZeroWindowProbes(numProbes, 10*time.Second)
+	if err != nil {
+		t.Fatalf("expected %d zero-window probes: %s", numProbes, err)
+	}
+	// The first interval includes the time taken by the DUT to notice the
+	// zero window, so only the following ones are checked for backoff.
+	for i := 2; i < len(intervals); i++ {
+		if intervals[i] <= intervals[i-1] {
+			t.Errorf("got zero-window probe intervals = %v, want increasing intervals", intervals)
+			break
+		}
+	}
+
+	// Opening the window resumes the transfer.
+	conn.AdvertiseWindow(math.MaxUint16)
+	if _, err := conn.ExpectData(&tb.TCP{Flags: tb.Uint8(header.TCPFlagAck | header.TCPFlagPsh)}, samplePayload, time.Second); err != nil {
+		t.Fatalf("expected a packet with payload %v after opening the window: %s", samplePayload, err)
+	}
+}
+
+// TestZeroWindowNoData tests that the DUT doesn't send data while the window
+// advertised to it is zero, until it probes the window.
+func TestZeroWindowNoData(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	listenFd, remotePort := dut.CreateListener(unix.SOCK_STREAM, unix.IPPROTO_TCP, 1)
+	defer dut.Close(listenFd)
+	conn := tb.NewTCPIPv4(t, tb.TCP{DstPort: &remotePort}, tb.TCP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	conn.Handshake()
+	acceptFd, _ := dut.Accept(listenFd)
+	defer dut.Close(acceptFd)
+
+	dut.SetSockOptInt(acceptFd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+
+	sampleData := []byte("Sample Data")
+	samplePayload := &tb.Payload{Bytes: sampleData}
+
+	// The first zero-window probe is sent no sooner than the minimum
+	// retransmission timeout of 200ms, so no data must be sent before then.
+	conn.AdvertiseWindow(0)
+	dut.Send(acceptFd, sampleData, 0)
+	if got, err := conn.ExpectData(&tb.TCP{}, samplePayload, 100*time.Millisecond); err == nil {
+		t.Fatalf("expected no data to be sent to a zero window, got %s", got)
+	}
+
+	conn.AdvertiseWindow(math.MaxUint16)
+	if _, err := conn.ExpectData(&tb.TCP{Flags: tb.Uint8(header.TCPFlagAck | header.TCPFlagPsh)}, samplePayload, time.Second); err != nil {
+		t.Fatalf("expected a packet with payload %v after opening the window: %s", samplePayload, err)
+	}
+}
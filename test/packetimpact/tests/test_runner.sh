@@ -217,6 +217,9 @@ docker exec -t "${DUT}" \
 # issue a RST. To prevent this IPtables can be used to filter those out.
 docker exec "${TESTBENCH}" \
   iptables -A INPUT -i ${TEST_DEVICE} -j DROP
+# Only TCP is filtered out for IPv6, as neighbor discovery must still work.
+docker exec "${TESTBENCH}" \
+  ip6tables -A INPUT -i ${TEST_DEVICE} -p tcp -j DROP
 
 # Wait for the DUT server to come up.  Attempt to connect to it from the test
 # bench every 100 milliseconds until success.
@@ -230,6 +233,12 @@ declare -r REMOTE_MAC=$(docker exec -t "${DUT}" ip link show \
 declare -r LOCAL_MAC=$(docker exec -t "${TESTBENCH}" ip link show \
   "${TEST_DEVICE}" | tail -1 | cut -d' ' -f6)
 
+# The test packets use the link-local IPv6 addresses of the test interfaces.
+declare -r REMOTE_IPV6=$(docker exec -t "${DUT}" ip addr show scope link \
+  "${TEST_DEVICE}" | grep inet6 | cut -d' ' -f6 | cut -d'/' -f1)
+declare -r LOCAL_IPV6=$(docker exec -t "${TESTBENCH}" ip addr show scope link \
+  "${TEST_DEVICE}" | grep inet6 | cut -d' ' -f6 | cut -d'/' -f1)
+
 declare -r DOCKER_TESTBENCH_BINARY="/$(basename ${TESTBENCH_BINARY})"
 docker cp -L "${TESTBENCH_BINARY}" "${TESTBENCH}:${DOCKER_TESTBENCH_BINARY}"
 
@@ -237,7 +246,8 @@ if [[ -z "${TSHARK-}" ]]; then
   # Run tcpdump in the test bench unbuffered, without dns resolution, just on
   # the interface with the test packets.
   docker exec -t "${TESTBENCH}" \
-    tcpdump -S -vvv -U -n -i "${TEST_DEVICE}" net "${TEST_NET_PREFIX}/24" &
+    tcpdump -S -vvv -U -n -i "${TEST_DEVICE}" \
+    net "${TEST_NET_PREFIX}/24" or host "${LOCAL_IPV6}" &
 else
   # Run tshark in the test bench unbuffered, without dns resolution, just on the
   # interface with the test packets.
@@ -245,7 +255,7 @@ else
     tshark -V -l -n -i "${TEST_DEVICE}" \
     -o tcp.check_checksum:TRUE \
     -o udp.check_checksum:TRUE \
-    host "${TEST_NET_PREFIX}${TESTBENCH_NET_SUFFIX}" &
+    host "${TEST_NET_PREFIX}${TESTBENCH_NET_SUFFIX}" or host "${LOCAL_IPV6}" &
 fi
 
 # tcpdump and tshark take time to startup
@@ -261,6 +271,8 @@ docker exec -t "${TESTBENCH}" \
   --posix_server_port=${CTRL_PORT} \
   --remote_ipv4=${TEST_NET_PREFIX}${DUT_NET_SUFFIX} \
   --local_ipv4=${TEST_NET_PREFIX}${TESTBENCH_NET_SUFFIX} \
+  --remote_ipv6=${REMOTE_IPV6} \
+  --local_ipv6=${LOCAL_IPV6} \
   --remote_mac=${REMOTE_MAC} \
   --local_mac=${LOCAL_MAC} \
   --device=${TEST_DEVICE}"
@@ -0,0 +1,43 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp_recv_multicast_bound_test
+
+import (
+	"net"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	tb "gvisor.dev/gvisor/test/packetimpact/testbench"
+)
+
+// TestUDPRecvMulticastBound tests that a UDP socket bound to a multicast group
+// that it has joined receives datagrams sent to that group.
+func TestUDPRecvMulticastBound(t *testing.T) {
+	dut := tb.NewDUT(t)
+	defer dut.TearDown()
+	group := net.ParseIP("239.1.2.3")
+	boundFD, remotePort := dut.CreateMulticastListener(group)
+	defer dut.Close(boundFD)
+	conn := tb.NewUDPIPv4(t, tb.UDP{DstPort: &remotePort}, tb.UDP{SrcPort: &remotePort})
+	defer conn.Close()
+
+	payload := []byte("hello multicast")
+	frame := conn.CreateFrame(&tb.UDP{}, &tb.Payload{Bytes: payload})
+	frame[1].(*tb.IPv4).DstAddr = tb.Address(tcpip.Address(group.To4()))
+	conn.SendFrame(frame)
+	if got, want := string(dut.Recv(boundFD, int32(len(payload)), 0)), string(payload); got != want {
+		t.Fatalf("got dut.Recv(...) = %q, want = %q", got, want)
+	}
+}